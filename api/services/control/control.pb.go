@@ -5,6 +5,7 @@ package moby_buildkit_v1
 
 import (
 	context "context"
+	encoding_binary "encoding/binary"
 	fmt "fmt"
 	_ "github.com/gogo/protobuf/gogoproto"
 	proto "github.com/gogo/protobuf/proto"
@@ -40,6 +41,9 @@ type PruneRequest struct {
 	All                  bool     `protobuf:"varint,2,opt,name=all,proto3" json:"all,omitempty"`
 	KeepDuration         int64    `protobuf:"varint,3,opt,name=keepDuration,proto3" json:"keepDuration,omitempty"`
 	KeepBytes            int64    `protobuf:"varint,4,opt,name=keepBytes,proto3" json:"keepBytes,omitempty"`
+	Force                bool     `protobuf:"varint,5,opt,name=force,proto3" json:"force,omitempty"`
+	MinHits              int64    `protobuf:"varint,6,opt,name=minHits,proto3" json:"minHits,omitempty"`
+	MaxFreed             int64    `protobuf:"varint,7,opt,name=maxFreed,proto3" json:"maxFreed,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -106,6 +110,27 @@ func (m *PruneRequest) GetKeepBytes() int64 {
 	return 0
 }
 
+func (m *PruneRequest) GetForce() bool {
+	if m != nil {
+		return m.Force
+	}
+	return false
+}
+
+func (m *PruneRequest) GetMinHits() int64 {
+	if m != nil {
+		return m.MinHits
+	}
+	return 0
+}
+
+func (m *PruneRequest) GetMaxFreed() int64 {
+	if m != nil {
+		return m.MaxFreed
+	}
+	return 0
+}
+
 type DiskUsageRequest struct {
 	Filter               []string `protobuf:"bytes,1,rep,name=filter,proto3" json:"filter,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -212,6 +237,16 @@ type UsageRecord struct {
 	Description          string     `protobuf:"bytes,9,opt,name=Description,proto3" json:"Description,omitempty"`
 	RecordType           string     `protobuf:"bytes,10,opt,name=RecordType,proto3" json:"RecordType,omitempty"`
 	Shared               bool       `protobuf:"varint,11,opt,name=Shared,proto3" json:"Shared,omitempty"`
+	Pinned               bool       `protobuf:"varint,12,opt,name=Pinned,proto3" json:"Pinned,omitempty"`
+	PinReason            string     `protobuf:"bytes,13,opt,name=PinReason,proto3" json:"PinReason,omitempty"`
+	ChainID              string     `protobuf:"bytes,14,opt,name=ChainID,proto3" json:"ChainID,omitempty"`
+	Blob                 string     `protobuf:"bytes,15,opt,name=Blob,proto3" json:"Blob,omitempty"`
+	MediaType            string     `protobuf:"bytes,16,opt,name=MediaType,proto3" json:"MediaType,omitempty"`
+	Lazy                 bool       `protobuf:"varint,17,opt,name=Lazy,proto3" json:"Lazy,omitempty"`
+	BlobSize             int64      `protobuf:"varint,18,opt,name=BlobSize,proto3" json:"BlobSize,omitempty"`
+	BuildID              string     `protobuf:"bytes,19,opt,name=BuildID,proto3" json:"BuildID,omitempty"`
+	Namespace            string     `protobuf:"bytes,20,opt,name=Namespace,proto3" json:"Namespace,omitempty"`
+	UsageScore           float64    `protobuf:"fixed64,21,opt,name=UsageScore,proto3" json:"UsageScore,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
 	XXX_unrecognized     []byte     `json:"-"`
 	XXX_sizecache        int32      `json:"-"`
@@ -327,6 +362,76 @@ func (m *UsageRecord) GetShared() bool {
 	return false
 }
 
+func (m *UsageRecord) GetPinned() bool {
+	if m != nil {
+		return m.Pinned
+	}
+	return false
+}
+
+func (m *UsageRecord) GetPinReason() string {
+	if m != nil {
+		return m.PinReason
+	}
+	return ""
+}
+
+func (m *UsageRecord) GetChainID() string {
+	if m != nil {
+		return m.ChainID
+	}
+	return ""
+}
+
+func (m *UsageRecord) GetBlob() string {
+	if m != nil {
+		return m.Blob
+	}
+	return ""
+}
+
+func (m *UsageRecord) GetMediaType() string {
+	if m != nil {
+		return m.MediaType
+	}
+	return ""
+}
+
+func (m *UsageRecord) GetLazy() bool {
+	if m != nil {
+		return m.Lazy
+	}
+	return false
+}
+
+func (m *UsageRecord) GetBlobSize() int64 {
+	if m != nil {
+		return m.BlobSize
+	}
+	return 0
+}
+
+func (m *UsageRecord) GetBuildID() string {
+	if m != nil {
+		return m.BuildID
+	}
+	return ""
+}
+
+func (m *UsageRecord) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *UsageRecord) GetUsageScore() float64 {
+	if m != nil {
+		return m.UsageScore
+	}
+	return 0
+}
+
 type SolveRequest struct {
 	Ref                  string                                                   `protobuf:"bytes,1,opt,name=Ref,proto3" json:"Ref,omitempty"`
 	Definition           *pb.Definition                                           `protobuf:"bytes,2,opt,name=Definition,proto3" json:"Definition,omitempty"`
@@ -338,6 +443,7 @@ type SolveRequest struct {
 	Cache                CacheOptions                                             `protobuf:"bytes,8,opt,name=Cache,proto3" json:"Cache"`
 	Entitlements         []github_com_moby_buildkit_util_entitlements.Entitlement `protobuf:"bytes,9,rep,name=Entitlements,proto3,customtype=github.com/moby/buildkit/util/entitlements.Entitlement" json:"Entitlements,omitempty"`
 	FrontendInputs       map[string]*pb.Definition                                `protobuf:"bytes,10,rep,name=FrontendInputs,proto3" json:"FrontendInputs,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	CacheNamespace       string                                                   `protobuf:"bytes,11,opt,name=CacheNamespace,proto3" json:"CacheNamespace,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}                                                 `json:"-"`
 	XXX_unrecognized     []byte                                                   `json:"-"`
 	XXX_sizecache        int32                                                    `json:"-"`
@@ -439,6 +545,13 @@ func (m *SolveRequest) GetFrontendInputs() map[string]*pb.Definition {
 	return nil
 }
 
+func (m *SolveRequest) GetCacheNamespace() string {
+	if m != nil {
+		return m.CacheNamespace
+	}
+	return ""
+}
+
 type CacheOptions struct {
 	// ExportRefDeprecated is deprecated in favor or the new Exports since BuildKit v0.4.0.
 	// When ExportRefDeprecated is set, the solver appends
@@ -1156,95 +1269,106 @@ func init() {
 func init() { proto.RegisterFile("control.proto", fileDescriptor_0c5120591600887d) }
 
 var fileDescriptor_0c5120591600887d = []byte{
-	// 1397 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x57, 0x4d, 0x6f, 0x1b, 0xc5,
-	0x1b, 0xef, 0xda, 0xf1, 0xdb, 0x63, 0x27, 0x4a, 0xa7, 0xfd, 0x57, 0xab, 0xfd, 0x8b, 0xc4, 0x6c,
-	0x8b, 0x64, 0x55, 0xed, 0x3a, 0x35, 0x14, 0x95, 0x08, 0x50, 0xeb, 0xb8, 0xa8, 0xa9, 0x1a, 0x51,
-	0x36, 0x2d, 0x95, 0x7a, 0x40, 0x5a, 0xdb, 0x13, 0x77, 0x95, 0xf5, 0xce, 0x32, 0x33, 0x1b, 0x6a,
-	0x3e, 0x00, 0x67, 0xbe, 0x03, 0x07, 0x4e, 0x9c, 0x38, 0xf0, 0x09, 0x90, 0x7a, 0xe4, 0xdc, 0x43,
-	0x40, 0xb9, 0xc3, 0x9d, 0x1b, 0x9a, 0x97, 0x75, 0xc6, 0xb1, 0x9d, 0xc4, 0xe9, 0xc9, 0xf3, 0x8c,
-	0x9f, 0xdf, 0x6f, 0x9f, 0xd7, 0x99, 0x79, 0x60, 0xb9, 0x47, 0x62, 0x4e, 0x49, 0xe4, 0x25, 0x94,
-	0x70, 0x82, 0x56, 0x87, 0xa4, 0x3b, 0xf2, 0xba, 0x69, 0x18, 0xf5, 0xf7, 0x43, 0xee, 0x1d, 0xdc,
-	0x71, 0x6e, 0x0f, 0x42, 0xfe, 0x2a, 0xed, 0x7a, 0x3d, 0x32, 0x6c, 0x0e, 0xc8, 0x80, 0x34, 0xa5,
-	0x62, 0x37, 0xdd, 0x93, 0x92, 0x14, 0xe4, 0x4a, 0x11, 0x38, 0xeb, 0x03, 0x42, 0x06, 0x11, 0x3e,
-	0xd6, 0xe2, 0xe1, 0x10, 0x33, 0x1e, 0x0c, 0x13, 0xad, 0x70, 0xcb, 0xe0, 0x13, 0x1f, 0x6b, 0x66,
-	0x1f, 0x6b, 0x32, 0x12, 0x1d, 0x60, 0xda, 0x4c, 0xba, 0x4d, 0x92, 0x30, 0xad, 0xdd, 0x9c, 0xab,
-	0x1d, 0x24, 0x61, 0x93, 0x8f, 0x12, 0xcc, 0x9a, 0xdf, 0x11, 0xba, 0x8f, 0xa9, 0x02, 0xb8, 0x3f,
-	0x58, 0x50, 0x7b, 0x4a, 0xd3, 0x18, 0xfb, 0xf8, 0xdb, 0x14, 0x33, 0x8e, 0xae, 0x41, 0x71, 0x2f,
-	0x8c, 0x38, 0xa6, 0xb6, 0x55, 0xcf, 0x37, 0x2a, 0xbe, 0x96, 0xd0, 0x2a, 0xe4, 0x83, 0x28, 0xb2,
-	0x73, 0x75, 0xab, 0x51, 0xf6, 0xc5, 0x12, 0x35, 0xa0, 0xb6, 0x8f, 0x71, 0xd2, 0x49, 0x69, 0xc0,
-	0x43, 0x12, 0xdb, 0xf9, 0xba, 0xd5, 0xc8, 0xb7, 0x97, 0xde, 0x1c, 0xae, 0x5b, 0xfe, 0xc4, 0x3f,
-	0xc8, 0x85, 0x8a, 0x90, 0xdb, 0x23, 0x8e, 0x99, 0xbd, 0x64, 0xa8, 0x1d, 0x6f, 0xbb, 0x37, 0x61,
-	0xb5, 0x13, 0xb2, 0xfd, 0xe7, 0x2c, 0x18, 0x9c, 0x65, 0x8b, 0xfb, 0x18, 0x2e, 0x1b, 0xba, 0x2c,
-	0x21, 0x31, 0xc3, 0xe8, 0x2e, 0x14, 0x29, 0xee, 0x11, 0xda, 0x97, 0xca, 0xd5, 0xd6, 0x7b, 0xde,
-	0xc9, 0xdc, 0x78, 0x1a, 0x20, 0x94, 0x7c, 0xad, 0xec, 0xfe, 0x9b, 0x83, 0xaa, 0xb1, 0x8f, 0x56,
-	0x20, 0xb7, 0xdd, 0xb1, 0xad, 0xba, 0xd5, 0xa8, 0xf8, 0xb9, 0xed, 0x0e, 0xb2, 0xa1, 0xb4, 0x93,
-	0xf2, 0xa0, 0x1b, 0x61, 0xed, 0x7b, 0x26, 0xa2, 0xab, 0x50, 0xd8, 0x8e, 0x9f, 0x33, 0x2c, 0x1d,
-	0x2f, 0xfb, 0x4a, 0x40, 0x08, 0x96, 0x76, 0xc3, 0xef, 0xb1, 0x72, 0xd3, 0x97, 0x6b, 0xe1, 0xc7,
-	0xd3, 0x80, 0xe2, 0x98, 0xdb, 0x05, 0xc9, 0xab, 0x25, 0xd4, 0x86, 0xca, 0x16, 0xc5, 0x01, 0xc7,
-	0xfd, 0x07, 0xdc, 0x2e, 0xd6, 0xad, 0x46, 0xb5, 0xe5, 0x78, 0xaa, 0x20, 0xbc, 0xac, 0x20, 0xbc,
-	0x67, 0x59, 0x41, 0xb4, 0xcb, 0x6f, 0x0e, 0xd7, 0x2f, 0xfd, 0xf8, 0xa7, 0x88, 0xdb, 0x18, 0x86,
-	0xee, 0x03, 0x3c, 0x09, 0x18, 0x7f, 0xce, 0x24, 0x49, 0xe9, 0x4c, 0x92, 0x25, 0x49, 0x60, 0x60,
-	0xd0, 0x1a, 0x80, 0x0c, 0xc0, 0x16, 0x49, 0x63, 0x6e, 0x97, 0xa5, 0xdd, 0xc6, 0x0e, 0xaa, 0x43,
-	0xb5, 0x83, 0x59, 0x8f, 0x86, 0x89, 0x4c, 0x73, 0x45, 0xba, 0x60, 0x6e, 0x09, 0x06, 0x15, 0xbd,
-	0x67, 0xa3, 0x04, 0xdb, 0x20, 0x15, 0x8c, 0x1d, 0xe1, 0xff, 0xee, 0xab, 0x80, 0xe2, 0xbe, 0x5d,
-	0x95, 0xa1, 0xd2, 0x92, 0xfb, 0x53, 0x11, 0x6a, 0xbb, 0xa2, 0x8a, 0xb3, 0x84, 0xaf, 0x42, 0xde,
-	0xc7, 0x7b, 0x3a, 0xfa, 0x62, 0x89, 0x3c, 0x80, 0x0e, 0xde, 0x0b, 0xe3, 0x50, 0x7e, 0x3b, 0x27,
-	0xdd, 0x5b, 0xf1, 0x92, 0xae, 0x77, 0xbc, 0xeb, 0x1b, 0x1a, 0xc8, 0x81, 0xf2, 0xc3, 0xd7, 0x09,
-	0xa1, 0xa2, 0x68, 0xf2, 0x92, 0x66, 0x2c, 0xa3, 0x17, 0xb0, 0x9c, 0xad, 0x1f, 0x70, 0x4e, 0x45,
-	0x29, 0x8a, 0x42, 0xb9, 0x33, 0x5d, 0x28, 0xa6, 0x51, 0xde, 0x04, 0xe6, 0x61, 0xcc, 0xe9, 0xc8,
-	0x9f, 0xe4, 0x11, 0x35, 0xb2, 0x8b, 0x19, 0x13, 0x16, 0xaa, 0x04, 0x67, 0xa2, 0x30, 0xe7, 0x0b,
-	0x4a, 0x62, 0x8e, 0xe3, 0xbe, 0x4c, 0x70, 0xc5, 0x1f, 0xcb, 0xc2, 0x9c, 0x6c, 0xad, 0xcc, 0x29,
-	0x9d, 0xcb, 0x9c, 0x09, 0x8c, 0x36, 0x67, 0x62, 0x0f, 0x6d, 0x42, 0x61, 0x2b, 0xe8, 0xbd, 0xc2,
-	0x32, 0x97, 0xd5, 0xd6, 0xda, 0x34, 0xa1, 0xfc, 0xfb, 0x4b, 0x99, 0x3c, 0x26, 0x5b, 0xf1, 0x92,
-	0xaf, 0x20, 0xe8, 0x1b, 0xa8, 0x3d, 0x8c, 0x79, 0xc8, 0x23, 0x3c, 0xc4, 0x31, 0x67, 0x76, 0x45,
-	0x34, 0x5e, 0x7b, 0xf3, 0xed, 0xe1, 0xfa, 0xc7, 0x73, 0x8f, 0x96, 0x94, 0x87, 0x51, 0x13, 0x1b,
-	0x28, 0xcf, 0xa0, 0xf0, 0x27, 0xf8, 0xd0, 0x4b, 0x58, 0xc9, 0x8c, 0xdd, 0x8e, 0x93, 0x94, 0x33,
-	0x1b, 0xa4, 0xd7, 0xad, 0x73, 0x7a, 0xad, 0x40, 0xca, 0xed, 0x13, 0x4c, 0xce, 0x7d, 0x40, 0xd3,
-	0xb9, 0x12, 0x35, 0xb5, 0x8f, 0x47, 0x59, 0x4d, 0xed, 0xe3, 0x91, 0x68, 0xdc, 0x83, 0x20, 0x4a,
-	0x55, 0x43, 0x57, 0x7c, 0x25, 0x6c, 0xe6, 0xee, 0x59, 0x82, 0x61, 0x3a, 0xbc, 0x0b, 0x31, 0x7c,
-	0x05, 0x57, 0x66, 0x98, 0x3a, 0x83, 0xe2, 0x86, 0x49, 0x31, 0x5d, 0xd3, 0xc7, 0x94, 0xee, 0x2f,
-	0x79, 0xa8, 0x99, 0x09, 0x43, 0x1b, 0x70, 0x45, 0xf9, 0xe9, 0xe3, 0xbd, 0x0e, 0x4e, 0x28, 0xee,
-	0x89, 0xb3, 0x40, 0x93, 0xcf, 0xfa, 0x0b, 0xb5, 0xe0, 0xea, 0xf6, 0x50, 0x6f, 0x33, 0x03, 0x92,
-	0x93, 0xc7, 0xea, 0xcc, 0xff, 0x10, 0x81, 0xff, 0x29, 0x2a, 0x19, 0x09, 0x03, 0x94, 0x97, 0x09,
-	0xfb, 0xe4, 0xf4, 0xaa, 0xf2, 0x66, 0x62, 0x55, 0xde, 0x66, 0xf3, 0xa2, 0xcf, 0xa0, 0xa4, 0xfe,
-	0xc8, 0x1a, 0xf3, 0xfa, 0xe9, 0x9f, 0x50, 0x64, 0x19, 0x46, 0xc0, 0x95, 0x1f, 0xcc, 0x2e, 0x2c,
-	0x00, 0xd7, 0x18, 0xe7, 0x11, 0x38, 0xf3, 0x4d, 0x5e, 0xa4, 0x04, 0xdc, 0x9f, 0x2d, 0xb8, 0x3c,
-	0xf5, 0x21, 0x71, 0x2f, 0xc8, 0xd3, 0x51, 0x51, 0xc8, 0x35, 0xea, 0x40, 0x41, 0x75, 0x7e, 0x4e,
-	0x1a, 0xec, 0x9d, 0xc3, 0x60, 0xcf, 0x68, 0x7b, 0x05, 0x76, 0xee, 0x01, 0x5c, 0xac, 0x58, 0xdd,
-	0xdf, 0x2c, 0x58, 0xd6, 0x5d, 0xa6, 0x2f, 0xd1, 0x00, 0x56, 0xb3, 0x16, 0xca, 0xf6, 0xf4, 0x75,
-	0x7a, 0x77, 0x6e, 0x83, 0x2a, 0x35, 0xef, 0x24, 0x4e, 0xd9, 0x38, 0x45, 0xe7, 0x6c, 0x65, 0x75,
-	0x75, 0x42, 0x75, 0x21, 0xcb, 0xdf, 0x87, 0xe5, 0x5d, 0x1e, 0xf0, 0x94, 0xcd, 0xbd, 0x39, 0xdc,
-	0x5f, 0x2d, 0x58, 0xc9, 0x74, 0xb4, 0x77, 0x1f, 0x41, 0xf9, 0x00, 0x53, 0x8e, 0x5f, 0x63, 0xa6,
-	0xbd, 0xb2, 0xa7, 0xbd, 0xfa, 0x5a, 0x6a, 0xf8, 0x63, 0x4d, 0xb4, 0x09, 0x65, 0x26, 0x79, 0x70,
-	0x96, 0xa8, 0xb5, 0x79, 0x28, 0xfd, 0xbd, 0xb1, 0x3e, 0x6a, 0xc2, 0x52, 0x44, 0x06, 0x4c, 0xf7,
-	0xcc, 0xff, 0xe7, 0xe1, 0x9e, 0x90, 0x81, 0x2f, 0x15, 0xdd, 0xc3, 0x1c, 0x14, 0xd5, 0x1e, 0x7a,
-	0x0c, 0xc5, 0x7e, 0x38, 0xc0, 0x8c, 0x2b, 0xaf, 0xda, 0x2d, 0x71, 0x4e, 0xbf, 0x3d, 0x5c, 0xbf,
-	0x69, 0x1c, 0xc4, 0x24, 0xc1, 0xb1, 0x78, 0x91, 0x06, 0x61, 0x8c, 0x29, 0x6b, 0x0e, 0xc8, 0x6d,
-	0x05, 0xf1, 0x3a, 0xf2, 0xc7, 0xd7, 0x0c, 0x82, 0x2b, 0x54, 0xc7, 0xad, 0x6c, 0xf9, 0x8b, 0x71,
-	0x29, 0x06, 0x51, 0xc9, 0x71, 0x30, 0xc4, 0xfa, 0x7a, 0x95, 0x6b, 0x71, 0xc3, 0xf7, 0x44, 0xa9,
-	0xf6, 0xe5, 0xbb, 0xa7, 0xec, 0x6b, 0x09, 0x6d, 0x42, 0x89, 0xf1, 0x80, 0x8a, 0x63, 0xa3, 0x70,
-	0xce, 0xa7, 0x49, 0x06, 0x40, 0x9f, 0x43, 0xa5, 0x47, 0x86, 0x49, 0x84, 0x05, 0xba, 0x78, 0x4e,
-	0xf4, 0x31, 0x44, 0x54, 0x0f, 0xa6, 0x94, 0x50, 0xf9, 0x28, 0xaa, 0xf8, 0x4a, 0x70, 0xff, 0xc9,
-	0x41, 0xcd, 0x4c, 0xd6, 0xd4, 0x83, 0xef, 0x31, 0x14, 0x55, 0xea, 0x55, 0xd5, 0x5d, 0x2c, 0x54,
-	0x8a, 0x61, 0x66, 0xa8, 0x6c, 0x28, 0xf5, 0x52, 0x2a, 0x5f, 0x83, 0xea, 0x8d, 0x98, 0x89, 0xc2,
-	0x60, 0x4e, 0x78, 0x10, 0xc9, 0x50, 0xe5, 0x7d, 0x25, 0x88, 0x47, 0xe2, 0x78, 0x26, 0x58, 0xec,
-	0x91, 0x38, 0x86, 0x99, 0x69, 0x28, 0xbd, 0x53, 0x1a, 0xca, 0x0b, 0xa7, 0xc1, 0xfd, 0xdd, 0x82,
-	0xca, 0xb8, 0xca, 0x8d, 0xe8, 0x5a, 0xef, 0x1c, 0xdd, 0x89, 0xc8, 0xe4, 0x2e, 0x16, 0x99, 0x6b,
-	0x50, 0x64, 0x9c, 0xe2, 0x60, 0xa8, 0xc6, 0x17, 0x5f, 0x4b, 0xe2, 0x3c, 0x19, 0xb2, 0x81, 0xcc,
-	0x50, 0xcd, 0x17, 0x4b, 0xd7, 0x85, 0x9a, 0x9c, 0x54, 0x76, 0x30, 0x13, 0x6f, 0x63, 0x91, 0xdb,
-	0x7e, 0xc0, 0x03, 0xe9, 0x47, 0xcd, 0x97, 0x6b, 0xf7, 0x16, 0xa0, 0x27, 0x21, 0xe3, 0x2f, 0xe4,
-	0x84, 0xc5, 0xce, 0x1a, 0x63, 0x76, 0xe1, 0xca, 0x84, 0xb6, 0x3e, 0xa5, 0x3e, 0x3d, 0x31, 0xc8,
-	0xdc, 0x98, 0x3e, 0x35, 0xe4, 0x20, 0xe7, 0x29, 0xe0, 0xe4, 0x3c, 0xd3, 0xfa, 0x3b, 0x0f, 0xa5,
-	0x2d, 0x35, 0xa3, 0xa2, 0x67, 0x50, 0x19, 0xcf, 0x49, 0xc8, 0x9d, 0xa6, 0x39, 0x39, 0x70, 0x39,
-	0xd7, 0x4f, 0xd5, 0xd1, 0xf6, 0x3d, 0x82, 0x82, 0x9c, 0x18, 0xd1, 0x8c, 0x63, 0xd0, 0x1c, 0x25,
-	0x9d, 0xd3, 0x27, 0xb0, 0x0d, 0x4b, 0x30, 0xc9, 0x3b, 0x64, 0x16, 0x93, 0xf9, 0xfa, 0x73, 0xd6,
-	0xcf, 0xb8, 0x7c, 0xd0, 0x0e, 0x14, 0x75, 0x3b, 0xcf, 0x52, 0x35, 0x6f, 0x0a, 0xa7, 0x3e, 0x5f,
-	0x41, 0x91, 0x6d, 0x58, 0x68, 0x67, 0xfc, 0xa0, 0x9f, 0x65, 0x9a, 0x59, 0x06, 0xce, 0x19, 0xff,
-	0x37, 0xac, 0x0d, 0x0b, 0xbd, 0x84, 0xaa, 0x91, 0x68, 0x34, 0x23, 0xa1, 0xd3, 0x55, 0xe3, 0x7c,
-	0x70, 0x86, 0x96, 0x32, 0xb6, 0x5d, 0x7b, 0x73, 0xb4, 0x66, 0xfd, 0x71, 0xb4, 0x66, 0xfd, 0x75,
-	0xb4, 0x66, 0x75, 0x8b, 0xb2, 0xee, 0x3f, 0xfc, 0x2f, 0x00, 0x00, 0xff, 0xff, 0xfb, 0x65, 0x7c,
-	0xd6, 0xa7, 0x10, 0x00, 0x00,
+	// 1570 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x58, 0xcd, 0x6e, 0x1b, 0x47,
+	0x12, 0xf6, 0x90, 0xe2, 0x5f, 0x91, 0xd2, 0xca, 0x2d, 0xdb, 0x18, 0xcc, 0xee, 0x4a, 0xda, 0xb1,
+	0x77, 0x21, 0x18, 0xf6, 0x50, 0xd6, 0xc6, 0x81, 0x23, 0x24, 0x81, 0x4d, 0xd1, 0x86, 0x65, 0x48,
+	0x89, 0xd3, 0xb2, 0x63, 0xc0, 0x87, 0x00, 0x43, 0xb2, 0x45, 0x0d, 0x34, 0x9c, 0x9e, 0x74, 0x37,
+	0x15, 0xd3, 0xd7, 0xbc, 0x40, 0xde, 0x22, 0xa7, 0x9c, 0x72, 0xc8, 0x13, 0x04, 0x30, 0x90, 0x4b,
+	0x90, 0xa3, 0x0f, 0x4a, 0xe0, 0x7b, 0xf2, 0x0c, 0x41, 0x57, 0xcf, 0x50, 0x43, 0x91, 0xd4, 0x9f,
+	0x4f, 0xec, 0xaa, 0xae, 0xfa, 0xba, 0xfe, 0xba, 0xa6, 0x8b, 0x30, 0xdb, 0xe6, 0x91, 0x12, 0x3c,
+	0xf4, 0x62, 0xc1, 0x15, 0x27, 0xf3, 0x3d, 0xde, 0x1a, 0x78, 0xad, 0x7e, 0x10, 0x76, 0xf6, 0x03,
+	0xe5, 0x1d, 0xdc, 0x71, 0x6e, 0x77, 0x03, 0xb5, 0xd7, 0x6f, 0x79, 0x6d, 0xde, 0xab, 0x77, 0x79,
+	0x97, 0xd7, 0x51, 0xb0, 0xd5, 0xdf, 0x45, 0x0a, 0x09, 0x5c, 0x19, 0x00, 0x67, 0xa9, 0xcb, 0x79,
+	0x37, 0x64, 0x47, 0x52, 0x2a, 0xe8, 0x31, 0xa9, 0xfc, 0x5e, 0x9c, 0x08, 0xdc, 0xca, 0xe0, 0xe9,
+	0xc3, 0xea, 0xe9, 0x61, 0x75, 0xc9, 0xc3, 0x03, 0x26, 0xea, 0x71, 0xab, 0xce, 0x63, 0x99, 0x48,
+	0xd7, 0xa7, 0x4a, 0xfb, 0x71, 0x50, 0x57, 0x83, 0x98, 0xc9, 0xfa, 0x37, 0x5c, 0xec, 0x33, 0x61,
+	0x14, 0xdc, 0xdf, 0x2c, 0xa8, 0x3d, 0x15, 0xfd, 0x88, 0x51, 0xf6, 0x75, 0x9f, 0x49, 0x45, 0xae,
+	0x41, 0x71, 0x37, 0x08, 0x15, 0x13, 0xb6, 0xb5, 0x9c, 0x5f, 0xa9, 0xd0, 0x84, 0x22, 0xf3, 0x90,
+	0xf7, 0xc3, 0xd0, 0xce, 0x2d, 0x5b, 0x2b, 0x65, 0xaa, 0x97, 0x64, 0x05, 0x6a, 0xfb, 0x8c, 0xc5,
+	0xcd, 0xbe, 0xf0, 0x55, 0xc0, 0x23, 0x3b, 0xbf, 0x6c, 0xad, 0xe4, 0x1b, 0x33, 0x6f, 0x0e, 0x97,
+	0x2c, 0x3a, 0xb2, 0x43, 0x5c, 0xa8, 0x68, 0xba, 0x31, 0x50, 0x4c, 0xda, 0x33, 0x19, 0xb1, 0x23,
+	0x36, 0xb9, 0x02, 0x85, 0x5d, 0x2e, 0xda, 0xcc, 0x2e, 0xe0, 0x09, 0x86, 0x20, 0x36, 0x94, 0x7a,
+	0x41, 0xf4, 0x38, 0x50, 0xd2, 0x2e, 0x6a, 0x3d, 0x9a, 0x92, 0xc4, 0x81, 0x72, 0xcf, 0x7f, 0xf5,
+	0x48, 0x30, 0xd6, 0xb1, 0x4b, 0xb8, 0x35, 0xa4, 0xdd, 0x9b, 0x30, 0xdf, 0x0c, 0xe4, 0xfe, 0x73,
+	0xe9, 0x77, 0x4f, 0xf3, 0xcb, 0x7d, 0x02, 0x97, 0x33, 0xb2, 0x32, 0xe6, 0x91, 0x64, 0xe4, 0x2e,
+	0x14, 0x05, 0x6b, 0x73, 0xd1, 0x41, 0xe1, 0xea, 0xda, 0xbf, 0xbd, 0xe3, 0x79, 0xf6, 0x12, 0x05,
+	0x2d, 0x44, 0x13, 0x61, 0xf7, 0xdb, 0x02, 0x54, 0x33, 0x7c, 0x32, 0x07, 0xb9, 0xcd, 0xa6, 0x6d,
+	0x2d, 0x5b, 0x2b, 0x15, 0x9a, 0xdb, 0x6c, 0x6a, 0x6f, 0xb6, 0xfb, 0xca, 0x6f, 0x85, 0x2c, 0x89,
+	0x63, 0x4a, 0x6a, 0xef, 0x37, 0xa3, 0xe7, 0x92, 0x61, 0x10, 0xcb, 0xd4, 0x10, 0x84, 0xc0, 0xcc,
+	0x4e, 0xf0, 0x9a, 0x99, 0x90, 0x51, 0x5c, 0x6b, 0x3f, 0x9e, 0xfa, 0x82, 0x45, 0x0a, 0x03, 0x55,
+	0xa1, 0x09, 0x45, 0x1a, 0x50, 0xd9, 0x10, 0xcc, 0x57, 0xac, 0xf3, 0x40, 0x61, 0xac, 0xaa, 0x6b,
+	0x8e, 0x67, 0x8a, 0xcb, 0x4b, 0x8b, 0xcb, 0x7b, 0x96, 0x16, 0x57, 0xa3, 0xfc, 0xe6, 0x70, 0xe9,
+	0xd2, 0x77, 0xbf, 0xeb, 0x1c, 0x0c, 0xd5, 0xc8, 0x7d, 0x80, 0x2d, 0x5f, 0xaa, 0xe7, 0x12, 0x41,
+	0x4a, 0xa7, 0x82, 0xcc, 0x20, 0x40, 0x46, 0x87, 0x2c, 0x02, 0x60, 0x00, 0x36, 0x78, 0x3f, 0x52,
+	0x76, 0x19, 0xed, 0xce, 0x70, 0xc8, 0x32, 0x54, 0x9b, 0x4c, 0xb6, 0x45, 0x10, 0x63, 0xc9, 0x54,
+	0xd0, 0x85, 0x2c, 0x4b, 0x23, 0x98, 0xe8, 0x3d, 0x1b, 0xc4, 0xcc, 0x06, 0x14, 0xc8, 0x70, 0xb4,
+	0xff, 0x3b, 0x7b, 0xbe, 0x60, 0x1d, 0xbb, 0x8a, 0xa1, 0x4a, 0x28, 0x8c, 0x4b, 0x10, 0x45, 0xac,
+	0x63, 0xd7, 0x0c, 0xdf, 0x50, 0xe4, 0x5f, 0x50, 0x79, 0x1a, 0x44, 0x94, 0xf9, 0x92, 0x47, 0xf6,
+	0x2c, 0xc2, 0x1d, 0x31, 0x74, 0x46, 0x36, 0xf6, 0xfc, 0x20, 0xda, 0x6c, 0xda, 0x73, 0xb8, 0x97,
+	0x92, 0x3a, 0xf6, 0x8d, 0x90, 0xb7, 0xec, 0x7f, 0x20, 0x1b, 0xd7, 0x1a, 0x6b, 0x9b, 0x75, 0x02,
+	0x1f, 0x4d, 0x9b, 0x37, 0x58, 0x43, 0x86, 0xd6, 0xd8, 0xf2, 0x5f, 0x0f, 0xec, 0xcb, 0x78, 0x3e,
+	0xae, 0x75, 0x95, 0x6a, 0x4d, 0xcc, 0x22, 0x31, 0x55, 0x9a, 0xd2, 0xfa, 0xec, 0x86, 0x2e, 0xa8,
+	0xcd, 0xa6, 0xbd, 0x60, 0xce, 0x4e, 0x48, 0x7d, 0xce, 0x67, 0x7e, 0x8f, 0xc9, 0xd8, 0x6f, 0x33,
+	0xfb, 0x8a, 0x39, 0x67, 0xc8, 0x18, 0xc6, 0x78, 0xa7, 0xcd, 0x05, 0xb3, 0xaf, 0x2e, 0x5b, 0x2b,
+	0x16, 0xcd, 0x70, 0xdc, 0x5f, 0x8a, 0x50, 0xdb, 0xd1, 0xbd, 0x21, 0x2d, 0xfd, 0x79, 0xc8, 0x53,
+	0xb6, 0x9b, 0xd4, 0xa1, 0x5e, 0x12, 0x0f, 0xa0, 0xc9, 0x76, 0x83, 0x28, 0xc0, 0x2c, 0xe4, 0x30,
+	0xd1, 0x73, 0x5e, 0xdc, 0xf2, 0x8e, 0xb8, 0x34, 0x23, 0xa1, 0xdd, 0x78, 0xf8, 0x2a, 0xe6, 0x42,
+	0x5f, 0x9f, 0x3c, 0xc2, 0x0c, 0x69, 0xf2, 0x02, 0x66, 0xd3, 0xf5, 0x03, 0xa5, 0x84, 0xbe, 0xe0,
+	0xfa, 0xca, 0xdc, 0x19, 0xbf, 0x32, 0x59, 0xa3, 0xbc, 0x11, 0x9d, 0x87, 0x91, 0x12, 0x03, 0x3a,
+	0x8a, 0xa3, 0xe3, 0xb3, 0xc3, 0xa4, 0xd4, 0x16, 0x9a, 0x52, 0x4f, 0x49, 0x6d, 0xce, 0x23, 0xc1,
+	0x23, 0xc5, 0xa2, 0x0e, 0x96, 0x7a, 0x85, 0x0e, 0x69, 0x6d, 0x4e, 0xba, 0x36, 0xe6, 0x94, 0xce,
+	0x64, 0xce, 0x88, 0x4e, 0x62, 0xce, 0x08, 0x8f, 0xac, 0x43, 0x61, 0xc3, 0x6f, 0xef, 0x31, 0xac,
+	0xea, 0xea, 0xda, 0xe2, 0x38, 0x20, 0x6e, 0x7f, 0x8e, 0x65, 0x2c, 0xb1, 0xc1, 0x5d, 0xa2, 0x46,
+	0x85, 0x7c, 0x05, 0xb5, 0x87, 0x91, 0x0a, 0x54, 0xc8, 0x7a, 0x2c, 0x52, 0xd2, 0xae, 0xe8, 0x16,
+	0xd4, 0x58, 0x7f, 0x7b, 0xb8, 0xf4, 0xe1, 0xd4, 0x86, 0xdd, 0x57, 0x41, 0x58, 0x67, 0x19, 0x2d,
+	0x2f, 0x03, 0x41, 0x47, 0xf0, 0xc8, 0x4b, 0x98, 0x4b, 0x8d, 0xdd, 0x8c, 0xe2, 0xbe, 0x92, 0x36,
+	0xa0, 0xd7, 0x6b, 0x67, 0xf4, 0xda, 0x28, 0x19, 0xb7, 0x8f, 0x21, 0x91, 0xff, 0xc1, 0x1c, 0x3a,
+	0x71, 0x54, 0x91, 0x55, 0x0c, 0xf9, 0x31, 0xae, 0x73, 0x1f, 0xc8, 0x78, 0x4e, 0x75, 0xed, 0xed,
+	0xb3, 0x41, 0x5a, 0x7b, 0xfb, 0x6c, 0xa0, 0x5b, 0xdd, 0x81, 0x1f, 0xf6, 0x4d, 0x0b, 0xac, 0x50,
+	0x43, 0xac, 0xe7, 0xee, 0x59, 0x1a, 0x61, 0x3c, 0x0d, 0xe7, 0x42, 0xf8, 0x02, 0x16, 0x26, 0xb8,
+	0x34, 0x01, 0xe2, 0x46, 0x16, 0x62, 0xbc, 0xf6, 0x8f, 0x20, 0xdd, 0x1f, 0xf2, 0x50, 0xcb, 0x26,
+	0x96, 0xac, 0xc2, 0x82, 0xf1, 0x93, 0xb2, 0xdd, 0x26, 0x8b, 0x05, 0x6b, 0xeb, 0xee, 0x99, 0x80,
+	0x4f, 0xda, 0x22, 0x6b, 0x70, 0x65, 0xb3, 0x97, 0xb0, 0x65, 0x46, 0x25, 0x87, 0x1f, 0xa2, 0x89,
+	0x7b, 0x84, 0xc3, 0x55, 0x03, 0x85, 0x91, 0xc8, 0x28, 0xe5, 0x31, 0xb1, 0x1f, 0x9d, 0x5c, 0x7d,
+	0xde, 0x44, 0x5d, 0x93, 0xdf, 0xc9, 0xb8, 0xe4, 0x13, 0x28, 0x99, 0x8d, 0xf4, 0x02, 0x5f, 0x3f,
+	0xf9, 0x08, 0x03, 0x96, 0xea, 0x68, 0x75, 0xe3, 0x87, 0xb4, 0x0b, 0xe7, 0x50, 0x4f, 0x74, 0x9c,
+	0xc7, 0xe0, 0x4c, 0x37, 0xf9, 0x3c, 0x25, 0xe0, 0x7e, 0x6f, 0xc1, 0xe5, 0xb1, 0x83, 0x74, 0x6f,
+	0xc6, 0xa6, 0x6d, 0x20, 0x70, 0x4d, 0x9a, 0x50, 0x30, 0x1d, 0x22, 0x87, 0x06, 0x7b, 0x67, 0x30,
+	0xd8, 0xcb, 0xb4, 0x07, 0xa3, 0xec, 0xdc, 0x03, 0xb8, 0x58, 0xb1, 0xba, 0x3f, 0x59, 0x30, 0x9b,
+	0xdc, 0xc6, 0xe4, 0xd9, 0xe1, 0xc3, 0x7c, 0x7a, 0x85, 0x52, 0x5e, 0xf2, 0x00, 0xb9, 0x3b, 0xf5,
+	0x22, 0x1b, 0x31, 0xef, 0xb8, 0x9e, 0xb1, 0x71, 0x0c, 0xce, 0xd9, 0x80, 0xab, 0xc7, 0x79, 0xe7,
+	0xb7, 0xfc, 0x3f, 0x30, 0xbb, 0xa3, 0x7c, 0xd5, 0x97, 0x53, 0xbf, 0x30, 0xee, 0x8f, 0x16, 0xcc,
+	0xa5, 0x32, 0x89, 0x77, 0x1f, 0x40, 0xf9, 0x80, 0x09, 0xc5, 0x5e, 0x31, 0x99, 0x78, 0x65, 0x8f,
+	0x7b, 0xf5, 0x25, 0x4a, 0xd0, 0xa1, 0x24, 0x59, 0x87, 0xb2, 0x44, 0x1c, 0x96, 0x26, 0x6a, 0x71,
+	0x9a, 0x56, 0x72, 0xde, 0x50, 0x9e, 0xd4, 0x61, 0x26, 0xe4, 0x5d, 0x99, 0xdc, 0x99, 0x7f, 0x4e,
+	0xd3, 0xdb, 0xe2, 0x5d, 0x8a, 0x82, 0xee, 0x61, 0x0e, 0x8a, 0x86, 0x47, 0x9e, 0x40, 0xb1, 0x13,
+	0x74, 0x99, 0x54, 0xc6, 0xab, 0xc6, 0x9a, 0xee, 0xe7, 0x6f, 0x0f, 0x97, 0x6e, 0x66, 0x1a, 0x36,
+	0x8f, 0x59, 0xa4, 0xe7, 0x01, 0x3f, 0x88, 0x98, 0x90, 0xf5, 0x2e, 0xbf, 0x6d, 0x54, 0xbc, 0x26,
+	0xfe, 0xd0, 0x04, 0x41, 0x63, 0x05, 0xa6, 0x2d, 0xe3, 0x95, 0xbf, 0x18, 0x96, 0x41, 0xd0, 0x95,
+	0x1c, 0xf9, 0x3d, 0x96, 0x7c, 0x86, 0x71, 0xad, 0xdf, 0x3e, 0x6d, 0x5d, 0xaa, 0x1d, 0x7c, 0x29,
+	0x96, 0x69, 0x42, 0x91, 0x75, 0x28, 0x49, 0xe5, 0x0b, 0xdd, 0x36, 0x0a, 0x67, 0x7c, 0xcc, 0xa5,
+	0x0a, 0xe4, 0x53, 0xa8, 0xb4, 0x79, 0x2f, 0x0e, 0x99, 0x62, 0xe6, 0x23, 0x7b, 0x16, 0xed, 0x23,
+	0x15, 0x5d, 0x3d, 0x4c, 0x08, 0x2e, 0xf0, 0x19, 0x59, 0xa1, 0x86, 0x70, 0xff, 0xca, 0x41, 0x2d,
+	0x9b, 0xac, 0xb1, 0x27, 0xf2, 0x13, 0x28, 0x9a, 0xd4, 0x9b, 0xaa, 0xbb, 0x58, 0xa8, 0x0c, 0xc2,
+	0xc4, 0x50, 0xd9, 0x50, 0x6a, 0xf7, 0x05, 0xbe, 0x9f, 0xcd, 0xab, 0x3a, 0x25, 0xb5, 0xc1, 0x8a,
+	0x2b, 0x3f, 0xc4, 0x50, 0xe5, 0xa9, 0x21, 0xf4, 0xb3, 0x7a, 0x38, 0x91, 0x9d, 0xef, 0x59, 0x3d,
+	0x54, 0xcb, 0xa6, 0xa1, 0xf4, 0x5e, 0x69, 0x28, 0x9f, 0x3b, 0x0d, 0xee, 0xcf, 0x16, 0x54, 0x86,
+	0x55, 0x9e, 0x89, 0xae, 0xf5, 0xde, 0xd1, 0x1d, 0x89, 0x4c, 0xee, 0x62, 0x91, 0xb9, 0x06, 0x45,
+	0xa9, 0x04, 0xf3, 0x7b, 0x66, 0x78, 0xa4, 0x09, 0xa5, 0xfb, 0x49, 0x4f, 0x76, 0x31, 0x43, 0x35,
+	0xaa, 0x97, 0xae, 0x0b, 0x35, 0x9c, 0x13, 0xb7, 0x99, 0xd4, 0x2f, 0x5d, 0x9d, 0xdb, 0x8e, 0xaf,
+	0x7c, 0xf4, 0xa3, 0x46, 0x71, 0xed, 0xde, 0x02, 0xb2, 0x15, 0x48, 0xf5, 0x02, 0xe7, 0x5b, 0x79,
+	0xda, 0xe0, 0xb7, 0x03, 0x0b, 0x23, 0xd2, 0x49, 0x97, 0xfa, 0xf8, 0xd8, 0xe8, 0x77, 0x63, 0xbc,
+	0x6b, 0xe0, 0x18, 0xed, 0x19, 0xc5, 0xd1, 0x09, 0x70, 0xed, 0xcf, 0x3c, 0x94, 0x36, 0xcc, 0x3f,
+	0x04, 0xe4, 0x19, 0x54, 0x86, 0x93, 0x25, 0x71, 0xc7, 0x61, 0x8e, 0x8f, 0xa8, 0xce, 0xf5, 0x13,
+	0x65, 0x12, 0xfb, 0x1e, 0x43, 0x01, 0xe7, 0x75, 0x32, 0xa1, 0x0d, 0x66, 0x07, 0x79, 0xe7, 0xe4,
+	0x99, 0x75, 0xd5, 0xd2, 0x48, 0xf8, 0x0d, 0x99, 0x84, 0x94, 0x7d, 0x25, 0x3a, 0x4b, 0xa7, 0x7c,
+	0x7c, 0xc8, 0x36, 0x14, 0x93, 0xeb, 0x3c, 0x49, 0x34, 0xfb, 0xa5, 0x70, 0x96, 0xa7, 0x0b, 0x18,
+	0xb0, 0x55, 0x8b, 0x6c, 0x0f, 0x1f, 0xfe, 0x93, 0x4c, 0xcb, 0x96, 0x81, 0x73, 0xca, 0xfe, 0x8a,
+	0xb5, 0x6a, 0x91, 0x97, 0x50, 0xcd, 0x24, 0x9a, 0x4c, 0x48, 0xe8, 0x78, 0xd5, 0x38, 0xff, 0x3d,
+	0x45, 0xca, 0x18, 0xdb, 0xa8, 0xbd, 0x79, 0xb7, 0x68, 0xfd, 0xfa, 0x6e, 0xd1, 0xfa, 0xe3, 0xdd,
+	0xa2, 0xd5, 0x2a, 0x62, 0xdd, 0xff, 0xff, 0xef, 0x01, 0x00, 0x99, 0x96, 0xeb, 0x77, 0x25, 0x12,
+	0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -1618,6 +1742,26 @@ func (m *PruneRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.MaxFreed != 0 {
+		i = encodeVarintControl(dAtA, i, uint64(m.MaxFreed))
+		i--
+		dAtA[i] = 0x38
+	}
+	if m.MinHits != 0 {
+		i = encodeVarintControl(dAtA, i, uint64(m.MinHits))
+		i--
+		dAtA[i] = 0x30
+	}
+	if m.Force {
+		i--
+		if m.Force {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x28
+	}
 	if m.KeepBytes != 0 {
 		i = encodeVarintControl(dAtA, i, uint64(m.KeepBytes))
 		i--
@@ -1751,6 +1895,91 @@ func (m *UsageRecord) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.UsageScore != 0 {
+		i -= 8
+		encoding_binary.LittleEndian.PutUint64(dAtA[i:], uint64(math.Float64bits(float64(m.UsageScore))))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xa9
+	}
+	if len(m.Namespace) > 0 {
+		i -= len(m.Namespace)
+		copy(dAtA[i:], m.Namespace)
+		i = encodeVarintControl(dAtA, i, uint64(len(m.Namespace)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xa2
+	}
+	if len(m.BuildID) > 0 {
+		i -= len(m.BuildID)
+		copy(dAtA[i:], m.BuildID)
+		i = encodeVarintControl(dAtA, i, uint64(len(m.BuildID)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x9a
+	}
+	if m.BlobSize != 0 {
+		i = encodeVarintControl(dAtA, i, uint64(m.BlobSize))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x90
+	}
+	if m.Lazy {
+		i--
+		if m.Lazy {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x88
+	}
+	if len(m.MediaType) > 0 {
+		i -= len(m.MediaType)
+		copy(dAtA[i:], m.MediaType)
+		i = encodeVarintControl(dAtA, i, uint64(len(m.MediaType)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x82
+	}
+	if len(m.Blob) > 0 {
+		i -= len(m.Blob)
+		copy(dAtA[i:], m.Blob)
+		i = encodeVarintControl(dAtA, i, uint64(len(m.Blob)))
+		i--
+		dAtA[i] = 0x7a
+	}
+	if len(m.ChainID) > 0 {
+		i -= len(m.ChainID)
+		copy(dAtA[i:], m.ChainID)
+		i = encodeVarintControl(dAtA, i, uint64(len(m.ChainID)))
+		i--
+		dAtA[i] = 0x72
+	}
+	if len(m.PinReason) > 0 {
+		i -= len(m.PinReason)
+		copy(dAtA[i:], m.PinReason)
+		i = encodeVarintControl(dAtA, i, uint64(len(m.PinReason)))
+		i--
+		dAtA[i] = 0x6a
+	}
+	if m.Pinned {
+		i--
+		if m.Pinned {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x60
+	}
 	if m.Shared {
 		i--
 		if m.Shared {
@@ -1864,6 +2093,13 @@ func (m *SolveRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.CacheNamespace) > 0 {
+		i -= len(m.CacheNamespace)
+		copy(dAtA[i:], m.CacheNamespace)
+		i = encodeVarintControl(dAtA, i, uint64(len(m.CacheNamespace)))
+		i--
+		dAtA[i] = 0x5a
+	}
 	if len(m.FrontendInputs) > 0 {
 		for k := range m.FrontendInputs {
 			v := m.FrontendInputs[k]
@@ -2652,6 +2888,15 @@ func (m *PruneRequest) Size() (n int) {
 	if m.KeepBytes != 0 {
 		n += 1 + sovControl(uint64(m.KeepBytes))
 	}
+	if m.Force {
+		n += 2
+	}
+	if m.MinHits != 0 {
+		n += 1 + sovControl(uint64(m.MinHits))
+	}
+	if m.MaxFreed != 0 {
+		n += 1 + sovControl(uint64(m.MaxFreed))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -2737,6 +2982,42 @@ func (m *UsageRecord) Size() (n int) {
 	if m.Shared {
 		n += 2
 	}
+	if m.Pinned {
+		n += 2
+	}
+	l = len(m.PinReason)
+	if l > 0 {
+		n += 1 + l + sovControl(uint64(l))
+	}
+	l = len(m.ChainID)
+	if l > 0 {
+		n += 1 + l + sovControl(uint64(l))
+	}
+	l = len(m.Blob)
+	if l > 0 {
+		n += 1 + l + sovControl(uint64(l))
+	}
+	l = len(m.MediaType)
+	if l > 0 {
+		n += 2 + l + sovControl(uint64(l))
+	}
+	if m.Lazy {
+		n += 3
+	}
+	if m.BlobSize != 0 {
+		n += 2 + sovControl(uint64(m.BlobSize))
+	}
+	l = len(m.BuildID)
+	if l > 0 {
+		n += 2 + l + sovControl(uint64(l))
+	}
+	l = len(m.Namespace)
+	if l > 0 {
+		n += 2 + l + sovControl(uint64(l))
+	}
+	if m.UsageScore != 0 {
+		n += 10
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -2806,6 +3087,10 @@ func (m *SolveRequest) Size() (n int) {
 			n += mapEntrySize + 1 + sovControl(uint64(mapEntrySize))
 		}
 	}
+	l = len(m.CacheNamespace)
+	if l > 0 {
+		n += 1 + l + sovControl(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -3227,6 +3512,64 @@ func (m *PruneRequest) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Force", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Force = bool(v != 0)
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinHits", wireType)
+			}
+			m.MinHits = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MinHits |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxFreed", wireType)
+			}
+			m.MaxFreed = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaxFreed |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipControl(dAtA[iNdEx:])
@@ -3741,6 +4084,268 @@ func (m *UsageRecord) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Shared = bool(v != 0)
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Pinned", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Pinned = bool(v != 0)
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PinReason", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthControl
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthControl
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PinReason = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChainID", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthControl
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthControl
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ChainID = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 15:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Blob", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthControl
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthControl
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Blob = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 16:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MediaType", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthControl
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthControl
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.MediaType = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 17:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Lazy", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Lazy = bool(v != 0)
+		case 18:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BlobSize", wireType)
+			}
+			m.BlobSize = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BlobSize |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 19:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BuildID", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthControl
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthControl
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.BuildID = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 20:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Namespace", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthControl
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthControl
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Namespace = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 21:
+			if wireType != 1 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UsageScore", wireType)
+			}
+			var v uint64
+			if (iNdEx + 8) > l {
+				return io.ErrUnexpectedEOF
+			}
+			v = uint64(encoding_binary.LittleEndian.Uint64(dAtA[iNdEx:]))
+			iNdEx += 8
+			m.UsageScore = float64(math.Float64frombits(v))
 		default:
 			iNdEx = preIndex
 			skippy, err := skipControl(dAtA[iNdEx:])
@@ -4404,6 +5009,38 @@ func (m *SolveRequest) Unmarshal(dAtA []byte) error {
 			}
 			m.FrontendInputs[mapkey] = mapvalue
 			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CacheNamespace", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowControl
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthControl
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthControl
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CacheNamespace = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipControl(dAtA[iNdEx:])
@@ -100,6 +100,7 @@ type GCPolicy struct {
 	KeepDuration         int64    `protobuf:"varint,2,opt,name=keepDuration,proto3" json:"keepDuration,omitempty"`
 	KeepBytes            int64    `protobuf:"varint,3,opt,name=keepBytes,proto3" json:"keepBytes,omitempty"`
 	Filters              []string `protobuf:"bytes,4,rep,name=filters,proto3" json:"filters,omitempty"`
+	MinHits              int64    `protobuf:"varint,5,opt,name=minHits,proto3" json:"minHits,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -166,6 +167,13 @@ func (m *GCPolicy) GetFilters() []string {
 	return nil
 }
 
+func (m *GCPolicy) GetMinHits() int64 {
+	if m != nil {
+		return m.MinHits
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*WorkerRecord)(nil), "moby.buildkit.v1.types.WorkerRecord")
 	proto.RegisterMapType((map[string]string)(nil), "moby.buildkit.v1.types.WorkerRecord.LabelsEntry")
@@ -175,30 +183,30 @@ func init() {
 func init() { proto.RegisterFile("worker.proto", fileDescriptor_e4ff6184b07e587a) }
 
 var fileDescriptor_e4ff6184b07e587a = []byte{
-	// 355 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x91, 0xc1, 0x4e, 0xea, 0x40,
-	0x14, 0x86, 0x6f, 0x5b, 0x2e, 0x97, 0x0e, 0xcd, 0x8d, 0x99, 0x18, 0xd3, 0x10, 0x83, 0x84, 0x15,
-	0x0b, 0x9d, 0xa2, 0x6e, 0xd4, 0xb8, 0x42, 0x8c, 0x92, 0xb8, 0x20, 0xb3, 0x71, 0xdd, 0x81, 0x01,
-	0x9b, 0x0e, 0x9c, 0xc9, 0x74, 0x8a, 0xf6, 0x39, 0x7c, 0x29, 0x96, 0x3e, 0x81, 0x31, 0x3c, 0x89,
-	0x99, 0x29, 0x08, 0x26, 0xba, 0x3b, 0xff, 0x9f, 0xff, 0xfb, 0xe7, 0x9c, 0x0c, 0x0a, 0x9e, 0x41,
-	0xa5, 0x5c, 0x11, 0xa9, 0x40, 0x03, 0x3e, 0x98, 0x01, 0x2b, 0x08, 0xcb, 0x13, 0x31, 0x4e, 0x13,
-	0x4d, 0x16, 0xa7, 0x44, 0x17, 0x92, 0x67, 0x8d, 0x93, 0x69, 0xa2, 0x9f, 0x72, 0x46, 0x46, 0x30,
-	0x8b, 0xa6, 0x30, 0x85, 0xc8, 0xc6, 0x59, 0x3e, 0xb1, 0xca, 0x0a, 0x3b, 0x95, 0x35, 0x8d, 0xe3,
-	0x9d, 0xb8, 0x69, 0x8c, 0x36, 0x8d, 0x51, 0x06, 0x62, 0xc1, 0x55, 0x24, 0x59, 0x04, 0x32, 0x2b,
-	0xd3, 0xed, 0x57, 0x17, 0x05, 0x8f, 0x76, 0x0b, 0xca, 0x47, 0xa0, 0xc6, 0xf8, 0x3f, 0x72, 0x07,
-	0xfd, 0xd0, 0x69, 0x39, 0x1d, 0x9f, 0xba, 0x83, 0x3e, 0xbe, 0x47, 0xd5, 0x87, 0x98, 0x71, 0x91,
-	0x85, 0x6e, 0xcb, 0xeb, 0xd4, 0xcf, 0xba, 0xe4, 0xe7, 0x35, 0xc9, 0x6e, 0x0b, 0x29, 0x91, 0xdb,
-	0xb9, 0x56, 0x05, 0x5d, 0xf3, 0xb8, 0x8b, 0x7c, 0x29, 0x62, 0x3d, 0x01, 0x35, 0xcb, 0x42, 0xcf,
-	0x96, 0x05, 0x44, 0x32, 0x32, 0x5c, 0x9b, 0xbd, 0xca, 0xf2, 0xfd, 0xe8, 0x0f, 0xdd, 0x86, 0xf0,
-	0x35, 0xaa, 0xdd, 0xdd, 0x0c, 0x41, 0x24, 0xa3, 0x22, 0xac, 0x58, 0xa0, 0xf5, 0xdb, 0xeb, 0x9b,
-	0x1c, 0xfd, 0x22, 0x1a, 0x97, 0xa8, 0xbe, 0xb3, 0x06, 0xde, 0x43, 0x5e, 0xca, 0x8b, 0xf5, 0x65,
-	0x66, 0xc4, 0xfb, 0xe8, 0xef, 0x22, 0x16, 0x39, 0x0f, 0x5d, 0xeb, 0x95, 0xe2, 0xca, 0xbd, 0x70,
-	0xda, 0x2f, 0xdb, 0x87, 0x0d, 0x17, 0x0b, 0x61, 0xb9, 0x1a, 0x35, 0x23, 0x6e, 0xa3, 0x20, 0xe5,
-	0x5c, 0xf6, 0x73, 0x15, 0xeb, 0x04, 0xe6, 0x16, 0xf7, 0xe8, 0x37, 0x0f, 0x1f, 0x22, 0xdf, 0xe8,
-	0x5e, 0xa1, 0xb9, 0x39, 0xd6, 0x04, 0xb6, 0x06, 0x0e, 0xd1, 0xbf, 0x49, 0x22, 0x34, 0x57, 0x99,
-	0xbd, 0xcb, 0xa7, 0x1b, 0xd9, 0x0b, 0x96, 0xab, 0xa6, 0xf3, 0xb6, 0x6a, 0x3a, 0x1f, 0xab, 0xa6,
-	0xc3, 0xaa, 0xf6, 0x93, 0xce, 0x3f, 0x03, 0x00, 0x00, 0xff, 0xff, 0xfc, 0x79, 0x52, 0x6a, 0x29,
-	0x02, 0x00, 0x00,
+	// 362 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x91, 0xc1, 0x4e, 0xc2, 0x30,
+	0x1c, 0xc6, 0xdd, 0x06, 0xc8, 0xca, 0x62, 0x4c, 0x63, 0xcc, 0x42, 0x0c, 0x12, 0x4e, 0x1c, 0xb4,
+	0x43, 0xbd, 0xa8, 0xf1, 0x84, 0x18, 0x21, 0xf1, 0x40, 0x7a, 0xf1, 0xbc, 0x42, 0xc1, 0x66, 0x1d,
+	0x5d, 0xba, 0x0e, 0xb3, 0xd7, 0xd0, 0x97, 0xe2, 0xe8, 0x13, 0x18, 0xc3, 0x93, 0x98, 0x76, 0x4c,
+	0x30, 0xd1, 0xdb, 0xff, 0xfb, 0xf6, 0xfd, 0xbe, 0xfe, 0xff, 0x19, 0xf0, 0x5e, 0x85, 0x8c, 0xa8,
+	0x44, 0x89, 0x14, 0x4a, 0xc0, 0xe3, 0x58, 0x90, 0x1c, 0x91, 0x8c, 0xf1, 0x69, 0xc4, 0x14, 0x5a,
+	0x5e, 0x20, 0x95, 0x27, 0x34, 0x6d, 0x9e, 0xcf, 0x99, 0x7a, 0xc9, 0x08, 0x9a, 0x88, 0x38, 0x98,
+	0x8b, 0xb9, 0x08, 0x4c, 0x9c, 0x64, 0x33, 0xa3, 0x8c, 0x30, 0x53, 0x51, 0xd3, 0x3c, 0xdb, 0x89,
+	0xeb, 0xc6, 0xa0, 0x6c, 0x0c, 0x52, 0xc1, 0x97, 0x54, 0x06, 0x09, 0x09, 0x44, 0x92, 0x16, 0xe9,
+	0xce, 0xbb, 0x0d, 0xbc, 0x67, 0xb3, 0x05, 0xa6, 0x13, 0x21, 0xa7, 0xf0, 0x00, 0xd8, 0xa3, 0x81,
+	0x6f, 0xb5, 0xad, 0xae, 0x8b, 0xed, 0xd1, 0x00, 0x0e, 0x41, 0xed, 0x29, 0x24, 0x94, 0xa7, 0xbe,
+	0xdd, 0x76, 0xba, 0x8d, 0xcb, 0x1e, 0xfa, 0x7b, 0x4d, 0xb4, 0xdb, 0x82, 0x0a, 0xe4, 0x61, 0xa1,
+	0x64, 0x8e, 0x37, 0x3c, 0xec, 0x01, 0x37, 0xe1, 0xa1, 0x9a, 0x09, 0x19, 0xa7, 0xbe, 0x63, 0xca,
+	0x3c, 0x94, 0x10, 0x34, 0xde, 0x98, 0xfd, 0xca, 0xea, 0xf3, 0x74, 0x0f, 0x6f, 0x43, 0xf0, 0x0e,
+	0xd4, 0x1f, 0xef, 0xc7, 0x82, 0xb3, 0x49, 0xee, 0x57, 0x0c, 0xd0, 0xfe, 0xef, 0xf5, 0x32, 0x87,
+	0x7f, 0x88, 0xe6, 0x0d, 0x68, 0xec, 0xac, 0x01, 0x0f, 0x81, 0x13, 0xd1, 0x7c, 0x73, 0x99, 0x1e,
+	0xe1, 0x11, 0xa8, 0x2e, 0x43, 0x9e, 0x51, 0xdf, 0x36, 0x5e, 0x21, 0x6e, 0xed, 0x6b, 0xab, 0xf3,
+	0x66, 0x6d, 0x5f, 0xd6, 0x60, 0xc8, 0xb9, 0x01, 0xeb, 0x58, 0x8f, 0xb0, 0x03, 0xbc, 0x88, 0xd2,
+	0x64, 0x90, 0xc9, 0x50, 0x31, 0xb1, 0x30, 0xbc, 0x83, 0x7f, 0x79, 0xf0, 0x04, 0xb8, 0x5a, 0xf7,
+	0x73, 0x45, 0xf5, 0xb5, 0x3a, 0xb0, 0x35, 0xa0, 0x0f, 0xf6, 0x67, 0x8c, 0x2b, 0x2a, 0x53, 0x73,
+	0x98, 0x8b, 0x4b, 0xa9, 0xbf, 0xc4, 0x6c, 0x31, 0x64, 0x2a, 0xf5, 0xab, 0x86, 0x2a, 0x65, 0xdf,
+	0x5b, 0xad, 0x5b, 0xd6, 0xc7, 0xba, 0x65, 0x7d, 0xad, 0x5b, 0x16, 0xa9, 0x99, 0xff, 0x77, 0xf5,
+	0x3d, 0x00, 0x2d, 0x90, 0xf3, 0x33, 0x44, 0x02, 0x00, 0x00,
 }
 
 func (m *WorkerRecord) Marshal() (dAtA []byte, err error) {
@@ -306,6 +314,11 @@ func (m *GCPolicy) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.MinHits != 0 {
+		i = encodeVarintWorker(dAtA, i, uint64(m.MinHits))
+		i--
+		dAtA[i] = 0x28
+	}
 	if len(m.Filters) > 0 {
 		for iNdEx := len(m.Filters) - 1; iNdEx >= 0; iNdEx-- {
 			i -= len(m.Filters[iNdEx])
@@ -406,6 +419,9 @@ func (m *GCPolicy) Size() (n int) {
 			n += 1 + l + sovWorker(uint64(l))
 		}
 	}
+	if m.MinHits != 0 {
+		n += 1 + sovWorker(uint64(m.MinHits))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -815,6 +831,25 @@ func (m *GCPolicy) Unmarshal(dAtA []byte) error {
 			}
 			m.Filters = append(m.Filters, string(dAtA[iNdEx:postIndex]))
 			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinHits", wireType)
+			}
+			m.MinHits = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowWorker
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MinHits |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipWorker(dAtA[iNdEx:])
@@ -1,19 +1,34 @@
 package cache
 
 import (
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
 
+	ctdcompression "github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/klauspost/compress/zstd"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/flightcontrol"
+	"github.com/moby/buildkit/util/tracing"
 	"github.com/moby/buildkit/util/winlayers"
 	digest "github.com/opencontainers/go-digest"
 	imagespecidentity "github.com/opencontainers/image-spec/identity"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -23,10 +38,39 @@ const containerdUncompressed = "containerd.io/uncompressed"
 
 var ErrNoBlobs = errors.Errorf("no blobs for snapshot")
 
+// blobAnnotationPrefixes match the compression specific annotations of a
+// blob descriptor, e.g. the estargz TOC digest, that are stored with the
+// blob so they survive cache export and import.
+var blobAnnotationPrefixes = []string{
+	"containerd.io/snapshot/",
+}
+
+func filterBlobAnnotations(annotations map[string]string) map[string]string {
+	var m map[string]string
+	for k, v := range annotations {
+		if isBlobAnnotation(k) {
+			if m == nil {
+				m = map[string]string{}
+			}
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func isBlobAnnotation(k string) bool {
+	for _, prefix := range blobAnnotationPrefixes {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // computeBlobChain ensures every ref in a parent chain has an associated blob in the content store. If
 // a blob is missing and createIfNeeded is true, then the blob will be created, otherwise ErrNoBlobs will
 // be returned. Caller must hold a lease when calling this function.
-func (sr *immutableRef) computeBlobChain(ctx context.Context, createIfNeeded bool, compressionType compression.Type, s session.Group) error {
+func (sr *immutableRef) computeBlobChain(ctx context.Context, createIfNeeded bool, comp compression.Config, s session.Group) error {
 	if _, ok := leases.FromContext(ctx); !ok {
 		return errors.Errorf("missing lease requirement for computeBlobChain")
 	}
@@ -39,20 +83,22 @@ func (sr *immutableRef) computeBlobChain(ctx context.Context, createIfNeeded boo
 		ctx = winlayers.UseWindowsLayerMode(ctx)
 	}
 
-	return computeBlobChain(ctx, sr, createIfNeeded, compressionType, s)
+	return computeBlobChain(ctx, sr, createIfNeeded, comp, s)
 }
 
-func computeBlobChain(ctx context.Context, sr *immutableRef, createIfNeeded bool, compressionType compression.Type, s session.Group) error {
+func computeBlobChain(ctx context.Context, sr *immutableRef, createIfNeeded bool, comp compression.Config, s session.Group) error {
 	baseCtx := ctx
 	eg, ctx := errgroup.WithContext(ctx)
 	var currentDescr ocispec.Descriptor
+	// diffDescr is the uncompressed diff kept next to the blob
+	var diffDescr ocispec.Descriptor
 	if sr.parent != nil {
 		eg.Go(func() error {
-			return computeBlobChain(ctx, sr.parent, createIfNeeded, compressionType, s)
+			return computeBlobChain(ctx, sr.parent, createIfNeeded, comp, s)
 		})
 	}
 	eg.Go(func() error {
-		dp, err := g.Do(ctx, sr.ID(), func(ctx context.Context) (interface{}, error) {
+		dp, err := g.Do(ctx, sr.ID(), func(ctx context.Context) (_ interface{}, rerr error) {
 			refInfo := sr.Info()
 			if refInfo.Blob != "" {
 				return nil, nil
@@ -60,31 +106,48 @@ func computeBlobChain(ctx context.Context, sr *immutableRef, createIfNeeded bool
 				return nil, errors.WithStack(ErrNoBlobs)
 			}
 
+			span, ctx := tracing.StartSpan(ctx, "create blob", opentracing.Tag{Key: "ref", Value: sr.ID()})
+			defer func() {
+				tracing.FinishWithError(span, rerr)
+			}()
+			span.SetTag("compression", comp.Type.String())
+			if comp.Level != nil {
+				span.SetTag("compression.level", *comp.Level)
+			}
+
 			var mediaType string
-			switch compressionType {
+			switch comp.Type {
 			case compression.Uncompressed:
 				mediaType = ocispec.MediaTypeImageLayer
 			case compression.Gzip:
 				mediaType = ocispec.MediaTypeImageLayerGzip
 			default:
-				return nil, errors.Errorf("unknown layer compression type: %q", compressionType)
+				return nil, errors.Errorf("unknown layer compression type: %q", comp.Type)
 			}
 
-			var descr ocispec.Descriptor
-			var err error
+			// The differ compresses with the default level of the compression
+			// type, so if a level is requested the diff is created uncompressed
+			// and compressed separately. The same goes for keeping the
+			// uncompressed diff.
+			diffMediaType := mediaType
+			if (comp.Level != nil || sr.cm.KeepUncompressedDiff) && comp.Type != compression.Uncompressed {
+				diffMediaType = ocispec.MediaTypeImageLayer
+			}
 
-			if descr.Digest == "" {
+			// the disk may be full of unused records that can be pruned
+			descr, err := sr.cm.withNoSpaceRetry(ctx, func() (ocispec.Descriptor, error) {
+				var descr ocispec.Descriptor
 				// reference needs to be committed
 				var lower []mount.Mount
 				if sr.parent != nil {
 					m, err := sr.parent.Mount(ctx, true, s)
 					if err != nil {
-						return nil, err
+						return ocispec.Descriptor{}, err
 					}
 					var release func() error
 					lower, release, err = m.Mount()
 					if err != nil {
-						return nil, err
+						return ocispec.Descriptor{}, err
 					}
 					if release != nil {
 						defer release()
@@ -92,22 +155,49 @@ func computeBlobChain(ctx context.Context, sr *immutableRef, createIfNeeded bool
 				}
 				m, err := sr.Mount(ctx, true, s)
 				if err != nil {
-					return nil, err
+					return ocispec.Descriptor{}, err
 				}
 				upper, release, err := m.Mount()
 				if err != nil {
-					return nil, err
+					return ocispec.Descriptor{}, err
 				}
 				if release != nil {
 					defer release()
 				}
-				descr, err = sr.cm.Differ.Compare(ctx, lower, upper,
-					diff.WithMediaType(mediaType),
-					diff.WithReference(sr.ID()),
-				)
+				start := time.Now()
+				if sr.cm.DiffPlans && !isTypeWindows(sr) {
+					descr, err = sr.cm.diffWithPlan(ctx, sr, lower, upper, diffMediaType)
+				} else {
+					descr, err = sr.cm.Differ.Compare(ctx, lower, upper,
+						diff.WithMediaType(diffMediaType),
+						diff.WithReference(sr.ID()),
+					)
+				}
 				if err != nil {
-					return nil, err
+					return ocispec.Descriptor{}, err
+				}
+				recordCompression(ctx, statsDiff, 0, descr.Size, time.Since(start))
+				if diffMediaType != mediaType {
+					span.SetTag("uncompressed.size", descr.Size)
+					if sr.cm.KeepUncompressedDiff {
+						diffDescr = descr
+					}
+					release, err := sr.cm.conversions.acquire(ctx)
+					if err != nil {
+						return ocispec.Descriptor{}, err
+					}
+					descr, err = compressBlob(ctx, sr.cm.ContentStore, descr, mediaType, comp, sr.ID())
+					release()
+					if err != nil {
+						return ocispec.Descriptor{}, err
+					}
 				}
+				span.SetTag("size", descr.Size)
+				span.SetTag("digest", descr.Digest.String())
+				return descr, nil
+			})
+			if err != nil {
+				return nil, err
 			}
 
 			if descr.Annotations == nil {
@@ -121,7 +211,7 @@ func computeBlobChain(ctx context.Context, sr *immutableRef, createIfNeeded bool
 
 			if diffID, ok := info.Labels[containerdUncompressed]; ok {
 				descr.Annotations[containerdUncompressed] = diffID
-			} else if compressionType == compression.Uncompressed {
+			} else if comp.Type == compression.Uncompressed {
 				descr.Annotations[containerdUncompressed] = descr.Digest.String()
 			} else {
 				return nil, errors.Errorf("unknown layer compression type")
@@ -148,9 +238,484 @@ func computeBlobChain(ctx context.Context, sr *immutableRef, createIfNeeded bool
 			return err
 		}
 	}
+	if diffDescr.Digest != "" {
+		if err := sr.keepUncompressedDiff(baseCtx, diffDescr); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// keepUncompressedDiff records the uncompressed diff of the blob of the ref
+// as its uncompressed variant and keeps it with the record. Later variants
+// are compressed from it instead of decompressing the blob.
+func (sr *immutableRef) keepUncompressedDiff(ctx context.Context, diff ocispec.Descriptor) error {
+	blob := sr.Info().Blob
+	info, err := sr.cm.ContentStore.Info(ctx, blob)
+	if err != nil {
+		return err
+	}
+	if blob == diff.Digest || info.Labels[labelUncompressedVariant] == diff.Digest.String() {
+		return nil
+	}
+	if err := sr.cm.LeaseManager.AddResource(ctx, leases.Lease{ID: sr.ID()}, leases.Resource{
+		ID:   diff.Digest.String(),
+		Type: "content",
+	}); err != nil {
+		return err
+	}
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+	info.Labels[labelUncompressedVariant] = diff.Digest.String()
+	if _, err := sr.cm.ContentStore.Update(ctx, info, "labels."+labelUncompressedVariant); err != nil {
+		return err
+	}
+
+	// the size of the record includes the diff now
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	setSize(sr.md, sizeUnknown)
+	sr.updateUsage()
+	return sr.md.Commit()
+}
+
+// compressBlob writes the blob desc compressed according to comp to the
+// content store and returns the descriptor of the compressed blob. A
+// compressed desc is decompressed on the fly, so converting a blob only
+// needs the space of the result. The uncompressed digest is computed while
+// compressing and checked against the one recorded for desc.
+func compressBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, mediaType string, comp compression.Config, ref string) (_ ocispec.Descriptor, rerr error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+
+	var r io.Reader = content.NewReader(ra)
+	if compression.FromMediaType(desc.MediaType) != compression.Uncompressed {
+		dr, err := decompressReader(desc, r)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		defer dr.Close()
+		r = dr
+	}
+	digester := digest.Canonical.Digester()
+	r = io.TeeReader(r, digester.Hash())
+
+	ref = ref + "-" + comp.Type.String()
+	cw, err := content.OpenWriter(ctx, cs,
+		content.WithRef(ref),
+		content.WithDescriptor(ocispec.Descriptor{MediaType: mediaType}),
+	)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer func() {
+		cw.Close()
+		if rerr != nil {
+			abortIngest(ctx, cs, ref)
+		}
+	}()
+	if err := cw.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	var w io.WriteCloser
+	switch comp.Type {
+	case compression.Gzip:
+		level := gzip.DefaultCompression
+		if comp.Level != nil {
+			level = *comp.Level
+		}
+		w, err = gzip.NewWriterLevel(cw, level)
+	case compression.Zstd:
+		var opts []zstd.EOption
+		if comp.Level != nil {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(*comp.Level)))
+		}
+		w, err = zstd.NewWriter(cw, opts...)
+	default:
+		err = errors.Errorf("unsupported compression type: %s", comp.Type)
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	start := time.Now()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to compress blob")
+	}
+	if err := w.Close(); err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to compress blob")
+	}
+	d := time.Since(start)
+
+	diffID := digester.Digest()
+	if expected, ok := desc.Annotations[containerdUncompressed]; ok && expected != diffID.String() {
+		return ocispec.Descriptor{}, errors.Errorf("uncompressed digest %s of blob %s doesn't match %s", diffID, desc.Digest, expected)
+	}
+
+	dgst := cw.Digest()
+	labels := map[string]string{
+		containerdUncompressed: diffID.String(),
+	}
+	if err := cw.Commit(ctx, 0, dgst, content.WithLabels(labels)); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to commit compressed blob")
+		}
+	}
+
+	info, err := cs.Info(ctx, dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	// Set uncompressed label if the blob already existed without it
+	if _, ok := info.Labels[containerdUncompressed]; !ok {
+		if info.Labels == nil {
+			info.Labels = map[string]string{}
+		}
+		info.Labels[containerdUncompressed] = diffID.String()
+		if _, err := cs.Update(ctx, info, "labels."+containerdUncompressed); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	recordCompression(ctx, comp.Type.String(), n, info.Size, d)
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      info.Size,
+		Annotations: map[string]string{
+			containerdUncompressed: diffID.String(),
+		},
+	}, nil
+}
+
+// labelVariantPrefix is the prefix of the content label pointing from a blob
+// to its variant with another compression. It's a GC reference so the
+// variant lives as long as the blob.
+const labelVariantPrefix = "containerd.io/gc.ref.content.buildkit.compression."
+
+// labelUncompressedVariant points from a blob to its uncompressed variant,
+// which is used as the source of other variants if it exists.
+var labelUncompressedVariant = labelVariantPrefix + compression.Uncompressed.String()
+
+// variantName identifies the variant of a blob created with comp. Variants
+// created with an explicit compression level are kept apart from the ones
+// with the default level. The choice of an if-smaller conversion is
+// recorded apart from the converted variant, as it may be the blob itself.
+func variantName(comp compression.Config) string {
+	name := comp.Type.String()
+	if comp.Level != nil {
+		name = fmt.Sprintf("%s.level%d", comp.Type, *comp.Level)
+	}
+	if comp.IfSmaller {
+		name += ".if-smaller"
+	}
+	return name
+}
+
+// getBlobVariant returns a blob with the content of desc compressed with
+// comp, creating it if the blob doesn't have one yet. The media type of the
+// variant is of the same family, Docker or OCI, as the one of desc. If
+// comp.IfSmaller is set and the converted blob isn't smaller than desc, desc
+// itself is recorded and returned as the variant, so later calls make the
+// same choice. The caller must hold a lease.
+func (cm *cacheManager) getBlobVariant(ctx context.Context, desc ocispec.Descriptor, comp compression.Config) (ocispec.Descriptor, error) {
+	mediaType, err := variantMediaType(comp, desc.MediaType)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	name := variantName(comp)
+	label := labelVariantPrefix + name
+	v, err := g.Do(ctx, "variant-"+desc.Digest.String()+"-"+name, func(ctx context.Context) (interface{}, error) {
+		info, err := cm.ContentStore.Info(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		diffID := desc.Annotations[containerdUncompressed]
+		if dgst, ok := info.Labels[label]; ok && diffID != "" {
+			vinfo, err := cm.ContentStore.Info(ctx, digest.Digest(dgst))
+			if err == nil {
+				return ocispec.Descriptor{
+					Digest: vinfo.Digest,
+					Size:   vinfo.Size,
+					Annotations: map[string]string{
+						containerdUncompressed: diffID,
+					},
+				}, nil
+			} else if !errors.Is(err, errdefs.ErrNotFound) {
+				return nil, err
+			}
+		}
+
+		release, err := cm.conversions.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		var variant ocispec.Descriptor
+		switch comp.Type {
+		case compression.Uncompressed:
+			variant = desc
+			if compression.FromMediaType(desc.MediaType) != compression.Uncompressed {
+				variant, err = cm.withNoSpaceRetry(ctx, func() (ocispec.Descriptor, error) {
+					return decompressBlob(ctx, cm.ContentStore, desc)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			variant.Annotations = map[string]string{
+				containerdUncompressed: variant.Digest.String(),
+			}
+		case compression.Gzip, compression.Zstd:
+			// streams from the blob into the variant without writing the
+			// uncompressed data, an existing uncompressed variant saves
+			// decompressing the blob
+			src := desc
+			if u, ok := cm.uncompressedVariant(ctx, info, diffID); ok {
+				src = u
+			}
+			variant, err = cm.withNoSpaceRetry(ctx, func() (ocispec.Descriptor, error) {
+				return compressBlob(ctx, cm.ContentStore, src, mediaType, comp, "variant-"+desc.Digest.String()+"-"+name)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if comp.IfSmaller && variant.Size >= desc.Size {
+			// the converted blob is left to the lease and collected
+			variant = ocispec.Descriptor{
+				Digest: desc.Digest,
+				Size:   desc.Size,
+				Annotations: map[string]string{
+					containerdUncompressed: variant.Annotations[containerdUncompressed],
+				},
+			}
+		}
+
+		if info.Labels == nil {
+			info.Labels = map[string]string{}
+		}
+		info.Labels[label] = variant.Digest.String()
+		if _, err := cm.ContentStore.Update(ctx, info, "labels."+label); err != nil {
+			return nil, err
+		}
+		return variant, nil
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	// the result is shared by concurrent callers
+	variant := v.(ocispec.Descriptor)
+	variant.MediaType = mediaType
+	if variant.Digest == desc.Digest {
+		variant.MediaType = desc.MediaType
+	}
+	variant.Annotations = map[string]string{}
+	for k, val := range v.(ocispec.Descriptor).Annotations {
+		variant.Annotations[k] = val
+	}
+	return variant, nil
+}
+
+// uncompressedVariant returns the uncompressed variant of the blob info if
+// it exists.
+func (cm *cacheManager) uncompressedVariant(ctx context.Context, info content.Info, diffID string) (ocispec.Descriptor, bool) {
+	dgst, ok := info.Labels[labelUncompressedVariant]
+	if !ok || diffID == "" || dgst != diffID || digest.Digest(dgst) == info.Digest {
+		return ocispec.Descriptor{}, false
+	}
+	vinfo, err := cm.ContentStore.Info(ctx, digest.Digest(dgst))
+	if err != nil {
+		return ocispec.Descriptor{}, false
+	}
+	return ocispec.Descriptor{
+		Digest:    vinfo.Digest,
+		Size:      vinfo.Size,
+		MediaType: ocispec.MediaTypeImageLayer,
+		Annotations: map[string]string{
+			containerdUncompressed: diffID,
+		},
+	}, true
+}
+
+// variantMediaType returns the media type of a variant created with comp of
+// a blob with mediaType. The variant keeps the media type family of the blob
+// unless comp selects one.
+func variantMediaType(comp compression.Config, mediaType string) (string, error) {
+	var docker bool
+	switch comp.MediaTypes {
+	case compression.DockerMediaTypes:
+		docker = true
+	case compression.AnyMediaTypes:
+		docker = strings.HasPrefix(mediaType, "application/vnd.docker.")
+	}
+	switch t := comp.Type; t {
+	case compression.Uncompressed:
+		if docker {
+			return images.MediaTypeDockerSchema2Layer, nil
+		}
+		return ocispec.MediaTypeImageLayer, nil
+	case compression.Gzip:
+		if docker {
+			return images.MediaTypeDockerSchema2LayerGzip, nil
+		}
+		return ocispec.MediaTypeImageLayerGzip, nil
+	case compression.Zstd:
+		if docker {
+			return "", errors.Errorf("no Docker media type for %s layers, use OCI media types", t)
+		}
+		return ocispec.MediaTypeImageLayer + "+" + t.String(), nil
+	default:
+		return "", errors.Errorf("unsupported compression type %s for blob variant", t)
+	}
+}
+
+// decompressBlob writes the decompressed content of the blob desc to the
+// content store and returns the descriptor of the uncompressed blob. It's
+// used for compression types the applier can't read. If desc records the
+// uncompressed digest, the content is verified against it.
+func decompressBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (_ ocispec.Descriptor, rerr error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+
+	r, err := decompressReader(desc, content.NewReader(ra))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer r.Close()
+
+	ref := "decompress-" + desc.Digest.String()
+	cw, err := content.OpenWriter(ctx, cs,
+		content.WithRef(ref),
+		content.WithDescriptor(ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer}),
+	)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer func() {
+		cw.Close()
+		if rerr != nil {
+			abortIngest(ctx, cs, ref)
+		}
+	}()
+	if err := cw.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	start := time.Now()
+	size, err := io.Copy(cw, r)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to decompress blob %s", desc.Digest)
+	}
+	d := time.Since(start)
+
+	dgst := cw.Digest()
+	if diffID, ok := desc.Annotations[containerdUncompressed]; ok && diffID != dgst.String() {
+		return ocispec.Descriptor{}, errors.Errorf("uncompressed digest %s of blob %s doesn't match %s", dgst, desc.Digest, diffID)
+	}
+	if err := cw.Commit(ctx, size, dgst); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to commit decompressed blob")
+		}
+	}
+	recordCompression(ctx, compression.Uncompressed.String(), desc.Size, size, d)
+
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    dgst,
+		Size:      size,
+	}, nil
+}
+
+// decompressReader returns a reader for the uncompressed data of the blob
+// desc read from r.
+func decompressReader(desc ocispec.Descriptor, r io.Reader) (io.ReadCloser, error) {
+	var dr io.ReadCloser
+	var err error
+	if compression.FromMediaType(desc.MediaType) == compression.Zstd {
+		dr, err = ctdcompression.DecompressStream(r)
+	} else {
+		dr, err = archive.DecompressStream(r)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress blob %s", desc.Digest)
+	}
+	return dr, nil
+}
+
+// abortIngest removes the partial ingest ref, also if the error is that ctx
+// was canceled.
+func abortIngest(ctx context.Context, cs content.Store, ref string) {
+	abortCtx := context.TODO()
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		abortCtx = namespaces.WithNamespace(abortCtx, ns)
+	}
+	cs.Abort(abortCtx, ref)
+}
+
+// computeDiffID returns the digest of the uncompressed content of the blob
+// desc.
+func computeDiffID(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (digest.Digest, error) {
+	ct, err := compression.DetectLayerCompression(ctx, cs, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	defer ra.Close()
+
+	var r io.ReadCloser
+	switch ct {
+	case compression.Zstd:
+		r, err = ctdcompression.DecompressStream(content.NewReader(ra))
+	default:
+		r, err = archive.DecompressStream(content.NewReader(ra))
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decompress blob %s", desc.Digest)
+	}
+	defer r.Close()
+
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), r); err != nil {
+		return "", errors.Wrapf(err, "failed to decompress blob %s", desc.Digest)
+	}
+	return digester.Digest(), nil
+}
+
+// verifyLayerMediaType checks that the blob data of desc matches the
+// compression of its media type. If the data uses a different compression
+// the media type detected from the data is returned instead.
+func verifyLayerMediaType(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (string, error) {
+	ct, err := compression.DetectLayerCompression(ctx, cs, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if ct == compression.FromMediaType(desc.MediaType) {
+		return desc.MediaType, nil
+	}
+	oci := !strings.HasPrefix(desc.MediaType, "application/vnd.docker.")
+	mediaType, err := compression.DetectLayerMediaType(ctx, cs, desc.Digest, oci)
+	if err != nil {
+		return "", err
+	}
+	logrus.Warnf("layer %s has media type %s but %s data, using media type %s", desc.Digest, desc.MediaType, ct, mediaType)
+	return mediaType, nil
+}
+
 // setBlob associates a blob with the cache record.
 // A lease must be held for the blob when calling this function
 // Caller should call Info() for knowing what current values are actually set
@@ -167,17 +732,6 @@ func (sr *immutableRef) setBlob(ctx context.Context, desc ocispec.Descriptor) er
 		return err
 	}
 
-	sr.mu.Lock()
-	defer sr.mu.Unlock()
-
-	if getChainID(sr.md) != "" {
-		return nil
-	}
-
-	if err := sr.finalize(ctx, true); err != nil {
-		return err
-	}
-
 	p := sr.parent
 	var parentChainID digest.Digest
 	var parentBlobChainID digest.Digest
@@ -189,6 +743,35 @@ func (sr *immutableRef) setBlob(ctx context.Context, desc ocispec.Descriptor) er
 		parentChainID = pInfo.ChainID
 		parentBlobChainID = pInfo.BlobChainID
 	}
+	chainID := diffID
+	if parentChainID != "" {
+		chainID = imagespecidentity.ChainID([]digest.Digest{parentChainID, chainID})
+	}
+
+	// identical layers created by different builds share their data
+	dup := sr.cm.findDuplicateLayer(ctx, sr, diffID, chainID)
+	if dup != nil {
+		defer dup.Release(context.TODO())
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if getChainID(sr.md) != "" {
+		return nil
+	}
+
+	// a duplicate is linked before the snapshot of sr is committed
+	if dup != nil {
+		desc, err = sr.linkDuplicateLayer(ctx, dup, desc)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := sr.finalize(ctx, true); err != nil {
+		return err
+	}
 
 	if err := sr.cm.LeaseManager.AddResource(ctx, leases.Lease{ID: sr.ID()}, leases.Resource{
 		ID:   desc.Digest.String(),
@@ -199,16 +782,15 @@ func (sr *immutableRef) setBlob(ctx context.Context, desc ocispec.Descriptor) er
 
 	queueDiffID(sr.md, diffID.String())
 	queueBlob(sr.md, desc.Digest.String())
-	chainID := diffID
 	blobChainID := imagespecidentity.ChainID([]digest.Digest{desc.Digest, diffID})
-	if parentChainID != "" {
-		chainID = imagespecidentity.ChainID([]digest.Digest{parentChainID, chainID})
+	if parentBlobChainID != "" {
 		blobChainID = imagespecidentity.ChainID([]digest.Digest{parentBlobChainID, blobChainID})
 	}
 	queueChainID(sr.md, chainID.String())
 	queueBlobChainID(sr.md, blobChainID.String())
 	queueMediaType(sr.md, desc.MediaType)
 	queueBlobSize(sr.md, desc.Size)
+	queueBlobAnnotations(sr.md, filterBlobAnnotations(desc.Annotations))
 	if err := sr.md.Commit(); err != nil {
 		return err
 	}
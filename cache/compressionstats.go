@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonistiigi/units"
+)
+
+// statsDiff is the key of the layers compressed by the differ while
+// diffing. Their uncompressed size isn't known.
+const statsDiff = "diff"
+
+type compressionStatsKey struct{}
+
+// CompressionStats collects the sizes and the time spent by the layer
+// compressions of an export, e.g. to report them in its progress.
+type CompressionStats struct {
+	mu    sync.Mutex
+	stats map[string]*CompressionStat
+}
+
+// CompressionStat is the total of the layers created with one compression.
+type CompressionStat struct {
+	Layers   int
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+}
+
+// WithCompressionStats returns a context whose layer compressions are
+// added to st.
+func WithCompressionStats(ctx context.Context, st *CompressionStats) context.Context {
+	return context.WithValue(ctx, compressionStatsKey{}, st)
+}
+
+func recordCompression(ctx context.Context, key string, in, out int64, d time.Duration) {
+	st, ok := ctx.Value(compressionStatsKey{}).(*CompressionStats)
+	if !ok || st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stats == nil {
+		st.stats = map[string]*CompressionStat{}
+	}
+	s, ok := st.stats[key]
+	if !ok {
+		s = &CompressionStat{}
+		st.stats[key] = s
+	}
+	s.Layers++
+	s.BytesIn += in
+	s.BytesOut += out
+	s.Duration += d
+}
+
+// Stats returns the totals by compression type. Layers compressed while
+// diffing are under "diff" and have no input size.
+func (st *CompressionStats) Stats() map[string]CompressionStat {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m := make(map[string]CompressionStat, len(st.stats))
+	for k, s := range st.stats {
+		m[k] = *s
+	}
+	return m
+}
+
+// String summarizes the stats on one line, or returns "" if no layers were
+// created.
+func (st *CompressionStats) String() string {
+	stats := st.Stats()
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		s := stats[k]
+		layers := "layers"
+		if s.Layers == 1 {
+			layers = "layer"
+		}
+		if s.BytesIn == 0 {
+			parts = append(parts, fmt.Sprintf("%s %d %s %.2f in %s", k, s.Layers, layers, units.Bytes(s.BytesOut), s.Duration.Round(time.Millisecond)))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %d %s %.2f -> %.2f (%.1f%%) in %s", k, s.Layers, layers, units.Bytes(s.BytesIn), units.Bytes(s.BytesOut), 100*float64(s.BytesOut)/float64(s.BytesIn), s.Duration.Round(time.Millisecond)))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+type conversionOwnerKey struct{}
+
+// withConversionOwner returns a context whose blob conversions are accounted
+// to a new owner, e.g. a single export, by the conversion limiter.
+func withConversionOwner(ctx context.Context) context.Context {
+	return context.WithValue(ctx, conversionOwnerKey{}, new(int))
+}
+
+// conversionLimiter bounds the number of blob conversions running at the
+// same time. A free slot goes to the waiting conversion whose owner holds the
+// fewest slots, the longest waiting one first, so an export converting many
+// layers can't keep the conversions of other exports waiting until it's
+// done.
+type conversionLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	held    map[interface{}]int
+	waiting []*conversionWaiter
+}
+
+type conversionWaiter struct {
+	owner interface{}
+	ch    chan struct{}
+}
+
+func newConversionLimiter(limit int) *conversionLimiter {
+	return &conversionLimiter{
+		limit: limit,
+		held:  map[interface{}]int{},
+	}
+}
+
+// acquire waits for a conversion slot for the owner of ctx. The returned
+// function releases the slot. A nil limiter doesn't limit conversions.
+func (l *conversionLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	owner := ctx.Value(conversionOwnerKey{})
+
+	l.mu.Lock()
+	if l.running < l.limit && len(l.waiting) == 0 {
+		l.grant(owner)
+		l.mu.Unlock()
+		return func() { l.release(owner) }, nil
+	}
+	w := &conversionWaiter{owner: owner, ch: make(chan struct{})}
+	l.waiting = append(l.waiting, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ch:
+		return func() { l.release(owner) }, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, w2 := range l.waiting {
+			if w2 == w {
+				l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// the slot was granted concurrently
+		l.releaseLocked(owner)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *conversionLimiter) grant(owner interface{}) {
+	l.running++
+	l.held[owner]++
+}
+
+func (l *conversionLimiter) release(owner interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(owner)
+}
+
+func (l *conversionLimiter) releaseLocked(owner interface{}) {
+	l.running--
+	l.held[owner]--
+	if l.held[owner] == 0 {
+		delete(l.held, owner)
+	}
+	for l.running < l.limit && len(l.waiting) > 0 {
+		next := 0
+		for i, w := range l.waiting {
+			if l.held[w.owner] < l.held[l.waiting[next].owner] {
+				next = i
+			}
+		}
+		w := l.waiting[next]
+		l.waiting = append(l.waiting[:next], l.waiting[next+1:]...)
+		l.grant(w.owner)
+		close(w.ch)
+	}
+}
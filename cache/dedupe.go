@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/moby/buildkit/solver"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const indexDiffID = "diffid:"
+
+// findDuplicateLayer returns a ref to another record with the layer diffID
+// on top of the same parent chain. The ref keeps the record from being
+// removed by a concurrent prune until its snapshot and blob have been added
+// to the lease of sr.
+//
+// Records with the same chain ID are identical as far as the layer tar goes,
+// which is also what a layer pulled from a registry is compared by. The tar
+// doesn't keep sub-second modification times or xattrs other than
+// security.capability, so the snapshots of the records may differ in those
+// and sr gets the ones of the other record.
+func (cm *cacheManager) findDuplicateLayer(ctx context.Context, sr *immutableRef, diffID, chainID digest.Digest) *immutableRef {
+	// the layer data is shared between cache namespaces, only cache hits
+	// are isolated
+	ctx = solver.WithCacheNamespace(ctx, "")
+
+	sis, err := cm.MetadataStore.Search(indexDiffID + diffID.String())
+	if err != nil {
+		logrus.Warnf("failed to search records with diffID %s: %v", diffID, err)
+		return nil
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, si := range sis {
+		if si.ID() == sr.ID() || getChainID(si) != chainID.String() {
+			continue
+		}
+		// records that are being deleted or are lazy can't be used
+		ref, err := cm.get(ctx, si.ID(), NoUpdateLastUsed)
+		if err != nil {
+			continue
+		}
+		return ref
+	}
+	return nil
+}
+
+// linkDuplicateLayer switches sr to the snapshot and blob of dup. If the
+// snapshot of sr isn't committed yet, sr takes the snapshot of dup instead
+// and the data of its mutable is dropped without being committed. Otherwise
+// the committed duplicate is released from the lease of sr and removed by
+// the next garbage collection, like a duplicate blob. desc is the blob
+// created for sr and the returned descriptor is the blob to record for it.
+// Requires sr.mu.
+func (sr *immutableRef) linkDuplicateLayer(ctx context.Context, dup *immutableRef, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	dup.mu.Lock()
+	defer dup.mu.Unlock()
+
+	if dup.isDead() || dup.equalMutable != nil {
+		return desc, nil
+	}
+
+	if dupBlob := digest.Digest(getBlob(dup.md)); dupBlob != desc.Digest && getMediaType(dup.md) == desc.MediaType {
+		if _, err := sr.cm.ContentStore.Info(ctx, dupBlob); err == nil {
+			annotations := map[string]string{}
+			for k, v := range getBlobAnnotations(dup.md) {
+				annotations[k] = v
+			}
+			annotations[containerdUncompressed] = getDiffID(dup.md)
+			desc = ocispec.Descriptor{
+				MediaType:   desc.MediaType,
+				Digest:      dupBlob,
+				Size:        getBlobSize(dup.md),
+				Annotations: annotations,
+			}
+		} else if !errors.Is(err, errdefs.ErrNotFound) {
+			return desc, err
+		}
+	}
+
+	snapshotID := getSnapshotID(sr.md)
+	dupSnapshotID := getSnapshotID(dup.md)
+	if getBlobOnly(dup.md) || dupSnapshotID == snapshotID {
+		return desc, nil
+	}
+	// files of snapshots created with other identity mappings are owned by
+	// different IDs
+	recorded, _ := getIdentityMapping(sr.md)
+	dupRecorded, _ := getIdentityMapping(dup.md)
+	if !sameIdentityMapping(recorded, dupRecorded) {
+		return desc, nil
+	}
+
+	snapshotType := "snapshots/" + sr.cm.Snapshotter.Name()
+	if sr.equalMutable != nil {
+		// a previous finalize may have committed the snapshot already
+		committed, err := sr.isCommitted(ctx)
+		if err != nil {
+			return desc, err
+		}
+		if !committed {
+			created, err := sr.createLease(ctx)
+			if err != nil {
+				return desc, err
+			}
+			if err := sr.cm.LeaseManager.AddResource(ctx, leases.Lease{ID: sr.ID()}, leases.Resource{
+				ID:   dupSnapshotID,
+				Type: snapshotType,
+			}); err != nil {
+				if created {
+					sr.cm.LeaseManager.Delete(context.TODO(), leases.Lease{ID: sr.ID()})
+				}
+				return desc, errors.Wrapf(err, "failed to add snapshot %s to lease", dupSnapshotID)
+			}
+			queueSnapshotID(sr.md, dupSnapshotID)
+			if err := sr.dropEqualMutable(); err != nil {
+				return desc, err
+			}
+			logrus.Debugf("linked record %s to the identical layer of %s before commit", sr.ID(), dup.ID())
+			return desc, nil
+		}
+		if err := sr.finalize(ctx, true); err != nil {
+			return desc, err
+		}
+	}
+
+	if err := sr.cm.LeaseManager.AddResource(ctx, leases.Lease{ID: sr.ID()}, leases.Resource{
+		ID:   dupSnapshotID,
+		Type: snapshotType,
+	}); err != nil {
+		return desc, errors.Wrapf(err, "failed to add snapshot %s to lease", dupSnapshotID)
+	}
+	queueSnapshotID(sr.md, dupSnapshotID)
+	if err := sr.md.Commit(); err != nil {
+		return desc, err
+	}
+	// snapshots of children keep the original one as their parent
+	if err := sr.cm.LeaseManager.DeleteResource(ctx, leases.Lease{ID: sr.ID()}, leases.Resource{
+		ID:   snapshotID,
+		Type: snapshotType,
+	}); err != nil {
+		logrus.Warnf("failed to release duplicate snapshot %s of %s: %v", snapshotID, sr.ID(), err)
+	}
+	logrus.Debugf("linked record %s to the identical layer of %s", sr.ID(), dup.ID())
+	return desc, nil
+}
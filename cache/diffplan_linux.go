@@ -0,0 +1,398 @@
+package cache
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/archive"
+	ctdcompression "github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/continuity/sysx"
+	"github.com/moby/buildkit/cache/metadata"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// errDiffPlanMismatch is returned when replaying a diff plan finds a file
+// that doesn't match the plan
+var errDiffPlanMismatch = errors.New("diff plan doesn't match snapshot")
+
+// diffPlan records the entries of the diff tar of a record so the diff can
+// be written again from the upper snapshot alone, without comparing it to
+// the lower one.
+type diffPlan struct {
+	// Parent is the snapshot the diff was computed against
+	Parent string
+	// Upper is the digest of the file listing of the upper snapshot
+	Upper   digest.Digest
+	Entries []diffPlanEntry
+}
+
+type diffPlanEntry struct {
+	Name string
+	// Digest is the digest of the content of regular files
+	Digest digest.Digest `json:",omitempty"`
+}
+
+// diffWithPlan creates the diff blob of sr. If a diff plan was recorded for
+// the snapshots before, the diff is written from it, otherwise the diff is
+// computed by comparing lower and upper and a plan is recorded.
+func (cm *cacheManager) diffWithPlan(ctx context.Context, sr *immutableRef, lower, upper []mount.Mount, mediaType string) (ocispec.Descriptor, error) {
+	if mediaType != ocispec.MediaTypeImageLayer && mediaType != ocispec.MediaTypeImageLayerGzip {
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotImplemented, "unsupported diff media type: %v", mediaType)
+	}
+	parentID := ""
+	if sr.parent != nil {
+		parentID = getSnapshotID(sr.parent.md)
+	}
+	plan := loadDiffPlan(sr.md)
+
+	var desc ocispec.Descriptor
+	err := mount.WithTempMount(ctx, upper, func(upperRoot string) error {
+		// the parent is committed, so only the files of the upper layer can
+		// change the merged snapshot
+		listRoot := upperRoot
+		if dir := overlayUpperDir(upper); dir != "" {
+			listRoot = dir
+		}
+		listing, err := listingDigest(listRoot)
+		if err != nil {
+			return err
+		}
+		if plan != nil && plan.Parent == parentID && plan.Upper == listing {
+			desc, err = cm.writeDiffBlob(ctx, sr.ID(), mediaType, func(w io.Writer) error {
+				return replayDiffPlan(ctx, w, upperRoot, plan)
+			})
+			if err == nil || !errors.Is(err, errDiffPlanMismatch) {
+				return err
+			}
+			logrus.Debugf("recomputing diff of %s: %v", sr.ID(), err)
+		}
+
+		return mount.WithTempMount(ctx, lower, func(lowerRoot string) error {
+			var recorded *diffPlan
+			desc, err = cm.writeDiffBlob(ctx, sr.ID(), mediaType, func(w io.Writer) (err error) {
+				recorded, err = recordDiff(ctx, w, lowerRoot, upperRoot)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if recorded != nil {
+				recorded.Parent = parentID
+				recorded.Upper = listing
+				if err := storeDiffPlan(sr.md, recorded); err != nil {
+					logrus.Warnf("failed to store diff plan of %s: %v", sr.ID(), err)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// writeDiffBlob writes the tar stream created by write to the content store
+// like the walking differ does.
+func (cm *cacheManager) writeDiffBlob(ctx context.Context, ref, mediaType string, write func(io.Writer) error) (_ ocispec.Descriptor, rerr error) {
+	cw, err := content.OpenWriter(ctx, cm.ContentStore,
+		content.WithRef(ref),
+		content.WithDescriptor(ocispec.Descriptor{MediaType: mediaType}),
+	)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to open writer")
+	}
+	defer func() {
+		cw.Close()
+		if rerr != nil {
+			cm.ContentStore.Abort(context.TODO(), ref)
+		}
+	}()
+	if err := cw.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	var uncompressed digest.Digest
+	if mediaType == ocispec.MediaTypeImageLayerGzip {
+		dgstr := digest.SHA256.Digester()
+		compressed, err := ctdcompression.CompressStream(cw, ctdcompression.Gzip)
+		if err != nil {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to get compressed stream")
+		}
+		err = write(io.MultiWriter(compressed, dgstr.Hash()))
+		compressed.Close()
+		if err != nil {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to write compressed diff")
+		}
+		uncompressed = dgstr.Digest()
+	} else {
+		if err := write(cw); err != nil {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to write diff")
+		}
+		uncompressed = cw.Digest()
+	}
+
+	labels := map[string]string{
+		containerdUncompressed: uncompressed.String(),
+	}
+	dgst := cw.Digest()
+	if err := cw.Commit(ctx, 0, dgst, content.WithLabels(labels)); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to commit")
+		}
+	}
+
+	info, err := cm.ContentStore.Info(ctx, dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to get info from content store")
+	}
+	if _, ok := info.Labels[containerdUncompressed]; !ok {
+		if info.Labels == nil {
+			info.Labels = map[string]string{}
+		}
+		info.Labels[containerdUncompressed] = uncompressed.String()
+		if _, err := cm.ContentStore.Update(ctx, info, "labels."+containerdUncompressed); err != nil {
+			return ocispec.Descriptor{}, errors.Wrap(err, "error setting uncompressed label")
+		}
+	}
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Size:      info.Size,
+		Digest:    info.Digest,
+	}, nil
+}
+
+// recordDiff writes the diff between lowerRoot and upperRoot to w and
+// returns the plan of the written tar. The plan is nil if the diff contains
+// entries that can't be replayed, e.g. hardlinks.
+func recordDiff(ctx context.Context, w io.Writer, lowerRoot, upperRoot string) (*diffPlan, error) {
+	pr, pw := io.Pipe()
+	type result struct {
+		plan *diffPlan
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		plan, err := planFromTar(pr)
+		// keep the writer going if the tar can't be parsed
+		io.Copy(ioutil.Discard, pr)
+		ch <- result{plan, err}
+	}()
+
+	err := archive.WriteDiff(ctx, io.MultiWriter(w, pw), lowerRoot, upperRoot)
+	pw.CloseWithError(err)
+	res := <-ch
+	if err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		logrus.Debugf("not recording diff plan: %v", res.err)
+		return nil, nil
+	}
+	return res.plan, nil
+}
+
+func planFromTar(r io.Reader) (*diffPlan, error) {
+	plan := &diffPlan{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return plan, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := diffPlanEntry{Name: hdr.Name}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if hdr.Size > 0 {
+				dgstr := digest.SHA256.Digester()
+				if _, err := io.Copy(dgstr.Hash(), tr); err != nil {
+					return nil, err
+				}
+				e.Digest = dgstr.Digest()
+			}
+		case tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			return nil, errors.Errorf("unsupported entry %s of type %c", hdr.Name, hdr.Typeflag)
+		}
+		plan.Entries = append(plan.Entries, e)
+	}
+}
+
+// replayDiffPlan writes the tar stream of plan from the files in upperRoot.
+// The headers are created the same way as by archive.WriteDiff. Files that
+// don't match the plan fail with errDiffPlanMismatch.
+func replayDiffPlan(ctx context.Context, w io.Writer, upperRoot string, plan *diffPlan) error {
+	tw := tar.NewWriter(w)
+	whiteoutT := time.Now()
+	for _, e := range plan.Entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(e.Name, "/")
+		if strings.HasPrefix(path.Base(name), ".wh.") {
+			hdr := &tar.Header{
+				Typeflag:   tar.TypeReg,
+				Name:       e.Name,
+				ModTime:    whiteoutT,
+				AccessTime: whiteoutT,
+				ChangeTime: whiteoutT,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrap(err, "failed to write whiteout header")
+			}
+			continue
+		}
+
+		source := filepath.Join(upperRoot, filepath.FromSlash(name))
+		fi, err := os.Lstat(source)
+		if err != nil {
+			return errors.Wrapf(errDiffPlanMismatch, "failed to stat %s: %v", name, err)
+		}
+		if fi.IsDir() != strings.HasSuffix(e.Name, "/") || fi.Mode()&os.ModeSocket != 0 {
+			return errors.Wrapf(errDiffPlanMismatch, "unexpected type of %s", name)
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(source); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Format = tar.FormatPAX
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		hdr.Name = e.Name
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && (st.Mode&syscall.S_IFBLK != 0 || st.Mode&syscall.S_IFCHR != 0) {
+			hdr.Devmajor = int64(unix.Major(st.Rdev))
+			hdr.Devminor = int64(unix.Minor(st.Rdev))
+		}
+		capability, err := sysx.LGetxattr(source, "security.capability")
+		if err != nil && err != unix.ENOTSUP && err != sysx.ENODATA {
+			return errors.Wrap(err, "failed to get capabilities xattr")
+		} else if err == nil && capability != nil {
+			hdr.PAXRecords = map[string]string{
+				"SCHILY.xattr.security.capability": string(capability),
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 && e.Digest == "" {
+			return errors.Wrapf(errDiffPlanMismatch, "%s has no recorded content", name)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "failed to write file header")
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if err := copyPlannedFile(tw, source, hdr.Size, e.Digest); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.Wrap(tw.Close(), "failed to close tar writer")
+}
+
+func copyPlannedFile(w io.Writer, source string, size int64, expected digest.Digest) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open path: %v", source)
+	}
+	defer f.Close()
+	dgstr := expected.Algorithm().Digester()
+	if _, err := io.CopyN(io.MultiWriter(w, dgstr.Hash()), f, size); err != nil {
+		return errors.Wrap(err, "failed to copy")
+	}
+	if dgstr.Digest() != expected {
+		return errors.Wrapf(errDiffPlanMismatch, "content of %s changed", source)
+	}
+	return nil
+}
+
+// listingDigest returns a digest of the names and stat data of all files
+// under root. Any change to the files, including metadata only changes,
+// changes the digest.
+func listingDigest(root string) (digest.Digest, error) {
+	dgstr := digest.SHA256.Digester()
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("unsupported stat type for %s", p)
+		}
+		fmt.Fprintf(dgstr.Hash(), "%q %o %d %d %d %d %d %d %d\n", rel, st.Mode, st.Uid, st.Gid, st.Size, st.Nlink, st.Rdev, st.Mtim.Nano(), st.Ctim.Nano())
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list %s", root)
+	}
+	return dgstr.Digest(), nil
+}
+
+// overlayUpperDir returns the directory of the topmost layer of an overlay
+// mount, or "" if mounts isn't a single overlay mount. The upper directory of
+// a read-only mount is the first lower directory.
+func overlayUpperDir(mounts []mount.Mount) string {
+	if len(mounts) != 1 || mounts[0].Type != "overlay" {
+		return ""
+	}
+	var lower string
+	for _, o := range mounts[0].Options {
+		if strings.HasPrefix(o, "upperdir=") {
+			return strings.TrimPrefix(o, "upperdir=")
+		}
+		if strings.HasPrefix(o, "lowerdir=") {
+			lower = strings.SplitN(strings.TrimPrefix(o, "lowerdir="), ":", 2)[0]
+		}
+	}
+	return lower
+}
+
+func loadDiffPlan(si *metadata.StorageItem) *diffPlan {
+	dt, err := si.GetExternal(keyDiffPlan)
+	if err != nil {
+		return nil
+	}
+	var plan diffPlan
+	if err := json.Unmarshal(dt, &plan); err != nil {
+		logrus.Debugf("invalid diff plan of %s: %v", si.ID(), err)
+		return nil
+	}
+	return &plan
+}
+
+func storeDiffPlan(si *metadata.StorageItem, plan *diffPlan) error {
+	dt, err := json.Marshal(plan)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return si.SetExternal(keyDiffPlan, dt)
+}
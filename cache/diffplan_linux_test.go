@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots/overlay"
+	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffPlan(t *testing.T) {
+	t.Parallel()
+	t.Run("native", func(t *testing.T) {
+		testDiffPlan(t, cmOpt{diffPlans: true})
+	})
+	t.Run("overlayfs", func(t *testing.T) {
+		tmpdir, err := ioutil.TempDir("", "diffplan")
+		require.NoError(t, err)
+		defer os.RemoveAll(tmpdir)
+		if err := overlayutils.Supported(tmpdir); err != nil {
+			t.Skipf("overlayfs not supported: %v", err)
+		}
+		sn, err := overlay.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+		require.NoError(t, err)
+		testDiffPlan(t, cmOpt{diffPlans: true, snapshotterName: "overlayfs", snapshotter: sn})
+	})
+}
+
+func testDiffPlan(t *testing.T, opt cmOpt) {
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, opt)
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	newRef := func(parent ImmutableRef, fn func(root string)) ImmutableRef {
+		active, err := cm.New(ctx, parent, nil)
+		require.NoError(t, err)
+		m, err := active.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		err = mount.WithTempMount(ctx, mounts, func(root string) error {
+			fn(root)
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, release())
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		return snap
+	}
+
+	parent := newRef(nil, func(root string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "a"), []byte("foo"), 0600))
+		require.NoError(t, os.Mkdir(filepath.Join(root, "dir"), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "dir/removed"), []byte("bar"), 0600))
+	})
+	defer parent.Release(context.TODO())
+	ref := newRef(parent, func(root string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "a"), []byte("foo2"), 0600))
+		require.NoError(t, os.Remove(filepath.Join(root, "dir/removed")))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "b"), []byte("baz"), 0600))
+		require.NoError(t, os.Symlink("a", filepath.Join(root, "link")))
+	})
+	defer ref.Release(context.TODO())
+	sr := ref.(*immutableRef)
+
+	diffEntries := func() map[string]string {
+		remote, err := ref.GetRemote(ctx, true, compression.New(compression.Uncompressed), nil)
+		require.NoError(t, err)
+		desc := remote.Descriptors[len(remote.Descriptors)-1]
+		dt, err := content.ReadBlob(ctx, remote.Provider, desc)
+		require.NoError(t, err)
+		entries := map[string]string{}
+		tr := tar.NewReader(bytes.NewReader(dt))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			entries[hdr.Name] = fmt.Sprintf("%c %o %s %s", hdr.Typeflag, hdr.Mode, hdr.Linkname, data)
+		}
+		require.NoError(t, clearBlob(sr.md))
+		return entries
+	}
+
+	expected := diffEntries()
+	require.Equal(t, 5, len(expected))
+	require.Contains(t, expected, "dir/.wh.removed")
+
+	plan := loadDiffPlan(sr.md)
+	require.NotNil(t, plan)
+	require.Equal(t, getSnapshotID(parent.(*immutableRef).md), plan.Parent)
+	require.Equal(t, 5, len(plan.Entries))
+
+	// only the files of the upper layer are listed on overlayfs
+	if opt.snapshotterName == "overlayfs" {
+		m, err := ref.Mount(ctx, true, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		dir := overlayUpperDir(mounts)
+		require.NoError(t, release())
+		require.NotEqual(t, "", dir)
+		listing, err := listingDigest(dir)
+		require.NoError(t, err)
+		require.Equal(t, listing, plan.Upper)
+	}
+
+	// the diff is written from the plan
+	require.Equal(t, expected, diffEntries())
+
+	var removed diffPlanEntry
+	for i, e := range plan.Entries {
+		if e.Name == "b" {
+			removed = e
+			plan.Entries = append(plan.Entries[:i], plan.Entries[i+1:]...)
+			break
+		}
+	}
+	require.Equal(t, "b", removed.Name)
+	require.NoError(t, storeDiffPlan(sr.md, plan))
+	entries := diffEntries()
+	require.NotContains(t, entries, "b")
+	require.Equal(t, 4, len(entries))
+
+	// content that doesn't match the plan makes the diff computed again
+	plan.Entries = append(plan.Entries, removed)
+	for i, e := range plan.Entries {
+		if e.Name == "a" {
+			plan.Entries[i].Digest = digest.FromBytes([]byte("foo"))
+		}
+	}
+	require.NoError(t, storeDiffPlan(sr.md, plan))
+	require.Equal(t, expected, diffEntries())
+	plan = loadDiffPlan(sr.md)
+	require.NotNil(t, plan)
+	require.Equal(t, 5, len(plan.Entries))
+	require.Equal(t, expected, diffEntries())
+}
+
+func TestOverlayUpperDir(t *testing.T) {
+	for _, tc := range []struct {
+		mounts   []mount.Mount
+		expected string
+	}{
+		{
+			mounts:   []mount.Mount{{Type: "bind", Source: "/snapshots/1/fs", Options: []string{"rbind", "ro"}}},
+			expected: "",
+		},
+		{
+			mounts: []mount.Mount{{Type: "overlay", Source: "overlay", Options: []string{
+				"workdir=/snapshots/3/work", "upperdir=/snapshots/3/fs", "lowerdir=/snapshots/2/fs:/snapshots/1/fs",
+			}}},
+			expected: "/snapshots/3/fs",
+		},
+		{
+			mounts:   []mount.Mount{{Type: "overlay", Source: "overlay", Options: readonlyOverlay([]string{"workdir=/snapshots/3/work", "upperdir=/snapshots/3/fs", "lowerdir=/snapshots/2/fs:/snapshots/1/fs"})}},
+			expected: "/snapshots/3/fs",
+		},
+		{
+			mounts:   []mount.Mount{{Type: "overlay", Source: "overlay", Options: []string{"lowerdir=/snapshots/2/fs:/snapshots/1/fs"}}},
+			expected: "/snapshots/2/fs",
+		},
+		{
+			mounts:   []mount.Mount{{Type: "overlay"}, {Type: "overlay"}},
+			expected: "",
+		},
+	} {
+		require.Equal(t, tc.expected, overlayUpperDir(tc.mounts))
+	}
+}
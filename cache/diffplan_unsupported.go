@@ -0,0 +1,20 @@
+// +build !linux
+
+package cache
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/mount"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// diffWithPlan falls back to the differ, diff plans are only supported on
+// Linux.
+func (cm *cacheManager) diffWithPlan(ctx context.Context, sr *immutableRef, lower, upper []mount.Mount, mediaType string) (ocispec.Descriptor, error) {
+	return cm.Differ.Compare(ctx, lower, upper,
+		diff.WithMediaType(mediaType),
+		diff.WithReference(sr.ID()),
+	)
+}
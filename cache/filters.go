@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/containerd/containerd/filters"
+	"github.com/pkg/errors"
+)
+
+var durationSelectorRe = regexp.MustCompile(`^\s*(age|unused)\s*(<=|>=|<|>)\s*(\S+)\s*$`)
+
+// parseFilters parses prune and disk usage filters. A record matches if any
+// of the filters matches. Within a filter, selectors in the containerd filter
+// syntax can be combined with "||" and "&&", with "&&" binding tighter. The
+// "age" (time since creation) and "unused" (time since last use) fields can
+// be compared against a duration with "<", "<=", ">" and ">=", e.g.
+// "type==exec.cachemount && unused>72h". Durations take the units of
+// time.ParseDuration and "d" for days. Duration selectors have to be joined
+// to other selectors with "&&", not ",". "&&" and "||" are part of quoted
+// values and of unquoted values, which end at a space or ",".
+func parseFilters(fs ...string) (filters.Filter, error) {
+	if len(fs) == 0 {
+		return filters.Always, nil
+	}
+	var anyOf filters.Any
+	for _, f := range fs {
+		for _, or := range splitFilter(f, "||") {
+			var all filters.All
+			for _, and := range splitFilter(or, "&&") {
+				sel, err := parseSelector(and)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid filter %q", f)
+				}
+				all = append(all, sel)
+			}
+			anyOf = append(anyOf, all)
+		}
+	}
+	return anyOf, nil
+}
+
+// splitFilter splits f at the operator op. Like the containerd filter
+// scanner, it skips quoted strings and the values following an operator.
+// Unterminated quotes are left to the selector parser to report.
+func splitFilter(f, op string) []string {
+	var parts []string
+	start, value := 0, false
+	for i := 0; i < len(f); {
+		switch ch := f[i]; {
+		case !value && strings.HasPrefix(f[i:], op):
+			parts = append(parts, f[start:i])
+			i += len(op)
+			start = i
+		case ch == '"' || ch == '/' || ch == '|' && !strings.HasPrefix(f[i:], "||"):
+			i = quotedEnd(f, i)
+			value = false
+		case strings.IndexByte("=!~<>", ch) >= 0:
+			for i < len(f) && strings.IndexByte("=!~<>", f[i]) >= 0 {
+				i++
+			}
+			for i < len(f) && unicode.IsSpace(rune(f[i])) {
+				i++
+			}
+			value = true
+		case value:
+			for i < len(f) && f[i] != ',' && !unicode.IsSpace(rune(f[i])) {
+				i++
+			}
+			value = false
+		default:
+			i++
+		}
+	}
+	return append(parts, f[start:])
+}
+
+// quotedEnd returns the index after the quoted string starting at i.
+func quotedEnd(f string, i int) int {
+	quote := f[i]
+	for i++; i < len(f); i++ {
+		switch f[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		}
+	}
+	return len(f)
+}
+
+func parseSelector(s string) (filters.Filter, error) {
+	m := durationSelectorRe.FindStringSubmatch(s)
+	if m == nil {
+		return filters.Parse(strings.TrimSpace(s))
+	}
+	d, err := parseDuration(m[3])
+	if err != nil {
+		return nil, err
+	}
+	field, op := m[1], m[2]
+	return filters.FilterFunc(func(adaptor filters.Adaptor) bool {
+		var since time.Time
+		if field == "unused" {
+			if v, ok := adaptor.Field([]string{"lastusedat"}); ok {
+				since, _ = time.Parse(time.RFC3339Nano, v)
+			}
+		}
+		if since.IsZero() {
+			v, ok := adaptor.Field([]string{"createdat"})
+			if !ok {
+				return false
+			}
+			since, _ = time.Parse(time.RFC3339Nano, v)
+			if since.IsZero() {
+				return false
+			}
+		}
+		elapsed := time.Since(since)
+		switch op {
+		case "<":
+			return elapsed < d
+		case "<=":
+			return elapsed <= d
+		case ">":
+			return elapsed > d
+		default:
+			return elapsed >= d
+		}
+	}), nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return d, nil
+}
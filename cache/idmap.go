@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/leases"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/util/leaseutil"
+	"github.com/moby/buildkit/util/progress"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// remapFrom returns the identity mapping the snapshot of the record was
+// created with if it differs from the mapping of the manager. The bool is
+// false if the snapshot can be used as it is.
+func (cr *cacheRecord) remapFrom() (*idtools.IdentityMapping, bool) {
+	recorded, ok := getIdentityMapping(cr.md)
+	if !ok || sameIdentityMapping(recorded, cr.cm.IdentityMapping()) {
+		return nil, false
+	}
+	return recorded, true
+}
+
+// mappedSnapshotID returns the snapshot of a committed record to use with
+// the identity mapping of the manager. Records created with a different
+// mapping get a copy of their snapshot with the ownership of all files
+// remapped. The copy is kept with the record and reused.
+func (cr *cacheRecord) mappedSnapshotID(ctx context.Context) (string, error) {
+	snapshotID := getSnapshotID(cr.md)
+	from, ok := cr.remapFrom()
+	if !ok {
+		return snapshotID, nil
+	}
+
+	remapped := fmt.Sprintf("%s-remap-%s", snapshotID, identityMappingDigest(cr.cm.IdentityMapping()).Hex()[:16])
+	if _, err := cr.cm.Snapshotter.Stat(ctx, remapped); err == nil {
+		return remapped, nil
+	}
+
+	_, err := cr.sizeG.Do(ctx, remapped, func(ctx context.Context) (_ interface{}, rerr error) {
+		if _, err := cr.cm.Snapshotter.Stat(ctx, remapped); err == nil {
+			return nil, nil
+		}
+		defer remapProgress(ctx, fmt.Sprintf("remapping ownership of %s by copying", cr.ID()))()
+
+		viewCtx, release, err := leaseutil.WithLease(ctx, cr.cm.LeaseManager, leaseutil.MakeTemporary)
+		if err != nil {
+			return nil, err
+		}
+		defer release(context.TODO())
+
+		src, err := cr.cm.Snapshotter.View(viewCtx, "remap-view-"+identity.NewID(), snapshotID)
+		if err != nil {
+			return nil, err
+		}
+
+		// the copy belongs to the record and is removed with it
+		ctx = leases.WithLease(ctx, cr.ID())
+		key := "remap-" + identity.NewID()
+		if err := cr.cm.Snapshotter.Prepare(ctx, key, ""); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if rerr != nil {
+				cr.cm.Snapshotter.Remove(context.TODO(), key)
+			}
+		}()
+		dst, err := cr.cm.Snapshotter.Mounts(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := withLocalMounts(src, dst, func(srcRoot, dstRoot string) error {
+			return copyRemapped(dstRoot, srcRoot, from, cr.cm.IdentityMapping())
+		}); err != nil {
+			return nil, errors.Wrapf(err, "failed to remap %s", cr.ID())
+		}
+
+		if err := cr.cm.Snapshotter.Commit(ctx, remapped, key); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return remapped, nil
+}
+
+// remapMutable changes the ownership of the files of a mutable record that
+// was created with another identity mapping in place. Requires cr.mu.
+func (cr *cacheRecord) remapMutable(ctx context.Context) error {
+	from, ok := cr.remapFrom()
+	if !ok {
+		return nil
+	}
+	defer remapProgress(ctx, fmt.Sprintf("remapping ownership of %s", cr.ID()))()
+
+	m, err := cr.cm.Snapshotter.Mounts(ctx, getSnapshotID(cr.md))
+	if err != nil {
+		return err
+	}
+	lm := snapshot.LocalMounter(m)
+	root, err := lm.Mount()
+	if err != nil {
+		return err
+	}
+	err = remapOwnership(root, from, cr.cm.IdentityMapping())
+	if err1 := lm.Unmount(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to remap %s", cr.ID())
+	}
+	if err := queueIdentityMapping(cr.md, cr.cm.IdentityMapping()); err != nil {
+		return err
+	}
+	return cr.md.Commit()
+}
+
+func withLocalMounts(src, dst snapshot.Mountable, fn func(srcRoot, dstRoot string) error) error {
+	srcMounter := snapshot.LocalMounter(src)
+	srcRoot, err := srcMounter.Mount()
+	if err != nil {
+		return err
+	}
+	defer srcMounter.Unmount()
+	dstMounter := snapshot.LocalMounter(dst)
+	dstRoot, err := dstMounter.Mount()
+	if err != nil {
+		return err
+	}
+	if err := fn(srcRoot, dstRoot); err != nil {
+		dstMounter.Unmount()
+		return err
+	}
+	return dstMounter.Unmount()
+}
+
+// remapProgress reports a remapping in the progress of the build since the
+// copy can take a long time.
+func remapProgress(ctx context.Context, id string) func() {
+	pw, _, _ := progress.FromContext(ctx)
+	now := time.Now()
+	st := progress.Status{
+		Action:  "remapping",
+		Started: &now,
+	}
+	pw.Write(id, st)
+	return func() {
+		now := time.Now()
+		st.Completed = &now
+		pw.Write(id, st)
+		pw.Close()
+	}
+}
+
+// remapID translates a host ID of the from mapping to the host ID of the
+// same container ID in the to mapping. Empty mappings map IDs to themselves.
+func remapID(id int, from, to []idtools.IDMap) (int, error) {
+	cid := id
+	if len(from) > 0 {
+		found := false
+		for _, m := range from {
+			if id >= m.HostID && id < m.HostID+m.Size {
+				cid = m.ContainerID + id - m.HostID
+				found = true
+				break
+			}
+		}
+		if !found {
+			return -1, errors.Errorf("host id %d is not mapped", id)
+		}
+	}
+	if len(to) == 0 {
+		return cid, nil
+	}
+	for _, m := range to {
+		if cid >= m.ContainerID && cid < m.ContainerID+m.Size {
+			return m.HostID + cid - m.ContainerID, nil
+		}
+	}
+	return -1, errors.Errorf("container id %d is not mapped", cid)
+}
+
+func idMaps(m *idtools.IdentityMapping) (uids, gids []idtools.IDMap) {
+	if m == nil {
+		return nil, nil
+	}
+	return m.UIDs(), m.GIDs()
+}
+
+func sameIdentityMapping(a, b *idtools.IdentityMapping) bool {
+	return identityMappingDigest(a) == identityMappingDigest(b)
+}
+
+func identityMappingDigest(m *idtools.IdentityMapping) digest.Digest {
+	uids, gids := idMaps(m)
+	return digest.FromString(fmt.Sprintf("%v %v", uids, gids))
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/continuity/sysx"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// copyRemapped copies src to dst and remaps the ownership of the copy.
+func copyRemapped(dst, src string, from, to *idtools.IdentityMapping) error {
+	if err := fs.CopyDir(dst, src); err != nil {
+		return errors.Wrap(err, "failed to copy")
+	}
+	return remapOwnership(dst, from, to)
+}
+
+// remapOwnership changes the owner of every file under root from the host
+// IDs of the from mapping to the host IDs of the to mapping.
+func remapOwnership(root string, from, to *idtools.IdentityMapping) error {
+	fromUIDs, fromGIDs := idMaps(from)
+	toUIDs, toGIDs := idMaps(to)
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("unsupported stat type for %s", p)
+		}
+		uid, err := remapID(int(st.Uid), fromUIDs, toUIDs)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remap owner of %s", p)
+		}
+		gid, err := remapID(int(st.Gid), fromGIDs, toGIDs)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remap group of %s", p)
+		}
+		if uid == int(st.Uid) && gid == int(st.Gid) {
+			return nil
+		}
+
+		// chown clears capabilities and setuid bits, restore them after
+		capability, err := sysx.LGetxattr(p, "security.capability")
+		if err != nil && err != unix.ENOTSUP && err != sysx.ENODATA {
+			return errors.Wrapf(err, "failed to get capabilities of %s", p)
+		}
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return errors.WithStack(err)
+		}
+		if fi.Mode()&os.ModeSymlink == 0 && fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			if err := os.Chmod(p, fi.Mode()); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if err == nil && len(capability) > 0 {
+			if err := sysx.LSetxattr(p, "security.capability", capability, 0); err != nil {
+				return errors.Wrapf(err, "failed to restore capabilities of %s", p)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots/native"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/util/progress"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemapIdentityMapping(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Requires root to mount and chown")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	tmpdir, err := ioutil.TempDir("", "cachemanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	snapshotter, err := native.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	require.NoError(t, err)
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		tmpdir:          tmpdir,
+		snapshotter:     snapshotter,
+		snapshotterName: "native",
+	})
+	require.NoError(t, err)
+	cm := co.manager
+
+	write := func(ref Mountable, fn func(root string)) {
+		m, err := ref.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		fn(mounts[0].Source)
+		require.NoError(t, release())
+	}
+
+	active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	write(active, func(root string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "suid"), []byte("foo"), 0755))
+		require.NoError(t, os.Chmod(filepath.Join(root, "suid"), 0755|os.ModeSetuid))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "user"), []byte("bar"), 0600))
+		require.NoError(t, os.Lchown(filepath.Join(root, "user"), 1000, 1000))
+	})
+	snap, err := active.Commit(ctx)
+	require.NoError(t, err)
+	require.NoError(t, snap.Finalize(ctx, true))
+	require.NoError(t, snap.Release(ctx))
+
+	cacheMount, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	write(cacheMount, func(root string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "cached"), []byte("baz"), 0600))
+	})
+	require.NoError(t, cacheMount.Release(ctx))
+
+	require.NoError(t, cm.Close())
+	require.NoError(t, cleanup())
+
+	idmap := idtools.NewIDMappingsFromMaps(
+		[]idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		[]idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	)
+	co, cleanup, err = newCacheManager(ctx, cmOpt{
+		tmpdir:          tmpdir,
+		snapshotter:     snapshotter,
+		snapshotterName: "native",
+		identityMapping: idmap,
+	})
+	require.NoError(t, err)
+	defer cleanup()
+	cm = co.manager
+
+	requireOwner := func(m snapshot.Mountable, name string, uid, gid int) os.FileInfo {
+		lm := snapshot.LocalMounter(m)
+		root, err := lm.Mount()
+		require.NoError(t, err)
+		defer lm.Unmount()
+		fi, err := os.Lstat(filepath.Join(root, name))
+		require.NoError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		require.Equal(t, uid, int(st.Uid))
+		require.Equal(t, gid, int(st.Gid))
+		return fi
+	}
+
+	pr, pctx, cancel := progress.NewContext(ctx)
+	ref, err := cm.Get(pctx, snap.ID())
+	require.NoError(t, err)
+	m, err := ref.Mount(pctx, true, nil)
+	require.NoError(t, err)
+	cancel()
+	fi := requireOwner(m, "suid", 100000, 100000)
+	require.Equal(t, os.ModeSetuid, fi.Mode()&os.ModeSetuid)
+	requireOwner(m, "user", 101000, 101000)
+
+	var remapped bool
+	for {
+		p, err := pr.Read(context.TODO())
+		if err != nil || len(p) == 0 {
+			break
+		}
+		for _, p := range p {
+			if strings.Contains(p.ID, "remapping ownership of "+snap.ID()) {
+				remapped = true
+			}
+		}
+	}
+	require.True(t, remapped)
+
+	// children are created on top of the remapped snapshot
+	child, err := cm.New(ctx, ref, nil)
+	require.NoError(t, err)
+	m, err = child.Mount(ctx, true, nil)
+	require.NoError(t, err)
+	requireOwner(m, "user", 101000, 101000)
+	require.NoError(t, child.Release(ctx))
+	require.NoError(t, ref.Release(ctx))
+
+	// mutable records are remapped in place
+	mutable, err := cm.GetMutable(ctx, cacheMount.ID())
+	require.NoError(t, err)
+	m, err = mutable.Mount(ctx, true, nil)
+	require.NoError(t, err)
+	requireOwner(m, "cached", 100000, 100000)
+	recorded, ok := getIdentityMapping(mutable.Metadata())
+	require.True(t, ok)
+	require.True(t, sameIdentityMapping(idmap, recorded))
+	require.NoError(t, mutable.Release(ctx))
+}
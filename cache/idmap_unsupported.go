@@ -0,0 +1,16 @@
+// +build !linux
+
+package cache
+
+import (
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+func copyRemapped(dst, src string, from, to *idtools.IdentityMapping) error {
+	return errors.New("remapping ownership is only supported on Linux")
+}
+
+func remapOwnership(root string, from, to *idtools.IdentityMapping) error {
+	return errors.New("remapping ownership is only supported on Linux")
+}
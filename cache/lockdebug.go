@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moby/buildkit/session"
+	"github.com/sirupsen/logrus"
+)
+
+// heldLocks contains all record mutexes that are currently locked
+var heldLocks sync.Map // *recordMutex -> struct{}
+
+// lockStacks is set while the lock watchdog is running. Capturing stacks
+// of holders and waiters is only done when it is needed for reporting.
+var lockStacks int32
+
+// LockHolder describes the holder of a cache record lock.
+type LockHolder struct {
+	Operation string
+	SessionID string
+	Acquired  time.Time
+	Stack     string `json:",omitempty"`
+}
+
+// LockInfo describes a held cache record lock and the callers waiting for
+// it.
+type LockInfo struct {
+	Record  string
+	Holder  LockHolder
+	Waiters []LockHolder `json:",omitempty"`
+}
+
+// recordMutex is the mutex guarding cache records. Besides locking it keeps
+// track of the current holder and of waiters so that locks that are held
+// for too long can be reported.
+type recordMutex struct {
+	mu     sync.Mutex
+	record string
+
+	state    sync.Mutex
+	holder   *LockHolder
+	waiters  map[*LockHolder]struct{}
+	reported *LockHolder
+}
+
+func newRecordMutex(record string) *recordMutex {
+	return &recordMutex{record: record}
+}
+
+func (m *recordMutex) Lock() {
+	m.lockFor(callerName(), nil)
+}
+
+// lockFor locks the mutex on behalf of an operation running for the
+// sessions in s.
+func (m *recordMutex) lockFor(op string, s session.Group) {
+	h := &LockHolder{Operation: op}
+	if ids := session.AllSessionIDs(s); len(ids) > 0 {
+		h.SessionID = strings.Join(ids, ",")
+	}
+	stacks := atomic.LoadInt32(&lockStacks) == 1
+	if stacks {
+		h.Acquired = time.Now()
+		h.Stack = stack()
+		m.state.Lock()
+		if m.waiters == nil {
+			m.waiters = map[*LockHolder]struct{}{}
+		}
+		m.waiters[h] = struct{}{}
+		m.state.Unlock()
+	}
+
+	m.mu.Lock()
+
+	m.state.Lock()
+	if stacks {
+		delete(m.waiters, h)
+	}
+	h.Acquired = time.Now()
+	m.holder = h
+	m.state.Unlock()
+	heldLocks.Store(m, struct{}{})
+}
+
+func (m *recordMutex) Unlock() {
+	heldLocks.Delete(m)
+	m.state.Lock()
+	m.holder = nil
+	m.state.Unlock()
+	m.mu.Unlock()
+}
+
+// info returns the current holder and waiters of the lock. The bool is
+// false if the lock is not held.
+func (m *recordMutex) info() (LockInfo, bool) {
+	m.state.Lock()
+	defer m.state.Unlock()
+	if m.holder == nil {
+		return LockInfo{}, false
+	}
+	li := LockInfo{Record: m.record, Holder: *m.holder}
+	for w := range m.waiters {
+		li.Waiters = append(li.Waiters, *w)
+	}
+	sort.Slice(li.Waiters, func(i, j int) bool {
+		return li.Waiters[i].Acquired.Before(li.Waiters[j].Acquired)
+	})
+	return li, true
+}
+
+// HeldLocks returns the cache record locks that have been held for longer
+// than threshold, longest held first.
+func HeldLocks(threshold time.Duration) []LockInfo {
+	var out []LockInfo
+	heldLocks.Range(func(k, _ interface{}) bool {
+		li, ok := k.(*recordMutex).info()
+		if ok && time.Since(li.Holder.Acquired) >= threshold {
+			out = append(out, li)
+		}
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Holder.Acquired.Before(out[j].Holder.Acquired)
+	})
+	return out
+}
+
+// StartLockWatchdog logs a warning with the stacks of the holder and the
+// waiters for every cache record lock that is held for longer than timeout.
+// The watchdog runs until ctx is cancelled.
+func StartLockWatchdog(ctx context.Context, timeout time.Duration) {
+	atomic.StoreInt32(&lockStacks, 1)
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		defer atomic.StoreInt32(&lockStacks, 0)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				checkLocks(timeout)
+			}
+		}
+	}()
+}
+
+func checkLocks(timeout time.Duration) {
+	heldLocks.Range(func(k, _ interface{}) bool {
+		m := k.(*recordMutex)
+		m.state.Lock()
+		h := m.holder
+		if h == nil || m.reported == h || time.Since(h.Acquired) < timeout {
+			m.state.Unlock()
+			return true
+		}
+		m.reported = h
+		m.state.Unlock()
+
+		li, ok := m.info()
+		if !ok {
+			return true
+		}
+		var sb strings.Builder
+		sb.WriteString(li.Holder.Stack)
+		for _, w := range li.Waiters {
+			sb.WriteString("\nwaiting " + w.Operation + " since " + w.Acquired.Format(time.RFC3339) + ":\n")
+			sb.WriteString(w.Stack)
+		}
+		logrus.WithFields(logrus.Fields{
+			"record":    li.Record,
+			"operation": li.Holder.Operation,
+			"session":   li.Holder.SessionID,
+			"held":      time.Since(li.Holder.Acquired).Round(time.Second),
+			"waiters":   len(li.Waiters),
+		}).Warnf("cache record lock held for too long:\n%s", sb.String())
+		return true
+	})
+}
+
+// callerName returns the name of the function calling recordMutex.Lock.
+func callerName() string {
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+func stack() string {
+	buf := make([]byte, 16<<10)
+	return string(buf[:runtime.Stack(buf, false)])
+}
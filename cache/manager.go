@@ -2,7 +2,10 @@ package cache
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,7 +21,10 @@ import (
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/flightcontrol"
+	"github.com/moby/buildkit/util/resolver/retryhandler"
 	digest "github.com/opencontainers/go-digest"
 	imagespecidentity "github.com/opencontainers/image-spec/identity"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -28,9 +34,10 @@ import (
 )
 
 var (
-	ErrLocked   = errors.New("locked")
-	errNotFound = errors.New("not found")
-	errInvalid  = errors.New("invalid")
+	ErrLocked          = errors.New("locked")
+	ErrSnapshotMissing = errors.New("snapshot missing")
+	errNotFound        = errors.New("not found")
+	errInvalid         = errors.New("invalid")
 )
 
 type ManagerOpt struct {
@@ -42,21 +49,76 @@ type ManagerOpt struct {
 	GarbageCollect  func(ctx context.Context) (gc.Stats, error)
 	Applier         diff.Applier
 	Differ          diff.Comparer
+	// SkipLayerVerification disables checking that the data of a layer
+	// matches its media type before it's extracted.
+	SkipLayerVerification bool
+	// EagerUnlazy makes GetRemote fetch all lazy blobs of a remote before
+	// returning it, so an unreachable registry fails an export up front
+	// instead of in the middle of it.
+	EagerUnlazy bool
+	// LazyRecordTTL is how long a record may stay lazy after it was last
+	// used before prune removes it. 0 keeps lazy records like any other
+	// record.
+	LazyRecordTTL time.Duration
+	// DiskQuota limits the size of the cache plus the space reserved by
+	// running builds. New fails with a QuotaExceededError for refs created
+	// with ReserveSpace when it would be exceeded. 0 disables it.
+	DiskQuota int64
+	// ReservationSize is the space reserved for refs created with
+	// ReserveSpace before their snapshot has grown larger.
+	ReservationSize int64
+	// DiffPlans makes the manager compute layer diffs itself instead of
+	// with Differ and record the entries of each diff. When the blob of a
+	// record has to be created again, e.g. after it was pruned, the diff is
+	// written from the recorded entries without comparing the snapshot to
+	// its parent, if none of the files changed.
+	DiffPlans bool
+	// MetadataCompactThreshold is the size of the free pages in the metadata
+	// store after which Prune compacts the store. 0 disables compaction.
+	MetadataCompactThreshold int64
+	// SharedNamespaces are the cache namespaces whose pulled layers can be
+	// used by builds in all namespaces. Other records are only used by
+	// builds in the namespace that created them.
+	SharedNamespaces []string
+	// NoSpaceReclaimSize is the size that is freed by pruning unused records
+	// when creating a blob fails because the disk is full, before the blob
+	// is created again. 0 disables it.
+	NoSpaceReclaimSize int64
+	// RetryPolicy is used for fetching the blobs of lazy records.
+	RetryPolicy retryhandler.Policy
+	// MaxParallelConversions limits the number of blobs that are compressed
+	// or decompressed at the same time to create blob variants or blobs with
+	// a compression level. 0 doesn't limit them.
+	MaxParallelConversions int
+	// KeepUncompressedDiff keeps the uncompressed diff of new blobs with
+	// their record. Blob variants are compressed from it instead of
+	// decompressing the blob, at the cost of the disk space of the diff,
+	// which is included in the size of the record.
+	KeepUncompressedDiff bool
 }
 
 type Accessor interface {
 	GetByBlob(ctx context.Context, desc ocispec.Descriptor, parent ImmutableRef, opts ...RefOption) (ImmutableRef, error)
+	ImportBlob(ctx context.Context, desc ocispec.Descriptor, parent ImmutableRef, opts ...RefOption) (ImmutableRef, error)
 	Get(ctx context.Context, id string, opts ...RefOption) (ImmutableRef, error)
 
 	New(ctx context.Context, parent ImmutableRef, s session.Group, opts ...RefOption) (MutableRef, error)
 	GetMutable(ctx context.Context, id string, opts ...RefOption) (MutableRef, error) // Rebase?
 	IdentityMapping() *idtools.IdentityMapping
 	Metadata(string) *metadata.StorageItem
+	ConvertRemote(ctx context.Context, r *solver.Remote, comp compression.Config) (*solver.Remote, error)
 }
 
 type Controller interface {
 	DiskUsage(ctx context.Context, info client.DiskUsageInfo) ([]*client.UsageInfo, error)
 	Prune(ctx context.Context, ch chan client.UsageInfo, info ...client.PruneInfo) error
+	Pin(ctx context.Context, id string, reason string) error
+	Unpin(ctx context.Context, id string) error
+	Verify(ctx context.Context, repair bool) ([]VerifyResult, error)
+	Search(ctx context.Context, query string, prefix bool) ([]string, error)
+	MigrateSnapshotter(ctx context.Context, to snapshot.Snapshotter, dryRun bool) (MigrateStats, error)
+	ExportState(ctx context.Context, w io.Writer, filter ...string) ([]string, error)
+	ImportState(ctx context.Context, r io.Reader) (map[string]string, error)
 }
 
 type Manager interface {
@@ -79,6 +141,12 @@ type cacheManager struct {
 
 	muPrune sync.Mutex // make sure parallel prune is not allowed so there will not be inconsistent results
 	unlazyG flightcontrol.Group
+
+	conversions *conversionLimiter
+
+	reservations reservations
+	usage        quotaUsage
+	done         chan struct{}
 }
 
 func NewManager(opt ManagerOpt) (Manager, error) {
@@ -92,6 +160,16 @@ func NewManager(opt ManagerOpt) (Manager, error) {
 		return nil, err
 	}
 
+	if opt.MaxParallelConversions > 0 {
+		cm.conversions = newConversionLimiter(opt.MaxParallelConversions)
+	}
+
+	if opt.DiskQuota > 0 {
+		cm.reservations.m = map[string]*reservation{}
+		cm.done = make(chan struct{})
+		go cm.sampleReservations(cm.done)
+	}
+
 	// cm.scheduleGC(5 * time.Minute)
 
 	return cm, nil
@@ -145,10 +223,14 @@ func (cm *cacheManager) GetByBlob(ctx context.Context, desc ocispec.Descriptor,
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
+	ns := solver.CacheNamespaceOf(ctx)
+
 	sis, err := cm.MetadataStore.Search("blobchainid:" + blobChainID.String())
 	if err != nil {
 		return nil, err
 	}
+	// layers pulled in other namespaces still share the snapshot below
+	sis = cm.filterNamespace(sis, ns)
 
 	if len(sis) > 0 {
 		ref, err := cm.get(ctx, sis[0].ID(), opts...)
@@ -227,7 +309,7 @@ func (cm *cacheManager) GetByBlob(ctx context.Context, desc ocispec.Descriptor,
 	md, _ := cm.md.Get(id)
 
 	rec := &cacheRecord{
-		mu:     &sync.Mutex{},
+		mu:     newRecordMutex(id),
 		cm:     cm,
 		refs:   make(map[ref]struct{}),
 		parent: p,
@@ -250,17 +332,65 @@ func (cm *cacheManager) GetByBlob(ctx context.Context, desc ocispec.Descriptor,
 	queueBlobOnly(rec.md, blobOnly)
 	queueMediaType(rec.md, desc.MediaType)
 	queueBlobSize(rec.md, desc.Size)
+	queueBlobAnnotations(rec.md, filterBlobAnnotations(desc.Annotations))
 	queueCommitted(rec.md)
+	if err := queueNamespace(rec.md, ns); err != nil {
+		return nil, err
+	}
+	if err := queuePulled(rec.md); err != nil {
+		return nil, err
+	}
 
 	if err := rec.md.Commit(); err != nil {
 		return nil, err
 	}
 
 	cm.records[id] = rec
+	rec.updateUsage()
 
 	return rec.ref(true, descHandlers), nil
 }
 
+// ImportBlob returns a ref for a layer blob that was added to the content
+// store outside of a pull. Unlike GetByBlob, the blob must exist and the
+// uncompressed digest and media type are taken from the blob data if the
+// descriptor doesn't record them. The layer is unpacked on first extract.
+func (cm *cacheManager) ImportBlob(ctx context.Context, desc ocispec.Descriptor, parent ImmutableRef, opts ...RefOption) (ImmutableRef, error) {
+	info, err := cm.ContentStore.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to import blob %s", desc.Digest)
+	}
+	if desc.Size == 0 {
+		desc.Size = info.Size
+	}
+
+	if !compression.IsLayerMediaTypeKnown(desc.MediaType) {
+		desc.MediaType, err = compression.DetectLayerMediaType(ctx, cm.ContentStore, desc.Digest, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := desc.Annotations[containerdUncompressed]; !ok {
+		diffID, ok := info.Labels[containerdUncompressed]
+		if !ok {
+			dgst, err := computeDiffID(ctx, cm.ContentStore, desc)
+			if err != nil {
+				return nil, err
+			}
+			diffID = dgst.String()
+		}
+		annotations := make(map[string]string, len(desc.Annotations)+1)
+		for k, v := range desc.Annotations {
+			annotations[k] = v
+		}
+		annotations[containerdUncompressed] = diffID
+		desc.Annotations = annotations
+	}
+
+	return cm.GetByBlob(ctx, desc, parent, opts...)
+}
+
 // init loads all snapshots from metadata state and tries to load the records
 // from the snapshotter. If snaphot can't be found, metadata is deleted as well.
 func (cm *cacheManager) init(ctx context.Context) error {
@@ -270,10 +400,21 @@ func (cm *cacheManager) init(ctx context.Context) error {
 	}
 
 	for _, si := range items {
-		if _, err := cm.getRecord(ctx, si.ID()); err != nil {
+		rec, err := cm.getRecord(ctx, si.ID())
+		if err != nil {
 			logrus.Debugf("could not load snapshot %s: %+v", si.ID(), err)
 			cm.md.Clear(si.ID())
 			cm.LeaseManager.Delete(ctx, leases.Lease{ID: si.ID()})
+			continue
+		}
+		// index descriptions of records created before they were indexed
+		if v := rec.md.Get(keyDescription); v != nil && v.Index == "" {
+			if err := queueDescription(rec.md, GetDescription(rec.md)); err != nil {
+				return err
+			}
+			if err := rec.md.Commit(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -288,6 +429,9 @@ func (cm *cacheManager) IdentityMapping() *idtools.IdentityMapping {
 // method should be called after Close.
 func (cm *cacheManager) Close() error {
 	// TODO: allocate internal context and cancel it here
+	if cm.done != nil {
+		close(cm.done)
+	}
 	return cm.md.Close()
 }
 
@@ -295,6 +439,9 @@ func (cm *cacheManager) Close() error {
 func (cm *cacheManager) Get(ctx context.Context, id string, opts ...RefOption) (ImmutableRef, error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	if err := cm.checkNamespace(ctx, id); err != nil {
+		return nil, err
+	}
 	return cm.get(ctx, id, opts...)
 }
 
@@ -393,7 +540,7 @@ func (cm *cacheManager) getRecord(ctx context.Context, id string, opts ...RefOpt
 			dhs = mutable.parent.descHandlers
 		}
 		rec := &cacheRecord{
-			mu:           &sync.Mutex{},
+			mu:           newRecordMutex(id),
 			cm:           cm,
 			refs:         make(map[ref]struct{}),
 			parent:       mutable.parentRef(false, dhs),
@@ -402,6 +549,7 @@ func (cm *cacheManager) getRecord(ctx context.Context, id string, opts ...RefOpt
 		}
 		mutable.equalImmutable = &immutableRef{cacheRecord: rec}
 		cm.records[id] = rec
+		rec.updateUsage()
 		return rec, nil
 	}
 
@@ -422,7 +570,7 @@ func (cm *cacheManager) getRecord(ctx context.Context, id string, opts ...RefOpt
 	}
 
 	rec := &cacheRecord{
-		mu:      &sync.Mutex{},
+		mu:      newRecordMutex(id),
 		mutable: !getCommitted(md),
 		cm:      cm,
 		refs:    make(map[ref]struct{}),
@@ -447,6 +595,7 @@ func (cm *cacheManager) getRecord(ctx context.Context, id string, opts ...RefOpt
 	}
 
 	cm.records[id] = rec
+	rec.updateUsage()
 	if err := checkLazyProviders(rec); err != nil {
 		return nil, err
 	}
@@ -475,7 +624,10 @@ func (cm *cacheManager) New(ctx context.Context, s ImmutableRef, sess session.Gr
 		if err := parent.Extract(ctx, sess); err != nil {
 			return nil, err
 		}
-		parentSnapshotID = getSnapshotID(parent.md)
+		parentSnapshotID, err = parent.mappedSnapshotID(ctx)
+		if err != nil {
+			return nil, err
+		}
 		parentID = parent.ID()
 	}
 
@@ -485,6 +637,17 @@ func (cm *cacheManager) New(ctx context.Context, s ImmutableRef, sess session.Gr
 		}
 	}()
 
+	if cm.DiskQuota > 0 && hasReserveSpace(opts...) {
+		if err := cm.reserve(id, id, buildIDOf(sess), cm.ReservationSize); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				cm.unreserve(id)
+			}
+		}()
+	}
+
 	l, err := cm.ManagerOpt.LeaseManager.Create(ctx, func(l *leases.Lease) error {
 		l.ID = id
 		l.Labels = map[string]string{
@@ -520,7 +683,7 @@ func (cm *cacheManager) New(ctx context.Context, s ImmutableRef, sess session.Gr
 	md, _ := cm.md.Get(id)
 
 	rec := &cacheRecord{
-		mu:      &sync.Mutex{},
+		mu:      newRecordMutex(id),
 		mutable: true,
 		cm:      cm,
 		refs:    make(map[ref]struct{}),
@@ -528,6 +691,16 @@ func (cm *cacheManager) New(ctx context.Context, s ImmutableRef, sess session.Gr
 		md:      md,
 	}
 
+	if err := queueBuildID(md, buildIDOf(sess)); err != nil {
+		return nil, err
+	}
+	if err := queueNamespace(md, solver.CacheNamespaceOf(ctx)); err != nil {
+		return nil, err
+	}
+	if err := queueIdentityMapping(md, cm.IdentityMapping()); err != nil {
+		return nil, err
+	}
+
 	if err := initializeMetadata(rec, parentID, opts...); err != nil {
 		return nil, err
 	}
@@ -540,6 +713,7 @@ func (cm *cacheManager) New(ctx context.Context, s ImmutableRef, sess session.Gr
 	defer cm.mu.Unlock()
 
 	cm.records[id] = rec // TODO: save to db
+	rec.updateUsage()
 
 	// parent refs are possibly lazy so keep it hold the description handlers.
 	var dhs DescHandlers
@@ -585,8 +759,19 @@ func (cm *cacheManager) GetMutable(ctx context.Context, id string, opts ...RefOp
 func (cm *cacheManager) Prune(ctx context.Context, ch chan client.UsageInfo, opts ...client.PruneInfo) error {
 	cm.muPrune.Lock()
 
-	for _, opt := range opts {
-		if err := cm.pruneOnce(ctx, ch, opt); err != nil {
+	if cm.LazyRecordTTL != 0 {
+		if err := cm.prune(ctx, ch, pruneOpt{
+			filter:  filters.Always,
+			lazyTTL: cm.LazyRecordTTL,
+			policy:  fmt.Sprintf("lazy record TTL %v", cm.LazyRecordTTL),
+		}); err != nil {
+			cm.muPrune.Unlock()
+			return err
+		}
+	}
+
+	for i, opt := range opts {
+		if err := cm.pruneOnce(ctx, ch, i, opt); err != nil {
 			cm.muPrune.Unlock()
 			return err
 		}
@@ -600,11 +785,130 @@ func (cm *cacheManager) Prune(ctx context.Context, ch chan client.UsageInfo, opt
 		}
 	}
 
+	cm.compactMetadata()
+
 	return nil
 }
 
-func (cm *cacheManager) pruneOnce(ctx context.Context, ch chan client.UsageInfo, opt client.PruneInfo) error {
-	filter, err := filters.ParseAll(opt.Filter...)
+// compactMetadata compacts the metadata store if the space freed by pruned
+// records exceeds MetadataCompactThreshold. Failures are only logged, the
+// store stays usable when compaction fails.
+func (cm *cacheManager) compactMetadata() {
+	if cm.MetadataCompactThreshold <= 0 {
+		return
+	}
+	st, err := cm.md.Stats()
+	if err != nil {
+		logrus.Warnf("failed to get metadata store stats: %+v", err)
+		return
+	}
+	if st.FreeSize < cm.MetadataCompactThreshold {
+		return
+	}
+	logrus.Debugf("compacting metadata store %s with %d of %d bytes free", st.Path, st.FreeSize, st.Size)
+	if err := cm.md.Compact(); err != nil {
+		logrus.Warnf("failed to compact metadata store: %+v", err)
+	}
+}
+
+// Search returns the IDs of the cache records with a description that
+// contains query. If prefix is set, the description has to start with query
+// and the records are looked up in the description index.
+func (cm *cacheManager) Search(ctx context.Context, query string, prefix bool) ([]string, error) {
+	var candidates []string
+	if prefix {
+		sis, err := cm.md.SearchPrefix(indexDescription + query)
+		if err != nil {
+			return nil, err
+		}
+		for _, si := range sis {
+			candidates = append(candidates, si.ID())
+		}
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if !prefix {
+		for id := range cm.records {
+			candidates = append(candidates, id)
+		}
+	}
+
+	var ids []string
+	for _, id := range candidates {
+		cr, ok := cm.records[id]
+		if !ok {
+			continue
+		}
+		cr.mu.Lock()
+		// ignore duplicates that share data
+		dup := cr.equalImmutable != nil && len(cr.equalImmutable.refs) > 0 || cr.equalMutable != nil && len(cr.refs) == 0
+		if !dup && !cr.isDead() && (prefix || strings.Contains(GetDescription(cr.md), query)) {
+			ids = append(ids, id)
+		}
+		cr.mu.Unlock()
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Pin excludes the record from prune unless the prune is forced. The pin is
+// stored in the record metadata so it's kept across restarts.
+func (cm *cacheManager) Pin(ctx context.Context, id string, reason string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	md, err := cm.pinMetadata(id)
+	if err != nil {
+		return err
+	}
+	return setPinned(md, reason)
+}
+
+// Unpin removes the pin of the record. It only needs the record metadata, so
+// it also works for records whose snapshot can't be loaded.
+func (cm *cacheManager) Unpin(ctx context.Context, id string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	md, err := cm.pinMetadata(id)
+	if err != nil {
+		return err
+	}
+	return unsetPinned(md)
+}
+
+// pinMetadata returns the metadata of the record, preferring the loaded
+// record so its cached values stay up to date. Requires manager lock.
+func (cm *cacheManager) pinMetadata(id string) (*metadata.StorageItem, error) {
+	if cr, ok := cm.records[id]; ok {
+		return cr.md, nil
+	}
+	md, ok := cm.md.Get(id)
+	if !ok {
+		return nil, errors.Wrapf(errNotFound, "%s not found", id)
+	}
+	return md, nil
+}
+
+func (cm *cacheManager) pruneOnce(ctx context.Context, ch chan client.UsageInfo, index int, opt client.PruneInfo) error {
+	vps, recordFilters, err := splitVariantFilters(opt.Filter)
+	if err != nil {
+		return err
+	}
+	for _, vp := range vps {
+		if err := cm.pruneVariants(ctx, ch, vp); err != nil {
+			return err
+		}
+	}
+	// variant filters only remove the variants of the matching records
+	if len(vps) > 0 && len(recordFilters) == 0 {
+		return nil
+	}
+	opt.Filter = recordFilters
+
+	filter, err := parseFilters(opt.Filter...)
 	if err != nil {
 		return errors.Wrapf(err, "failed to parse prune filters %v", opt.Filter)
 	}
@@ -635,10 +939,14 @@ func (cm *cacheManager) pruneOnce(ctx context.Context, ch chan client.UsageInfo,
 	return cm.prune(ctx, ch, pruneOpt{
 		filter:       filter,
 		all:          opt.All,
+		force:        opt.Force,
 		checkShared:  check,
 		keepDuration: opt.KeepDuration,
 		keepBytes:    opt.KeepBytes,
 		totalSize:    totalSize,
+		minHits:      opt.MinHits,
+		maxFreed:     opt.MaxFreed,
+		policy:       fmt.Sprintf("%d (all=%v filters=%v keepDuration=%v keepBytes=%d minHits=%d maxFreed=%d)", index, opt.All, opt.Filter, opt.KeepDuration, opt.KeepBytes, opt.MinHits, opt.MaxFreed),
 	})
 }
 
@@ -648,13 +956,17 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 	if opt.keepBytes != 0 && opt.totalSize < opt.keepBytes {
 		return nil
 	}
+	if opt.maxFreed != 0 && opt.freed >= opt.maxFreed {
+		return nil
+	}
 
 	cm.mu.Lock()
 
 	gcMode := opt.keepBytes != 0
-	cutOff := time.Now().Add(-opt.keepDuration)
+	now := time.Now()
+	cutOff := now.Add(-opt.keepDuration)
 
-	locked := map[*sync.Mutex]struct{}{}
+	locked := map[*recordMutex]struct{}{}
 
 	for _, cr := range cm.records {
 		if _, ok := locked[cr.mu]; ok {
@@ -691,16 +1003,48 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 				}
 			}
 
+			if !opt.force {
+				if pinned, _ := cr.pinned(); pinned {
+					cr.mu.Unlock()
+					continue
+				}
+			}
+
 			c := &client.UsageInfo{
 				ID:         cr.ID(),
 				Mutable:    cr.mutable,
 				RecordType: recordType,
 				Shared:     shared,
+				CreatedAt:  GetCreatedAt(cr.md),
+				Namespace:  GetNamespace(cr.md),
 			}
 
 			usageCount, lastUsedAt := getLastUsed(cr.md)
 			c.LastUsedAt = lastUsedAt
 			c.UsageCount = usageCount
+			c.UsageScore = getUsageScore(cr.md, now)
+
+			// records whose blob can't be checked are handled like records
+			// with content, the records collected so far are still locked
+			lazy, err := cr.isLazy(ctx)
+			if err != nil {
+				logrus.Warnf("failed to check if cache record %s is lazy: %v", cr.ID(), err)
+				lazy = false
+			}
+			c.Lazy = lazy
+
+			if opt.lazyTTL != 0 {
+				// records that are reused become lazy again on release, so the
+				// TTL starts at their last use
+				lazySince := c.CreatedAt
+				if lastUsedAt != nil && lastUsedAt.After(lazySince) {
+					lazySince = *lastUsedAt
+				}
+				if !lazy || lazySince.After(now.Add(-opt.lazyTTL)) {
+					cr.mu.Unlock()
+					continue
+				}
+			}
 
 			if opt.keepDuration != 0 {
 				if lastUsedAt != nil && lastUsedAt.After(cutOff) {
@@ -709,14 +1053,21 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 				}
 			}
 
+			if opt.minHits != 0 && getRecentUses(cr.md, now) >= opt.minHits {
+				cr.mu.Unlock()
+				continue
+			}
+
 			if opt.filter.Match(adaptUsageInfo(c)) {
 				toDelete = append(toDelete, &deleteRecord{
 					cacheRecord: cr,
 					lastUsedAt:  c.LastUsedAt,
-					usageCount:  c.UsageCount,
+					usageScore:  getUsageScore(cr.md, now),
+					size:        reclaimableSize(cr, lazy),
 				})
 				if !gcMode {
 					cr.dead = true
+					cr.updateUsage()
 
 					// mark metadata as deleted in case we crash before cleanup finished
 					if err := setDeleted(cr.md); err != nil {
@@ -733,13 +1084,18 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 		cr.mu.Unlock()
 	}
 
+	// an explicit prune that only needs to free some space removes the
+	// records freeing the most for their use first, GC policies remove the
+	// least recently used records
+	sortDeleteRecords(toDelete, opt.maxFreed != 0)
+
 	if gcMode && len(toDelete) > 0 {
-		sortDeleteRecords(toDelete)
 		var err error
 		for i, cr := range toDelete {
 			// only remove single record at a time
 			if i == 0 {
 				cr.dead = true
+				cr.updateUsage()
 				err = setDeleted(cr.md)
 			}
 			cr.mu.Unlock()
@@ -757,7 +1113,23 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 	}
 
 	var err error
-	for _, cr := range toDelete {
+	for i, cr := range toDelete {
+		// stop between records, the records that were not removed yet are
+		// kept
+		stop := ctx.Err()
+		if stop == nil && opt.maxFreed != 0 && opt.freed >= opt.maxFreed {
+			stop = errMaxFreed
+		}
+		if stop != nil {
+			if err1 := reviveRecords(toDelete[i:]); err1 != nil {
+				return err1
+			}
+			if stop == errMaxFreed {
+				return nil
+			}
+			return stop
+		}
+
 		cr.mu.Lock()
 
 		usageCount, lastUsedAt := getLastUsed(cr.md)
@@ -771,6 +1143,7 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 			Description: GetDescription(cr.md),
 			LastUsedAt:  lastUsedAt,
 			UsageCount:  usageCount,
+			UsageScore:  getUsageScore(cr.md, now),
 		}
 
 		if cr.parent != nil {
@@ -800,8 +1173,16 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 			err = err1
 		}
 
-		if err == nil && ch != nil {
-			ch <- c
+		if err == nil {
+			opt.freed += c.Size
+			logrus.Debugf("pruned cache record %s matching policy %s", c.ID, opt.policy)
+			if ch != nil {
+				// the receiver may be gone once the prune is canceled
+				select {
+				case ch <- c:
+				case <-ctx.Done():
+				}
+			}
 		}
 		cr.mu.Unlock()
 	}
@@ -854,16 +1235,26 @@ type cacheUsageInfo struct {
 	mutable     bool
 	createdAt   time.Time
 	usageCount  int
+	usageScore  float64
 	lastUsedAt  *time.Time
 	description string
 	doubleRef   bool
 	recordType  client.UsageRecordType
 	shared      bool
+	pinned      bool
+	pinReason   string
+	chainID     digest.Digest
+	blob        digest.Digest
+	mediaType   string
+	lazy        bool
+	blobSize    int64
+	buildID     string
+	namespace   string
 	parentChain []digest.Digest
 }
 
 func (cm *cacheManager) DiskUsage(ctx context.Context, opt client.DiskUsageInfo) ([]*client.UsageInfo, error) {
-	filter, err := filters.ParseAll(opt.Filter...)
+	filter, err := parseFilters(opt.Filter...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to parse diskusage filters %v", opt.Filter)
 	}
@@ -872,6 +1263,7 @@ func (cm *cacheManager) DiskUsage(ctx context.Context, opt client.DiskUsageInfo)
 
 	m := make(map[string]*cacheUsageInfo, len(cm.records))
 	rescan := make(map[string]struct{}, len(cm.records))
+	now := time.Now()
 
 	for id, cr := range cm.records {
 		cr.mu.Lock()
@@ -888,8 +1280,11 @@ func (cm *cacheManager) DiskUsage(ctx context.Context, opt client.DiskUsageInfo)
 			size:        getSize(cr.md),
 			createdAt:   GetCreatedAt(cr.md),
 			usageCount:  usageCount,
+			usageScore:  getUsageScore(cr.md, now),
 			lastUsedAt:  lastUsedAt,
 			description: GetDescription(cr.md),
+			buildID:     GetBuildID(cr.md),
+			namespace:   GetNamespace(cr.md),
 			doubleRef:   cr.equalImmutable != nil,
 			recordType:  GetRecordType(cr),
 			parentChain: cr.parentChain(),
@@ -897,11 +1292,30 @@ func (cm *cacheManager) DiskUsage(ctx context.Context, opt client.DiskUsageInfo)
 		if c.recordType == "" {
 			c.recordType = client.UsageRecordTypeRegular
 		}
+		c.pinned, c.pinReason = cr.pinned()
+		if blob := getBlob(cr.md); blob != "" {
+			c.chainID = digest.Digest(getChainID(cr.md))
+			c.blob = digest.Digest(blob)
+			c.mediaType = getMediaType(cr.md)
+			// like in prune, records whose blob can't be checked are
+			// reported as records with content
+			lazy, err := cr.isLazy(ctx)
+			if err != nil {
+				logrus.Warnf("failed to check if cache record %s is lazy: %v", cr.ID(), err)
+				lazy = false
+			}
+			c.lazy = lazy
+			if s := getBlobSize(cr.md); !lazy && s != sizeUnknown {
+				c.blobSize = s
+			}
+		}
 		if cr.parent != nil {
 			c.parent = cr.parent.ID()
 		}
 		if cr.mutable && c.refs > 0 {
-			c.size = 0 // size can not be determined because it is changing
+			// size can not be determined because it is changing, use the
+			// sampled size if the space is reserved
+			c.size, _ = cm.reservedSize(id)
 		}
 		m[id] = c
 		rescan[id] = struct{}{}
@@ -942,8 +1356,18 @@ func (cm *cacheManager) DiskUsage(ctx context.Context, opt client.DiskUsageInfo)
 			Description: cr.description,
 			LastUsedAt:  cr.lastUsedAt,
 			UsageCount:  cr.usageCount,
+			UsageScore:  cr.usageScore,
 			RecordType:  cr.recordType,
 			Shared:      cr.shared,
+			Pinned:      cr.pinned,
+			PinReason:   cr.pinReason,
+			ChainID:     cr.chainID,
+			Blob:        cr.blob,
+			MediaType:   cr.mediaType,
+			Lazy:        cr.lazy,
+			BlobSize:    cr.blobSize,
+			BuildID:     cr.buildID,
+			Namespace:   cr.namespace,
 		}
 		if filter.Match(adaptUsageInfo(c)) {
 			du = append(du, c)
@@ -1105,6 +1529,19 @@ func adaptUsageInfo(info *client.UsageInfo) filters.Adaptor {
 			return "", info.Shared
 		case "private":
 			return "", !info.Shared
+		case "lazy":
+			return "", info.Lazy
+		case "buildid":
+			return info.BuildID, info.BuildID != ""
+		case "namespace":
+			return info.Namespace, info.Namespace != ""
+		case "createdat":
+			return info.CreatedAt.Format(time.RFC3339Nano), !info.CreatedAt.IsZero()
+		case "lastusedat":
+			if info.LastUsedAt == nil {
+				return "", false
+			}
+			return info.LastUsedAt.Format(time.RFC3339Nano), true
 		}
 
 		// TODO: add int/datetime/bytes support for more fields
@@ -1116,21 +1553,80 @@ func adaptUsageInfo(info *client.UsageInfo) filters.Adaptor {
 type pruneOpt struct {
 	filter       filters.Filter
 	all          bool
+	force        bool
 	checkShared  ExternalRefChecker
 	keepDuration time.Duration
 	keepBytes    int64
 	totalSize    int64
+	// minHits keeps records used at least this many times in the last
+	// usageWindow
+	minHits int
+	// maxFreed stops the prune once freed reaches it
+	maxFreed int64
+	freed    int64
+	// lazyTTL only matches lazy records that have not been used for longer
+	// than it
+	lazyTTL time.Duration
+	// policy describes the prune options for logging
+	policy string
 }
 
 type deleteRecord struct {
 	*cacheRecord
-	lastUsedAt      *time.Time
-	usageCount      int
+	lastUsedAt *time.Time
+	// usageScore is the decayed number of uses of the record
+	usageScore      float64
 	lastUsedAtIndex int
-	usageCountIndex int
+	usageScoreIndex int
+	// size is the estimated number of bytes freed by removing the record
+	size int64
+	// cost grows with how recently and how often the record was used
+	cost float64
 }
 
-func sortDeleteRecords(toDelete []*deleteRecord) {
+var errMaxFreed = errors.New("prune freed enough space")
+
+// reclaimableSize estimates the bytes freed by removing cr without
+// calculating the size of snapshots that have not been measured yet. Lazy
+// records only hold metadata. Requires cr.mu.
+func reclaimableSize(cr *cacheRecord, lazy bool) int64 {
+	if lazy {
+		return 0
+	}
+	if s := getSize(cr.md); s != sizeUnknown {
+		return s
+	}
+	if cr.equalImmutable != nil {
+		if s := getSize(cr.equalImmutable.md); s != sizeUnknown {
+			return s
+		}
+	}
+	if s := getBlobSize(cr.md); s != sizeUnknown {
+		return s
+	}
+	return 0
+}
+
+// reviveRecords unmarks records that were selected for removal by a prune
+// that stopped early.
+func reviveRecords(toDelete []*deleteRecord) error {
+	var err error
+	for _, cr := range toDelete {
+		cr.mu.Lock()
+		cr.dead = false
+		cr.updateUsage()
+		if err1 := unsetDeleted(cr.md); err == nil {
+			err = err1
+		}
+		cr.mu.Unlock()
+	}
+	return err
+}
+
+// sortDeleteRecords sorts the records that were used least recently and
+// have the lowest usage score first. With bySize the size of a record is divided by that
+// cost, so large records go before more recently used small ones.
+func sortDeleteRecords(toDelete []*deleteRecord, bySize bool) {
 	sort.Slice(toDelete, func(i, j int) bool {
 		if toDelete[i].lastUsedAt == nil {
 			return true
@@ -1152,24 +1648,45 @@ func sortDeleteRecords(toDelete []*deleteRecord) {
 	}
 
 	sort.Slice(toDelete, func(i, j int) bool {
-		return toDelete[i].usageCount < toDelete[j].usageCount
+		return toDelete[i].usageScore < toDelete[j].usageScore
 	})
 
-	maxUsageCountIndex := 0
-	var count int
+	maxUsageScoreIndex := 0
+	var score float64
 	for _, v := range toDelete {
-		if v.usageCount != count {
-			count = v.usageCount
-			maxUsageCountIndex++
+		if v.usageScore != score {
+			score = v.usageScore
+			maxUsageScoreIndex++
 		}
-		v.usageCountIndex = maxUsageCountIndex
+		v.usageScoreIndex = maxUsageScoreIndex
 	}
 
-	sort.Slice(toDelete, func(i, j int) bool {
-		return float64(toDelete[i].lastUsedAtIndex)/float64(maxLastUsedIndex)+
-			float64(toDelete[i].usageCountIndex)/float64(maxUsageCountIndex) <
-			float64(toDelete[j].lastUsedAtIndex)/float64(maxLastUsedIndex)+
-				float64(toDelete[j].usageCountIndex)/float64(maxUsageCountIndex)
+	for _, v := range toDelete {
+		v.cost = 1
+		if maxLastUsedIndex > 0 {
+			v.cost += float64(v.lastUsedAtIndex) / float64(maxLastUsedIndex)
+		}
+		if maxUsageScoreIndex > 0 {
+			v.cost += float64(v.usageScoreIndex) / float64(maxUsageScoreIndex)
+		}
+	}
+
+	if !bySize {
+		sort.SliceStable(toDelete, func(i, j int) bool {
+			return toDelete[i].cost < toDelete[j].cost
+		})
+		return
+	}
+
+	// records freeing the most space for the least recent and frequent use
+	// go first
+	sort.SliceStable(toDelete, func(i, j int) bool {
+		ri := float64(toDelete[i].size) / toDelete[i].cost
+		rj := float64(toDelete[j].size) / toDelete[j].cost
+		if ri != rj {
+			return ri > rj
+		}
+		return toDelete[i].cost < toDelete[j].cost
 	})
 }
 
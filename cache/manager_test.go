@@ -5,43 +5,75 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/diff/apply"
+	"github.com/containerd/containerd/diff/walking"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/leases"
 	ctdmetadata "github.com/containerd/containerd/metadata"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/native"
+	"github.com/docker/docker/pkg/idtools"
 	"github.com/moby/buildkit/cache/metadata"
 	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/snapshot"
 	containerdsnapshot "github.com/moby/buildkit/snapshot/containerd"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/leaseutil"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sync/errgroup"
 )
 
 type cmOpt struct {
 	snapshotterName string
 	snapshotter     snapshots.Snapshotter
 	tmpdir          string
+	diskQuota       int64
+	reservationSize int64
+	// extraSnapshotters are registered with the metadata db next to
+	// snapshotter
+	extraSnapshotters map[string]snapshots.Snapshotter
+	// wrapSnapshotter wraps the snapshotter used by the manager
+	wrapSnapshotter func(snapshot.Snapshotter) snapshot.Snapshotter
+	// wrapContentStore wraps the content store used by the manager
+	wrapContentStore func(content.Store) content.Store
+	diffPlans        bool
+	identityMapping  *idtools.IdentityMapping
+	sharedNamespaces []string
+	noSpaceReclaim   int64
 }
 
 type cmOut struct {
-	manager Manager
-	lm      leases.Manager
-	cs      content.Store
+	manager     Manager
+	lm          leases.Manager
+	cs          content.Store
+	snapshotter snapshots.Snapshotter
+	mdb         *ctdmetadata.DB
 }
 
 func newCacheManager(ctx context.Context, opt cmOpt) (co *cmOut, cleanup func() error, err error) {
@@ -109,30 +141,52 @@ func newCacheManager(ctx context.Context, opt cmOpt) (co *cmOut, cleanup func()
 		return db.Close()
 	})
 
-	mdb := ctdmetadata.NewDB(db, store, map[string]snapshots.Snapshotter{
+	sns := map[string]snapshots.Snapshotter{
 		opt.snapshotterName: opt.snapshotter,
-	})
+	}
+	for name, sn := range opt.extraSnapshotters {
+		sns[name] = sn
+	}
+	mdb := ctdmetadata.NewDB(db, store, sns)
 	if err := mdb.Init(context.TODO()); err != nil {
 		return nil, nil, err
 	}
 
 	lm := ctdmetadata.NewLeaseManager(mdb)
 
+	sn := snapshot.FromContainerdSnapshotter(opt.snapshotterName, containerdsnapshot.NSSnapshotter(ns, mdb.Snapshotter(opt.snapshotterName)), opt.identityMapping)
+	if opt.wrapSnapshotter != nil {
+		sn = opt.wrapSnapshotter(sn)
+	}
+
+	var cs content.Store = mdb.ContentStore()
+	if opt.wrapContentStore != nil {
+		cs = opt.wrapContentStore(cs)
+	}
+
 	cm, err := NewManager(ManagerOpt{
-		Snapshotter:    snapshot.FromContainerdSnapshotter(opt.snapshotterName, containerdsnapshot.NSSnapshotter(ns, mdb.Snapshotter(opt.snapshotterName)), nil),
-		MetadataStore:  md,
-		ContentStore:   mdb.ContentStore(),
-		LeaseManager:   leaseutil.WithNamespace(lm, ns),
-		GarbageCollect: mdb.GarbageCollect,
-		Applier:        apply.NewFileSystemApplier(mdb.ContentStore()),
+		Snapshotter:        sn,
+		MetadataStore:      md,
+		ContentStore:       cs,
+		LeaseManager:       leaseutil.WithNamespace(lm, ns),
+		GarbageCollect:     mdb.GarbageCollect,
+		Applier:            apply.NewFileSystemApplier(mdb.ContentStore()),
+		Differ:             walking.NewWalkingDiff(mdb.ContentStore()),
+		DiskQuota:          opt.diskQuota,
+		ReservationSize:    opt.reservationSize,
+		DiffPlans:          opt.diffPlans,
+		SharedNamespaces:   opt.sharedNamespaces,
+		NoSpaceReclaimSize: opt.noSpaceReclaim,
 	})
 	if err != nil {
 		return nil, nil, err
 	}
 	return &cmOut{
-		manager: cm,
-		lm:      lm,
-		cs:      mdb.ContentStore(),
+		manager:     cm,
+		lm:          lm,
+		cs:          mdb.ContentStore(),
+		snapshotter: mdb.Snapshotter(opt.snapshotterName),
+		mdb:         mdb,
 	}, cleanup, nil
 }
 
@@ -409,6 +463,69 @@ func TestSnapshotExtract(t *testing.T) {
 	checkNumBlobs(ctx, t, co.cs, 0)
 }
 
+func TestDecompressBlobAbort(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	// the ingest is aborted if the build is canceled while decompressing
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, err = decompressBlob(cctx, &cancelingStore{Store: co.cs, cancel: cancel}, desc)
+	require.Error(t, err)
+	statuses, err := co.cs.ListStatuses(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(statuses))
+
+	desc.Annotations["containerd.io/uncompressed"] = digest.FromBytes([]byte("foo")).String()
+	_, err = decompressBlob(ctx, co.cs, desc)
+	require.Error(t, err)
+
+	statuses, err = co.cs.ListStatuses(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(statuses))
+}
+
+// cancelingStore cancels the context of its writers on the first write.
+// Like the containerd client store, it fails on canceled contexts.
+type cancelingStore struct {
+	content.Store
+	cancel func()
+}
+
+func (s *cancelingStore) Abort(ctx context.Context, ref string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Abort(ctx, ref)
+}
+
+func (s *cancelingStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	w, err := s.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &cancelingWriter{Writer: w, cancel: s.cancel}, nil
+}
+
+type cancelingWriter struct {
+	content.Writer
+	cancel func()
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return 0, context.Canceled
+}
+
 func TestExtractOnMutable(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
@@ -688,221 +805,3216 @@ func TestSetBlob(t *testing.T) {
 	//snap.SetBlob()
 }
 
-func TestPrune(t *testing.T) {
+func TestCompressBlobLevel(t *testing.T) {
 	t.Parallel()
 	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
 
-	tmpdir, err := ioutil.TempDir("", "cachemanager")
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
 	require.NoError(t, err)
-	defer os.RemoveAll(tmpdir)
+	defer cleanup()
 
-	snapshotter, err := native.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(buf, "line %d of a compressible layer %d\n", i, i*i)
+	}
+	dt := buf.Bytes()
+	desc := ocispec.Descriptor{
+		Digest:    digest.FromBytes(dt),
+		MediaType: ocispec.MediaTypeImageLayer,
+		Size:      int64(len(dt)),
+	}
+	err = content.WriteBlob(ctx, co.cs, "uncompressed", bytes.NewReader(dt), desc)
+	require.NoError(t, err)
+
+	comp := compression.New(compression.Gzip)
+	fast, err := compressBlob(ctx, co.cs, desc, ocispec.MediaTypeImageLayerGzip, comp.SetLevel(gzip.BestSpeed), "fast")
+	require.NoError(t, err)
+	best, err := compressBlob(ctx, co.cs, desc, ocispec.MediaTypeImageLayerGzip, comp.SetLevel(gzip.BestCompression), "best")
 	require.NoError(t, err)
 
+	require.NotEqual(t, fast.Digest, best.Digest)
+	require.True(t, best.Size < fast.Size)
+
+	for _, d := range []ocispec.Descriptor{fast, best} {
+		require.Equal(t, ocispec.MediaTypeImageLayerGzip, d.MediaType)
+		info, err := co.cs.Info(ctx, d.Digest)
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest.String(), info.Labels["containerd.io/uncompressed"])
+
+		ra, err := co.cs.ReaderAt(ctx, d)
+		require.NoError(t, err)
+		gz, err := gzip.NewReader(content.NewReader(ra))
+		require.NoError(t, err)
+		out, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+		require.Equal(t, dt, out)
+		ra.Close()
+	}
+}
+
+func TestCompressBlobStreaming(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	var decompressed int64
 	co, cleanup, err := newCacheManager(ctx, cmOpt{
-		snapshotter:     snapshotter,
-		snapshotterName: "native",
+		wrapContentStore: func(cs content.Store) content.Store {
+			return &writerCountingStore{Store: cs, prefix: "decompress-", count: &decompressed}
+		},
 	})
 	require.NoError(t, err)
-
 	defer cleanup()
-	cm := co.manager
 
-	active, err := cm.New(ctx, nil, nil)
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
 	require.NoError(t, err)
+	defer done(context.TODO())
 
-	snap, err := active.Commit(ctx)
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
 	require.NoError(t, err)
-
-	active, err = cm.New(ctx, snap, nil, CachePolicyRetain)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
 	require.NoError(t, err)
+	diffID := desc.Annotations["containerd.io/uncompressed"]
 
-	snap2, err := active.Commit(ctx)
+	zst, err := compressBlob(ctx, co.cs, desc, ocispec.MediaTypeImageLayer+"+zstd", compression.New(compression.Zstd), "zstd")
 	require.NoError(t, err)
+	require.Equal(t, diffID, zst.Annotations["containerd.io/uncompressed"])
+	info, err := co.cs.Info(ctx, zst.Digest)
+	require.NoError(t, err)
+	require.Equal(t, diffID, info.Labels["containerd.io/uncompressed"])
+	dgst, err := computeDiffID(ctx, co.cs, zst)
+	require.NoError(t, err)
+	require.Equal(t, diffID, dgst.String())
 
-	checkDiskUsage(ctx, t, cm, 2, 0)
+	// the uncompressed data is never written to the content store
+	require.Equal(t, int64(0), atomic.LoadInt64(&decompressed))
+	_, err = co.cs.Info(ctx, digest.Digest(diffID))
+	require.True(t, errors.Is(err, errdefs.ErrNotFound))
 
-	dirs, err := ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
+	// a blob that doesn't match its diffID leaves no ingest behind
+	desc.Annotations["containerd.io/uncompressed"] = digest.FromString("foo").String()
+	_, err = compressBlob(ctx, co.cs, desc, ocispec.MediaTypeImageLayerGzip, compression.New(compression.Gzip).SetLevel(gzip.BestCompression), "mismatch")
+	require.Error(t, err)
+	statuses, err := co.cs.ListStatuses(ctx)
 	require.NoError(t, err)
-	require.Equal(t, 2, len(dirs))
+	require.Equal(t, 0, len(statuses))
+}
 
-	// prune with keeping refs does nothing
-	buf := pruneResultBuffer()
-	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
-	buf.close()
-	require.NoError(t, err)
+func TestGetRemotes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
 
-	checkDiskUsage(ctx, t, cm, 2, 0)
-	require.Equal(t, len(buf.all), 0)
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
 
-	dirs, err = ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
 	require.NoError(t, err)
-	require.Equal(t, 2, len(dirs))
+	defer cleanup()
 
-	err = snap2.Release(ctx)
-	require.NoError(t, err)
+	cm := co.manager
 
-	checkDiskUsage(ctx, t, cm, 1, 1)
+	var parent ImmutableRef
+	for i := 0; i < 2; i++ {
+		active, err := cm.New(ctx, parent, nil)
+		require.NoError(t, err)
+		m, err := active.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(mounts[0].Source, fmt.Sprintf("file%d", i)), []byte("data"), 0600)
+		require.NoError(t, err)
+		require.NoError(t, release())
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		if parent != nil {
+			require.NoError(t, parent.Release(ctx))
+		}
+		parent = snap
+	}
+	ref := parent
+	defer ref.Release(context.TODO())
 
-	// prune with keeping single refs deletes one
-	buf = pruneResultBuffer()
-	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
-	buf.close()
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
 	require.NoError(t, err)
+	defer done(context.TODO())
 
-	checkDiskUsage(ctx, t, cm, 1, 0)
-	require.Equal(t, len(buf.all), 1)
+	configs := []compression.Config{
+		compression.New(compression.Gzip),
+		compression.New(compression.Uncompressed),
+		compression.New(compression.Zstd),
+	}
 
-	dirs, err = ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
-	require.NoError(t, err)
-	require.Equal(t, 1, len(dirs))
+	// without all the existing blobs are returned, other configs would be
+	// ignored
+	_, err = ref.GetRemotes(ctx, true, configs, false, nil)
+	require.Error(t, err)
+	_, err = ref.GetRemotes(ctx, true, []compression.Config{compression.New(compression.Bzip2)}, true, nil)
+	require.Error(t, err)
 
-	err = snap.Release(ctx)
-	require.NoError(t, err)
+	remotes, err := ref.GetRemotes(ctx, true, configs, true, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(remotes))
+	for i, desc := range remotes[1].Descriptors {
+		gz := remotes[0].Descriptors[i]
+		require.Equal(t, ocispec.MediaTypeImageLayerGzip, gz.MediaType)
+		require.Equal(t, ocispec.MediaTypeImageLayer, desc.MediaType)
+		require.Equal(t, gz.Annotations["containerd.io/uncompressed"], desc.Digest.String())
+		require.Equal(t, gz.Annotations["buildkit/createdat"], desc.Annotations["buildkit/createdat"])
+
+		dt, err := content.ReadBlob(ctx, remotes[1].Provider, desc)
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest, digest.FromBytes(dt))
+
+		info, err := co.cs.Info(ctx, gz.Digest)
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest.String(), info.Labels[labelVariantPrefix+"uncompressed"])
+
+		zst := remotes[2].Descriptors[i]
+		require.Equal(t, ocispec.MediaTypeImageLayer+"+zstd", zst.MediaType)
+		require.Equal(t, desc.Digest.String(), zst.Annotations["containerd.io/uncompressed"])
+		diffID, err := computeDiffID(ctx, co.cs, zst)
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest, diffID)
+	}
 
-	active, err = cm.New(ctx, snap, nil, CachePolicyRetain)
+	// variants of Docker layers have Docker media types, there is none for
+	// zstd
+	gz := remotes[0].Descriptors[0]
+	gz.MediaType = images.MediaTypeDockerSchema2LayerGzip
+	variant, err := cm.(*cacheManager).getBlobVariant(ctx, gz, configs[1])
 	require.NoError(t, err)
+	require.Equal(t, images.MediaTypeDockerSchema2Layer, variant.MediaType)
+	require.Equal(t, remotes[1].Descriptors[0].Digest, variant.Digest)
+	_, err = cm.(*cacheManager).getBlobVariant(ctx, gz, configs[2])
+	require.Error(t, err)
 
-	snap2, err = active.Commit(ctx)
+	// the media type family of the config overrides the one of the blobs
+	docker, err := ref.GetRemotes(ctx, false, []compression.Config{configs[0].SetMediaTypes(compression.DockerMediaTypes)}, false, nil)
 	require.NoError(t, err)
-
-	err = snap.Release(ctx)
+	for i, desc := range docker[0].Descriptors {
+		require.Equal(t, images.MediaTypeDockerSchema2LayerGzip, desc.MediaType)
+		require.Equal(t, remotes[0].Descriptors[i].Digest, desc.Digest)
+	}
+	variant, err = cm.(*cacheManager).getBlobVariant(ctx, remotes[0].Descriptors[0], configs[1].SetMediaTypes(compression.DockerMediaTypes))
 	require.NoError(t, err)
+	require.Equal(t, images.MediaTypeDockerSchema2Layer, variant.MediaType)
+	_, err = ref.GetRemotes(ctx, false, []compression.Config{configs[2].SetMediaTypes(compression.DockerMediaTypes)}, true, nil)
+	require.Error(t, err)
 
-	checkDiskUsage(ctx, t, cm, 2, 0)
+	// variants are reused
+	again, err := ref.GetRemotes(ctx, false, configs[1:], true, nil)
+	require.NoError(t, err)
+	require.Equal(t, remotes[1].Descriptors, again[0].Descriptors)
 
-	// prune with parent released does nothing
-	buf = pruneResultBuffer()
-	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
-	buf.close()
+	remote, err := ref.GetRemote(ctx, false, configs[0], nil)
 	require.NoError(t, err)
+	require.Equal(t, remotes[0].Descriptors, remote.Descriptors)
+}
 
-	checkDiskUsage(ctx, t, cm, 2, 0)
-	require.Equal(t, len(buf.all), 0)
+func TestGetRemotesZstdFirst(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
 
-	// releasing last reference
-	err = snap2.Release(ctx)
-	require.NoError(t, err)
-	checkDiskUsage(ctx, t, cm, 0, 2)
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
 
-	buf = pruneResultBuffer()
-	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
-	buf.close()
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
 	require.NoError(t, err)
+	defer cleanup()
 
-	checkDiskUsage(ctx, t, cm, 0, 0)
-	require.Equal(t, len(buf.all), 2)
+	cm := co.manager
 
-	dirs, err = ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
 	require.NoError(t, err)
-	require.Equal(t, 0, len(dirs))
+	defer done(context.TODO())
+
+	for _, all := range []bool{false, true} {
+		var parent ImmutableRef
+		for i := 0; i < 2; i++ {
+			active, err := cm.New(ctx, parent, nil)
+			require.NoError(t, err)
+			m, err := active.Mount(ctx, false, nil)
+			require.NoError(t, err)
+			mounts, release, err := m.Mount()
+			require.NoError(t, err)
+			err = ioutil.WriteFile(filepath.Join(mounts[0].Source, fmt.Sprintf("file%d", i)), []byte(fmt.Sprintf("%v", all)), 0600)
+			require.NoError(t, err)
+			require.NoError(t, release())
+			snap, err := active.Commit(ctx)
+			require.NoError(t, err)
+			if parent != nil {
+				require.NoError(t, parent.Release(ctx))
+			}
+			parent = snap
+		}
+		ref := parent
+
+		// the layers have no blobs yet, they are created with gzip and
+		// converted to zstd
+		remotes, err := ref.GetRemotes(ctx, true, []compression.Config{compression.New(compression.Zstd)}, all, nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(remotes))
+		require.Equal(t, 2, len(remotes[0].Descriptors))
+		for _, desc := range remotes[0].Descriptors {
+			require.Equal(t, ocispec.MediaTypeImageLayer+"+zstd", desc.MediaType)
+			diffID, err := computeDiffID(ctx, co.cs, desc)
+			require.NoError(t, err)
+			require.Equal(t, desc.Annotations["containerd.io/uncompressed"], diffID.String())
+		}
+		require.Equal(t, ocispec.MediaTypeImageLayerGzip, getMediaType(ref.(*immutableRef).md))
+
+		require.NoError(t, ref.Release(ctx))
+	}
 }
 
-func TestLazyCommit(t *testing.T) {
-	t.Parallel()
+func TestGetRemotesLevel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
 
+	t.Parallel()
 	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
 
-	tmpdir, err := ioutil.TempDir("", "cachemanager")
-	require.NoError(t, err)
-	defer os.RemoveAll(tmpdir)
-
-	snapshotter, err := native.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
 	require.NoError(t, err)
+	defer cleanup()
 
-	co, cleanup, err := newCacheManager(ctx, cmOpt{
-		tmpdir:          tmpdir,
-		snapshotter:     snapshotter,
-		snapshotterName: "native",
-	})
-	require.NoError(t, err)
 	cm := co.manager
 
-	active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	active, err := cm.New(ctx, nil, nil)
 	require.NoError(t, err)
-
-	// after commit mutable is locked
-	snap, err := active.Commit(ctx)
+	m, err := active.Mount(ctx, false, nil)
 	require.NoError(t, err)
-
-	_, err = cm.GetMutable(ctx, active.ID())
-	require.Error(t, err)
-	require.Equal(t, true, errors.Is(err, ErrLocked))
-
-	// immutable refs still work
-	snap2, err := cm.Get(ctx, snap.ID())
+	mounts, release, err := m.Mount()
 	require.NoError(t, err)
-	require.Equal(t, snap.ID(), snap2.ID())
-
-	err = snap.Release(ctx)
+	err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "file"), bytes.Repeat([]byte("compressible data "), 1<<12), 0600)
 	require.NoError(t, err)
-
-	err = snap2.Release(ctx)
+	require.NoError(t, release())
+	ref, err := active.Commit(ctx)
 	require.NoError(t, err)
+	defer ref.Release(context.TODO())
 
-	// immutable work after final release as well
-	snap, err = cm.Get(ctx, snap.ID())
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
 	require.NoError(t, err)
-	require.Equal(t, snap.ID(), snap2.ID())
-
-	// active can't be get while immutable is held
-	_, err = cm.GetMutable(ctx, active.ID())
-	require.Error(t, err)
-	require.Equal(t, true, errors.Is(err, ErrLocked))
+	defer done(context.TODO())
 
-	err = snap.Release(ctx)
-	require.NoError(t, err)
+	configs := []compression.Config{
+		compression.New(compression.Gzip).SetLevel(gzip.HuffmanOnly),
+		compression.New(compression.Gzip).SetLevel(gzip.BestCompression),
+		compression.New(compression.Gzip),
+	}
 
-	// after release mutable becomes available again
-	active2, err := cm.GetMutable(ctx, active.ID())
+	// the blob is created with the level of the first config
+	remotes, err := ref.GetRemotes(ctx, true, configs[:1], false, nil)
 	require.NoError(t, err)
-	require.Equal(t, active2.ID(), active.ID())
-
-	// because ref was took mutable old immutable are cleared
-	_, err = cm.Get(ctx, snap.ID())
-	require.Error(t, err)
-	require.Equal(t, true, errors.Is(err, errNotFound))
+	huffman := remotes[0].Descriptors[0]
+	require.Equal(t, digest.Digest(getBlob(ref.(*immutableRef).md)), huffman.Digest)
 
-	snap, err = active2.Commit(ctx)
+	// variants with other levels are not mixed up
+	remotes, err = ref.GetRemotes(ctx, false, configs, true, nil)
 	require.NoError(t, err)
+	require.Equal(t, huffman.Digest, remotes[0].Descriptors[0].Digest)
+	best := remotes[1].Descriptors[0]
+	require.NotEqual(t, huffman.Digest, best.Digest)
+	require.True(t, best.Size < huffman.Size)
+	// any gzip blob is used without a level
+	require.Equal(t, huffman.Digest, remotes[2].Descriptors[0].Digest)
 
-	// this time finalize commit
-	err = snap.Finalize(ctx, true)
+	info, err := co.cs.Info(ctx, huffman.Digest)
 	require.NoError(t, err)
+	require.Equal(t, best.Digest.String(), info.Labels[labelVariantPrefix+"gzip.level9"])
+	_, ok := info.Labels[labelVariantPrefix+"gzip"]
+	require.False(t, ok)
 
-	err = snap.Release(ctx)
+	again, err := ref.GetRemotes(ctx, false, configs[1:2], true, nil)
 	require.NoError(t, err)
+	require.Equal(t, best.Digest, again[0].Descriptors[0].Digest)
+}
 
-	// mutable is gone after finalize
-	_, err = cm.GetMutable(ctx, active2.ID())
-	require.Error(t, err)
-	require.Equal(t, true, errors.Is(err, errNotFound))
+// TestGetRemotesPassthrough checks that the blob of a pulled layer is
+// returned without reading it when its compression is requested.
+func TestGetRemotesPassthrough(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
 
-	// immutable still works
-	snap2, err = cm.Get(ctx, snap.ID())
+	var reads int64
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		wrapContentStore: func(cs content.Store) content.Store {
+			return &readCountingStore{Store: cs, count: &reads}
+		},
+	})
 	require.NoError(t, err)
-	require.Equal(t, snap.ID(), snap2.ID())
+	defer cleanup()
 
-	err = snap2.Release(ctx)
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
 	require.NoError(t, err)
+	defer done(context.TODO())
 
-	// test restarting after commit
-	active, err = cm.New(ctx, nil, nil, CachePolicyRetain)
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
 	require.NoError(t, err)
-
-	// after commit mutable is locked
-	snap, err = active.Commit(ctx)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
 	require.NoError(t, err)
 
-	err = cm.Close()
+	ref, err := co.manager.GetByBlob(ctx, desc, nil)
 	require.NoError(t, err)
+	defer ref.Release(context.TODO())
 
-	cleanup()
+	atomic.StoreInt64(&reads, 0)
+	for _, all := range []bool{false, true} {
+		remotes, err := ref.GetRemotes(ctx, false, []compression.Config{compression.New(compression.Gzip)}, all, nil)
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest, remotes[0].Descriptors[0].Digest)
+		require.Equal(t, desc.Annotations["containerd.io/uncompressed"], remotes[0].Descriptors[0].Annotations["containerd.io/uncompressed"])
+	}
+	require.Equal(t, int64(0), atomic.LoadInt64(&reads))
+}
 
-	// we can't close snapshotter and open it twice (especially, its internal bbolt store)
-	co, cleanup, err = newCacheManager(ctx, cmOpt{
-		tmpdir:          tmpdir,
-		snapshotter:     snapshotter,
+type readCountingStore struct {
+	content.Store
+	count *int64
+}
+
+func (s *readCountingStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	atomic.AddInt64(s.count, 1)
+	return s.Store.ReaderAt(ctx, desc)
+}
+
+func TestGetRemotesIfSmaller(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil)
+	require.NoError(t, err)
+	m, err := active.Mount(ctx, false, nil)
+	require.NoError(t, err)
+	mounts, release, err := m.Mount()
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "file"), bytes.Repeat([]byte("compressible data "), 1<<12), 0600)
+	require.NoError(t, err)
+	require.NoError(t, release())
+	ref, err := active.Commit(ctx)
+	require.NoError(t, err)
+	defer ref.Release(context.TODO())
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	remotes, err := ref.GetRemotes(ctx, true, []compression.Config{compression.New(compression.Gzip)}, false, nil)
+	require.NoError(t, err)
+	blob := remotes[0].Descriptors[0]
+
+	// the uncompressed variant is larger, the blob is kept
+	ifSmaller := compression.New(compression.Uncompressed).SetIfSmaller()
+	for i := 0; i < 2; i++ {
+		remotes, err = ref.GetRemotes(ctx, false, []compression.Config{ifSmaller}, true, nil)
+		require.NoError(t, err)
+		require.Equal(t, blob.Digest, remotes[0].Descriptors[0].Digest)
+		require.Equal(t, blob.MediaType, remotes[0].Descriptors[0].MediaType)
+		require.Equal(t, blob.Annotations["containerd.io/uncompressed"], remotes[0].Descriptors[0].Annotations["containerd.io/uncompressed"])
+	}
+
+	info, err := co.cs.Info(ctx, blob.Digest)
+	require.NoError(t, err)
+	require.Equal(t, blob.Digest.String(), info.Labels[labelVariantPrefix+"uncompressed.if-smaller"])
+
+	// without if-smaller the choice isn't reused
+	remotes, err = ref.GetRemotes(ctx, false, []compression.Config{compression.New(compression.Uncompressed)}, true, nil)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageLayer, remotes[0].Descriptors[0].MediaType)
+	require.True(t, remotes[0].Descriptors[0].Size > blob.Size)
+
+	// the smaller variant is used
+	uncompressed := remotes[0].Descriptors[0]
+	gzipped, err := cm.(*cacheManager).getBlobVariant(ctx, uncompressed, compression.New(compression.Gzip).SetIfSmaller())
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, gzipped.MediaType)
+	require.True(t, gzipped.Size < uncompressed.Size)
+}
+
+func TestConvertRemote(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	buf := contentutil.NewBuffer()
+	err = content.WriteBlob(ctx, buf, desc.Digest.String(), bytes.NewReader(b), desc)
+	require.NoError(t, err)
+	provider := &countingProvider{Provider: buf}
+	r := &solver.Remote{Descriptors: []ocispec.Descriptor{desc}, Provider: provider}
+
+	zstdConfig := compression.New(compression.Zstd)
+	_, err = cm.ConvertRemote(ctx, r, zstdConfig)
+	require.Error(t, err)
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	converted, err := cm.ConvertRemote(ctx, r, zstdConfig)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(converted.Descriptors))
+	zdesc := converted.Descriptors[0]
+	require.Equal(t, ocispec.MediaTypeImageLayer+"+zstd", zdesc.MediaType)
+	require.NotEqual(t, desc.Digest, zdesc.Digest)
+	require.Equal(t, desc.Annotations["containerd.io/uncompressed"], zdesc.Annotations["containerd.io/uncompressed"])
+	_, err = content.ReadBlob(ctx, converted.Provider, zdesc)
+	require.NoError(t, err)
+	diffID, err := computeDiffID(ctx, co.cs, zdesc)
+	require.NoError(t, err)
+	require.Equal(t, desc.Annotations["containerd.io/uncompressed"], diffID.String())
+
+	// the variant of the fetched blob is reused
+	again, err := cm.ConvertRemote(ctx, r, zstdConfig)
+	require.NoError(t, err)
+	require.Equal(t, zdesc.Digest, again.Descriptors[0].Digest)
+	info, err := co.cs.Info(ctx, desc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, zdesc.Digest.String(), info.Labels[labelVariantPrefix+"zstd"])
+
+	// layers with the requested compression are passed through unread
+	reads := atomic.LoadInt32(&provider.count)
+	zprovider := &countingProvider{Provider: converted.Provider}
+	same, err := cm.ConvertRemote(ctx, &solver.Remote{Descriptors: converted.Descriptors, Provider: zprovider}, zstdConfig)
+	require.NoError(t, err)
+	require.Equal(t, converted.Descriptors, same.Descriptors)
+	require.Equal(t, int32(0), atomic.LoadInt32(&zprovider.count))
+	require.Equal(t, reads, atomic.LoadInt32(&provider.count))
+
+	uncompressed, err := cm.ConvertRemote(ctx, converted, compression.New(compression.Uncompressed))
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageLayer, uncompressed.Descriptors[0].MediaType)
+	require.Equal(t, desc.Annotations["containerd.io/uncompressed"], uncompressed.Descriptors[0].Digest.String())
+}
+
+func TestGetRemotesVariantsKept(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil)
+	require.NoError(t, err)
+	ref, err := active.Commit(ctx)
+	require.NoError(t, err)
+
+	lctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	remotes, err := ref.GetRemotes(lctx, true, []compression.Config{compression.New(compression.Zstd)}, true, nil)
+	require.NoError(t, err)
+	variant := remotes[0].Descriptors[0]
+	require.NoError(t, done(ctx))
+
+	// the variant is kept by the record once the export is done
+	_, err = cm.(*cacheManager).GarbageCollect(ctx)
+	require.NoError(t, err)
+	_, err = co.cs.Info(ctx, variant.Digest)
+	require.NoError(t, err)
+
+	// and removed with it
+	require.NoError(t, ref.Release(ctx))
+	buf := pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{All: true})
+	buf.close()
+	require.NoError(t, err)
+	_, err = co.cs.Info(ctx, variant.Digest)
+	require.True(t, errors.Is(err, errdefs.ErrNotFound))
+}
+
+func TestKeepUncompressedDiff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	var reads digestReads
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		wrapContentStore: func(cs content.Store) content.Store {
+			return &digestReadStore{Store: cs, reads: &reads}
+		},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager.(*cacheManager)
+	cm.KeepUncompressedDiff = true
+
+	active, err := cm.New(ctx, nil, nil)
+	require.NoError(t, err)
+	m, err := active.Mount(ctx, false, nil)
+	require.NoError(t, err)
+	mounts, release, err := m.Mount()
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "file"), bytes.Repeat([]byte("data "), 1<<12), 0600)
+	require.NoError(t, err)
+	require.NoError(t, release())
+	ref, err := active.Commit(ctx)
+	require.NoError(t, err)
+
+	lctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	remote, err := ref.GetRemote(lctx, true, compression.New(compression.Gzip), nil)
+	require.NoError(t, err)
+	require.NoError(t, done(ctx))
+	blob := remote.Descriptors[0]
+	diffID := digest.Digest(blob.Annotations["containerd.io/uncompressed"])
+
+	// the diff is kept by the record once the export is done
+	_, err = cm.GarbageCollect(ctx)
+	require.NoError(t, err)
+	info, err := co.cs.Info(ctx, blob.Digest)
+	require.NoError(t, err)
+	require.Equal(t, diffID.String(), info.Labels[labelUncompressedVariant])
+	diffInfo, err := co.cs.Info(ctx, diffID)
+	require.NoError(t, err)
+
+	// and counted in its size
+	size, err := ref.Size(ctx)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, size, blob.Size+diffInfo.Size)
+
+	// other variants are compressed from the diff
+	lctx, done, err = leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	reads.reset()
+	remotes, err := ref.GetRemotes(lctx, true, []compression.Config{compression.New(compression.Zstd)}, true, nil)
+	require.NoError(t, err)
+	require.NoError(t, done(ctx))
+	require.Equal(t, ocispec.MediaTypeImageLayer+"+zstd", remotes[0].Descriptors[0].MediaType)
+	require.Equal(t, 0, reads.get(blob.Digest))
+	require.Equal(t, 1, reads.get(diffID))
+
+	// the diff is removed with the record
+	require.NoError(t, ref.Release(ctx))
+	buf := pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{All: true})
+	buf.close()
+	require.NoError(t, err)
+	_, err = co.cs.Info(ctx, diffID)
+	require.True(t, errors.Is(err, errdefs.ErrNotFound))
+}
+
+type digestReads struct {
+	mu sync.Mutex
+	m  map[digest.Digest]int
+}
+
+func (r *digestReads) reset() {
+	r.mu.Lock()
+	r.m = nil
+	r.mu.Unlock()
+}
+
+func (r *digestReads) get(dgst digest.Digest) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.m[dgst]
+}
+
+type digestReadStore struct {
+	content.Store
+	reads *digestReads
+}
+
+func (s *digestReadStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	s.reads.mu.Lock()
+	if s.reads.m == nil {
+		s.reads.m = map[digest.Digest]int{}
+	}
+	s.reads.m[desc.Digest]++
+	s.reads.mu.Unlock()
+	return s.Store.ReaderAt(ctx, desc)
+}
+
+func TestCompressionStats(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil)
+	require.NoError(t, err)
+	m, err := active.Mount(ctx, false, nil)
+	require.NoError(t, err)
+	mounts, release, err := m.Mount()
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "file"), bytes.Repeat([]byte("data "), 1<<12), 0600)
+	require.NoError(t, err)
+	require.NoError(t, release())
+	ref, err := active.Commit(ctx)
+	require.NoError(t, err)
+	defer ref.Release(context.TODO())
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	var stats CompressionStats
+	sctx := WithCompressionStats(ctx, &stats)
+	remote, err := ref.GetRemote(sctx, true, compression.New(compression.Gzip).SetLevel(1), nil)
+	require.NoError(t, err)
+	blob := remote.Descriptors[0]
+	diff, err := co.cs.Info(ctx, digest.Digest(blob.Annotations["containerd.io/uncompressed"]))
+	require.NoError(t, err)
+
+	st := stats.Stats()
+	require.Equal(t, 2, len(st))
+	require.Equal(t, 1, st[statsDiff].Layers)
+	require.Equal(t, int64(0), st[statsDiff].BytesIn)
+	require.Equal(t, diff.Size, st[statsDiff].BytesOut)
+	require.Equal(t, 1, st["gzip"].Layers)
+	require.Equal(t, diff.Size, st["gzip"].BytesIn)
+	require.Equal(t, blob.Size, st["gzip"].BytesOut)
+
+	// conversions to other compressions are counted too
+	remotes, err := ref.GetRemotes(sctx, true, []compression.Config{compression.New(compression.Zstd)}, true, nil)
+	require.NoError(t, err)
+	st = stats.Stats()
+	require.Equal(t, 1, st["zstd"].Layers)
+	require.Equal(t, diff.Size, st["zstd"].BytesIn)
+	require.Equal(t, remotes[0].Descriptors[0].Size, st["zstd"].BytesOut)
+	require.Contains(t, stats.String(), "zstd 1 layer ")
+
+	// exports without stats don't record anything
+	_, err = ref.GetRemotes(ctx, true, []compression.Config{compression.New(compression.Uncompressed)}, true, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(stats.Stats()))
+}
+
+func TestGetRemotesSharedVariants(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	var conversions int64
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		wrapContentStore: func(cs content.Store) content.Store {
+			// slow conversions overlap the concurrent requests
+			return &writerCountingStore{Store: cs, prefix: "decompress-", count: &conversions, delay: 100 * time.Millisecond}
+		},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	var parent ImmutableRef
+	for i := 0; i < 2; i++ {
+		active, err := cm.New(ctx, parent, nil)
+		require.NoError(t, err)
+		m, err := active.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(mounts[0].Source, fmt.Sprintf("file%d", i)), []byte("data"), 0600)
+		require.NoError(t, err)
+		require.NoError(t, release())
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		if parent != nil {
+			require.NoError(t, parent.Release(ctx))
+		}
+		parent = snap
+	}
+	ref := parent
+	defer ref.Release(context.TODO())
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	_, err = ref.GetRemote(ctx, true, compression.New(compression.Gzip), nil)
+	require.NoError(t, err)
+
+	// e.g. the image and the cache exporter of a solve asking for the
+	// same compression at the same time
+	configs := []compression.Config{compression.New(compression.Uncompressed)}
+	remotes := make([]*solver.Remote, 4)
+	eg, egctx := errgroup.WithContext(ctx)
+	for i := range remotes {
+		i := i
+		eg.Go(func() error {
+			r, err := ref.GetRemotes(egctx, false, configs, true, nil)
+			if err != nil {
+				return err
+			}
+			remotes[i] = r[0]
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+	for _, r := range remotes[1:] {
+		require.Equal(t, remotes[0].Descriptors, r.Descriptors)
+	}
+	require.Equal(t, int64(2), atomic.LoadInt64(&conversions))
+
+	_, err = ref.GetRemotes(ctx, false, configs, true, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), atomic.LoadInt64(&conversions))
+}
+
+// writerCountingStore counts the writers opened with a ref starting with
+// prefix and delays opening them.
+type writerCountingStore struct {
+	content.Store
+	prefix string
+	count  *int64
+	delay  time.Duration
+}
+
+func (s *writerCountingStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasPrefix(wOpts.Ref, s.prefix) {
+		atomic.AddInt64(s.count, 1)
+		time.Sleep(s.delay)
+	}
+	return s.Store.Writer(ctx, opts...)
+}
+
+// inflightStore tracks the highest number of writers with prefix that are
+// open at the same time.
+type inflightStore struct {
+	content.Store
+	prefix   string
+	inflight int64
+	max      int64
+}
+
+func (s *inflightStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	w, err := s.Store.Writer(ctx, opts...)
+	if err != nil || !strings.HasPrefix(wOpts.Ref, s.prefix) {
+		return w, err
+	}
+	n := atomic.AddInt64(&s.inflight, 1)
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if n <= max || atomic.CompareAndSwapInt64(&s.max, max, n) {
+			break
+		}
+	}
+	// slow conversions overlap each other
+	time.Sleep(20 * time.Millisecond)
+	return &inflightWriter{Writer: w, s: s}, nil
+}
+
+type inflightWriter struct {
+	content.Writer
+	s    *inflightStore
+	once sync.Once
+}
+
+func (w *inflightWriter) Close() error {
+	w.once.Do(func() { atomic.AddInt64(&w.s.inflight, -1) })
+	return w.Writer.Close()
+}
+
+func TestMaxParallelConversions(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	var store *inflightStore
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		wrapContentStore: func(cs content.Store) content.Store {
+			store = &inflightStore{Store: cs, prefix: "variant-"}
+			return store
+		},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager.(*cacheManager)
+	cm.conversions = newConversionLimiter(2)
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	remotes := make([]*solver.Remote, 3)
+	for i := range remotes {
+		buf := contentutil.NewBuffer()
+		remotes[i] = &solver.Remote{Provider: buf}
+		for j := 0; j < 4; j++ {
+			b, desc, err := mapToBlob(map[string]string{"foo": fmt.Sprintf("%d-%d", i, j)})
+			require.NoError(t, err)
+			err = content.WriteBlob(ctx, buf, desc.Digest.String(), bytes.NewReader(b), desc)
+			require.NoError(t, err)
+			remotes[i].Descriptors = append(remotes[i].Descriptors, desc)
+		}
+	}
+
+	eg, egctx := errgroup.WithContext(ctx)
+	for _, r := range remotes {
+		r := r
+		eg.Go(func() error {
+			_, err := cm.ConvertRemote(egctx, r, compression.New(compression.Zstd))
+			return err
+		})
+	}
+	require.NoError(t, eg.Wait())
+	require.Equal(t, int64(2), atomic.LoadInt64(&store.max))
+	require.Equal(t, int64(0), atomic.LoadInt64(&store.inflight))
+}
+
+func TestConversionLimiterFairness(t *testing.T) {
+	t.Parallel()
+	l := newConversionLimiter(2)
+	ctxA := withConversionOwner(context.TODO())
+	ctxB := withConversionOwner(context.TODO())
+
+	releaseA1, err := l.acquire(ctxA)
+	require.NoError(t, err)
+	releaseA2, err := l.acquire(ctxA)
+	require.NoError(t, err)
+
+	acquired := make(chan string, 3)
+	wait := func(ctx context.Context, name string) {
+		release, err := l.acquire(ctx)
+		if err == nil {
+			acquired <- name
+			release()
+		}
+	}
+	go wait(ctxA, "a")
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.waiting) == 1
+	}, time.Second, time.Millisecond)
+	go wait(ctxB, "b")
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.waiting) == 2
+	}, time.Second, time.Millisecond)
+
+	// b holds no slot, so it goes before the earlier conversion of a
+	releaseA1()
+	require.Equal(t, "b", <-acquired)
+	releaseA2()
+	require.Equal(t, "a", <-acquired)
+
+	// waiting is canceled without taking a slot
+	r1, err := l.acquire(ctxA)
+	require.NoError(t, err)
+	r2, err := l.acquire(ctxB)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(ctxA)
+	cancel()
+	_, err = l.acquire(ctx)
+	require.Error(t, err)
+	r1()
+	r2()
+	require.Equal(t, 0, l.running)
+	require.Equal(t, 0, len(l.waiting))
+	require.Equal(t, 0, len(l.held))
+}
+
+func TestChainIDRecompressedBlob(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	cm := co.manager
+	comp := compression.New(compression.Gzip)
+
+	var fast, best []ocispec.Descriptor
+	for _, m := range []map[string]string{{"foo": "bar"}, {"foo2": "bar2"}} {
+		b, desc, err := mapToBlob(m)
+		require.NoError(t, err)
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		require.NoError(t, err)
+		dt, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+
+		uncompressed := ocispec.Descriptor{
+			Digest:    digest.Digest(desc.Annotations["containerd.io/uncompressed"]),
+			MediaType: ocispec.MediaTypeImageLayer,
+			Size:      int64(len(dt)),
+		}
+		err = content.WriteBlob(ctx, co.cs, "uncompressed", bytes.NewReader(dt), uncompressed)
+		require.NoError(t, err)
+
+		annotations := map[string]string{"containerd.io/uncompressed": uncompressed.Digest.String()}
+		f, err := compressBlob(ctx, co.cs, uncompressed, ocispec.MediaTypeImageLayerGzip, comp.SetLevel(gzip.BestSpeed), "fast")
+		require.NoError(t, err)
+		f.Annotations = annotations
+		fast = append(fast, f)
+		b2, err := compressBlob(ctx, co.cs, uncompressed, ocispec.MediaTypeImageLayerGzip, comp.SetLevel(gzip.BestCompression), "best")
+		require.NoError(t, err)
+		b2.Annotations = annotations
+		best = append(best, b2)
+		require.NotEqual(t, f.Digest, b2.Digest)
+	}
+
+	getChain := func(descs []ocispec.Descriptor) ImmutableRef {
+		var parent ImmutableRef
+		for _, desc := range descs {
+			ref, err := cm.GetByBlob(ctx, desc, parent)
+			require.NoError(t, err)
+			if parent != nil {
+				require.NoError(t, parent.Release(context.TODO()))
+			}
+			parent = ref
+		}
+		return parent
+	}
+
+	ref1 := getChain(fast)
+	defer ref1.Release(context.TODO())
+	ref2 := getChain(best)
+	defer ref2.Release(context.TODO())
+
+	info1, info2 := ref1.Info(), ref2.Info()
+	require.NotEqual(t, ref1.ID(), ref2.ID())
+	require.Equal(t, info1.ChainID, info2.ChainID)
+	require.Equal(t, info1.DiffID, info2.DiffID)
+	require.NotEqual(t, info1.BlobChainID, info2.BlobChainID)
+	require.Equal(t, getSnapshotID(ref1.Metadata()), getSnapshotID(ref2.Metadata()))
+}
+
+func TestDecompressBlob(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	// tar archive with a single file "foo" compressed with bzip2 and xz
+	diffID := digest.Digest("sha256:49a11e7756879b641f47aa5dc4ac7bb9eb26744abda4f984db2d1d68071dc13b")
+	for _, tc := range []struct {
+		mediaType string
+		blob      string
+	}{
+		{
+			mediaType: ocispec.MediaTypeImageLayer + "+bzip2",
+			blob: "" +
+				"425a68393141592653591674b0b700006efb80c990000140004700000271009e" +
+				"0008082000543486800069a08a281a19001f7399288657a226bd5684694c5048" +
+				"0c24adc33026d286c2d80d066c09c5ded102aad08880f8bb9229c28480b3a585" +
+				"b8",
+		},
+		{
+			mediaType: ocispec.MediaTypeImageLayer + "+xz",
+			blob: "" +
+				"fd377a585a000004e6d6b4460200210116000000742fe5a3e027ff00585d0033" +
+				"1bec01ba70c3444c180f2966be73f3555d54998e4a113e532d5fab2e6ab4d8aa" +
+				"8e69571be92fb42d99eea5553bd5c2a62d269fa9392b63576fa976cdc76e8f91" +
+				"a74717bafd17ed7448855844dd25d9f13dd8aecf6c000000b214a57cb4d7b7e8" +
+				"00017480500000003a240d29b1c467fb020000000004595a",
+		},
+	} {
+		tc := tc
+		t.Run(tc.mediaType, func(t *testing.T) {
+			if tc.mediaType == ocispec.MediaTypeImageLayer+"+xz" {
+				if _, err := exec.LookPath("xz"); err != nil {
+					t.Skip("xz binary not found")
+				}
+			}
+			require.Equal(t, compression.FromMediaType(tc.mediaType).String(), strings.TrimPrefix(tc.mediaType, ocispec.MediaTypeImageLayer+"+"))
+
+			dt, err := hex.DecodeString(tc.blob)
+			require.NoError(t, err)
+			desc := ocispec.Descriptor{
+				Digest:    digest.FromBytes(dt),
+				MediaType: tc.mediaType,
+				Size:      int64(len(dt)),
+				Annotations: map[string]string{
+					"containerd.io/uncompressed": diffID.String(),
+				},
+			}
+			err = content.WriteBlob(ctx, co.cs, desc.Digest.String(), bytes.NewReader(dt), desc)
+			require.NoError(t, err)
+
+			uncompressed, err := decompressBlob(ctx, co.cs, desc)
+			require.NoError(t, err)
+			require.Equal(t, diffID, uncompressed.Digest)
+			require.Equal(t, ocispec.MediaTypeImageLayer, uncompressed.MediaType)
+
+			desc.Annotations["containerd.io/uncompressed"] = digest.FromBytes([]byte("foo")).String()
+			_, err = decompressBlob(ctx, co.cs, desc)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestBlobAnnotations(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	tocDigest := digest.FromBytes([]byte("toc")).String()
+	desc.Annotations["containerd.io/snapshot/stargz/toc.digest"] = tocDigest
+	desc.Annotations["containerd.io/distribution.source.docker.io"] = "library/foo"
+
+	ref, err := co.manager.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	defer ref.Release(context.TODO())
+
+	remote, err := ref.GetRemote(ctx, false, compression.New(compression.Default), nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(remote.Descriptors))
+
+	annotations := remote.Descriptors[0].Annotations
+	require.Equal(t, tocDigest, annotations["containerd.io/snapshot/stargz/toc.digest"])
+	require.Equal(t, desc.Annotations["containerd.io/uncompressed"], annotations["containerd.io/uncompressed"])
+	_, ok := annotations["containerd.io/distribution.source.docker.io"]
+	require.False(t, ok)
+}
+
+func TestVerifyLayerMediaType(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	gz, _, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	require.NoError(t, err)
+	tr, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		mediaType string
+		expected  string
+	}{
+		{"gzip", gz, ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayerGzip},
+		{"tar", tr, ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayer},
+		{"empty", []byte{}, ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayer},
+		{"gzip-as-tar", gz, ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayerGzip},
+		{"tar-as-gzip", tr, images.MediaTypeDockerSchema2LayerGzip, images.MediaTypeDockerSchema2Layer},
+		{"garbage-as-tar", []byte("not a tar stream"), ocispec.MediaTypeImageLayer, ""},
+		{"garbage-as-gzip", bytes.Repeat([]byte("x"), 1024), ocispec.MediaTypeImageLayerGzip, ""},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			desc := ocispec.Descriptor{
+				MediaType: tc.mediaType,
+				Digest:    digest.FromBytes(tc.data),
+				Size:      int64(len(tc.data)),
+			}
+			err := content.WriteBlob(ctx, co.cs, tc.name, bytes.NewReader(tc.data), desc)
+			require.NoError(t, err)
+
+			mediaType, err := verifyLayerMediaType(ctx, co.cs, desc)
+			if tc.expected == "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), desc.Digest.String())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, mediaType)
+		})
+	}
+}
+
+func TestDiskUsageBlobInfo(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	ref, err := co.manager.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	defer ref.Release(context.TODO())
+
+	// the blob of the child is not in the content store
+	_, desc2, err := mapToBlob(map[string]string{"foo2": "bar2"})
+	require.NoError(t, err)
+	ref2, err := co.manager.GetByBlob(ctx, desc2, ref, DescHandlers{desc2.Digest: &DescHandler{}})
+	require.NoError(t, err)
+	defer ref2.Release(context.TODO())
+
+	du, err := co.manager.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(du))
+
+	records := map[string]*client.UsageInfo{}
+	for _, d := range du {
+		records[d.ID] = d
+	}
+
+	r := records[ref.ID()]
+	require.NotNil(t, r)
+	require.Equal(t, ref.Info().ChainID, r.ChainID)
+	require.Equal(t, desc.Digest, r.Blob)
+	require.Equal(t, desc.MediaType, r.MediaType)
+	require.False(t, r.Lazy)
+	require.Equal(t, desc.Size, r.BlobSize)
+	require.True(t, r.Size >= r.BlobSize)
+
+	r = records[ref2.ID()]
+	require.NotNil(t, r)
+	require.Equal(t, ref.ID(), r.Parent)
+	require.Equal(t, ref2.Info().ChainID, r.ChainID)
+	require.Equal(t, desc2.Digest, r.Blob)
+	require.True(t, r.Lazy)
+	require.Equal(t, int64(0), r.BlobSize)
+}
+
+func TestDiskUsageLazyCheckError(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	store := &infoErrorStore{}
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		wrapContentStore: func(cs content.Store) content.Store {
+			store.Store = cs
+			return store
+		},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	lctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(lctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	ref, err := co.manager.GetByBlob(lctx, desc, nil)
+	require.NoError(t, err)
+	defer ref.Release(context.TODO())
+
+	// a record whose blob can't be checked is reported as not lazy and
+	// doesn't fail the disk usage of the other records or the gc
+	store.setFail(desc.Digest)
+	du, err := co.manager.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(du))
+	require.False(t, du[0].Lazy)
+
+	err = co.manager.Prune(ctx, nil, client.PruneInfo{KeepBytes: 1})
+	require.NoError(t, err)
+}
+
+type infoErrorStore struct {
+	content.Store
+	mu   sync.Mutex
+	fail digest.Digest
+}
+
+func (s *infoErrorStore) setFail(dgst digest.Digest) {
+	s.mu.Lock()
+	s.fail = dgst
+	s.mu.Unlock()
+}
+
+func (s *infoErrorStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	s.mu.Lock()
+	fail := s.fail
+	s.mu.Unlock()
+	if dgst == fail {
+		return content.Info{}, errors.Errorf("failed to get info of %s", dgst)
+	}
+	return s.Store.Info(ctx, dgst)
+}
+
+func TestUnlazySharedBlob(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	parent, err := co.manager.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	defer parent.Release(context.TODO())
+
+	// the same lazy blob in two different chains
+	b2, desc2, err := mapToBlob(map[string]string{"foo2": "bar2"})
+	require.NoError(t, err)
+	buf := contentutil.NewBuffer()
+	err = content.WriteBlob(ctx, buf, "ref2", bytes.NewBuffer(b2), desc2)
+	require.NoError(t, err)
+	provider := &countingProvider{Provider: buf}
+	dhs := DescHandlers{desc2.Digest: &DescHandler{
+		Provider: func(session.Group) content.Provider { return provider },
+	}}
+
+	ref1, err := co.manager.GetByBlob(ctx, desc2, nil, dhs)
+	require.NoError(t, err)
+	defer ref1.Release(context.TODO())
+
+	ref2, err := co.manager.GetByBlob(ctx, desc2, parent, dhs)
+	require.NoError(t, err)
+	defer ref2.Release(context.TODO())
+	require.NotEqual(t, ref1.ID(), ref2.ID())
+
+	eg, egctx := errgroup.WithContext(ctx)
+	for _, ref := range []ImmutableRef{ref1, ref2} {
+		ref := ref.(*immutableRef)
+		eg.Go(func() error {
+			return lazyRefProvider{ref: ref, desc: desc2, dh: dhs[desc2.Digest]}.Unlazy(egctx)
+		})
+	}
+	require.NoError(t, eg.Wait())
+	require.Equal(t, int32(1), atomic.LoadInt32(&provider.count))
+
+	_, err = co.cs.Info(ctx, desc2.Digest)
+	require.NoError(t, err)
+}
+
+func TestLazyRecordPolicies(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager.(*cacheManager)
+
+	buf := contentutil.NewBuffer()
+	provider := &countingProvider{Provider: buf}
+	dhs := DescHandlers{}
+	var descs []ocispec.Descriptor
+	for i := 0; i < 3; i++ {
+		b, desc, err := mapToBlob(map[string]string{fmt.Sprintf("foo%d", i): "bar"})
+		require.NoError(t, err)
+		err = content.WriteBlob(ctx, buf, "ref", bytes.NewBuffer(b), desc)
+		require.NoError(t, err)
+		dhs[desc.Digest] = &DescHandler{
+			Provider: func(session.Group) content.Provider { return provider },
+		}
+		descs = append(descs, desc)
+	}
+
+	// eagerly fetched when exported
+	cm.EagerUnlazy = true
+	ref1, err := cm.GetByBlob(ctx, descs[0], nil, dhs)
+	require.NoError(t, err)
+	exportCtx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	_, err = ref1.GetRemote(exportCtx, false, compression.New(compression.Default), nil)
+	require.NoError(t, err)
+	require.NoError(t, done(ctx))
+	require.Equal(t, int32(1), atomic.LoadInt32(&provider.count))
+	lazy, err := ref1.(*immutableRef).isLazy(ctx)
+	require.NoError(t, err)
+	require.False(t, lazy)
+	require.NoError(t, ref1.Release(context.TODO()))
+
+	ref2, err := cm.GetByBlob(ctx, descs[1], nil, dhs)
+	require.NoError(t, err)
+	require.NoError(t, ref2.Release(context.TODO()))
+
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{Filter: []string{"lazy"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(du))
+	require.Equal(t, ref2.ID(), du[0].ID)
+
+	// lazy records younger than the TTL are kept
+	cm.LazyRecordTTL = time.Hour
+	require.NoError(t, cm.Prune(ctx, nil))
+	checkDiskUsage(ctx, t, cm, 0, 2)
+
+	// the TTL starts at the last use of records created long ago
+	cm.LazyRecordTTL = time.Hour
+	ref3, err := cm.GetByBlob(ctx, descs[2], nil, dhs, WithCreationTime(time.Now().Add(-2*time.Hour)))
+	require.NoError(t, err)
+	require.NoError(t, ref3.Release(context.TODO()))
+	require.NoError(t, cm.Prune(ctx, nil))
+	checkDiskUsage(ctx, t, cm, 0, 3)
+
+	cm.LazyRecordTTL = time.Nanosecond
+	require.NoError(t, cm.Prune(ctx, nil))
+	checkDiskUsage(ctx, t, cm, 0, 1)
+	du, err = cm.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, ref1.ID(), du[0].ID)
+}
+
+func TestHeldLocks(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	active, err := co.manager.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	defer active.Release(context.TODO())
+
+	findLock := func(id string) *LockInfo {
+		for _, li := range HeldLocks(0) {
+			if li.Record == id {
+				return &li
+			}
+		}
+		return nil
+	}
+
+	mu := active.(*mutableRef).mu
+	mu.Lock()
+	li := findLock(active.ID())
+	require.NotNil(t, li)
+	require.Contains(t, li.Holder.Operation, "TestHeldLocks")
+	require.Equal(t, 0, len(HeldLocks(time.Hour)))
+	mu.Unlock()
+	require.Nil(t, findLock(active.ID()))
+
+	mu.lockFor("mount", session.NewGroup("sess1"))
+	li = findLock(active.ID())
+	require.NotNil(t, li)
+	require.Equal(t, "mount", li.Holder.Operation)
+	require.Equal(t, "sess1", li.Holder.SessionID)
+	mu.Unlock()
+}
+
+func TestMigrateSnapshotter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	tmpdir, err := ioutil.TempDir("", "cachemanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	target, err := native.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	require.NoError(t, err)
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		extraSnapshotters: map[string]snapshots.Snapshotter{"native2": target},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+	to := snapshot.FromContainerdSnapshotter("native2", containerdsnapshot.NSSnapshotter("buildkit-test", co.mdb.Snapshotter("native2")), nil)
+
+	// record with a blob
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+	withBlob, err := cm.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	require.NoError(t, withBlob.Extract(ctx, nil))
+
+	// record without a blob
+	active, err := cm.New(ctx, withBlob, nil)
+	require.NoError(t, err)
+	noBlob, err := active.Commit(ctx)
+	require.NoError(t, err)
+	require.NoError(t, noBlob.Finalize(ctx, true))
+
+	// mutable records can't be migrated
+	mutable, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	defer mutable.Release(context.TODO())
+
+	withBlobSnapshot := getSnapshotID(withBlob.Metadata())
+	noBlobSnapshot := getSnapshotID(noBlob.Metadata())
+	require.Equal(t, "", getBlob(noBlob.Metadata()))
+	require.NoError(t, withBlob.Release(context.TODO()))
+	require.NoError(t, noBlob.Release(context.TODO()))
+
+	stats, err := cm.MigrateSnapshotter(ctx, to, true)
+	require.NoError(t, err)
+	require.Equal(t, MigrateStats{Migratable: 2, Unmigratable: 1}, stats)
+	_, err = to.Stat(ctx, withBlobSnapshot)
+	require.True(t, errors.Is(err, errdefs.ErrNotFound))
+
+	stats, err = cm.MigrateSnapshotter(ctx, to, false)
+	require.NoError(t, err)
+	require.Equal(t, MigrateStats{Migratable: 2, Unmigratable: 1}, stats)
+
+	for _, id := range []string{withBlobSnapshot, noBlobSnapshot} {
+		_, err = to.Stat(ctx, id)
+		require.NoError(t, err)
+	}
+	info, err := to.Stat(ctx, noBlobSnapshot)
+	require.NoError(t, err)
+	require.Equal(t, withBlobSnapshot, info.Parent)
+
+	ref, err := cm.Get(ctx, noBlob.ID())
+	require.NoError(t, err)
+	require.NotEqual(t, "", getBlob(ref.Metadata()))
+	require.NoError(t, ref.Release(context.TODO()))
+
+	// old snapshots are released
+	_, err = co.mdb.GarbageCollect(ctx)
+	require.NoError(t, err)
+	for _, id := range []string{withBlobSnapshot, noBlobSnapshot} {
+		_, err = co.snapshotter.Stat(ctx, id)
+		require.True(t, errors.Is(err, errdefs.ErrNotFound))
+	}
+
+	mounts, err := to.View(ctx, "check-migrated", withBlobSnapshot)
+	require.NoError(t, err)
+	ms, release, err := mounts.Mount()
+	require.NoError(t, err)
+	defer release()
+	require.Equal(t, 1, len(ms))
+	dt, err := ioutil.ReadFile(filepath.Join(ms[0].Source, "foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(dt))
+}
+
+func TestDiskQuota(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		diskQuota:       1000,
+		reservationSize: 600,
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	active1, err := cm.New(ctx, nil, session.NewGroup("build1"), ReserveSpace)
+	require.NoError(t, err)
+
+	_, err = cm.New(ctx, nil, session.NewGroup("build2"), ReserveSpace)
+	require.Error(t, err)
+	var qe *QuotaExceededError
+	require.True(t, errors.As(err, &qe))
+	require.Equal(t, int64(600), qe.Reserved)
+	require.Equal(t, []BuildUsage{{BuildID: "build1", Size: 600}}, qe.Builds)
+	require.Contains(t, err.Error(), "build build1")
+
+	// refs that don't reserve space are not limited
+	other, err := cm.New(ctx, nil, session.NewGroup("build2"))
+	require.NoError(t, err)
+	require.NoError(t, other.Release(ctx))
+
+	// reservations grow with the snapshot
+	m, err := active1.Mount(ctx, false, nil)
+	require.NoError(t, err)
+	mounts, release, err := m.Mount()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mounts))
+	err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "data"), make([]byte, 8192), 0600)
+	require.NoError(t, err)
+	require.NoError(t, release())
+
+	cm.(*cacheManager).sampleReservationsOnce(ctx)
+	size, ok := cm.(*cacheManager).reservedSize(active1.ID())
+	require.True(t, ok)
+	require.True(t, size >= 8192)
+
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{Filter: []string{"buildid==build1"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(du))
+	require.Equal(t, size, du[0].Size)
+	require.Equal(t, "build1", du[0].BuildID)
+
+	require.NoError(t, active1.Release(ctx))
+
+	active2, err := cm.New(ctx, nil, session.NewGroup("build2"), ReserveSpace)
+	require.NoError(t, err)
+	snap, err := active2.Commit(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "build2", GetBuildID(snap.Metadata()))
+	_, ok = cm.(*cacheManager).reservedSize(active2.ID())
+	require.False(t, ok)
+
+	// the committed record keeps the reservation until its size is known
+	size, ok = cm.(*cacheManager).reservedSize(snap.ID())
+	require.True(t, ok)
+	require.Equal(t, int64(600), size)
+	_, err = cm.New(ctx, nil, session.NewGroup("build3"), ReserveSpace)
+	require.Error(t, err)
+	require.True(t, errors.As(err, &qe))
+	require.Equal(t, []BuildUsage{{BuildID: "build2", Size: 600}}, qe.Builds)
+
+	_, err = snap.(*immutableRef).Size(ctx)
+	require.NoError(t, err)
+	_, ok = cm.(*cacheManager).reservedSize(snap.ID())
+	require.False(t, ok)
+	active3, err := cm.New(ctx, nil, session.NewGroup("build3"), ReserveSpace, CachePolicyRetain)
+	require.NoError(t, err)
+
+	// the reservation is kept until the last handle of a ref is released
+	cm.(*cacheManager).mu.Lock()
+	handle := active3.(*mutableRef).mref(false, nil)
+	cm.(*cacheManager).mu.Unlock()
+	require.NoError(t, handle.Release(ctx))
+	_, ok = cm.(*cacheManager).reservedSize(active3.ID())
+	require.True(t, ok)
+	require.NoError(t, active3.Release(ctx))
+	_, ok = cm.(*cacheManager).reservedSize(active3.ID())
+	require.False(t, ok)
+	require.NoError(t, snap.Release(ctx))
+}
+
+func TestQuotaUsage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		diskQuota:       1 << 30,
+		reservationSize: 1 << 20,
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager.(*cacheManager)
+	checkUsage := func() {
+		t.Helper()
+		require.Equal(t, sumUsedSize(cm), cm.usedSize())
+	}
+
+	var refs []ImmutableRef
+	for i := 0; i < 3; i++ {
+		active, err := cm.New(ctx, nil, nil, ReserveSpace)
+		require.NoError(t, err)
+		m, err := active.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "data"), make([]byte, 4096), 0600)
+		require.NoError(t, err)
+		require.NoError(t, release())
+		checkUsage()
+
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		refs = append(refs, snap)
+	}
+	checkUsage()
+
+	for _, ref := range refs {
+		_, err := ref.(*immutableRef).Size(ctx)
+		require.NoError(t, err)
+		checkUsage()
+	}
+
+	// finalizing the records keeps their size
+	for _, ref := range refs {
+		require.NoError(t, ref.Finalize(ctx, true))
+		checkUsage()
+	}
+	require.True(t, cm.usedSize() > 0)
+	// the mutable records are removed in the background
+	require.Eventually(t, func() bool {
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		return len(cm.records) == len(refs)
+	}, 5*time.Second, 10*time.Millisecond)
+	checkUsage()
+
+	for _, ref := range refs {
+		require.NoError(t, ref.Release(ctx))
+		checkUsage()
+	}
+
+	buf := pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{All: true})
+	buf.close()
+	require.NoError(t, err)
+	checkUsage()
+	require.Equal(t, int64(0), cm.usedSize())
+}
+
+// sumUsedSize sums the sizes of the records counted in the disk quota
+func sumUsedSize(cm *cacheManager) int64 {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	var used int64
+	for _, cr := range cm.records {
+		cr.mu.Lock()
+		if !cr.isDead() && cr.equalMutable == nil && !(cr.mutable && len(cr.refs) > 0) {
+			if s := getSize(cr.md); s != sizeUnknown {
+				used += s
+			}
+		}
+		cr.mu.Unlock()
+	}
+	return used
+}
+
+func TestCacheNamespaces(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		sharedNamespaces: []string{"base"},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	ctxA := solver.WithCacheNamespace(ctx, "a")
+	ctxB := solver.WithCacheNamespace(ctx, "b")
+	ctxBase := solver.WithCacheNamespace(ctx, "base")
+
+	active, err := cm.New(ctxA, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	snap, err := active.Commit(ctxA)
+	require.NoError(t, err)
+	require.Equal(t, "a", GetNamespace(snap.Metadata()))
+	id := snap.ID()
+	require.NoError(t, snap.Release(ctx))
+
+	ref, err := cm.Get(ctxA, id)
+	require.NoError(t, err)
+	require.NoError(t, ref.Release(ctx))
+
+	// builds without a namespace see all records
+	ref, err = cm.Get(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, ref.Release(ctx))
+
+	_, err = cm.Get(ctxB, id)
+	require.Error(t, err)
+	require.True(t, IsNotFound(err))
+
+	// layers pulled in a shared namespace are used by all namespaces
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	base, err := cm.GetByBlob(ctxBase, desc, nil)
+	require.NoError(t, err)
+	defer base.Release(context.TODO())
+
+	pulled, err := cm.GetByBlob(ctxB, desc, nil)
+	require.NoError(t, err)
+	require.Equal(t, base.ID(), pulled.ID())
+	require.NoError(t, pulled.Release(ctx))
+
+	ref, err = cm.Get(ctxB, base.ID())
+	require.NoError(t, err)
+	require.NoError(t, ref.Release(ctx))
+
+	// other pulled layers get a record in each namespace
+	b, desc, err = mapToBlob(map[string]string{"foo2": "bar2"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref2", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	pulledA, err := cm.GetByBlob(ctxA, desc, nil)
+	require.NoError(t, err)
+	defer pulledA.Release(context.TODO())
+
+	pulledB, err := cm.GetByBlob(ctxB, desc, nil)
+	require.NoError(t, err)
+	defer pulledB.Release(context.TODO())
+	require.NotEqual(t, pulledA.ID(), pulledB.ID())
+	require.Equal(t, pulledA.Info().SnapshotID, pulledB.Info().SnapshotID)
+
+	_, err = cm.Get(ctxB, pulledA.ID())
+	require.True(t, IsNotFound(err))
+
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{Filter: []string{"namespace==a"}})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(du))
+	for _, d := range du {
+		require.Equal(t, "a", d.Namespace)
+	}
+
+	ch := make(chan client.UsageInfo)
+	var pruned []client.UsageInfo
+	donePrune := make(chan struct{})
+	go func() {
+		for u := range ch {
+			pruned = append(pruned, u)
+		}
+		close(donePrune)
+	}()
+	err = cm.Prune(ctx, ch, client.PruneInfo{Filter: []string{"namespace==a"}})
+	require.NoError(t, err)
+	close(ch)
+	<-donePrune
+	require.Equal(t, 1, len(pruned))
+
+	// only the unused record of the namespace was pruned
+	_, err = cm.Get(ctx, id)
+	require.True(t, IsNotFound(err))
+	ref, err = cm.Get(ctxB, base.ID())
+	require.NoError(t, err)
+	require.NoError(t, ref.Release(ctx))
+}
+
+func TestNoSpaceRetry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		noSpaceReclaim: 1,
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager.(*cacheManager)
+
+	newUnused := func() string {
+		active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+		require.NoError(t, err)
+		m, err := active.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		lm := snapshot.LocalMounter(m)
+		target, err := lm.Mount()
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(target, "data"), make([]byte, 8192), 0600)
+		require.NoError(t, err)
+		require.NoError(t, lm.Unmount())
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		id := snap.ID()
+		require.NoError(t, snap.Release(ctx))
+		return id
+	}
+
+	unused := newUnused()
+
+	// records in use are kept
+	active, err := cm.New(ctx, nil, nil)
+	require.NoError(t, err)
+	defer active.Release(ctx)
+
+	noSpace := errors.Wrap(syscall.ENOSPC, "failed to copy")
+
+	calls := 0
+	desc, err := cm.withNoSpaceRetry(ctx, func() (ocispec.Descriptor, error) {
+		calls++
+		if calls == 1 {
+			return ocispec.Descriptor{}, noSpace
+		}
+		return ocispec.Descriptor{Digest: digest.FromString("foo")}, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+	require.Equal(t, digest.FromString("foo"), desc.Digest)
+
+	_, err = cm.Get(ctx, unused)
+	require.True(t, IsNotFound(err))
+	_, err = cm.GetMutable(ctx, active.ID())
+	require.Error(t, err) // locked by active, not removed
+	require.False(t, IsNotFound(err))
+
+	// the original error is returned if the retry fails too
+	newUnused()
+	calls = 0
+	_, err = cm.withNoSpaceRetry(ctx, func() (ocispec.Descriptor, error) {
+		calls++
+		return ocispec.Descriptor{}, errors.New("rpc error: write /var/lib/buildkit/foo: no space left on device")
+	})
+	require.Error(t, err)
+	require.Equal(t, 2, calls)
+	require.True(t, isNoSpace(err))
+	require.Contains(t, err.Error(), "pruning 1 cache records")
+
+	// other errors are not retried
+	calls = 0
+	_, err = cm.withNoSpaceRetry(ctx, func() (ocispec.Descriptor, error) {
+		calls++
+		return ocispec.Descriptor{}, errors.New("other")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestExportImportState(t *testing.T) {
+	t.Parallel()
+	nsCtx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(nsCtx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(nsCtx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+	b2, desc2, err := mapToBlob(map[string]string{"foo2": "bar2"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref2", bytes.NewBuffer(b2), desc2)
+	require.NoError(t, err)
+
+	ref, err := co.manager.GetByBlob(ctx, desc, nil, WithDescription("layer1"), WithImageRef("docker.io/library/foo:latest"))
+	require.NoError(t, err)
+	ref2, err := co.manager.GetByBlob(ctx, desc2, ref, WithDescription("layer2"))
+	require.NoError(t, err)
+	id, id2 := ref.ID(), ref2.ID()
+	require.NoError(t, ref2.Release(ctx))
+	require.NoError(t, ref.Release(ctx))
+
+	// records without a blob can't be restored and are not exported
+	active, err := co.manager.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	snap, err := active.Commit(ctx)
+	require.NoError(t, err)
+	require.NoError(t, snap.Release(ctx))
+
+	// the parent of a matching record is always exported
+	buf := &bytes.Buffer{}
+	exported, err := co.manager.ExportState(ctx, buf, "description==layer2")
+	require.NoError(t, err)
+	require.Equal(t, []string{id, id2}, exported)
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{"index.json", "records/" + id + ".json", "records/" + id2 + ".json"}, names)
+
+	co2, cleanup2, err := newCacheManager(nsCtx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup2()
+
+	ctx, done2, err := leaseutil.WithLease(nsCtx, co2.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done2(context.TODO())
+
+	imported, err := co2.manager.ImportState(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	du, err := co2.manager.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(du))
+	records := map[string]*client.UsageInfo{}
+	for _, d := range du {
+		require.True(t, d.Lazy)
+		require.NotNil(t, d.LastUsedAt)
+		records[d.Description] = d
+	}
+	require.NotNil(t, records["layer1"])
+	require.NotNil(t, records["layer2"])
+	require.Equal(t, records["layer1"].ID, records["layer2"].Parent)
+	require.Equal(t, map[string]string{id: records["layer1"].ID, id2: records["layer2"].ID}, imported)
+	require.True(t, HasCachePolicyRetain(co2.manager.Metadata(records["layer2"].ID)))
+	require.Equal(t, desc2.Digest, records["layer2"].Blob)
+
+	// the content is fetched on demand
+	_, err = co2.manager.Get(ctx, records["layer2"].ID)
+	var missing NeedsRemoteProvidersError
+	require.True(t, errors.As(err, &missing))
+	require.Equal(t, NeedsRemoteProvidersError{desc2.Digest, desc.Digest}, missing)
+
+	// a pull of the same layers reuses the restored records
+	err = content.WriteBlob(ctx, co2.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co2.cs, "ref2", bytes.NewBuffer(b2), desc2)
+	require.NoError(t, err)
+
+	ref, err = co2.manager.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	defer ref.Release(context.TODO())
+	require.Equal(t, records["layer1"].ID, ref.ID())
+	ref2, err = co2.manager.GetByBlob(ctx, desc2, ref)
+	require.NoError(t, err)
+	defer ref2.Release(context.TODO())
+	require.Equal(t, records["layer2"].ID, ref2.ID())
+
+	err = ref2.Extract(ctx, nil)
+	require.NoError(t, err)
+
+	// importing the same state again doesn't create new records
+	imported2, err := co2.manager.ImportState(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, imported, imported2)
+	du, err = co2.manager.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(du))
+
+	_, err = co2.manager.ImportState(ctx, bytes.NewReader([]byte("invalid")))
+	require.Error(t, err)
+}
+
+func TestDedupeLayers(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	cm := co.manager
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	// the same layer compressed differently
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	zw, err := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	require.NoError(t, err)
+	_, err = io.Copy(zw, zr)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	b2 := buf.Bytes()
+	desc2 := ocispec.Descriptor{
+		Digest:      digest.FromBytes(b2),
+		MediaType:   desc.MediaType,
+		Size:        int64(len(b2)),
+		Annotations: desc.Annotations,
+	}
+	require.NotEqual(t, desc.Digest, desc2.Digest)
+	err = content.WriteBlob(ctx, co.cs, "ref2", bytes.NewBuffer(b2), desc2)
+	require.NoError(t, err)
+
+	var snaps []ImmutableRef
+	for i, d := range []ocispec.Descriptor{desc, desc2, desc2} {
+		active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+		require.NoError(t, err)
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		if i == 2 {
+			// a duplicate that is already committed
+			require.NoError(t, snap.Finalize(ctx, true))
+		}
+		err = snap.(*immutableRef).setBlob(ctx, d)
+		require.NoError(t, err)
+		snaps = append(snaps, snap)
+	}
+
+	info1 := snaps[0].Info()
+	for _, snap := range snaps[1:] {
+		info := snap.Info()
+		require.NotEqual(t, snaps[0].ID(), snap.ID())
+		require.Equal(t, info1.SnapshotID, info.SnapshotID)
+		require.Equal(t, desc.Digest, info.Blob)
+		require.Equal(t, info1.BlobChainID, info.BlobChainID)
+	}
+	info2 := snaps[1].Info()
+
+	// the snapshot of a duplicate that wasn't committed yet never is
+	_, err = co.snapshotter.Stat(ctx, snaps[1].ID())
+	require.True(t, errors.Is(err, errdefs.ErrNotFound))
+
+	// the shared snapshot is kept when the matched record is removed
+	require.NoError(t, snaps[0].Release(ctx))
+	err = cm.Prune(ctx, nil, client.PruneInfo{Filter: []string{"id==" + snaps[0].ID()}})
+	require.NoError(t, err)
+	_, err = cm.Get(ctx, snaps[0].ID())
+	require.Error(t, err)
+
+	_, err = co.snapshotter.Stat(ctx, info2.SnapshotID)
+	require.NoError(t, err)
+	for _, snap := range snaps[1:] {
+		_, err = co.snapshotter.Stat(ctx, snap.ID())
+		require.True(t, errors.Is(err, errdefs.ErrNotFound))
+
+		m, err := snap.Mount(ctx, true, nil)
+		require.NoError(t, err)
+		_, release, err := m.Mount()
+		require.NoError(t, err)
+		require.NoError(t, release())
+		require.NoError(t, snap.Release(ctx))
+	}
+}
+
+func TestFinalizeInterrupted(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	var commitHook func(ctx context.Context, sn snapshot.Snapshotter, name, key string) error
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		wrapSnapshotter: func(sn snapshot.Snapshotter) snapshot.Snapshotter {
+			return &commitHookSnapshotter{Snapshotter: sn, hook: &commitHook}
+		},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	newLazy := func() ImmutableRef {
+		active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+		require.NoError(t, err)
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		return snap
+	}
+	hasLease := func(id string) bool {
+		ls, err := co.lm.List(ctx, "id=="+id)
+		require.NoError(t, err)
+		return len(ls) == 1
+	}
+	requireFinalized := func(snap ImmutableRef) {
+		require.NoError(t, snap.Finalize(ctx, true))
+		require.Nil(t, snap.(*immutableRef).equalMutable)
+		require.True(t, hasLease(snap.ID()))
+		info, err := co.snapshotter.Stat(ctx, snap.ID())
+		require.NoError(t, err)
+		require.Equal(t, snapshots.KindCommitted, info.Kind)
+		require.NoError(t, snap.Release(ctx))
+	}
+
+	// cancelled before committing
+	snap := newLazy()
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = snap.Finalize(cctx, true)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.NotNil(t, snap.(*immutableRef).equalMutable)
+	require.False(t, hasLease(snap.ID()))
+	requireFinalized(snap)
+
+	// commit fails without committing, the lease is rolled back
+	snap = newLazy()
+	commitHook = func(ctx context.Context, sn snapshot.Snapshotter, name, key string) error {
+		return context.Canceled
+	}
+	err = snap.Finalize(ctx, true)
+	require.Error(t, err)
+	require.NotNil(t, snap.(*immutableRef).equalMutable)
+	require.False(t, hasLease(snap.ID()))
+	commitHook = nil
+	requireFinalized(snap)
+
+	// commit completes but reports the cancellation
+	snap = newLazy()
+	commitHook = func(ctx context.Context, sn snapshot.Snapshotter, name, key string) error {
+		if err := sn.Commit(ctx, name, key); err != nil {
+			return err
+		}
+		return context.Canceled
+	}
+	requireFinalized(snap)
+	commitHook = nil
+
+	// commit completed by an earlier attempt that didn't record it
+	snap = newLazy()
+	sr := snap.(*immutableRef)
+	_, err = co.lm.Create(ctx, leases.WithID(snap.ID()))
+	require.NoError(t, err)
+	require.NoError(t, cm.(*cacheManager).Snapshotter.Commit(leases.WithLease(ctx, snap.ID()), snap.ID(), sr.equalMutable.ID()))
+	requireFinalized(snap)
+}
+
+// commitHookSnapshotter replaces Commit with a hook when it is set
+type commitHookSnapshotter struct {
+	snapshot.Snapshotter
+	hook *func(ctx context.Context, sn snapshot.Snapshotter, name, key string) error
+}
+
+func (s *commitHookSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	if h := *s.hook; h != nil {
+		return h(ctx, s.Snapshotter, name, key)
+	}
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
+
+func TestImportBlob(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	ctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+	defer done(context.TODO())
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	diffID := digest.Digest(desc.Annotations["containerd.io/uncompressed"])
+
+	// blob produced without the uncompressed digest and media type
+	imported := ocispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    desc.Digest,
+	}
+
+	_, err = co.manager.ImportBlob(ctx, imported, nil)
+	require.Error(t, err)
+	require.True(t, errdefs.IsNotFound(err))
+
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	ref, err := co.manager.ImportBlob(ctx, imported, nil)
+	require.NoError(t, err)
+	defer ref.Release(context.TODO())
+
+	info := ref.Info()
+	require.Equal(t, desc.Digest, info.Blob)
+	require.Equal(t, diffID, info.DiffID)
+	require.Equal(t, diffID, info.ChainID)
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, info.MediaType)
+	require.Equal(t, desc.Size, getBlobSize(ref.(*immutableRef).md))
+
+	// importing again returns the same record
+	ref2, err := co.manager.ImportBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	defer ref2.Release(context.TODO())
+	require.Equal(t, ref.ID(), ref2.ID())
+}
+
+func TestVerify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	local, err := active.Commit(ctx)
+	require.NoError(t, err)
+	require.NoError(t, local.Finalize(ctx, true))
+	localID := local.ID()
+	localSnapshotID := getSnapshotID(local.(*immutableRef).md)
+	require.NoError(t, local.Release(ctx))
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	pulled, err := cm.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	require.NoError(t, pulled.Extract(ctx, nil))
+	pulledID := pulled.ID()
+	pulledSnapshotID := getSnapshotID(pulled.(*immutableRef).md)
+	require.NoError(t, pulled.Release(ctx))
+
+	// the blob of a lazy record is not in the content store
+	_, lazyDesc, err := mapToBlob(map[string]string{"foo2": "bar2"})
+	require.NoError(t, err)
+	lazy, err := cm.GetByBlob(ctx, lazyDesc, nil, DescHandlers{lazyDesc.Digest: &DescHandler{}})
+	require.NoError(t, err)
+	lazyID := lazy.ID()
+	require.NoError(t, lazy.Release(ctx))
+
+	res, err := cm.Verify(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(res))
+
+	require.NoError(t, co.snapshotter.Remove(ctx, localSnapshotID))
+	require.NoError(t, co.snapshotter.Remove(ctx, pulledSnapshotID))
+
+	res, err = cm.Verify(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	for _, r := range res {
+		require.False(t, r.Repaired)
+	}
+
+	res, err = cm.Verify(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	for _, r := range res {
+		require.True(t, r.Repaired)
+	}
+
+	// record without a blob can't be recovered and is removed
+	_, err = cm.Get(ctx, localID)
+	require.Error(t, err)
+
+	// record with a blob is extracted again on demand
+	pulled, err = cm.Get(ctx, pulledID)
+	require.NoError(t, err)
+	require.False(t, pulled.Info().Extracted)
+	require.NoError(t, pulled.Extract(ctx, nil))
+	require.True(t, pulled.Info().Extracted)
+	require.NoError(t, pulled.Release(ctx))
+
+	// the lazy record keeps its blob
+	lazy, err = cm.Get(ctx, lazyID, DescHandlers{lazyDesc.Digest: &DescHandler{}})
+	require.NoError(t, err)
+	require.Equal(t, lazyDesc.Digest, lazy.Info().Blob)
+	require.NotEqual(t, digest.Digest(""), lazy.Info().ChainID)
+	require.NoError(t, lazy.Release(ctx))
+
+	res, err = cm.Verify(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(res))
+}
+
+func TestVerifyUnlocked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	var statHook func()
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		wrapSnapshotter: func(sn snapshot.Snapshotter) snapshot.Snapshotter {
+			return &statHookSnapshotter{Snapshotter: sn, hook: &statHook}
+		},
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	snap, err := active.Commit(ctx)
+	require.NoError(t, err)
+	require.NoError(t, snap.Finalize(ctx, true))
+	id := snap.ID()
+	require.NoError(t, snap.Release(ctx))
+
+	// the manager can be used while the snapshotter is queried
+	called := false
+	statHook = func() {
+		called = true
+		ref, err := cm.Get(ctx, id)
+		require.NoError(t, err)
+		require.NoError(t, ref.Release(ctx))
+	}
+	res, err := cm.Verify(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(res))
+	require.True(t, called)
+}
+
+// statHookSnapshotter calls hook before every Stat.
+type statHookSnapshotter struct {
+	snapshot.Snapshotter
+	hook *func()
+}
+
+func (sn *statHookSnapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	if *sn.hook != nil {
+		(*sn.hook)()
+	}
+	return sn.Snapshotter.Stat(ctx, key)
+}
+
+func TestSnapshotMissing(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	pulled, err := cm.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+	defer pulled.Release(context.TODO())
+	require.NoError(t, pulled.Extract(ctx, nil))
+
+	snapshotID := getSnapshotID(pulled.(*immutableRef).md)
+	require.NoError(t, co.snapshotter.Remove(ctx, snapshotID))
+
+	// unpacked again from the blob
+	require.NoError(t, pulled.Extract(ctx, nil))
+	require.True(t, pulled.Info().Extracted)
+	_, err = co.snapshotter.Stat(ctx, snapshotID)
+	require.NoError(t, err)
+
+	active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+	local, err := active.Commit(ctx)
+	require.NoError(t, err)
+	defer local.Release(context.TODO())
+	require.NoError(t, local.Finalize(ctx, true))
+
+	require.NoError(t, co.snapshotter.Remove(ctx, getSnapshotID(local.(*immutableRef).md)))
+
+	_, err = local.Mount(ctx, true, nil)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrSnapshotMissing))
+	var missing *SnapshotMissingError
+	require.True(t, errors.As(err, &missing))
+	require.Equal(t, local.ID(), missing.ID)
+	require.Equal(t, local.Info().ChainID, missing.ChainID)
+
+	// record without snapshot or blob is no longer a valid cache result
+	_, err = cm.Get(ctx, local.ID())
+	require.Error(t, err)
+}
+
+func TestGetRemoteLease(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	b, desc, err := mapToBlob(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, co.cs, "ref1", bytes.NewBuffer(b), desc)
+	require.NoError(t, err)
+
+	ref, err := cm.GetByBlob(ctx, desc, nil)
+	require.NoError(t, err)
+
+	exportCtx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+
+	remote, err := ref.GetRemote(exportCtx, false, compression.New(compression.Default), nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(remote.Descriptors))
+	require.NoError(t, ref.Release(ctx))
+
+	// the record is gone but the blob is kept by the export lease
+	err = cm.Prune(ctx, nil, client.PruneInfo{All: true})
+	require.NoError(t, err)
+	checkDiskUsage(ctx, t, cm, 0, 0)
+	checkNumBlobs(ctx, t, co.cs, 1)
+
+	require.NoError(t, done(ctx))
+
+	err = cm.Prune(ctx, nil, client.PruneInfo{All: true})
+	require.NoError(t, err)
+	checkNumBlobs(ctx, t, co.cs, 0)
+}
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	tmpdir, err := ioutil.TempDir("", "cachemanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	snapshotter, err := native.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	require.NoError(t, err)
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		snapshotter:     snapshotter,
+		snapshotterName: "native",
+	})
+	require.NoError(t, err)
+
+	defer cleanup()
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil)
+	require.NoError(t, err)
+
+	snap, err := active.Commit(ctx)
+	require.NoError(t, err)
+
+	active, err = cm.New(ctx, snap, nil, CachePolicyRetain)
+	require.NoError(t, err)
+
+	snap2, err := active.Commit(ctx)
+	require.NoError(t, err)
+
+	checkDiskUsage(ctx, t, cm, 2, 0)
+
+	dirs, err := ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(dirs))
+
+	// prune with keeping refs does nothing
+	buf := pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
+	buf.close()
+	require.NoError(t, err)
+
+	checkDiskUsage(ctx, t, cm, 2, 0)
+	require.Equal(t, len(buf.all), 0)
+
+	dirs, err = ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(dirs))
+
+	err = snap2.Release(ctx)
+	require.NoError(t, err)
+
+	checkDiskUsage(ctx, t, cm, 1, 1)
+
+	// prune with keeping single refs deletes one
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
+	buf.close()
+	require.NoError(t, err)
+
+	checkDiskUsage(ctx, t, cm, 1, 0)
+	require.Equal(t, len(buf.all), 1)
+
+	dirs, err = ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dirs))
+
+	err = snap.Release(ctx)
+	require.NoError(t, err)
+
+	active, err = cm.New(ctx, snap, nil, CachePolicyRetain)
+	require.NoError(t, err)
+
+	snap2, err = active.Commit(ctx)
+	require.NoError(t, err)
+
+	err = snap.Release(ctx)
+	require.NoError(t, err)
+
+	checkDiskUsage(ctx, t, cm, 2, 0)
+
+	// prune with parent released does nothing
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
+	buf.close()
+	require.NoError(t, err)
+
+	checkDiskUsage(ctx, t, cm, 2, 0)
+	require.Equal(t, len(buf.all), 0)
+
+	// releasing last reference
+	err = snap2.Release(ctx)
+	require.NoError(t, err)
+	checkDiskUsage(ctx, t, cm, 0, 2)
+
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
+	buf.close()
+	require.NoError(t, err)
+
+	checkDiskUsage(ctx, t, cm, 0, 0)
+	require.Equal(t, len(buf.all), 2)
+
+	dirs, err = ioutil.ReadDir(filepath.Join(tmpdir, "snapshots/snapshots"))
+	require.NoError(t, err)
+	require.Equal(t, 0, len(dirs))
+}
+
+func TestPinnedPrune(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	tmpdir, err := ioutil.TempDir("", "cachemanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	snapshotter, err := native.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	require.NoError(t, err)
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		tmpdir:          tmpdir,
+		snapshotter:     snapshotter,
+		snapshotterName: "native",
+	})
+	require.NoError(t, err)
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+
+	snap, err := active.Commit(ctx)
+	require.NoError(t, err)
+
+	err = cm.Pin(ctx, snap.ID(), "base image")
+	require.NoError(t, err)
+
+	err = snap.Release(ctx)
+	require.NoError(t, err)
+
+	err = cm.Pin(ctx, "nonexistent", "")
+	require.Error(t, err)
+	require.True(t, errors.Is(err, errNotFound))
+
+	err = cm.Close()
+	require.NoError(t, err)
+
+	cleanup()
+
+	// pins are kept across restarts
+	co, cleanup, err = newCacheManager(ctx, cmOpt{
+		tmpdir:          tmpdir,
+		snapshotter:     snapshotter,
+		snapshotterName: "native",
+	})
+	require.NoError(t, err)
+	defer cleanup()
+	cm = co.manager
+
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(du))
+	require.True(t, du[0].Pinned)
+	require.Equal(t, "base image", du[0].PinReason)
+
+	// prune skips pinned records
+	buf := pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{All: true})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(buf.all))
+	checkDiskUsage(ctx, t, cm, 0, 1)
+
+	err = cm.Unpin(ctx, snap.ID())
+	require.NoError(t, err)
+
+	du, err = cm.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(du))
+	require.False(t, du[0].Pinned)
+
+	err = cm.Pin(ctx, snap.ID(), "")
+	require.NoError(t, err)
+
+	// forced prune removes pinned records
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{All: true, Force: true})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(buf.all))
+	checkDiskUsage(ctx, t, cm, 0, 0)
+}
+
+func TestPruneMinHits(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+	cm := co.manager
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+		require.NoError(t, err)
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		require.NoError(t, snap.Finalize(ctx, true))
+		ids = append(ids, snap.ID())
+		require.NoError(t, snap.Release(ctx))
+	}
+
+	// use the first record a few more times
+	for i := 0; i < 3; i++ {
+		ref, err := cm.Get(ctx, ids[0])
+		require.NoError(t, err)
+		require.NoError(t, ref.Release(ctx))
+	}
+
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	usage := map[string]int{}
+	scores := map[string]float64{}
+	for _, d := range du {
+		usage[d.ID] = d.UsageCount
+		scores[d.ID] = d.UsageScore
+	}
+	require.True(t, usage[ids[0]] > usage[ids[1]])
+
+	// the records were just used so their scores have hardly decayed
+	for _, id := range ids {
+		require.True(t, scores[id] > 0)
+		require.InDelta(t, float64(usage[id]), scores[id], 0.01)
+	}
+
+	buf := pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{MinHits: usage[ids[0]]})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(buf.all))
+	require.Equal(t, ids[1], buf.all[0].ID)
+	require.InDelta(t, scores[ids[1]], buf.all[0].UsageScore, 0.01)
+	checkDiskUsage(ctx, t, cm, 0, 1)
+
+	// only the uses of the last week are counted
+	md := cm.Metadata(ids[0])
+	require.NotNil(t, md)
+	v, err := metadata.NewValue([]dayUses{{Day: usageDay(time.Now().Add(-2 * usageWindow)), Count: usage[ids[0]]}})
+	require.NoError(t, err)
+	require.NoError(t, md.Update(func(b *bolt.Bucket) error {
+		return md.SetValue(b, keyRecentUses, v)
+	}))
+
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{MinHits: usage[ids[0]]})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(buf.all))
+	require.Equal(t, ids[0], buf.all[0].ID)
+	checkDiskUsage(ctx, t, cm, 0, 0)
+}
+
+func TestUsageScore(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	require.Equal(t, 3.0, decayUsageScore(3, 0))
+	require.InDelta(t, 1.5, decayUsageScore(3, usageScoreHalfLife), 1e-9)
+	require.InDelta(t, 0.75, decayUsageScore(3, 2*usageScoreHalfLife), 1e-9)
+
+	uses := []dayUses{
+		{Day: usageDay(now.Add(-8 * 24 * time.Hour)), Count: 5},
+		{Day: usageDay(now.Add(-2 * 24 * time.Hour)), Count: 2},
+		{Day: usageDay(now), Count: 1},
+	}
+	require.Equal(t, 3, countRecentUses(uses, now))
+}
+
+func TestPruneMaxFreed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	for _, size := range []int{1024, 65536, 16384} {
+		active, err := cm.New(ctx, nil, nil, CachePolicyRetain, WithDescription(fmt.Sprintf("data%d", size)))
+		require.NoError(t, err)
+		m, err := active.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "data"), make([]byte, size), 0600)
+		require.NoError(t, err)
+		require.NoError(t, release())
+		snap, err := active.Commit(ctx)
+		require.NoError(t, err)
+		require.NoError(t, snap.Release(ctx))
+	}
+
+	// sizes are known after they have been calculated once
+	checkDiskUsage(ctx, t, cm, 0, 3)
+
+	// records selected by a canceled prune are kept
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	buf := pruneResultBuffer()
+	err = cm.Prune(cctx, buf.C, client.PruneInfo{})
+	buf.close()
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Equal(t, 0, len(buf.all))
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(du))
+	for _, d := range du {
+		ref, err := cm.Get(ctx, d.ID)
+		require.NoError(t, err)
+		require.NoError(t, ref.Release(ctx))
+	}
+
+	// the largest record is removed first and enough space is freed by it
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{MaxFreed: 1})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(buf.all))
+	require.Equal(t, "data65536", buf.all[0].Description)
+	checkDiskUsage(ctx, t, cm, 0, 2)
+
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(buf.all))
+	checkDiskUsage(ctx, t, cm, 0, 0)
+}
+
+func TestSortDeleteRecords(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	records := func() []*deleteRecord {
+		return []*deleteRecord{
+			{lastUsedAt: &now, usageScore: 1, size: 1 << 30},
+			{lastUsedAt: &old, usageScore: 1, size: 1 << 10},
+			{lastUsedAt: nil, usageScore: 0, size: 1 << 20},
+		}
+	}
+	sizes := func(toDelete []*deleteRecord) []int64 {
+		var out []int64
+		for _, r := range toDelete {
+			out = append(out, r.size)
+		}
+		return out
+	}
+
+	// GC policies keep the recently used records regardless of their size
+	toDelete := records()
+	sortDeleteRecords(toDelete, false)
+	require.Equal(t, []int64{1 << 20, 1 << 10, 1 << 30}, sizes(toDelete))
+
+	toDelete = records()
+	sortDeleteRecords(toDelete, true)
+	require.Equal(t, []int64{1 << 30, 1 << 20, 1 << 10}, sizes(toDelete))
+}
+
+func TestPruneFilterExpressions(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	old := now.Add(-100 * time.Hour)
+	recent := now.Add(-time.Hour)
+
+	cacheMountOld := &client.UsageInfo{RecordType: client.UsageRecordTypeCacheMount, CreatedAt: old, LastUsedAt: &old}
+	cacheMountRecent := &client.UsageInfo{RecordType: client.UsageRecordTypeCacheMount, CreatedAt: old, LastUsedAt: &recent}
+	regularOld := &client.UsageInfo{RecordType: client.UsageRecordTypeRegular, CreatedAt: old}
+	localRecent := &client.UsageInfo{RecordType: client.UsageRecordTypeLocalSource, CreatedAt: recent}
+
+	cases := []struct {
+		filters []string
+		matches []bool
+	}{
+		{nil, []bool{true, true, true, true}},
+		{[]string{"type==exec.cachemount"}, []bool{true, true, false, false}},
+		{[]string{"type==exec.cachemount && unused>72h"}, []bool{true, false, false, false}},
+		{[]string{"type==exec.cachemount && age>3d"}, []bool{true, true, false, false}},
+		{[]string{"unused>=72h"}, []bool{true, false, true, false}},
+		{[]string{"unused<2h"}, []bool{false, true, false, true}},
+		{[]string{"type==source.local || type==regular && age>72h"}, []bool{false, false, true, true}},
+		{[]string{"type==source.local", "type==exec.cachemount && unused>72h"}, []bool{true, false, false, true}},
+	}
+	for _, tc := range cases {
+		f, err := parseFilters(tc.filters...)
+		require.NoError(t, err)
+		for i, ui := range []*client.UsageInfo{cacheMountOld, cacheMountRecent, regularOld, localRecent} {
+			require.Equal(t, tc.matches[i], f.Match(adaptUsageInfo(ui)), "filters %v, record %d", tc.filters, i)
+		}
+	}
+
+	install := &client.UsageInfo{Description: "apt-get update && apt-get install"}
+	update := &client.UsageInfo{Description: "apt-get update"}
+	cases = []struct {
+		filters []string
+		matches []bool
+	}{
+		{[]string{`description=="apt-get update && apt-get install"`}, []bool{true, false}},
+		{[]string{`description~="update && apt" || description=="apt-get update"`}, []bool{true, true}},
+		{[]string{`description~=update&&apt`}, []bool{false, false}},
+		{[]string{`description~=/install$/ && description~="a||b|get"`}, []bool{true, false}},
+	}
+	for _, tc := range cases {
+		f, err := parseFilters(tc.filters...)
+		require.NoError(t, err)
+		for i, ui := range []*client.UsageInfo{install, update} {
+			require.Equal(t, tc.matches[i], f.Match(adaptUsageInfo(ui)), "filters %v, record %d", tc.filters, i)
+		}
+	}
+
+	_, err := parseFilters("unused>72x")
+	require.Error(t, err)
+	_, err = parseFilters("type==regular,unused>72h")
+	require.Error(t, err)
+	_, err = parseFilters(`description=="apt-get update && apt-get install`)
+	require.Error(t, err)
+}
+
+func TestPruneVariants(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Depends on unimplemented containerd bind-mount support on Windows")
+	}
+
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	// variants are only kept by the labels of the blobs once the lease of
+	// the conversions is gone
+	lctx, done, err := leaseutil.WithLease(ctx, co.lm, leaseutil.MakeTemporary)
+	require.NoError(t, err)
+
+	blobs := map[string]ocispec.Descriptor{}
+	var ids []string
+	for i, comps := range [][]compression.Config{
+		{compression.New(compression.Zstd), compression.New(compression.Uncompressed)},
+		{compression.New(compression.Uncompressed), compression.New(compression.Uncompressed).SetIfSmaller()},
+	} {
+		active, err := cm.New(ctx, nil, nil)
+		require.NoError(t, err)
+		m, err := active.Mount(ctx, false, nil)
+		require.NoError(t, err)
+		mounts, release, err := m.Mount()
+		require.NoError(t, err)
+		err = ioutil.WriteFile(filepath.Join(mounts[0].Source, "file"), bytes.Repeat([]byte(fmt.Sprintf("data %d ", i)), 1<<12), 0600)
+		require.NoError(t, err)
+		require.NoError(t, release())
+		ref, err := active.Commit(ctx)
+		require.NoError(t, err)
+
+		remotes, err := ref.GetRemotes(lctx, true, []compression.Config{compression.New(compression.Gzip)}, false, nil)
+		require.NoError(t, err)
+		blobs[fmt.Sprintf("%d-gzip", i)] = remotes[0].Descriptors[0]
+		remotes, err = ref.GetRemotes(lctx, false, comps, true, nil)
+		require.NoError(t, err)
+		for j, comp := range comps {
+			blobs[fmt.Sprintf("%d-%s", i, variantName(comp))] = remotes[j].Descriptors[0]
+		}
+		ids = append(ids, ref.ID())
+		require.NoError(t, ref.Release(ctx))
+	}
+	require.NoError(t, done(ctx))
+	// the if-smaller choice of the second record is its own blob
+	require.Equal(t, blobs["1-gzip"].Digest, blobs["1-uncompressed.if-smaller"].Digest)
+
+	exists := func(key string) bool {
+		_, err := co.cs.Info(ctx, blobs[key].Digest)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return false
+		}
+		require.NoError(t, err)
+		return true
+	}
+
+	buf := pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{Filter: []string{"variant==zstd"}})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(buf.all))
+	require.Equal(t, ids[0], buf.all[0].ID)
+	require.Equal(t, blobs["0-zstd"].Size, buf.all[0].Size)
+	require.False(t, exists("0-zstd"))
+	require.True(t, exists("0-gzip"))
+	require.True(t, exists("0-uncompressed"))
+	checkDiskUsage(ctx, t, cm, 0, 2)
+
+	// the variants of a record whose blob is one of them are kept
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{Filter: []string{"variant==uncompressed && id==" + ids[1]}})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(buf.all))
+	require.True(t, exists("1-uncompressed"))
+
+	buf = pruneResultBuffer()
+	err = cm.Prune(ctx, buf.C, client.PruneInfo{Filter: []string{"variant==uncompressed"}})
+	buf.close()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(buf.all))
+	require.Equal(t, ids[0], buf.all[0].ID)
+	require.False(t, exists("0-uncompressed"))
+	require.True(t, exists("1-uncompressed"))
+	require.True(t, exists("0-gzip"))
+	require.True(t, exists("1-gzip"))
+	checkDiskUsage(ctx, t, cm, 0, 2)
+
+	for _, f := range []string{"variant==nydus", "variant==zstd || type==regular", "variant==zstd && variant==gzip"} {
+		err = cm.Prune(ctx, nil, client.PruneInfo{Filter: []string{f}})
+		require.Error(t, err, f)
+	}
+}
+
+func TestSearchDescription(t *testing.T) {
+	t.Parallel()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil, WithDescription("mount / from exec apt-get update"))
+	require.NoError(t, err)
+	ref1, err := active.Commit(ctx)
+	require.NoError(t, err)
+	defer ref1.Release(ctx)
+
+	active, err = cm.New(ctx, nil, nil, WithDescription("pulled from docker.io/library/alpine:latest"))
+	require.NoError(t, err)
+	ref2, err := active.Commit(ctx)
+	require.NoError(t, err)
+	defer ref2.Release(ctx)
+
+	ids, err := cm.Search(ctx, "apt-get", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{ref1.ID()}, ids)
+
+	ids, err = cm.Search(ctx, "apt-get", true)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(ids))
+
+	ids, err = cm.Search(ctx, "pulled from ", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{ref2.ID()}, ids)
+
+	require.NoError(t, SetDescription(ref2, "mount /src from exec make"))
+
+	ids, err = cm.Search(ctx, "pulled from ", true)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(ids))
+
+	ids, err = cm.Search(ctx, "mount ", true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{ref1.ID(), ref2.ID()}, ids)
+
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{Filter: []string{"description~=apt-get"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(du))
+	require.Equal(t, ref1.ID(), du[0].ID)
+}
+
+func TestLazyCommit(t *testing.T) {
+	t.Parallel()
+
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	tmpdir, err := ioutil.TempDir("", "cachemanager")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	snapshotter, err := native.NewSnapshotter(filepath.Join(tmpdir, "snapshots"))
+	require.NoError(t, err)
+
+	co, cleanup, err := newCacheManager(ctx, cmOpt{
+		tmpdir:          tmpdir,
+		snapshotter:     snapshotter,
+		snapshotterName: "native",
+	})
+	require.NoError(t, err)
+	cm := co.manager
+
+	active, err := cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+
+	// after commit mutable is locked
+	snap, err := active.Commit(ctx)
+	require.NoError(t, err)
+
+	_, err = cm.GetMutable(ctx, active.ID())
+	require.Error(t, err)
+	require.Equal(t, true, errors.Is(err, ErrLocked))
+
+	// immutable refs still work
+	snap2, err := cm.Get(ctx, snap.ID())
+	require.NoError(t, err)
+	require.Equal(t, snap.ID(), snap2.ID())
+
+	err = snap.Release(ctx)
+	require.NoError(t, err)
+
+	err = snap2.Release(ctx)
+	require.NoError(t, err)
+
+	// immutable work after final release as well
+	snap, err = cm.Get(ctx, snap.ID())
+	require.NoError(t, err)
+	require.Equal(t, snap.ID(), snap2.ID())
+
+	// active can't be get while immutable is held
+	_, err = cm.GetMutable(ctx, active.ID())
+	require.Error(t, err)
+	require.Equal(t, true, errors.Is(err, ErrLocked))
+
+	err = snap.Release(ctx)
+	require.NoError(t, err)
+
+	// after release mutable becomes available again
+	active2, err := cm.GetMutable(ctx, active.ID())
+	require.NoError(t, err)
+	require.Equal(t, active2.ID(), active.ID())
+
+	// because ref was took mutable old immutable are cleared
+	_, err = cm.Get(ctx, snap.ID())
+	require.Error(t, err)
+	require.Equal(t, true, errors.Is(err, errNotFound))
+
+	snap, err = active2.Commit(ctx)
+	require.NoError(t, err)
+
+	// this time finalize commit
+	err = snap.Finalize(ctx, true)
+	require.NoError(t, err)
+
+	err = snap.Release(ctx)
+	require.NoError(t, err)
+
+	// mutable is gone after finalize
+	_, err = cm.GetMutable(ctx, active2.ID())
+	require.Error(t, err)
+	require.Equal(t, true, errors.Is(err, errNotFound))
+
+	// immutable still works
+	snap2, err = cm.Get(ctx, snap.ID())
+	require.NoError(t, err)
+	require.Equal(t, snap.ID(), snap2.ID())
+
+	err = snap2.Release(ctx)
+	require.NoError(t, err)
+
+	// test restarting after commit
+	active, err = cm.New(ctx, nil, nil, CachePolicyRetain)
+	require.NoError(t, err)
+
+	// after commit mutable is locked
+	snap, err = active.Commit(ctx)
+	require.NoError(t, err)
+
+	err = cm.Close()
+	require.NoError(t, err)
+
+	cleanup()
+
+	// we can't close snapshotter and open it twice (especially, its internal bbolt store)
+	co, cleanup, err = newCacheManager(ctx, cmOpt{
+		tmpdir:          tmpdir,
+		snapshotter:     snapshotter,
 		snapshotterName: "native",
 	})
 	require.NoError(t, err)
@@ -965,6 +4077,10 @@ func checkDiskUsage(ctx context.Context, t *testing.T, cm Manager, inuse, unused
 	}
 	require.Equal(t, inuse, inuseActual)
 	require.Equal(t, unused, unusedActual)
+	// DiskUsage computes the sizes, so the quota usage is checked too
+	if cm, ok := cm.(*cacheManager); ok {
+		require.Equal(t, sumUsedSize(cm), cm.usedSize())
+	}
 }
 
 func checkNumBlobs(ctx context.Context, t *testing.T, cs content.Store, expected int) {
@@ -1031,3 +4147,13 @@ func mapToBlob(m map[string]string) ([]byte, ocispec.Descriptor, error) {
 		},
 	}, nil
 }
+
+type countingProvider struct {
+	content.Provider
+	count int32
+}
+
+func (p *countingProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	atomic.AddInt32(&p.count, 1)
+	return p.Provider.ReaderAt(ctx, desc)
+}
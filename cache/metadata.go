@@ -1,8 +1,10 @@
 package cache
 
 import (
+	"math"
 	"time"
 
+	"github.com/docker/docker/pkg/idtools"
 	"github.com/moby/buildkit/cache/metadata"
 	"github.com/moby/buildkit/client"
 	"github.com/pkg/errors"
@@ -14,9 +16,18 @@ const keySize = "snapshot.size"
 const keyEqualMutable = "cache.equalMutable"
 const keyCachePolicy = "cache.cachePolicy"
 const keyDescription = "cache.description"
+const indexDescription = "description:"
 const keyCreatedAt = "cache.createdAt"
 const keyLastUsedAt = "cache.lastUsedAt"
 const keyUsageCount = "cache.usageCount"
+
+// RecentUses are the number of uses of the record per day over the last
+// usageWindow
+const keyRecentUses = "cache.recentUses"
+
+// UsageScore is the number of uses of the record decayed by
+// usageScoreHalfLife, as of the last use
+const keyUsageScore = "cache.usageScore"
 const keyLayerType = "cache.layerType"
 const keyRecordType = "cache.recordType"
 const keyCommitted = "snapshot.committed"
@@ -33,8 +44,31 @@ const keyImageRefs = "cache.imageRefs"
 // BlobSize is the packed blob size as specified in the oci descriptor
 const keyBlobSize = "cache.blobsize"
 
+// BlobAnnotations are the compression specific annotations of the blob
+// descriptor that need to be kept with the blob
+const keyBlobAnnotations = "cache.blobAnnotations"
+
 const keyDeleted = "cache.deleted"
 
+// Pinned records are skipped by prune unless it's forced, the value is the
+// reason for pinning
+const keyPinned = "cache.pinned"
+
+// BuildID is the session of the build that created the record
+const keyBuildID = "cache.buildID"
+
+// DiffPlan is the recorded diff tar of the record, stored externally
+const keyDiffPlan = "cache.diffPlan"
+
+// IdentityMapping is the uid and gid mapping the snapshot was created with
+const keyIdentityMapping = "cache.identityMapping"
+
+// Namespace is the cache namespace of the build that created the record
+const keyNamespace = "cache.namespace"
+
+// Pulled records were created for a layer blob by GetByBlob
+const keyPulled = "cache.pulled"
+
 func queueDiffID(si *metadata.StorageItem, str string) error {
 	if str == "" {
 		return nil
@@ -43,6 +77,7 @@ func queueDiffID(si *metadata.StorageItem, str string) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to create diffID value")
 	}
+	v.Index = indexDiffID + str
 	si.Update(func(b *bolt.Bucket) error {
 		return si.SetValue(b, keyDiffID, v)
 	})
@@ -227,6 +262,40 @@ func setDeleted(si *metadata.StorageItem) error {
 	return nil
 }
 
+func unsetDeleted(si *metadata.StorageItem) error {
+	return si.Update(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyDeleted, nil)
+	})
+}
+
+func setPinned(si *metadata.StorageItem, reason string) error {
+	v, err := metadata.NewValue(reason)
+	if err != nil {
+		return errors.Wrap(err, "failed to create pinned value")
+	}
+	return si.Update(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyPinned, v)
+	})
+}
+
+func unsetPinned(si *metadata.StorageItem) error {
+	return si.Update(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyPinned, nil)
+	})
+}
+
+func getPinned(si *metadata.StorageItem) (bool, string) {
+	v := si.Get(keyPinned)
+	if v == nil {
+		return false, ""
+	}
+	var reason string
+	if err := v.Unmarshal(&reason); err != nil {
+		return false, ""
+	}
+	return true, reason
+}
+
 func getDeleted(si *metadata.StorageItem) bool {
 	v := si.Get(keyDeleted)
 	if v == nil {
@@ -368,6 +437,32 @@ func getBlobSize(si *metadata.StorageItem) int64 {
 	return size
 }
 
+func queueBlobAnnotations(si *metadata.StorageItem, m map[string]string) error {
+	if len(m) == 0 {
+		return nil
+	}
+	v, err := metadata.NewValue(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to create blobAnnotations value")
+	}
+	si.Queue(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyBlobAnnotations, v)
+	})
+	return nil
+}
+
+func getBlobAnnotations(si *metadata.StorageItem) map[string]string {
+	v := si.Get(keyBlobAnnotations)
+	if v == nil {
+		return nil
+	}
+	var m map[string]string
+	if err := v.Unmarshal(&m); err != nil {
+		return nil
+	}
+	return m
+}
+
 func getEqualMutable(si *metadata.StorageItem) string {
 	v := si.Get(keyEqualMutable)
 	if v == nil {
@@ -426,12 +521,21 @@ func queueDescription(si *metadata.StorageItem, descr string) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to create description value")
 	}
+	v.Index = indexDescription + descr
 	si.Queue(func(b *bolt.Bucket) error {
 		return si.SetValue(b, keyDescription, v)
 	})
 	return nil
 }
 
+// SetDescription replaces the description of the record.
+func SetDescription(m withMetadata, descr string) error {
+	if err := queueDescription(m.Metadata(), descr); err != nil {
+		return err
+	}
+	return m.Metadata().Commit()
+}
+
 func GetDescription(si *metadata.StorageItem) string {
 	v := si.Get(keyDescription)
 	if v == nil {
@@ -444,6 +548,117 @@ func GetDescription(si *metadata.StorageItem) string {
 	return str
 }
 
+func queueBuildID(si *metadata.StorageItem, id string) error {
+	if id == "" {
+		return nil
+	}
+	v, err := metadata.NewValue(id)
+	if err != nil {
+		return errors.Wrap(err, "failed to create buildID value")
+	}
+	si.Queue(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyBuildID, v)
+	})
+	return nil
+}
+
+func GetBuildID(si *metadata.StorageItem) string {
+	v := si.Get(keyBuildID)
+	if v == nil {
+		return ""
+	}
+	var str string
+	if err := v.Unmarshal(&str); err != nil {
+		return ""
+	}
+	return str
+}
+
+func queueNamespace(si *metadata.StorageItem, ns string) error {
+	if ns == "" {
+		return nil
+	}
+	v, err := metadata.NewValue(ns)
+	if err != nil {
+		return errors.Wrap(err, "failed to create namespace value")
+	}
+	si.Queue(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyNamespace, v)
+	})
+	return nil
+}
+
+func GetNamespace(si *metadata.StorageItem) string {
+	v := si.Get(keyNamespace)
+	if v == nil {
+		return ""
+	}
+	var str string
+	if err := v.Unmarshal(&str); err != nil {
+		return ""
+	}
+	return str
+}
+
+func queuePulled(si *metadata.StorageItem) error {
+	v, err := metadata.NewValue(true)
+	if err != nil {
+		return errors.Wrap(err, "failed to create pulled value")
+	}
+	si.Queue(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyPulled, v)
+	})
+	return nil
+}
+
+func isPulled(si *metadata.StorageItem) bool {
+	v := si.Get(keyPulled)
+	if v == nil {
+		return false
+	}
+	var pulled bool
+	if err := v.Unmarshal(&pulled); err != nil {
+		return false
+	}
+	return pulled
+}
+
+type identityMappingValue struct {
+	UIDs []idtools.IDMap `json:",omitempty"`
+	GIDs []idtools.IDMap `json:",omitempty"`
+}
+
+func queueIdentityMapping(si *metadata.StorageItem, idmap *idtools.IdentityMapping) error {
+	var m identityMappingValue
+	if idmap != nil {
+		m.UIDs = idmap.UIDs()
+		m.GIDs = idmap.GIDs()
+	}
+	v, err := metadata.NewValue(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to create identity mapping value")
+	}
+	si.Queue(func(b *bolt.Bucket) error {
+		return si.SetValue(b, keyIdentityMapping, v)
+	})
+	return nil
+}
+
+// getIdentityMapping returns the identity mapping the snapshot of the record
+// was created with. The bool is false for records created before the
+// mapping was recorded.
+func getIdentityMapping(si *metadata.StorageItem) (*idtools.IdentityMapping, bool) {
+	v := si.Get(keyIdentityMapping)
+	if v == nil {
+		return nil, false
+	}
+	var m identityMappingValue
+	if err := v.Unmarshal(&m); err != nil {
+		return nil, false
+	}
+	return idtools.NewIDMappingsFromMaps(m.UIDs, m.GIDs), true
+}
+
 func queueCreatedAt(si *metadata.StorageItem, tm time.Time) error {
 	v, err := metadata.NewValue(tm.UnixNano())
 	if err != nil {
@@ -488,22 +703,127 @@ func getLastUsed(si *metadata.StorageItem) (int, *time.Time) {
 	return usageCount, &tm
 }
 
+// usageWindow is the period over which recent uses are counted for the
+// min-hits of prune policies.
+const usageWindow = 7 * 24 * time.Hour
+
+// usageScoreHalfLife is the time after which a use counts half in the usage
+// score.
+const usageScoreHalfLife = 7 * 24 * time.Hour
+
+// dayUses is the number of uses of a record on a day since the epoch.
+type dayUses struct {
+	Day   int64
+	Count int
+}
+
+func usageDay(tm time.Time) int64 {
+	return tm.Unix() / int64(24*time.Hour/time.Second)
+}
+
+// getRecentUses returns the number of uses of a record in the usageWindow
+// before now, counted per day. Records last used before the uses were
+// recorded per day count all their uses if the last one is recent.
+func getRecentUses(si *metadata.StorageItem, now time.Time) int {
+	v := si.Get(keyRecentUses)
+	if v == nil {
+		count, lastUsedAt := getLastUsed(si)
+		if lastUsedAt != nil && lastUsedAt.After(now.Add(-usageWindow)) {
+			return count
+		}
+		return 0
+	}
+	var uses []dayUses
+	if err := v.Unmarshal(&uses); err != nil {
+		return 0
+	}
+	return countRecentUses(uses, now)
+}
+
+func countRecentUses(uses []dayUses, now time.Time) int {
+	since := usageDay(now.Add(-usageWindow))
+	count := 0
+	for _, u := range uses {
+		if u.Day > since {
+			count += u.Count
+		}
+	}
+	return count
+}
+
+// getUsageScore returns the usage score of a record decayed to now.
+func getUsageScore(si *metadata.StorageItem, now time.Time) float64 {
+	count, lastUsedAt := getLastUsed(si)
+	if lastUsedAt == nil {
+		return 0
+	}
+	score := float64(count)
+	if v := si.Get(keyUsageScore); v != nil {
+		if err := v.Unmarshal(&score); err != nil {
+			return 0
+		}
+	}
+	return decayUsageScore(score, now.Sub(*lastUsedAt))
+}
+
+func decayUsageScore(score float64, age time.Duration) float64 {
+	if age <= 0 {
+		return score
+	}
+	return score * math.Exp2(-float64(age)/float64(usageScoreHalfLife))
+}
+
 func updateLastUsed(si *metadata.StorageItem) error {
+	now := time.Now()
 	count, _ := getLastUsed(si)
 	count++
+	score := getUsageScore(si, now) + 1
+
+	var uses []dayUses
+	if v := si.Get(keyRecentUses); v != nil {
+		if err := v.Unmarshal(&uses); err != nil {
+			uses = nil
+		}
+	}
+	since := usageDay(now.Add(-usageWindow))
+	recent := make([]dayUses, 0, len(uses)+1)
+	for _, u := range uses {
+		if u.Day > since {
+			recent = append(recent, u)
+		}
+	}
+	if day := usageDay(now); len(recent) > 0 && recent[len(recent)-1].Day == day {
+		recent[len(recent)-1].Count++
+	} else {
+		recent = append(recent, dayUses{Day: day, Count: 1})
+	}
 
 	v, err := metadata.NewValue(count)
 	if err != nil {
 		return errors.Wrap(err, "failed to create usageCount value")
 	}
-	v2, err := metadata.NewValue(time.Now().UnixNano())
+	v2, err := metadata.NewValue(now.UnixNano())
 	if err != nil {
 		return errors.Wrap(err, "failed to create lastUsedAt value")
 	}
+	v3, err := metadata.NewValue(recent)
+	if err != nil {
+		return errors.Wrap(err, "failed to create recentUses value")
+	}
+	v4, err := metadata.NewValue(score)
+	if err != nil {
+		return errors.Wrap(err, "failed to create usageScore value")
+	}
 	return si.Update(func(b *bolt.Bucket) error {
 		if err := si.SetValue(b, keyUsageCount, v); err != nil {
 			return err
 		}
+		if err := si.SetValue(b, keyRecentUses, v3); err != nil {
+			return err
+		}
+		if err := si.SetValue(b, keyUsageScore, v4); err != nil {
+			return err
+		}
 		return si.SetValue(b, keyLastUsedAt, v2)
 	})
 }
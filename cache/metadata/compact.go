@@ -0,0 +1,165 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	compactSuffix = ".compact"
+	backupSuffix  = ".bak"
+)
+
+// stores tracks the open stores so their size can be reported by the debug
+// handlers of the daemon.
+var stores sync.Map // map[*Store]struct{}
+
+// OpenStores returns the stores that are currently open sorted by path.
+func OpenStores() []*Store {
+	var out []*Store
+	stores.Range(func(k, _ interface{}) bool {
+		out = append(out, k.(*Store))
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].path < out[j].path
+	})
+	return out
+}
+
+// Stats describes the disk usage of a store.
+type Stats struct {
+	Path string
+	// Size is the size of the database file
+	Size int64
+	// FreeSize is the size of the pages in the file that are not used by any
+	// data and can be reclaimed by compacting the store
+	FreeSize     int64
+	FreePages    int
+	PendingPages int
+}
+
+func (s *Store) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return Stats{}, errors.WithStack(err)
+	}
+	st := s.db.Stats()
+	return Stats{
+		Path:         s.path,
+		Size:         fi.Size(),
+		FreeSize:     int64(st.FreeAlloc),
+		FreePages:    st.FreePageN,
+		PendingPages: st.PendingPageN,
+	}, nil
+}
+
+// Compact rewrites the database into a new file without the free pages and
+// replaces the original file with it. All other access to the store is
+// blocked while the store is compacted. If compaction fails the original
+// database is kept.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.path + compactSuffix
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if err := copyDB(tmp, s.db); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to compact %s", s.path)
+	}
+
+	// keep a link to the original until the compacted database is opened
+	backup := s.path + backupSuffix
+	os.Remove(backup)
+	if err := os.Link(s.path, backup); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	defer os.Remove(backup)
+
+	if err := s.db.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return s.reopen(errors.WithStack(err))
+	}
+	syncDir(filepath.Dir(s.path))
+
+	db, err := bolt.Open(s.path, 0600, nil)
+	if err != nil {
+		if err := os.Rename(backup, s.path); err != nil {
+			return errors.Wrapf(err, "failed to restore %s", s.path)
+		}
+		return s.reopen(errors.Wrapf(err, "failed to open compacted database %s", s.path))
+	}
+	s.db = db
+	return nil
+}
+
+// reopen opens the database file again after a failed compaction and returns
+// the original error.
+func (s *Store) reopen(err error) error {
+	db, err1 := bolt.Open(s.path, 0600, nil)
+	if err1 != nil {
+		return errors.Wrapf(err1, "failed to reopen %s after %v", s.path, err)
+	}
+	s.db = db
+	return err
+}
+
+func copyDB(dst string, src *bolt.DB) error {
+	db, err := bolt.Open(dst, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = src.View(func(stx *bolt.Tx) error {
+		return db.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nb, b)
+			})
+		})
+	})
+	if err1 := db.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nb, src.Bucket(k))
+	})
+}
+
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
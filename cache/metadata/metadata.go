@@ -3,6 +3,7 @@ package metadata
 import (
 	"bytes"
 	"encoding/json"
+	"os"
 	"strings"
 	"sync"
 
@@ -20,24 +21,55 @@ const (
 var errNotFound = errors.Errorf("not found")
 
 type Store struct {
-	db *bolt.DB
+	// mu is held exclusively while the database is swapped by Compact
+	mu   sync.RWMutex
+	db   *bolt.DB
+	path string
 }
 
 func NewStore(dbPath string) (*Store, error) {
+	// leftovers of a compaction that did not complete, the database file
+	// itself is only replaced once the compacted copy is complete
+	os.Remove(dbPath + compactSuffix)
+	os.Remove(dbPath + backupSuffix)
+
 	db, err := bolt.Open(dbPath, 0600, nil)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to open database file %s", dbPath)
 	}
-	return &Store{db: db}, nil
+	s := &Store{db: db, path: dbPath}
+	stores.Store(s, struct{}{})
+	return s, nil
 }
 
+// DB returns the underlying database. The returned handle is closed when the
+// store is compacted.
 func (s *Store) DB() *bolt.DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.db
 }
 
+// Path returns the path of the database file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Update(fn)
+}
+
 func (s *Store) All() ([]*StorageItem, error) {
 	var out []*StorageItem
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(mainBucket))
 		if b == nil {
 			return nil
@@ -60,7 +92,7 @@ func (s *Store) All() ([]*StorageItem, error) {
 
 func (s *Store) Probe(index string) (bool, error) {
 	var exists bool
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(indexBucket))
 		if b == nil {
 			return nil
@@ -81,8 +113,17 @@ func (s *Store) Probe(index string) (bool, error) {
 }
 
 func (s *Store) Search(index string) ([]*StorageItem, error) {
+	return s.search(indexKey(index, ""))
+}
+
+// SearchPrefix returns the items with an index value that starts with prefix.
+func (s *Store) SearchPrefix(prefix string) ([]*StorageItem, error) {
+	return s.search(prefix)
+}
+
+func (s *Store) search(prefix string) ([]*StorageItem, error) {
 	var out []*StorageItem
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(indexBucket))
 		if b == nil {
 			return nil
@@ -91,12 +132,12 @@ func (s *Store) Search(index string) ([]*StorageItem, error) {
 		if main == nil {
 			return nil
 		}
-		index = indexKey(index, "")
 		c := b.Cursor()
-		k, _ := c.Seek([]byte(index))
+		k, _ := c.Seek([]byte(prefix))
 		for {
-			if k != nil && strings.HasPrefix(string(k), index) {
-				itemID := strings.TrimPrefix(string(k), index)
+			if k != nil && strings.HasPrefix(string(k), prefix) {
+				key := string(k)
+				itemID := key[strings.LastIndex(key, "::")+2:]
 				k, _ = c.Next()
 				b := main.Bucket([]byte(itemID))
 				if b == nil {
@@ -118,7 +159,7 @@ func (s *Store) Search(index string) ([]*StorageItem, error) {
 }
 
 func (s *Store) View(id string, fn func(b *bolt.Bucket) error) error {
-	return s.db.View(func(tx *bolt.Tx) error {
+	return s.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(mainBucket))
 		if b == nil {
 			return errors.WithStack(errNotFound)
@@ -132,7 +173,7 @@ func (s *Store) View(id string, fn func(b *bolt.Bucket) error) error {
 }
 
 func (s *Store) Clear(id string) error {
-	return errors.WithStack(s.db.Update(func(tx *bolt.Tx) error {
+	return errors.WithStack(s.update(func(tx *bolt.Tx) error {
 		external := tx.Bucket([]byte(externalBucket))
 		if external != nil {
 			external.DeleteBucket([]byte(id))
@@ -164,7 +205,7 @@ func (s *Store) Clear(id string) error {
 }
 
 func (s *Store) Update(id string, fn func(b *bolt.Bucket) error) error {
-	return errors.WithStack(s.db.Update(func(tx *bolt.Tx) error {
+	return errors.WithStack(s.update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(mainBucket))
 		if err != nil {
 			return errors.WithStack(err)
@@ -182,6 +223,8 @@ func (s *Store) Get(id string) (*StorageItem, bool) {
 		si, _ := newStorageItem(id, nil, s)
 		return si
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	tx, err := s.db.Begin(false)
 	if err != nil {
 		return empty(), false
@@ -200,6 +243,9 @@ func (s *Store) Get(id string) (*StorageItem, bool) {
 }
 
 func (s *Store) Close() error {
+	stores.Delete(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return errors.WithStack(s.db.Close())
 }
 
@@ -271,7 +317,7 @@ func (s *StorageItem) Get(k string) *Value {
 
 func (s *StorageItem) GetExternal(k string) ([]byte, error) {
 	var dt []byte
-	err := s.storage.db.View(func(tx *bolt.Tx) error {
+	err := s.storage.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(externalBucket))
 		if b == nil {
 			return errors.WithStack(errNotFound)
@@ -293,7 +339,7 @@ func (s *StorageItem) GetExternal(k string) ([]byte, error) {
 }
 
 func (s *StorageItem) SetExternal(k string, dt []byte) error {
-	return errors.WithStack(s.storage.db.Update(func(tx *bolt.Tx) error {
+	return errors.WithStack(s.storage.update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(externalBucket))
 		if err != nil {
 			return errors.WithStack(err)
@@ -359,6 +405,13 @@ func (s *StorageItem) SetValue(b *bolt.Bucket, key string, v *Value) error {
 	if err := b.Put([]byte(key), dt); err != nil {
 		return errors.WithStack(err)
 	}
+	if old, ok := s.values[key]; ok && old.Index != "" && old.Index != v.Index {
+		b, err := b.Tx().CreateBucketIfNotExists([]byte(indexBucket))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		b.Delete([]byte(indexKey(old.Index, s.ID()))) // ignore error
+	}
 	if v.Index != "" {
 		b, err := b.Tx().CreateBucketIfNotExists([]byte(indexBucket))
 		if err != nil {
@@ -1,6 +1,8 @@
 package metadata
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -210,3 +212,86 @@ func TestExternalData(t *testing.T) {
 	_, err = si.GetExternal("ext1")
 	require.Error(t, err)
 }
+
+func TestCompact(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, err := ioutil.TempDir("", "buildkit-storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dbPath := filepath.Join(tmpdir, "storage.db")
+
+	s, err := NewStore(dbPath)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Contains(t, OpenStores(), s)
+
+	for i := 0; i < 200; i++ {
+		si, _ := s.Get(fmt.Sprintf("item%d", i))
+		err = si.SetExternal("ext", bytes.Repeat([]byte{'a'}, 16*1024))
+		require.NoError(t, err)
+	}
+	for i := 1; i < 200; i++ {
+		err = s.Clear(fmt.Sprintf("item%d", i))
+		require.NoError(t, err)
+	}
+
+	before, err := s.Stats()
+	require.NoError(t, err)
+	require.True(t, before.FreeSize > 0)
+
+	// a failing compaction keeps the original database
+	err = os.Mkdir(dbPath+compactSuffix, 0700)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dbPath+compactSuffix, "foo"), nil, 0600)
+	require.NoError(t, err)
+
+	err = s.Compact()
+	require.Error(t, err)
+
+	si, _ := s.Get("item0")
+	dt, err := si.GetExternal("ext")
+	require.NoError(t, err)
+	require.Equal(t, 16*1024, len(dt))
+
+	err = os.RemoveAll(dbPath + compactSuffix)
+	require.NoError(t, err)
+
+	err = s.Compact()
+	require.NoError(t, err)
+
+	after, err := s.Stats()
+	require.NoError(t, err)
+	require.True(t, after.Size < before.Size)
+	require.True(t, after.FreeSize < before.FreeSize)
+
+	// items loaded before the compaction can still be used
+	dt, err = si.GetExternal("ext")
+	require.NoError(t, err)
+	require.Equal(t, 16*1024, len(dt))
+
+	err = si.SetExternal("ext2", []byte("data"))
+	require.NoError(t, err)
+
+	_, err = os.Stat(dbPath + backupSuffix)
+	require.True(t, os.IsNotExist(err))
+
+	err = s.Close()
+	require.NoError(t, err)
+	require.NotContains(t, OpenStores(), s)
+
+	s, err = NewStore(dbPath)
+	require.NoError(t, err)
+	defer s.Close()
+
+	si, _ = s.Get("item0")
+	dt, err = si.GetExternal("ext2")
+	require.NoError(t, err)
+	require.Equal(t, "data", string(dt))
+
+	si, _ = s.Get("item1")
+	_, err = si.GetExternal("ext")
+	require.Error(t, err)
+}
@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/leaseutil"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// MigrateStats reports the records found by a snapshotter migration.
+type MigrateStats struct {
+	// Migratable is the number of committed records that have a blob or a
+	// snapshot to create one from.
+	Migratable int
+	// Unmigratable is the number of records that can't be moved. These are
+	// mutable records, e.g. cache mounts, and records that lost both their
+	// snapshot and their blob.
+	Unmigratable int
+}
+
+// MigrateSnapshotter moves the snapshots of all committed records to
+// snapshotter to. Records with a blob are unpacked from it, records without
+// one get their blob created from the current snapshot first. Lazy records
+// are left as they are and get unpacked by the new snapshotter when they are
+// used. The lease of each record is switched to the new snapshot so the old
+// one is released on the next garbage collection. If dryRun is set, records
+// are only counted.
+//
+// Snapshot IDs are kept, so to has to be a different snapshotter known to
+// the lease manager of the cache. After a migration the manager has to be
+// recreated with the new snapshotter before it is used again.
+func (cm *cacheManager) MigrateSnapshotter(ctx context.Context, to snapshot.Snapshotter, dryRun bool) (MigrateStats, error) {
+	var stats MigrateStats
+	if to.Name() == cm.Snapshotter.Name() {
+		return stats, errors.Errorf("records already use snapshotter %s", to.Name())
+	}
+
+	cm.mu.Lock()
+	var ids []string
+	for id, cr := range cm.records {
+		cr.mu.Lock()
+		if !cr.isDead() {
+			if !cr.mutable {
+				ids = append(ids, id)
+			} else if cr.equalImmutable == nil {
+				stats.Unmigratable++
+			}
+		}
+		cr.mu.Unlock()
+	}
+	cm.mu.Unlock()
+
+	ctx, done, err := leaseutil.WithLease(ctx, cm.LeaseManager, leaseutil.MakeTemporary)
+	if err != nil {
+		return stats, err
+	}
+	defer done(context.TODO())
+
+	results := map[string]bool{}
+	var migrate func(id string) (bool, error)
+	migrate = func(id string) (bool, error) {
+		if ok, found := results[id]; found {
+			return ok, nil
+		}
+		cm.mu.Lock()
+		cr, found := cm.records[id]
+		cm.mu.Unlock()
+		if !found {
+			return false, errors.Wrapf(errNotFound, "%s not found", id)
+		}
+		if parent := getParent(cr.md); parent != "" {
+			ok, err := migrate(parent)
+			if err != nil || !ok {
+				results[id] = false
+				return false, err
+			}
+		}
+		ok, err := cm.migrateRecord(ctx, cr, to, dryRun)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to migrate %s", id)
+		}
+		results[id] = ok
+		return ok, nil
+	}
+
+	for _, id := range ids {
+		ok, err := migrate(id)
+		if err != nil {
+			return stats, err
+		}
+		if ok {
+			stats.Migratable++
+		} else {
+			stats.Unmigratable++
+		}
+	}
+	if dryRun {
+		return stats, nil
+	}
+
+	// views keep the old snapshots alive
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, cr := range cm.records {
+		cr.mu.Lock()
+		if cr.viewMount != nil {
+			if err := cm.LeaseManager.Delete(ctx, leases.Lease{ID: cr.view}); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+				cr.mu.Unlock()
+				return stats, errors.Wrapf(err, "failed to remove view lease %s", cr.view)
+			}
+			cr.view = ""
+			cr.viewMount = nil
+		}
+		cr.mu.Unlock()
+	}
+	return stats, nil
+}
+
+// migrateRecord moves the snapshot of a record whose parent has already been
+// migrated. The returned bool is false if the record can't be migrated.
+func (cm *cacheManager) migrateRecord(ctx context.Context, cr *cacheRecord, to snapshot.Snapshotter, dryRun bool) (bool, error) {
+	if getBlobOnly(cr.md) {
+		// nothing unpacked yet
+		return true, nil
+	}
+
+	blob := digest.Digest(getBlob(cr.md))
+	blobPresent := false
+	if blob != "" {
+		if _, err := cm.ContentStore.Info(ctx, blob); err == nil {
+			blobPresent = true
+		} else if !errors.Is(err, errdefs.ErrNotFound) {
+			return false, err
+		}
+	}
+	if !blobPresent {
+		cr.mu.Lock()
+		snapshotID := getSnapshotID(cr.md)
+		if cr.equalMutable != nil {
+			snapshotID = getSnapshotID(cr.equalMutable.md)
+		}
+		cr.mu.Unlock()
+		if _, err := cm.Snapshotter.Stat(ctx, snapshotID); err != nil {
+			if errors.Is(err, errdefs.ErrNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	ref, err := cm.Get(ctx, cr.ID(), NoUpdateLastUsed)
+	if err != nil {
+		return false, err
+	}
+	defer ref.Release(context.TODO())
+	if err := ref.Finalize(ctx, true); err != nil {
+		return false, err
+	}
+	sr := ref.(*immutableRef)
+
+	if !blobPresent {
+		if blob != "" {
+			if err := clearBlob(sr.md); err != nil {
+				return false, err
+			}
+		}
+		if err := sr.computeBlobChain(ctx, true, compression.New(compression.Default), nil); err != nil {
+			return false, err
+		}
+	}
+
+	desc, err := sr.ociDesc()
+	if err != nil {
+		return false, err
+	}
+	desc, err = sr.prepareLayer(ctx, desc)
+	if err != nil {
+		return false, err
+	}
+
+	snapshotID := getSnapshotID(sr.md)
+	if _, err := to.Stat(ctx, snapshotID); err != nil {
+		if !errors.Is(err, errdefs.ErrNotFound) {
+			return false, err
+		}
+		parentID := ""
+		if sr.parent != nil {
+			parentID = getSnapshotID(sr.parent.md)
+		}
+		key := fmt.Sprintf("migrate-%s %s", identity.NewID(), sr.Info().ChainID)
+		if err := to.Prepare(ctx, key, parentID); err != nil {
+			return false, err
+		}
+		mountable, err := to.Mounts(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		mounts, unmount, err := mountable.Mount()
+		if err != nil {
+			return false, err
+		}
+		if _, err := cm.Applier.Apply(ctx, desc, mounts); err != nil {
+			unmount()
+			return false, err
+		}
+		if err := unmount(); err != nil {
+			return false, err
+		}
+		if err := to.Commit(ctx, snapshotID, key); err != nil && !errors.Is(err, errdefs.ErrAlreadyExists) {
+			return false, err
+		}
+	}
+
+	l := leases.Lease{ID: sr.ID()}
+	if err := cm.LeaseManager.AddResource(ctx, l, leases.Resource{
+		ID:   snapshotID,
+		Type: "snapshots/" + to.Name(),
+	}); err != nil {
+		return false, errors.Wrapf(err, "failed to add snapshot %s to lease", snapshotID)
+	}
+	if err := cm.LeaseManager.DeleteResource(ctx, l, leases.Resource{
+		ID:   snapshotID,
+		Type: "snapshots/" + cm.Snapshotter.Name(),
+	}); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+		return false, errors.Wrapf(err, "failed to remove snapshot %s from lease", snapshotID)
+	}
+	return true, nil
+}
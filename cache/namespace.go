@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/solver"
+	"github.com/pkg/errors"
+)
+
+// inNamespace returns true if the record can be used by builds in the cache
+// namespace ns. Builds without a namespace can use all records. Records of
+// other namespaces can only be used if they were pulled in one of the
+// SharedNamespaces.
+func (cm *cacheManager) inNamespace(md *metadata.StorageItem, ns string) bool {
+	if ns == "" {
+		return true
+	}
+	recNS := GetNamespace(md)
+	if recNS == ns {
+		return true
+	}
+	if !isPulled(md) {
+		return false
+	}
+	for _, shared := range cm.SharedNamespaces {
+		if recNS == shared {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNamespace fails with a not found error if the record can't be used
+// in the cache namespace of ctx. Requires cm.mu.
+func (cm *cacheManager) checkNamespace(ctx context.Context, id string) error {
+	ns := solver.CacheNamespaceOf(ctx)
+	if ns == "" {
+		return nil
+	}
+	var md *metadata.StorageItem
+	if rec, ok := cm.records[id]; ok {
+		md = rec.md
+	} else if si, ok := cm.md.Get(id); ok {
+		md = si
+	} else {
+		return nil
+	}
+	if !cm.inNamespace(md, ns) {
+		return errors.Wrapf(errNotFound, "%s is not in cache namespace %s", id, ns)
+	}
+	return nil
+}
+
+func (cm *cacheManager) filterNamespace(sis []*metadata.StorageItem, ns string) []*metadata.StorageItem {
+	out := sis[:0]
+	for _, si := range sis {
+		if cm.inNamespace(si, ns) {
+			out = append(out, si)
+		}
+	}
+	return out
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/filters"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/progress"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// isNoSpace returns true if err was caused by a full disk. Errors of remote
+// content stores only keep the message of the original error.
+func isNoSpace(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), syscall.ENOSPC.Error())
+}
+
+// withNoSpaceRetry runs fn to create a blob. If the disk is full, unused
+// records are pruned to free NoSpaceReclaimSize bytes and fn is retried once.
+func (cm *cacheManager) withNoSpaceRetry(ctx context.Context, fn func() (ocispec.Descriptor, error)) (ocispec.Descriptor, error) {
+	desc, err := fn()
+	if !isNoSpace(err) || cm.NoSpaceReclaimSize <= 0 {
+		return desc, err
+	}
+
+	freed, n, perr := cm.reclaimSpace(ctx)
+	if perr != nil {
+		logrus.Warnf("failed to prune cache after running out of space: %+v", perr)
+	}
+	noSpaceProgress(ctx, fmt.Sprintf("warning: no space left on device, pruned %d cache records freeing %d bytes", n, freed))
+
+	desc, rerr := fn()
+	if rerr != nil {
+		logrus.Debugf("retry after freeing %d bytes failed: %v", freed, rerr)
+		return desc, errors.Wrapf(err, "no space left after pruning %d cache records freeing %d bytes", n, freed)
+	}
+	return desc, nil
+}
+
+// reclaimSpace synchronously prunes records that are not in use, pinned or
+// shared until NoSpaceReclaimSize bytes are freed and runs the garbage
+// collection. It returns the size and number of the pruned records.
+func (cm *cacheManager) reclaimSpace(ctx context.Context) (int64, int, error) {
+	cm.muPrune.Lock()
+	defer cm.muPrune.Unlock()
+
+	// records of all namespaces are pruned
+	ctx = solver.WithCacheNamespace(ctx, "")
+
+	var check ExternalRefChecker
+	if f := cm.PruneRefChecker; f != nil {
+		c, err := f()
+		if err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+		check = c
+	}
+
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{})
+	if err != nil {
+		return 0, 0, err
+	}
+	var totalSize int64
+	for _, ui := range du {
+		if !ui.Shared {
+			totalSize += ui.Size
+		}
+	}
+	keepBytes := totalSize - cm.NoSpaceReclaimSize
+	if keepBytes < 1 {
+		keepBytes = 1
+	}
+
+	ch := make(chan client.UsageInfo)
+	done := make(chan struct{})
+	var freed int64
+	var n int
+	go func() {
+		for ui := range ch {
+			freed += ui.Size
+			n++
+		}
+		close(done)
+	}()
+
+	err = cm.prune(ctx, ch, pruneOpt{
+		filter:      filters.Always,
+		checkShared: check,
+		keepBytes:   keepBytes,
+		totalSize:   totalSize,
+		policy:      fmt.Sprintf("no space left (reclaim=%d)", cm.NoSpaceReclaimSize),
+	})
+	close(ch)
+	<-done
+	if err != nil {
+		return freed, n, err
+	}
+
+	if cm.GarbageCollect != nil {
+		if _, err := cm.GarbageCollect(ctx); err != nil {
+			return freed, n, err
+		}
+	}
+	return freed, n, nil
+}
+
+func noSpaceProgress(ctx context.Context, id string) {
+	pw, _, _ := progress.FromContext(ctx)
+	now := time.Now()
+	pw.Write(id, progress.Status{
+		Started:   &now,
+		Completed: &now,
+	})
+	pw.Close()
+}
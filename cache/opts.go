@@ -33,3 +33,19 @@ type NeedsRemoteProvidersError []digest.Digest
 func (m NeedsRemoteProvidersError) Error() string {
 	return fmt.Sprintf("missing descriptor handlers for lazy blobs %+v", []digest.Digest(m))
 }
+
+// SnapshotMissingError is returned when the snapshot of a cache record was
+// removed outside of buildkit and can't be restored from a blob. It matches
+// ErrSnapshotMissing with errors.Is.
+type SnapshotMissingError struct {
+	ID      string
+	ChainID digest.Digest
+}
+
+func (e *SnapshotMissingError) Error() string {
+	return fmt.Sprintf("snapshot for %s (chain %s) does not exist", e.ID, e.ChainID)
+}
+
+func (e *SnapshotMissingError) Unwrap() error {
+	return ErrSnapshotMissing
+}
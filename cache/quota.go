@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/session"
+	"github.com/sirupsen/logrus"
+)
+
+// reservationSampleInterval is how often the usage of snapshots with a
+// reservation is sampled
+const reservationSampleInterval = 10 * time.Second
+
+type reserveSpace struct{}
+
+// ReserveSpace makes New reserve ManagerOpt.ReservationSize bytes of the disk
+// quota for the new ref until it is released or, once it's committed, until
+// the size of the committed record is known. The reservation grows with the
+// snapshot.
+var ReserveSpace reserveSpace
+
+func hasReserveSpace(opts ...RefOption) bool {
+	for _, opt := range opts {
+		if _, ok := opt.(reserveSpace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaExceededError is returned by New when the size of the cache and the
+// space reserved by running builds would exceed ManagerOpt.DiskQuota.
+type QuotaExceededError struct {
+	Quota     int64
+	Used      int64
+	Reserved  int64
+	Requested int64
+	// Builds is the space reserved by running builds, largest first
+	Builds []BuildUsage
+}
+
+// BuildUsage is the space reserved by the mutable refs of a build.
+type BuildUsage struct {
+	BuildID string
+	Size    int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	msg := fmt.Sprintf("disk quota of %d bytes exceeded: %d bytes used by cache, %d bytes reserved by running builds, %d bytes requested", e.Quota, e.Used, e.Reserved, e.Requested)
+	if len(e.Builds) > 0 && e.Builds[0].BuildID != "" {
+		msg += fmt.Sprintf(", build %s uses %d bytes", e.Builds[0].BuildID, e.Builds[0].Size)
+	}
+	return msg
+}
+
+// reservation is the disk space reserved for a mutable ref
+type reservation struct {
+	buildID    string
+	snapshotID string
+	estimate   int64
+	usage      int64 // last sampled usage of the snapshot
+}
+
+func (r *reservation) size() int64 {
+	if r.usage > r.estimate {
+		return r.usage
+	}
+	return r.estimate
+}
+
+type reservations struct {
+	mu sync.Mutex
+	m  map[string]*reservation // by record ID
+}
+
+func buildIDOf(s session.Group) string {
+	ids := session.AllSessionIDs(s)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+// reserve reserves space for a new mutable record or fails with a
+// QuotaExceededError.
+func (cm *cacheManager) reserve(id, snapshotID, buildID string, estimate int64) error {
+	used := cm.usedSize()
+
+	cm.reservations.mu.Lock()
+	defer cm.reservations.mu.Unlock()
+
+	var reserved int64
+	byBuild := map[string]int64{}
+	for _, r := range cm.reservations.m {
+		reserved += r.size()
+		byBuild[r.buildID] += r.size()
+	}
+	if used+reserved+estimate > cm.DiskQuota {
+		err := &QuotaExceededError{
+			Quota:     cm.DiskQuota,
+			Used:      used,
+			Reserved:  reserved,
+			Requested: estimate,
+		}
+		for id, size := range byBuild {
+			err.Builds = append(err.Builds, BuildUsage{BuildID: id, Size: size})
+		}
+		sort.Slice(err.Builds, func(i, j int) bool {
+			return err.Builds[i].Size > err.Builds[j].Size
+		})
+		return err
+	}
+	cm.reservations.m[id] = &reservation{
+		buildID:    buildID,
+		snapshotID: snapshotID,
+		estimate:   estimate,
+	}
+	return nil
+}
+
+// unreserve releases the space reserved for a record
+func (cm *cacheManager) unreserve(id string) {
+	if cm.DiskQuota == 0 {
+		return
+	}
+	cm.reservations.mu.Lock()
+	delete(cm.reservations.m, id)
+	cm.reservations.mu.Unlock()
+}
+
+// moveReservation moves the space reserved for a mutable record to the
+// record committed from it. The size of the committed record is unknown
+// until it's computed, so the reservation with the last sampled usage of
+// the snapshot stays until then.
+func (cm *cacheManager) moveReservation(from, to string) {
+	if cm.DiskQuota == 0 {
+		return
+	}
+	cm.reservations.mu.Lock()
+	if r, ok := cm.reservations.m[from]; ok {
+		delete(cm.reservations.m, from)
+		cm.reservations.m[to] = r
+	}
+	cm.reservations.mu.Unlock()
+}
+
+// reservedSize returns the space reserved for a record, the bool is false if
+// the record has no reservation
+func (cm *cacheManager) reservedSize(id string) (int64, bool) {
+	if cm.DiskQuota == 0 {
+		return 0, false
+	}
+	cm.reservations.mu.Lock()
+	defer cm.reservations.mu.Unlock()
+	r, ok := cm.reservations.m[id]
+	if !ok {
+		return 0, false
+	}
+	return r.size(), true
+}
+
+// quotaUsage is the size of all records that is known without computing it.
+// It's kept up to date by updateUsage so reserving space doesn't need to sum
+// the sizes of all records.
+type quotaUsage struct {
+	mu   sync.Mutex
+	size int64
+}
+
+// usedSize returns the size of all records that is known without computing
+// it. Mutable refs that are in use and committed records whose size wasn't
+// computed yet are accounted for by their reservations.
+func (cm *cacheManager) usedSize() int64 {
+	cm.usage.mu.Lock()
+	defer cm.usage.mu.Unlock()
+	return cm.usage.size
+}
+
+// updateUsage updates the size counted in the disk quota for the record and
+// the records sharing its data after a change of their size, refs or state.
+// Requires cr.mu.
+func (cr *cacheRecord) updateUsage() {
+	cr.updateUsageOf()
+	if cr.equalMutable != nil {
+		cr.equalMutable.updateUsageOf()
+	}
+	if cr.equalImmutable != nil {
+		cr.equalImmutable.updateUsageOf()
+	}
+}
+
+func (cr *cacheRecord) updateUsageOf() {
+	var size int64
+	// ignore duplicates that share data
+	if !cr.isDead() && cr.equalMutable == nil && !(cr.mutable && len(cr.refs) > 0) {
+		if s := getSize(cr.md); s != sizeUnknown {
+			size = s
+		}
+	}
+	cr.cm.usage.mu.Lock()
+	if !cr.removed {
+		cr.cm.usage.size += size - cr.quotaSize
+		cr.quotaSize = size
+	}
+	cr.cm.usage.mu.Unlock()
+}
+
+// removeUsage stops counting the size of a removed record in the disk quota.
+func (cr *cacheRecord) removeUsage() {
+	cr.cm.usage.mu.Lock()
+	cr.cm.usage.size -= cr.quotaSize
+	cr.quotaSize = 0
+	cr.removed = true
+	cr.cm.usage.mu.Unlock()
+}
+
+// sampleReservations periodically updates the reservations with the usage
+// of their snapshots until done is closed.
+func (cm *cacheManager) sampleReservations(done <-chan struct{}) {
+	t := time.NewTicker(reservationSampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			cm.sampleReservationsOnce(context.TODO())
+		}
+	}
+}
+
+func (cm *cacheManager) sampleReservationsOnce(ctx context.Context) {
+	cm.reservations.mu.Lock()
+	snapshots := make(map[string]string, len(cm.reservations.m))
+	for id, r := range cm.reservations.m {
+		snapshots[id] = r.snapshotID
+	}
+	cm.reservations.mu.Unlock()
+
+	for id, snapshotID := range snapshots {
+		usage, err := cm.Snapshotter.Usage(ctx, snapshotID)
+		if err != nil {
+			logrus.Debugf("failed to sample usage of %s: %v", id, err)
+			continue
+		}
+		cm.reservations.mu.Lock()
+		if r, ok := cm.reservations.m[id]; ok {
+			r.usage = usage.Size
+		}
+		cm.reservations.mu.Unlock()
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/containerd/containerd/errdefs"
@@ -46,7 +45,8 @@ type ImmutableRef interface {
 
 	Info() RefInfo
 	Extract(ctx context.Context, s session.Group) error // +progress
-	GetRemote(ctx context.Context, createIfNeeded bool, compressionType compression.Type, s session.Group) (*solver.Remote, error)
+	GetRemote(ctx context.Context, createIfNeeded bool, comp compression.Config, s session.Group) (*solver.Remote, error)
+	GetRemotes(ctx context.Context, createIfNeeded bool, configs []compression.Config, all bool, s session.Group) ([]*solver.Remote, error)
 }
 
 type RefInfo struct {
@@ -74,7 +74,7 @@ type ref interface {
 
 type cacheRecord struct {
 	cm *cacheManager
-	mu *sync.Mutex // the mutex is shared by records sharing data
+	mu *recordMutex // the mutex is shared by records sharing data
 
 	mutable bool
 	refs    map[ref]struct{}
@@ -94,6 +94,10 @@ type cacheRecord struct {
 	equalImmutable *immutableRef
 
 	parentChainCache []digest.Digest
+
+	// the size of the record counted in cm.usage, guarded by cm.usage.mu
+	quotaSize int64
+	removed   bool
 }
 
 // hold ref lock before calling
@@ -104,6 +108,7 @@ func (cr *cacheRecord) ref(triggerLastUsed bool, descHandlers DescHandlers) *imm
 		descHandlers:    descHandlers,
 	}
 	cr.refs[ref] = struct{}{}
+	cr.updateUsage()
 	return ref
 }
 
@@ -115,6 +120,7 @@ func (cr *cacheRecord) mref(triggerLastUsed bool, descHandlers DescHandlers) *mu
 		descHandlers:    descHandlers,
 	}
 	cr.refs[ref] = struct{}{}
+	cr.updateUsage()
 	return ref
 }
 
@@ -143,6 +149,18 @@ func (cr *cacheRecord) isDead() bool {
 	return cr.dead || (cr.equalImmutable != nil && cr.equalImmutable.dead) || (cr.equalMutable != nil && cr.equalMutable.dead)
 }
 
+// pinned returns whether the record, or the immutable record sharing its
+// data, is pinned and the reason for pinning. Requires cr.mu.
+func (cr *cacheRecord) pinned() (bool, string) {
+	if pinned, reason := getPinned(cr.md); pinned {
+		return true, reason
+	}
+	if cr.equalImmutable != nil {
+		return getPinned(cr.equalImmutable.md)
+	}
+	return false, ""
+}
+
 func (cr *cacheRecord) isLazy(ctx context.Context) (bool, error) {
 	if !getBlobOnly(cr.md) {
 		return false, nil
@@ -197,6 +215,9 @@ func (cr *cacheRecord) Size(ctx context.Context) (int64, error) {
 			info, err := cr.cm.ContentStore.Info(ctx, digest.Digest(dgst))
 			if err == nil {
 				usage.Size += info.Size
+				if u, ok := cr.cm.uncompressedVariant(ctx, info, getDiffID(cr.md)); cr.cm.KeepUncompressedDiff && ok {
+					usage.Size += u.Size
+				}
 			}
 		}
 		cr.mu.Lock()
@@ -205,7 +226,10 @@ func (cr *cacheRecord) Size(ctx context.Context) (int64, error) {
 			cr.mu.Unlock()
 			return s, err
 		}
+		cr.updateUsage()
 		cr.mu.Unlock()
+		// the record is accounted for by its size now
+		cr.cm.unreserve(cr.ID())
 		return usage.Size, nil
 	})
 	if err != nil {
@@ -227,8 +251,14 @@ func (cr *cacheRecord) parentRef(hidden bool, descHandlers DescHandlers) *immuta
 // must be called holding cacheRecord mu
 func (cr *cacheRecord) mount(ctx context.Context, readonly bool) (snapshot.Mountable, error) {
 	if cr.mutable {
+		if err := cr.remapMutable(ctx); err != nil {
+			return nil, err
+		}
 		m, err := cr.cm.Snapshotter.Mounts(ctx, getSnapshotID(cr.md))
 		if err != nil {
+			if errors.Is(err, errdefs.ErrNotFound) {
+				return nil, errors.WithStack(&SnapshotMissingError{ID: cr.ID()})
+			}
 			return nil, errors.Wrapf(err, "failed to mount %s", cr.ID())
 		}
 		if readonly {
@@ -237,7 +267,7 @@ func (cr *cacheRecord) mount(ctx context.Context, readonly bool) (snapshot.Mount
 		return m, nil
 	}
 
-	if cr.equalMutable != nil && readonly {
+	if _, remap := cr.remapFrom(); cr.equalMutable != nil && readonly && !remap {
 		m, err := cr.cm.Snapshotter.Mounts(ctx, getSnapshotID(cr.equalMutable.md))
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to mount %s", cr.equalMutable.ID())
@@ -260,8 +290,13 @@ func (cr *cacheRecord) mount(ctx context.Context, readonly bool) (snapshot.Mount
 		if err != nil {
 			return nil, err
 		}
+		snapshotID, err := cr.mappedSnapshotID(ctx)
+		if err != nil {
+			cr.cm.LeaseManager.Delete(context.TODO(), leases.Lease{ID: l.ID})
+			return nil, err
+		}
 		ctx = leases.WithLease(ctx, l.ID)
-		m, err := cr.cm.Snapshotter.View(ctx, view, getSnapshotID(cr.md))
+		m, err := cr.cm.Snapshotter.View(ctx, view, snapshotID)
 		if err != nil {
 			cr.cm.LeaseManager.Delete(context.TODO(), leases.Lease{ID: l.ID})
 			return nil, errors.Wrapf(err, "failed to mount %s", cr.ID())
@@ -275,6 +310,8 @@ func (cr *cacheRecord) mount(ctx context.Context, readonly bool) (snapshot.Mount
 // call when holding the manager lock
 func (cr *cacheRecord) remove(ctx context.Context, removeSnapshot bool) error {
 	delete(cr.cm.records, cr.ID())
+	cr.removeUsage()
+	cr.cm.unreserve(cr.ID())
 	if cr.parent != nil {
 		cr.parent.mu.Lock()
 		err := cr.parent.release(ctx)
@@ -344,6 +381,10 @@ func (sr *immutableRef) ociDesc() (ocispec.Descriptor, error) {
 		Annotations: make(map[string]string),
 	}
 
+	for k, v := range getBlobAnnotations(sr.md) {
+		desc.Annotations[k] = v
+	}
+
 	diffID := getDiffID(sr.md)
 	if diffID != "" {
 		desc.Annotations["containerd.io/uncompressed"] = diffID
@@ -379,14 +420,19 @@ func (sr *immutableRef) Mount(ctx context.Context, readonly bool, s session.Grou
 		return nil, err
 	}
 
-	sr.mu.Lock()
+	sr.mu.lockFor("mount", s)
 	defer sr.mu.Unlock()
 	return sr.mount(ctx, readonly)
 }
 
 func (sr *immutableRef) Extract(ctx context.Context, s session.Group) (rerr error) {
 	if !getBlobOnly(sr.md) {
-		return
+		if err := sr.checkSnapshot(ctx); err != nil {
+			return err
+		}
+		if !getBlobOnly(sr.md) {
+			return
+		}
 	}
 
 	ctx, done, err := leaseutil.WithLease(ctx, sr.cm.LeaseManager, leaseutil.MakeTemporary)
@@ -408,6 +454,42 @@ func (sr *immutableRef) Extract(ctx context.Context, s session.Group) (rerr erro
 	return sr.extract(ctx, sr.descHandlers, s)
 }
 
+// checkSnapshot makes sure the snapshot of an extracted ref still exists. If
+// it was removed outside of buildkit the ref is extracted again from its blob.
+// Without a blob the record is invalidated so it is no longer used as a cache
+// result.
+func (sr *immutableRef) checkSnapshot(ctx context.Context) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.equalMutable != nil || sr.viewMount != nil || getBlobOnly(sr.md) {
+		return nil
+	}
+
+	snapshotID := getSnapshotID(sr.md)
+	if _, err := sr.cm.Snapshotter.Stat(ctx, snapshotID); err == nil {
+		return nil
+	} else if !errors.Is(err, errdefs.ErrNotFound) {
+		return err
+	}
+
+	if blob := digest.Digest(getBlob(sr.md)); blob != "" {
+		if _, err := sr.cm.ContentStore.Info(ctx, blob); err == nil || sr.descHandlers[blob] != nil {
+			logrus.Warnf("snapshot %s for %s is missing, extracting again from %s", snapshotID, sr.ID(), blob)
+			queueBlobOnly(sr.md, true)
+			return sr.md.Commit()
+		}
+	}
+
+	// the record is removed on restart, see getRecord
+	sr.dead = true
+	sr.updateUsage()
+	if err := setDeleted(sr.md); err != nil {
+		return err
+	}
+	return &SnapshotMissingError{ID: sr.ID(), ChainID: digest.Digest(getChainID(sr.md))}
+}
+
 func (sr *immutableRef) prepareRemoteSnapshots(ctx context.Context, dhs DescHandlers) (bool, error) {
 	ok, err := sr.sizeG.Do(ctx, sr.ID()+"-prepare-remote-snapshot", func(ctx context.Context) (_ interface{}, rerr error) {
 		snapshotID := getSnapshotID(sr.md)
@@ -481,8 +563,9 @@ func (sr *immutableRef) extract(ctx context.Context, dhs DescHandlers, s session
 				if err := sr.parent.extract(egctx, dhs, s); err != nil {
 					return err
 				}
-				parentID = getSnapshotID(sr.parent.md)
-				return nil
+				var err error
+				parentID, err = sr.parent.mappedSnapshotID(egctx)
+				return err
 			})
 		}
 
@@ -494,12 +577,17 @@ func (sr *immutableRef) extract(ctx context.Context, dhs DescHandlers, s session
 
 		eg.Go(func() error {
 			// unlazies if needed, otherwise a no-op
-			return lazyRefProvider{
+			if err := (lazyRefProvider{
 				ref:     sr,
 				desc:    desc,
 				dh:      dh,
 				session: s,
-			}.Unlazy(egctx)
+			}).Unlazy(egctx); err != nil {
+				return err
+			}
+			var err error
+			desc, err = sr.prepareLayer(egctx, desc)
+			return err
 		})
 
 		if err := eg.Wait(); err != nil {
@@ -544,14 +632,48 @@ func (sr *immutableRef) extract(ctx context.Context, dhs DescHandlers, s session
 		}
 		queueBlobOnly(sr.md, false)
 		setSize(sr.md, sizeUnknown)
+		if err := queueIdentityMapping(sr.md, sr.cm.IdentityMapping()); err != nil {
+			return nil, err
+		}
 		if err := sr.md.Commit(); err != nil {
 			return nil, err
 		}
+		sr.updateUsage()
 		return nil, nil
 	})
 	return err
 }
 
+// prepareLayer returns the descriptor of the layer blob to pass to the
+// applier. It runs while the parent layers are applied, so layers the
+// applier can't read are decompressed in the meantime. Gzip and zstd layers
+// are not decompressed ahead, the applier decompresses them while
+// untarring and writing them to the content store first gained little.
+func (sr *immutableRef) prepareLayer(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	var err error
+	// The applier picks the decompressor by media type, so detect the
+	// compression from blob data if the media type doesn't tell.
+	if !compression.IsLayerMediaTypeKnown(desc.MediaType) {
+		desc.MediaType, err = compression.DetectLayerMediaType(ctx, sr.cm.ContentStore, desc.Digest, false)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	} else if !sr.cm.SkipLayerVerification {
+		desc.MediaType, err = verifyLayerMediaType(ctx, sr.cm.ContentStore, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	// The applier only reads gzip and zstd compressed layers, layers
+	// with other compression are decompressed to the content store first
+	switch compression.FromMediaType(desc.MediaType) {
+	case compression.Bzip2, compression.Xz:
+		return decompressBlob(ctx, sr.cm.ContentStore, desc)
+	}
+	return desc, nil
+}
+
 func (sr *immutableRef) Release(ctx context.Context) error {
 	sr.cm.mu.Lock()
 	defer sr.cm.mu.Unlock()
@@ -580,6 +702,7 @@ func (sr *immutableRef) updateLastUsedNow() bool {
 
 func (sr *immutableRef) release(ctx context.Context) error {
 	delete(sr.refs, sr)
+	sr.updateUsage()
 
 	if sr.updateLastUsedNow() {
 		updateLastUsed(sr.md)
@@ -616,6 +739,13 @@ func (cr *cacheRecord) Metadata() *metadata.StorageItem {
 	return cr.md
 }
 
+// finalize commits the snapshot of the equal mutable of the record and drops
+// the mutable. The commit runs under the lease of the record, if it fails or
+// is cancelled before the snapshot was committed the lease is removed again
+// and the record is left unchanged, so finalize can be called again. A
+// snapshot that was committed without the record being updated is detected
+// with isCommitted and reused instead of being committed again. Requires
+// cr.mu.
 func (cr *cacheRecord) finalize(ctx context.Context, commit bool) error {
 	mutable := cr.equalMutable
 	if mutable == nil {
@@ -629,16 +759,26 @@ func (cr *cacheRecord) finalize(ctx context.Context, commit bool) error {
 		return nil
 	}
 
-	_, err := cr.cm.ManagerOpt.LeaseManager.Create(ctx, func(l *leases.Lease) error {
-		l.ID = cr.ID()
-		l.Labels = map[string]string{
-			"containerd.io/gc.flat": time.Now().UTC().Format(time.RFC3339Nano),
+	// A previous finalize may have committed the snapshot but failed before
+	// recording it, in that case the commit is reused.
+	committed, err := cr.isCommitted(ctx)
+	if err != nil {
+		return err
+	}
+	if !committed {
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
 		}
-		return nil
-	})
+	}
+
+	created, err := cr.createLease(ctx)
 	if err != nil {
-		if !errors.Is(err, errdefs.ErrAlreadyExists) { // migrator adds leases for everything
-			return errors.Wrap(err, "failed to create lease")
+		return err
+	}
+	// rollback removes the lease if the snapshot was not committed
+	rollback := func() {
+		if created && !committed {
+			cr.cm.LeaseManager.Delete(context.TODO(), leases.Lease{ID: cr.ID()})
 		}
 	}
 
@@ -646,15 +786,49 @@ func (cr *cacheRecord) finalize(ctx context.Context, commit bool) error {
 		ID:   cr.ID(),
 		Type: "snapshots/" + cr.cm.ManagerOpt.Snapshotter.Name(),
 	}); err != nil {
-		cr.cm.LeaseManager.Delete(context.TODO(), leases.Lease{ID: cr.ID()})
+		rollback()
 		return errors.Wrapf(err, "failed to add snapshot %s to lease", cr.ID())
 	}
 
-	err = cr.cm.Snapshotter.Commit(ctx, cr.ID(), mutable.ID())
+	if !committed {
+		// commit under the lease of the record so the snapshot is never left
+		// unreferenced
+		if err := cr.cm.Snapshotter.Commit(leases.WithLease(ctx, cr.ID()), cr.ID(), mutable.ID()); err != nil {
+			// the commit may have completed before it was cancelled
+			if committed, _ = cr.isCommitted(context.TODO()); !committed {
+				rollback()
+				return errors.Wrapf(err, "failed to commit %s", mutable.ID())
+			}
+		}
+	}
+
+	// recording the commit can't be cancelled anymore
+	return cr.dropEqualMutable()
+}
+
+// createLease creates the lease of the record. It returns false if the lease
+// already existed.
+func (cr *cacheRecord) createLease(ctx context.Context) (bool, error) {
+	_, err := cr.cm.ManagerOpt.LeaseManager.Create(ctx, func(l *leases.Lease) error {
+		l.ID = cr.ID()
+		l.Labels = map[string]string{
+			"containerd.io/gc.flat": time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		return nil
+	})
 	if err != nil {
-		cr.cm.LeaseManager.Delete(context.TODO(), leases.Lease{ID: cr.ID()})
-		return errors.Wrapf(err, "failed to commit %s", mutable.ID())
+		if !errors.Is(err, errdefs.ErrAlreadyExists) { // migrator adds leases for everything
+			return false, errors.Wrap(err, "failed to create lease")
+		}
+		return false, nil
 	}
+	return true, nil
+}
+
+// dropEqualMutable removes the equal mutable of the record once the record
+// has a snapshot of its own. Requires cr.mu.
+func (cr *cacheRecord) dropEqualMutable() error {
+	mutable := cr.equalMutable
 	mutable.dead = true
 	go func() {
 		cr.cm.mu.Lock()
@@ -665,10 +839,25 @@ func (cr *cacheRecord) finalize(ctx context.Context, commit bool) error {
 	}()
 
 	cr.equalMutable = nil
+	cr.updateUsage()
+	mutable.updateUsage()
 	clearEqualMutable(cr.md)
 	return cr.md.Commit()
 }
 
+// isCommitted reports whether the snapshot of the record has been committed
+// while the record still refers to its equal mutable. Requires cr.mu.
+func (cr *cacheRecord) isCommitted(ctx context.Context) (bool, error) {
+	info, err := cr.cm.Snapshotter.Stat(ctx, cr.ID())
+	if err != nil {
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to stat %s", cr.ID())
+	}
+	return info.Kind == snapshots.KindCommitted, nil
+}
+
 func (sr *mutableRef) updateLastUsed() bool {
 	return sr.triggerLastUsed
 }
@@ -694,6 +883,17 @@ func (sr *mutableRef) commit(ctx context.Context) (*immutableRef, error) {
 			return nil, err
 		}
 	}
+	if err := queueBuildID(md, GetBuildID(sr.md)); err != nil {
+		return nil, err
+	}
+	if err := queueNamespace(md, GetNamespace(sr.md)); err != nil {
+		return nil, err
+	}
+	if idmap, ok := getIdentityMapping(sr.md); ok {
+		if err := queueIdentityMapping(md, idmap); err != nil {
+			return nil, err
+		}
+	}
 
 	parentID := ""
 	if rec.parent != nil {
@@ -704,6 +904,7 @@ func (sr *mutableRef) commit(ctx context.Context) (*immutableRef, error) {
 	}
 
 	sr.cm.records[id] = rec
+	rec.updateUsage()
 
 	if err := sr.md.Commit(); err != nil {
 		return nil, err
@@ -718,11 +919,12 @@ func (sr *mutableRef) commit(ctx context.Context) (*immutableRef, error) {
 
 	ref := rec.ref(true, sr.descHandlers)
 	sr.equalImmutable = ref
+	sr.cm.moveReservation(sr.ID(), id)
 	return ref, nil
 }
 
 func (sr *mutableRef) Mount(ctx context.Context, readonly bool, s session.Group) (snapshot.Mountable, error) {
-	sr.mu.Lock()
+	sr.mu.lockFor("mount", s)
 	defer sr.mu.Unlock()
 
 	return sr.mount(ctx, readonly)
@@ -750,6 +952,10 @@ func (sr *mutableRef) Release(ctx context.Context) error {
 
 func (sr *mutableRef) release(ctx context.Context) error {
 	delete(sr.refs, sr)
+	sr.updateUsage()
+	if len(sr.refs) == 0 {
+		sr.cm.unreserve(sr.ID())
+	}
 	if getCachePolicy(sr.md) != cachePolicyRetain {
 		if sr.equalImmutable != nil {
 			if getCachePolicy(sr.equalImmutable.md) == cachePolicyRetain {
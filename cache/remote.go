@@ -8,6 +8,7 @@ import (
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/reference"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/solver"
@@ -27,35 +28,83 @@ type Unlazier interface {
 
 // GetRemote gets a *solver.Remote from content store for this ref (potentially pulling lazily).
 // Note: Use WorkerRef.GetRemote instead as moby integration requires custom GetRemote implementation.
-func (sr *immutableRef) GetRemote(ctx context.Context, createIfNeeded bool, compressionType compression.Type, s session.Group) (*solver.Remote, error) {
-	ctx, done, err := leaseutil.WithLease(ctx, sr.cm.LeaseManager, leaseutil.MakeTemporary)
+func (sr *immutableRef) GetRemote(ctx context.Context, createIfNeeded bool, comp compression.Config, s session.Group) (*solver.Remote, error) {
+	remotes, err := sr.GetRemotes(ctx, createIfNeeded, []compression.Config{comp}, false, s)
 	if err != nil {
 		return nil, err
 	}
-	defer done(ctx)
+	return remotes[0], nil
+}
+
+// GetRemotes gets a *solver.Remote for every compression config in a single
+// pass over the layer chain. Missing blobs are created with the first config
+// if it is gzip or uncompressed and with gzip otherwise, then converted to
+// the first config. If all is set, layers whose blob uses a different
+// compression or level than a config get a blob variant with that
+// compression, variants are created concurrently and reused by later calls.
+// Otherwise the existing blobs are returned as they are, so only a single
+// config is accepted. The returned remotes are in the order of configs.
+func (sr *immutableRef) GetRemotes(ctx context.Context, createIfNeeded bool, configs []compression.Config, all bool, s session.Group) ([]*solver.Remote, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("no compression configs")
+	}
+	if !all && len(configs) > 1 {
+		return nil, errors.Errorf("can't get remotes for %d compression configs without creating blob variants", len(configs))
+	}
+	for _, comp := range configs {
+		if err := comp.Validate(); err != nil {
+			return nil, err
+		}
+		switch comp.Type {
+		case compression.Uncompressed, compression.Gzip, compression.Zstd:
+		default:
+			return nil, errors.Errorf("unsupported compression type %s for remote", comp.Type)
+		}
+	}
+
+	// The blobs of the remote are added to the caller's lease so they
+	// remain available for the lifetime of it, even if the refs are
+	// released and pruned while the remote is being exported.
+	callerLease, hasCallerLease := leases.FromContext(ctx)
 
-	err = sr.computeBlobChain(ctx, createIfNeeded, compressionType, s)
+	ctx, done, err := leaseutil.WithLease(ctx, sr.cm.LeaseManager, leaseutil.MakeTemporary)
 	if err != nil {
 		return nil, err
 	}
+	defer done(ctx)
+	ctx = withConversionOwner(ctx)
 
-	mprovider := &lazyMultiProvider{mprovider: contentutil.NewMultiProvider(nil)}
-	remote := &solver.Remote{
-		Provider: mprovider,
+	// the differ only creates gzip and uncompressed blobs
+	create := configs[0]
+	if create.Type != compression.Uncompressed && create.Type != compression.Gzip {
+		create = compression.New(compression.Gzip)
+	}
+
+	chain := sr.parentRefChain()
+	created := make([]bool, len(chain))
+	for i, ref := range chain {
+		created[i] = ref.Info().Blob == ""
+	}
+
+	err = sr.computeBlobChain(ctx, createIfNeeded, create, s)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, ref := range sr.parentRefChain() {
+	base := make([]ocispec.Descriptor, len(chain))
+	for i, ref := range chain {
 		desc, err := ref.ociDesc()
 		if err != nil {
 			return nil, err
 		}
 
 		// NOTE: The media type might be missing for some migrated ones
-		// from before lease based storage. If so, we should detect
-		// the media type from blob data.
+		// from before lease based storage, or be a generic one for blobs
+		// imported from some registries and OCI layouts. If so, we should
+		// detect the media type from blob data.
 		//
 		// Discussion: https://github.com/moby/buildkit/pull/1277#discussion_r352795429
-		if desc.MediaType == "" {
+		if !compression.IsLayerMediaTypeKnown(desc.MediaType) {
 			desc.MediaType, err = compression.DetectLayerMediaType(ctx, sr.cm.ContentStore, desc.Digest, false)
 			if err != nil {
 				return nil, err
@@ -103,16 +152,165 @@ func (sr *immutableRef) GetRemote(ctx context.Context, createIfNeeded bool, comp
 				desc.Annotations[dslKey] = strings.Join(existingRepos, ",")
 			}
 		}
+		base[i] = desc
+	}
+
+	descs := make([][]ocispec.Descriptor, len(configs))
+	eg, egctx := errgroup.WithContext(ctx)
+	for i, comp := range configs {
+		descs[i] = make([]ocispec.Descriptor, len(chain))
+		for j, desc := range base {
+			// the level of an existing blob isn't known, only the blobs
+			// created above are known to have the requested one
+			same := compression.FromMediaType(desc.MediaType) == comp.Type &&
+				(comp.Level == nil || created[j] && create.Type == comp.Type && sameLevel(create.Level, comp.Level))
+			if same || !all && !created[j] {
+				descs[i][j] = desc
+				continue
+			}
+			i, j, desc, comp, ref := i, j, desc, comp, chain[j]
+			eg.Go(func() error {
+				p := lazyRefProvider{
+					ref:     ref,
+					desc:    desc,
+					dh:      sr.descHandlers[desc.Digest],
+					session: s,
+				}
+				if err := p.Unlazy(egctx); err != nil {
+					return err
+				}
+				v, err := sr.cm.getBlobVariant(egctx, desc, comp)
+				if err != nil {
+					return errors.Wrapf(err, "failed to create %s variant of %s", comp.Type, desc.Digest)
+				}
+				// the lease of the record is flat, the variant label alone
+				// doesn't keep the variant from being collected
+				if err := sr.cm.LeaseManager.AddResource(egctx, leases.Lease{ID: ref.ID()}, leases.Resource{
+					ID:   v.Digest.String(),
+					Type: "content",
+				}); err != nil {
+					return errors.Wrapf(err, "failed to add variant %s to lease", v.Digest)
+				}
+				descs[i][j] = withLayerAnnotations(v, desc)
+				return nil
+			})
+		}
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
 
-		remote.Descriptors = append(remote.Descriptors, desc)
-		mprovider.Add(lazyRefProvider{
-			ref:     ref,
-			desc:    desc,
-			dh:      sr.descHandlers[desc.Digest],
-			session: s,
+	remotes := make([]*solver.Remote, len(configs))
+	for i := range configs {
+		mprovider := &lazyMultiProvider{mprovider: contentutil.NewMultiProvider(nil)}
+		remote := &solver.Remote{
+			Provider: mprovider,
+		}
+		layers, err := configs[i].LayerMediaTypes(descs[i]...)
+		if err != nil {
+			return nil, err
+		}
+		for j, desc := range layers {
+			if hasCallerLease {
+				if err := sr.cm.LeaseManager.AddResource(ctx, leases.Lease{ID: callerLease}, leases.Resource{
+					ID:   desc.Digest.String(),
+					Type: "content",
+				}); err != nil {
+					return nil, err
+				}
+			}
+
+			remote.Descriptors = append(remote.Descriptors, desc)
+			mprovider.Add(lazyRefProvider{
+				ref:     chain[j],
+				desc:    desc,
+				dh:      sr.descHandlers[base[j].Digest],
+				session: s,
+			})
+		}
+
+		if sr.cm.EagerUnlazy {
+			if err := mprovider.Unlazy(ctx); err != nil {
+				return nil, err
+			}
+		}
+		remotes[i] = remote
+	}
+	return remotes, nil
+}
+
+// ConvertRemote returns a remote with the layers of r compressed with comp.
+// Layers that already use the compression are passed through unchanged.
+// Other layers are fetched into the content store and converted once. The
+// conversion is recorded as a blob variant and reused by later calls and by
+// GetRemotes. The diffIDs of the layers are kept. The caller must hold a
+// lease, the fetched and converted blobs are added to it.
+func (cm *cacheManager) ConvertRemote(ctx context.Context, r *solver.Remote, comp compression.Config) (*solver.Remote, error) {
+	if _, ok := leases.FromContext(ctx); !ok {
+		return nil, errors.Errorf("missing lease requirement for ConvertRemote")
+	}
+	if err := comp.Validate(); err != nil {
+		return nil, err
+	}
+	switch comp.Type {
+	case compression.Uncompressed, compression.Gzip, compression.Zstd:
+	default:
+		return nil, errors.Errorf("unsupported compression type %s for remote", comp.Type)
+	}
+
+	descs := make([]ocispec.Descriptor, len(r.Descriptors))
+	mprovider := contentutil.NewMultiProvider(r.Provider)
+	eg, egctx := errgroup.WithContext(withConversionOwner(ctx))
+	for i, desc := range r.Descriptors {
+		if compression.FromMediaType(desc.MediaType) == comp.Type && comp.Level == nil {
+			descs[i] = desc
+			continue
+		}
+		i, desc := i, desc
+		eg.Go(func() error {
+			if err := contentutil.Copy(egctx, cm.ContentStore, r.Provider, desc, cm.RetryPolicy, nil); err != nil {
+				return errors.Wrapf(err, "failed to fetch %s", desc.Digest)
+			}
+			v, err := cm.getBlobVariant(egctx, desc, comp)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create %s variant of %s", comp.Type, desc.Digest)
+			}
+			descs[i] = withLayerAnnotations(v, desc)
+			mprovider.Add(v.Digest, cm.ContentStore)
+			return nil
 		})
 	}
-	return remote, nil
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	layers, err := comp.LayerMediaTypes(descs...)
+	if err != nil {
+		return nil, err
+	}
+	return &solver.Remote{
+		Descriptors: layers,
+		Provider:    mprovider,
+	}, nil
+}
+
+// withLayerAnnotations adds the annotations of the layer desc to its variant
+// v. Annotations specific to the compression of the blob don't apply to the
+// variant.
+func withLayerAnnotations(v, desc ocispec.Descriptor) ocispec.Descriptor {
+	for k, val := range desc.Annotations {
+		if _, ok := v.Annotations[k]; !ok && !isBlobAnnotation(k) {
+			v.Annotations[k] = val
+		}
+	}
+	return v
+}
+
+func sameLevel(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
 }
 
 type lazyMultiProvider struct {
@@ -183,7 +381,7 @@ func (p lazyRefProvider) Unlazy(ctx context.Context) error {
 		err := contentutil.Copy(ctx, p.ref.cm.ContentStore, &pullprogress.ProviderWithProgress{
 			Provider: p.dh.Provider(p.session),
 			Manager:  p.ref.cm.ContentStore,
-		}, p.desc, logs.LoggerFromContext(ctx))
+		}, p.desc, p.ref.cm.RetryPolicy, logs.LoggerFromContext(ctx))
 		if err != nil {
 			return nil, err
 		}
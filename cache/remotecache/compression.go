@@ -0,0 +1,185 @@
+package remotecache
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/moby/buildkit/util/compression"
+	"github.com/pkg/errors"
+)
+
+const (
+	attrLayerCompression = "compression"
+	attrCompressionLevel = "compression-level"
+	attrForceCompression = "force-compression"
+
+	forceCompressionIfSmaller = "if-smaller"
+)
+
+// ParseLayerCompression parses the compression, compression-level and
+// force-compression attributes of the cache exporters. Layers are gzip
+// compressed by default. With force-compression, layers with another
+// compression are exported as variants with the requested one. With
+// force-compression=if-smaller, a layer is only converted if the variant is
+// smaller than the original blob.
+func ParseLayerCompression(attrs map[string]string) (compression.Config, bool, error) {
+	comp := compression.New(compression.Default)
+	if v, ok := attrs[attrLayerCompression]; ok {
+		switch v {
+		case compression.Gzip.String():
+			comp.Type = compression.Gzip
+		case compression.Uncompressed.String():
+			comp.Type = compression.Uncompressed
+		case compression.Zstd.String():
+			comp.Type = compression.Zstd
+		default:
+			return compression.Config{}, false, errors.Errorf("unsupported layer compression type %q", v)
+		}
+	}
+	if v, ok := attrs[attrCompressionLevel]; ok {
+		l, err := strconv.Atoi(v)
+		if err != nil {
+			return compression.Config{}, false, errors.Wrapf(err, "failed to parse %s", attrCompressionLevel)
+		}
+		comp = comp.SetLevel(l)
+	}
+	if err := comp.Validate(); err != nil {
+		return compression.Config{}, false, err
+	}
+	force := false
+	if v, ok := attrs[attrForceCompression]; ok && v == forceCompressionIfSmaller {
+		comp = comp.SetIfSmaller()
+		force = true
+	} else if ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return compression.Config{}, false, errors.Wrapf(err, "failed to parse %s", attrForceCompression)
+		}
+		force = b
+	}
+	// new layers can only be created with gzip or without compression,
+	// other compressions are always variants of them
+	if comp.Type == compression.Zstd && !force {
+		return compression.Config{}, false, errors.Errorf("%s layer compression requires %s", comp.Type, attrForceCompression)
+	}
+	return comp, force, nil
+}
+
+// HasLayerCompression returns true if attrs set the compression of the
+// layers. Without it, the compression preferred by the backend is used.
+func HasLayerCompression(attrs map[string]string) bool {
+	for _, k := range []string{attrLayerCompression, attrCompressionLevel, attrForceCompression} {
+		if _, ok := attrs[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithLayerCompression sets the compression of the layers exported by an
+// exporter returned by NewExporter or NewIncrementalExporter. Other
+// exporters are returned unchanged and export layers gzip compressed.
+func WithLayerCompression(e Exporter, comp compression.Config, force bool) Exporter {
+	if ce, ok := e.(*contentCacheExporter); ok {
+		ce.layerCompression = comp
+		ce.forceCompression = force
+		ce.layerCompressionSet = true
+	}
+	return e
+}
+
+// LayerCompression returns the compression of the exported layers and
+// whether layers with another compression are converted.
+func (ce *contentCacheExporter) LayerCompression() (compression.Config, bool) {
+	return ce.layerCompression, ce.forceCompression
+}
+
+// SupportedLayerCompressions returns the compressions of the layers that
+// the exporter can store. zstd layers need OCI media types.
+func (ce *contentCacheExporter) SupportedLayerCompressions() []compression.Type {
+	if ce.oci {
+		return []compression.Type{compression.Uncompressed, compression.Gzip, compression.Zstd}
+	}
+	return []compression.Type{compression.Uncompressed, compression.Gzip}
+}
+
+// PreferredLayerCompression returns the compression of the layers created
+// for the exporter if none was set. Existing layers are kept as they are so
+// that the cache shares its blobs with the images.
+func (ce *contentCacheExporter) PreferredLayerCompression() compression.Config {
+	return compression.New(compression.Default)
+}
+
+// LayerCompressionCapabilities is implemented by cache exporters whose
+// backend only stores some layer compressions or prefers one of them.
+type LayerCompressionCapabilities interface {
+	// SupportedLayerCompressions returns the compressions of the layers the
+	// backend can store.
+	SupportedLayerCompressions() []compression.Type
+	// PreferredLayerCompression returns the compression used for the layers
+	// if the user didn't set one.
+	PreferredLayerCompression() compression.Config
+}
+
+// LayerCompressionChoice is the compression of the layers exported by a
+// cache exporter.
+type LayerCompressionChoice struct {
+	Config compression.Config
+	// Force converts all layers with another compression to Config.
+	Force bool
+	// Supported are the compressions the backend can store, existing
+	// layers with other compressions are converted to Config. Any
+	// compression is stored if empty.
+	Supported []compression.Type
+	// Source tells where the choice comes from.
+	Source string
+}
+
+// IsSupported returns true if layers with compression t can be exported
+// without converting them.
+func (c LayerCompressionChoice) IsSupported(t compression.Type) bool {
+	if len(c.Supported) == 0 {
+		return true
+	}
+	for _, s := range c.Supported {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (c LayerCompressionChoice) String() string {
+	s := c.Config.Type.String()
+	if c.Config.Level != nil {
+		s = fmt.Sprintf("%s level %d", s, *c.Config.Level)
+	}
+	if c.Force {
+		s += ", forced"
+		if c.Config.IfSmaller {
+			s += " if smaller"
+		}
+	}
+	return fmt.Sprintf("%s (%s)", s, c.Source)
+}
+
+// NegotiateLayerCompression returns the compression of the layers exported
+// by e. The compression set with WithLayerCompression is used if there is
+// one, otherwise the one preferred by the backend and gzip for exporters
+// without LayerCompressionCapabilities.
+func NegotiateLayerCompression(e Exporter) LayerCompressionChoice {
+	c := LayerCompressionChoice{
+		Config: compression.New(compression.Default),
+		Source: "default",
+	}
+	if caps, ok := e.(LayerCompressionCapabilities); ok {
+		c.Config = caps.PreferredLayerCompression()
+		c.Supported = caps.SupportedLayerCompressions()
+		c.Source = "preferred by cache backend"
+	}
+	if ce, ok := e.(*contentCacheExporter); ok && ce.layerCompressionSet {
+		c.Config, c.Force = ce.layerCompression, ce.forceCompression
+		c.Source = "set by cache exporter options"
+	}
+	return c
+}
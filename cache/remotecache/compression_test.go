@@ -0,0 +1,81 @@
+package remotecache
+
+import (
+	"testing"
+
+	"github.com/moby/buildkit/util/compression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLayerCompression(t *testing.T) {
+	t.Parallel()
+
+	comp, force, err := ParseLayerCompression(nil)
+	require.NoError(t, err)
+	require.Equal(t, compression.New(compression.Default), comp)
+	require.False(t, force)
+
+	comp, force, err = ParseLayerCompression(map[string]string{"compression": "zstd", "force-compression": "true"})
+	require.NoError(t, err)
+	require.Equal(t, compression.New(compression.Zstd), comp)
+	require.True(t, force)
+
+	comp, force, err = ParseLayerCompression(map[string]string{"compression": "zstd", "force-compression": "if-smaller"})
+	require.NoError(t, err)
+	require.Equal(t, compression.New(compression.Zstd).SetIfSmaller(), comp)
+	require.True(t, force)
+
+	comp, _, err = ParseLayerCompression(map[string]string{"compression-level": "3"})
+	require.NoError(t, err)
+	require.Equal(t, compression.New(compression.Gzip).SetLevel(3), comp)
+
+	for _, attrs := range []map[string]string{
+		{"compression": "xz"},
+		{"compression": "zstd"},
+		{"compression": "uncompressed", "compression-level": "3"},
+		{"compression-level": "high"},
+		{"force-compression": "maybe"},
+	} {
+		_, _, err := ParseLayerCompression(attrs)
+		require.Error(t, err, "%v", attrs)
+	}
+
+	e := WithLayerCompression(NewExporter(nil, true, compression.Uncompressed), comp, true)
+	lc, ok := e.(interface {
+		LayerCompression() (compression.Config, bool)
+	})
+	require.True(t, ok)
+	comp, force = lc.LayerCompression()
+	require.Equal(t, compression.New(compression.Gzip).SetLevel(3), comp)
+	require.True(t, force)
+}
+
+func TestNegotiateLayerCompression(t *testing.T) {
+	t.Parallel()
+
+	lc := NegotiateLayerCompression(NewExporter(nil, false, compression.Uncompressed))
+	require.Equal(t, compression.New(compression.Default), lc.Config)
+	require.False(t, lc.Force)
+	require.True(t, lc.IsSupported(compression.Gzip))
+	require.False(t, lc.IsSupported(compression.Zstd))
+	require.Equal(t, "gzip (preferred by cache backend)", lc.String())
+
+	lc = NegotiateLayerCompression(NewExporter(nil, true, compression.Uncompressed))
+	require.True(t, lc.IsSupported(compression.Zstd))
+
+	comp, force, err := ParseLayerCompression(map[string]string{"compression": "zstd", "compression-level": "3", "force-compression": "true"})
+	require.NoError(t, err)
+	lc = NegotiateLayerCompression(WithLayerCompression(NewExporter(nil, true, compression.Uncompressed), comp, force))
+	require.Equal(t, compression.New(compression.Zstd).SetLevel(3), lc.Config)
+	require.True(t, lc.Force)
+	require.Equal(t, "zstd level 3, forced (set by cache exporter options)", lc.String())
+
+	// exporters without capabilities store any compression
+	lc = NegotiateLayerCompression(struct{ Exporter }{})
+	require.Equal(t, compression.New(compression.Default), lc.Config)
+	require.True(t, lc.IsSupported(compression.Zstd))
+	require.Equal(t, "gzip (default)", lc.String())
+
+	require.False(t, HasLayerCompression(map[string]string{"oci-mediatypes": "true"}))
+	require.True(t, HasLayerCompression(map[string]string{"compression-level": "3"}))
+}
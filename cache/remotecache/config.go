@@ -0,0 +1,71 @@
+package remotecache
+
+import (
+	"bytes"
+
+	"github.com/klauspost/compress/zstd"
+	v1 "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/pkg/errors"
+)
+
+// maxConfigSize limits the size of a decompressed cache config.
+const maxConfigSize = 64 << 20
+
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// ParseConfigCompression parses the config-compression attribute of the
+// cache exporters. The cache config is uncompressed by default.
+func ParseConfigCompression(v string) (compression.Type, error) {
+	switch v {
+	case "", compression.Uncompressed.String():
+		return compression.Uncompressed, nil
+	case compression.Zstd.String():
+		return compression.Zstd, nil
+	default:
+		return compression.UnknownCompression, errors.Errorf("unsupported cache config compression %q", v)
+	}
+}
+
+// compressConfig returns the cache config dt compressed with ct and the
+// media type of the compressed config.
+func compressConfig(dt []byte, ct compression.Type) ([]byte, string, error) {
+	switch ct {
+	case compression.Uncompressed:
+		return dt, v1.CacheConfigMediaTypeV0, nil
+	case compression.Zstd:
+		zw, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, "", errors.WithStack(err)
+		}
+		defer zw.Close()
+		return zw.EncodeAll(dt, nil), v1.CacheConfigMediaTypeV0Zstd, nil
+	default:
+		return nil, "", errors.Errorf("unsupported cache config compression %s", ct)
+	}
+}
+
+// isCacheConfig returns true if mediaType is the media type of a cache
+// config in any of the supported compressions.
+func isCacheConfig(mediaType string) bool {
+	return mediaType == v1.CacheConfigMediaTypeV0 || mediaType == v1.CacheConfigMediaTypeV0Zstd
+}
+
+// decompressConfig returns the uncompressed cache config. The compression is
+// detected from the data, a JSON config never starts with the zstd magic
+// number.
+func decompressConfig(dt []byte) ([]byte, error) {
+	if !bytes.HasPrefix(dt, zstdMagic) {
+		return dt, nil
+	}
+	zr, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxConfigSize))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer zr.Close()
+	dt, err = zr.DecodeAll(dt, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress cache config")
+	}
+	return dt, nil
+}
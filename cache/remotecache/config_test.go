@@ -0,0 +1,119 @@
+package remotecache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	v1 "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigCompression(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cs, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+
+	for _, ct := range []compression.Type{compression.Uncompressed, compression.Zstd} {
+		ct := ct
+		t.Run(ct.String(), func(t *testing.T) {
+			ce := NewExporter(cs, true, ct)
+			foo := ce.Add(digest.FromString("foo-" + ct.String()))
+			bar := ce.Add(digest.FromString("bar-" + ct.String()))
+			bar.LinkFrom(foo, 0, "")
+
+			res, err := ce.Finalize(ctx)
+			require.NoError(t, err)
+
+			var desc ocispec.Descriptor
+			err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+			require.NoError(t, err)
+
+			dt, err := readBlob(ctx, cs, desc)
+			require.NoError(t, err)
+			var mfst ocispec.Index
+			err = json.Unmarshal(dt, &mfst)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(mfst.Manifests))
+
+			configDesc := mfst.Manifests[0]
+			require.True(t, isCacheConfig(configDesc.MediaType))
+			dt, err = readBlob(ctx, cs, configDesc)
+			require.NoError(t, err)
+			if ct == compression.Zstd {
+				require.Equal(t, v1.CacheConfigMediaTypeV0Zstd, configDesc.MediaType)
+				require.Equal(t, zstdMagic, dt[:len(zstdMagic)])
+			} else {
+				require.Equal(t, v1.CacheConfigMediaTypeV0, configDesc.MediaType)
+			}
+
+			dt, err = decompressConfig(dt)
+			require.NoError(t, err)
+			var config v1.CacheConfig
+			err = json.Unmarshal(dt, &config)
+			require.NoError(t, err)
+			require.Equal(t, 2, len(config.Records))
+
+			cc := v1.NewCacheChains()
+			err = v1.Parse(dt, v1.DescriptorProvider{}, cc)
+			require.NoError(t, err)
+		})
+	}
+
+	_, err = ParseConfigCompression("gzip")
+	require.Error(t, err)
+}
+
+func TestImportCorruptedConfig(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cs, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+
+	ce := NewExporter(cs, true, compression.Uncompressed)
+	ce.Add(digest.FromString("foo"))
+	res, err := ce.Finalize(ctx)
+	require.NoError(t, err)
+
+	var desc ocispec.Descriptor
+	err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+	require.NoError(t, err)
+	dt, err := readBlob(ctx, cs, desc)
+	require.NoError(t, err)
+	var mfst ocispec.Index
+	err = json.Unmarshal(dt, &mfst)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mfst.Manifests))
+
+	// the local store returns the file content without verifying it
+	configDesc := mfst.Manifests[0]
+	p := filepath.Join(tmpdir, "blobs", configDesc.Digest.Algorithm().String(), configDesc.Digest.Hex())
+	dt, err = ioutil.ReadFile(p)
+	require.NoError(t, err)
+	dt[len(dt)-1] = ' '
+	require.NoError(t, os.Chmod(p, 0644))
+	err = ioutil.WriteFile(p, dt, 0644)
+	require.NoError(t, err)
+
+	_, err = NewImporter(cs).Resolve(ctx, desc, "test", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "corrupted cache blob "+configDesc.Digest.String())
+}
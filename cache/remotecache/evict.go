@@ -0,0 +1,77 @@
+package remotecache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	attrTTL     = "ttl"
+	attrMaxSize = "max-size"
+
+	// ExporterResponseEvictedRecords is a key for the map returned from
+	// Exporter.Finalize. The value is the number of cache records whose
+	// results were dropped by the EvictionPolicy of the exporter.
+	ExporterResponseEvictedRecords = "cache.evicted"
+)
+
+// EvictionPolicy limits the cache written by an exporter. Results of
+// records older than TTL are dropped first, then the results of the oldest
+// records until the layers of the cache fit in MaxSize bytes. The budget
+// applies to every cache manifest, so to every platform of a cache split by
+// platform. Zero values disable the respective limit.
+type EvictionPolicy struct {
+	TTL     time.Duration
+	MaxSize int64
+}
+
+// ParseEvictionPolicy parses the ttl and max-size attributes of the cache
+// exporters.
+func ParseEvictionPolicy(attrs map[string]string) (EvictionPolicy, error) {
+	var p EvictionPolicy
+	if v, ok := attrs[attrTTL]; ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			return p, errors.Errorf("invalid %s %q", attrTTL, v)
+		}
+		p.TTL = ttl
+	}
+	if v, ok := attrs[attrMaxSize]; ok {
+		maxSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxSize < 0 {
+			return p, errors.Errorf("invalid %s %q", attrMaxSize, v)
+		}
+		p.MaxSize = maxSize
+	}
+	return p, nil
+}
+
+// WithEvictionPolicy sets the eviction policy of an exporter returned by
+// NewExporter or NewIncrementalExporter. Other exporters are returned
+// unchanged.
+func WithEvictionPolicy(e Exporter, p EvictionPolicy) Exporter {
+	if ce, ok := e.(*contentCacheExporter); ok {
+		ce.eviction = p
+	}
+	return e
+}
+
+// evict applies the eviction policy to the chains of all platforms.
+func (ce *contentCacheExporter) evict(ctx context.Context) int {
+	if ce.eviction == (EvictionPolicy{}) {
+		return 0
+	}
+	now := time.Now()
+	evicted := ce.chains.Evict(ce.eviction.TTL, ce.eviction.MaxSize, now)
+	for _, pc := range ce.platforms {
+		evicted += pc.chains.Evict(ce.eviction.TTL, ce.eviction.MaxSize, now)
+	}
+	if evicted > 0 {
+		oneOffProgress(ctx, fmt.Sprintf("evicting %d cache records", evicted))(nil)
+	}
+	return evicted
+}
@@ -0,0 +1,73 @@
+package remotecache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportEviction(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	src, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+	oldLayer := writeTestLayer(ctx, t, src, "old")
+	newLayer := writeTestLayer(ctx, t, src, "new")
+
+	p, err := ParseEvictionPolicy(map[string]string{"ttl": "24h", "max-size": "1024"})
+	require.NoError(t, err)
+	require.Equal(t, EvictionPolicy{TTL: 24 * time.Hour, MaxSize: 1024}, p)
+
+	ce := WithEvictionPolicy(NewExporter(src, true, compression.Uncompressed), p)
+	old := ce.Add(digest.FromString("old"))
+	old.AddResult(time.Now().Add(-48*time.Hour), &solver.Remote{
+		Descriptors: []ocispec.Descriptor{oldLayer},
+		Provider:    src,
+	})
+	recent := ce.Add(digest.FromString("new"))
+	recent.AddResult(time.Now(), &solver.Remote{
+		Descriptors: []ocispec.Descriptor{newLayer},
+		Provider:    src,
+	})
+
+	res, err := ce.Finalize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "1", res[ExporterResponseEvictedRecords])
+
+	var desc ocispec.Descriptor
+	err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+	require.NoError(t, err)
+	dt, err := readBlob(ctx, src, desc)
+	require.NoError(t, err)
+	var mfst ocispec.Index
+	err = json.Unmarshal(dt, &mfst)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mfst.Manifests))
+	require.Equal(t, newLayer.Digest, mfst.Manifests[0].Digest)
+
+	// exporters without a policy don't report evictions
+	res, err = NewExporter(src, true, compression.Uncompressed).Finalize(ctx)
+	require.NoError(t, err)
+	_, ok := res[ExporterResponseEvictedRecords]
+	require.False(t, ok)
+
+	for _, attrs := range []map[string]string{{"ttl": "1d"}, {"ttl": "-1h"}, {"max-size": "1GB"}} {
+		_, err := ParseEvictionPolicy(attrs)
+		require.Error(t, err)
+	}
+}
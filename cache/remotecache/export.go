@@ -3,8 +3,11 @@ package remotecache
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/content"
@@ -13,9 +16,7 @@ import (
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/util/compression"
-	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/progress"
-	"github.com/moby/buildkit/util/progress/logs"
 	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -47,6 +48,13 @@ type Exporter interface {
 	Finalize(ctx context.Context) (map[string]string, error)
 }
 
+// PlatformSplitter is implemented by exporters that can write the cache of
+// every platform of a multi-platform build to its own cache manifest.
+type PlatformSplitter interface {
+	// ForPlatform returns the target for the cache of platform.
+	ForPlatform(platform ocispec.Platform) solver.CacheExporterTarget
+}
+
 const (
 	// ExportResponseManifestDesc is a key for the map returned from Exporter.Finalize.
 	// The map value is a JSON string of an OCI desciptor of a manifest.
@@ -55,93 +63,174 @@ const (
 
 type contentCacheExporter struct {
 	solver.CacheExporterTarget
-	chains   *v1.CacheChains
-	ingester content.Ingester
-	oci      bool
+	chains            *v1.CacheChains
+	ingester          content.Ingester
+	oci               bool
+	configCompression compression.Type
+	previous          PreviousCacheFunc
+	eviction          EvictionPolicy
+	signer            crypto.Signer
+	pushConcurrency   int
+	layerCompression  compression.Config
+	forceCompression  bool
+	// layerCompressionSet is true if the compression of the layers was set
+	// by the user
+	layerCompressionSet bool
+
+	mu        sync.Mutex
+	platforms []*platformChains
 }
 
-func NewExporter(ingester content.Ingester, oci bool) Exporter {
-	cc := v1.NewCacheChains()
-	return &contentCacheExporter{CacheExporterTarget: cc, chains: cc, ingester: ingester, oci: oci}
+// NewExporter returns an exporter writing the cache to ingester. The cache
+// config is compressed with configCompression, either Uncompressed or Zstd.
+func NewExporter(ingester content.Ingester, oci bool, configCompression compression.Type) Exporter {
+	return NewIncrementalExporter(ingester, oci, configCompression, nil)
 }
 
-func (ce *contentCacheExporter) Finalize(ctx context.Context) (map[string]string, error) {
-	res := make(map[string]string)
-	config, descs, err := ce.chains.Marshal()
-	if err != nil {
-		return nil, err
-	}
+// NewIncrementalExporter returns an exporter that only writes the blobs
+// that are not part of the cache previously exported to the same
+// destination. previous is called on Finalize to get the manifest of that
+// cache. If there is no previous cache or it can't be read, e.g. because an
+// older version wrote it in another format, the full cache is written.
+func NewIncrementalExporter(ingester content.Ingester, oci bool, configCompression compression.Type, previous PreviousCacheFunc) Exporter {
+	cc := v1.NewCacheChains()
+	return &contentCacheExporter{CacheExporterTarget: cc, chains: cc, ingester: ingester, oci: oci, configCompression: configCompression, previous: previous, layerCompression: compression.New(compression.Default)}
+}
 
-	// own type because oci type can't be pushed and docker type doesn't have annotations
-	type manifestList struct {
-		specs.Versioned
+// manifestList is the cache manifest. It's an own type because the oci
+// type can't be pushed and the docker type doesn't have annotations.
+type manifestList struct {
+	specs.Versioned
 
-		MediaType string `json:"mediaType,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
 
-		// Manifests references platform specific manifests.
-		Manifests []ocispec.Descriptor `json:"manifests"`
-	}
+	// Manifests references platform specific manifests.
+	Manifests []ocispec.Descriptor `json:"manifests"`
+}
 
+func (ce *contentCacheExporter) newManifestList() manifestList {
 	var mfst manifestList
 	mfst.SchemaVersion = 2
 	mfst.MediaType = images.MediaTypeDockerSchema2ManifestList
 	if ce.oci {
 		mfst.MediaType = ocispec.MediaTypeImageIndex
 	}
+	return mfst
+}
+
+func (ce *contentCacheExporter) Finalize(ctx context.Context) (map[string]string, error) {
+	res := make(map[string]string)
+
+	evicted := ce.evict(ctx)
+	prev := ce.loadPrevious(ctx)
+
+	var desc ocispec.Descriptor
+	var err error
+	if len(ce.platforms) == 0 {
+		desc, err = ce.writeManifest(ctx, ce.chains, prev)
+	} else {
+		desc, err = ce.writePlatformIndex(ctx, prev)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	descJSON, err := json.Marshal(desc)
+	if err != nil {
+		return nil, err
+	}
+	res[ExporterResponseManifestDesc] = string(descJSON)
+	if ce.eviction != (EvictionPolicy{}) {
+		res[ExporterResponseEvictedRecords] = strconv.Itoa(evicted)
+	}
+	return res, nil
+}
+
+// writeManifest writes the layers and config of chains and the cache
+// manifest referencing them.
+func (ce *contentCacheExporter) writeManifest(ctx context.Context, chains *v1.CacheChains, prev *previousCache) (ocispec.Descriptor, error) {
+	config, descs, err := chains.Marshal()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	mfst := ce.newManifestList()
 
+	reused := 0
+	var layers []v1.DescriptorProviderPair
 	for _, l := range config.Layers {
 		dgstPair, ok := descs[l.Blob]
 		if !ok {
-			return nil, errors.Errorf("missing blob %s", l.Blob)
+			return ocispec.Descriptor{}, errors.Errorf("missing blob %s", l.Blob)
 		}
-		layerDone := oneOffProgress(ctx, fmt.Sprintf("writing layer %s", l.Blob))
-		if err := contentutil.Copy(ctx, ce.ingester, dgstPair.Provider, dgstPair.Descriptor, logs.LoggerFromContext(ctx)); err != nil {
-			return nil, layerDone(errors.Wrap(err, "error writing layer blob"))
-		}
-		layerDone(nil)
 		mfst.Manifests = append(mfst.Manifests, dgstPair.Descriptor)
+		if prev.hasBlob(l.Blob) {
+			reused++
+			continue
+		}
+		layers = append(layers, dgstPair)
+	}
+	if err := ce.writeLayers(ctx, layers); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	if reused > 0 {
+		oneOffProgress(ctx, fmt.Sprintf("reusing %d layers of previous cache export", reused))(nil)
 	}
 
 	mfst.Manifests = compression.ConvertAllLayerMediaTypes(ce.oci, mfst.Manifests...)
 
 	dt, err := json.Marshal(config)
 	if err != nil {
-		return nil, err
+		return ocispec.Descriptor{}, err
+	}
+	dt, mediaType, err := compressConfig(dt, ce.configCompression)
+	if err != nil {
+		return ocispec.Descriptor{}, err
 	}
 	dgst := digest.FromBytes(dt)
 	desc := ocispec.Descriptor{
 		Digest:    dgst,
 		Size:      int64(len(dt)),
-		MediaType: v1.CacheConfigMediaTypeV0,
+		MediaType: mediaType,
 	}
-	configDone := oneOffProgress(ctx, fmt.Sprintf("writing config %s", dgst))
-	if err := content.WriteBlob(ctx, ce.ingester, dgst.String(), bytes.NewReader(dt), desc); err != nil {
-		return nil, configDone(errors.Wrap(err, "error writing config blob"))
+	if !prev.hasBlob(dgst) {
+		configDone := oneOffProgress(ctx, fmt.Sprintf("writing config %s", dgst))
+		if err := content.WriteBlob(ctx, ce.ingester, dgst.String(), bytes.NewReader(dt), desc); err != nil {
+			return ocispec.Descriptor{}, configDone(errors.Wrap(err, "error writing config blob"))
+		}
+		configDone(nil)
+	}
+	if ce.signer != nil {
+		if desc, err = signConfig(ce.signer, desc); err != nil {
+			return ocispec.Descriptor{}, err
+		}
 	}
-	configDone(nil)
 
 	mfst.Manifests = append(mfst.Manifests, desc)
 
-	dt, err = json.Marshal(mfst)
+	return ce.writeManifestList(ctx, mfst, prev)
+}
+
+func (ce *contentCacheExporter) writeManifestList(ctx context.Context, mfst manifestList, prev *previousCache) (ocispec.Descriptor, error) {
+	dt, err := json.Marshal(mfst)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to marshal manifest")
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal manifest")
 	}
-	dgst = digest.FromBytes(dt)
+	dgst := digest.FromBytes(dt)
 
-	desc = ocispec.Descriptor{
+	desc := ocispec.Descriptor{
 		Digest:    dgst,
 		Size:      int64(len(dt)),
 		MediaType: mfst.MediaType,
 	}
+	if prev.hasBlob(dgst) {
+		return desc, nil
+	}
 	mfstDone := oneOffProgress(ctx, fmt.Sprintf("writing manifest %s", dgst))
 	if err := content.WriteBlob(ctx, ce.ingester, dgst.String(), bytes.NewReader(dt), desc); err != nil {
-		return nil, mfstDone(errors.Wrap(err, "error writing manifest blob"))
+		return ocispec.Descriptor{}, mfstDone(errors.Wrap(err, "error writing manifest blob"))
 	}
-	descJSON, err := json.Marshal(desc)
-	if err != nil {
-		return nil, err
-	}
-	res[ExporterResponseManifestDesc] = string(descJSON)
 	mfstDone(nil)
-	return res, nil
+	return desc, nil
 }
@@ -0,0 +1,50 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/moby/buildkit/cache/remotecache"
+	"github.com/moby/buildkit/session"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	attrURL      = "url"
+	attrChecksum = "checksum"
+	attrTag      = "tag"
+)
+
+// ResolveCacheImporterFunc for "http" cache importer. The cache is read from
+// an OCI layout tarball, e.g. a tarball of a directory written by the
+// "local" cache exporter or the output of the "oci" exporter with inline
+// cache.
+func ResolveCacheImporterFunc() remotecache.ResolveCacheImporterFunc {
+	return func(ctx context.Context, _ session.Group, attrs map[string]string) (remotecache.Importer, ocispec.Descriptor, error) {
+		u, err := url.Parse(attrs[attrURL])
+		if err != nil {
+			return nil, ocispec.Descriptor{}, errors.Wrapf(err, "invalid %s", attrURL)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, ocispec.Descriptor{}, errors.New("http cache importer requires http or https url")
+		}
+		var checksum digest.Digest
+		if v, ok := attrs[attrChecksum]; ok {
+			if checksum, err = digest.Parse(v); err != nil {
+				return nil, ocispec.Descriptor{}, errors.Wrapf(err, "invalid %s", attrChecksum)
+			}
+		}
+		l, err := openLayout(ctx, http.DefaultClient, u.String(), checksum)
+		if err != nil {
+			return nil, ocispec.Descriptor{}, err
+		}
+		desc, err := l.manifest(ctx, attrs[attrTag])
+		if err != nil {
+			return nil, ocispec.Descriptor{}, err
+		}
+		return remotecache.NewImporter(l), desc, nil
+	}
+}
@@ -0,0 +1,243 @@
+package httpcache
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const indexJSON = "index.json"
+
+type section struct {
+	offset int64
+	size   int64
+}
+
+// layout is an OCI layout tarball. Only the offsets of the files are read
+// when it's opened, blobs are read when they are needed.
+type layout struct {
+	readerAt func(ctx context.Context) io.ReaderAt
+	files    map[string]section
+}
+
+var _ content.Provider = &layout{}
+
+// openLayout opens the tarball at url. If the server supports range
+// requests and no checksum is set, only the tar headers and the blobs used
+// by the import are downloaded. Otherwise the tarball is downloaded to a
+// temporary file and verified against checksum.
+func openLayout(ctx context.Context, client *http.Client, url string, checksum digest.Digest) (*layout, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	if checksum == "" {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", url)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		rr := &rangeReader{client: client, url: url}
+		return readLayout(ctx, func(ctx context.Context) io.ReaderAt {
+			return &ctxReaderAt{ctx: ctx, rr: rr}
+		}, size)
+	case http.StatusOK:
+		return downloadLayout(ctx, resp.Body, checksum)
+	default:
+		return nil, errors.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+}
+
+// downloadLayout writes the tarball to a temporary file that is removed
+// right away, the file is closed when the layout is garbage collected.
+func downloadLayout(ctx context.Context, r io.Reader, checksum digest.Digest) (*layout, error) {
+	f, err := ioutil.TempFile("", "buildkit-http-cache")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	os.Remove(f.Name())
+
+	var verifier digest.Verifier
+	if checksum != "" {
+		verifier = checksum.Verifier()
+		r = io.TeeReader(r, verifier)
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to download cache tarball")
+	}
+	if verifier != nil && !verifier.Verified() {
+		f.Close()
+		return nil, errors.Errorf("cache tarball doesn't match checksum %s", checksum)
+	}
+
+	l, err := readLayout(ctx, func(context.Context) io.ReaderAt { return f }, size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	runtime.SetFinalizer(l, func(*layout) {
+		f.Close()
+	})
+	return l, nil
+}
+
+func readLayout(ctx context.Context, readerAt func(ctx context.Context) io.ReaderAt, size int64) (*layout, error) {
+	sr := io.NewSectionReader(readerAt(ctx), 0, size)
+	tr := tar.NewReader(sr)
+	l := &layout{readerAt: readerAt, files: map[string]section{}}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read cache tarball")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// tar.Reader doesn't buffer, the data follows the header
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		l.files[name] = section{offset: offset, size: hdr.Size}
+	}
+	if _, ok := l.files[indexJSON]; !ok {
+		return nil, errors.Errorf("invalid cache tarball: missing %s", indexJSON)
+	}
+	return l, nil
+}
+
+// manifest returns the descriptor of the manifest with tag in index.json.
+// Without a tag, the only manifest or the one tagged "latest" is used.
+func (l *layout) manifest(ctx context.Context, tag string) (ocispec.Descriptor, error) {
+	s := l.files[indexJSON]
+	dt, err := ioutil.ReadAll(io.NewSectionReader(l.readerAt(ctx), s.offset, s.size))
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to read %s", indexJSON)
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(dt, &idx); err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to parse %s", indexJSON)
+	}
+	if tag == "" && len(idx.Manifests) == 1 {
+		return idx.Manifests[0], nil
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	for _, m := range idx.Manifests {
+		if m.Annotations[ocispec.AnnotationRefName] == tag {
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, errors.Errorf("no manifest with tag %q in cache tarball", tag)
+}
+
+func (l *layout) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s, ok := l.files[path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Hex())]
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "blob %s not in cache tarball", desc.Digest)
+	}
+	return &blobReaderAt{SectionReader: io.NewSectionReader(l.readerAt(ctx), s.offset, s.size), l: l}, nil
+}
+
+type blobReaderAt struct {
+	*io.SectionReader
+	// l keeps the temporary file of a downloaded tarball open
+	l *layout
+}
+
+func (r *blobReaderAt) Close() error {
+	return nil
+}
+
+// rangeReader reads the tarball with range requests.
+type rangeReader struct {
+	client *http.Client
+	url    string
+}
+
+func (rr *rangeReader) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, rr.url, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := rr.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to fetch %s", rr.url)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	default:
+		return 0, errors.Errorf("failed to fetch range of %s: %s", rr.url, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type ctxReaderAt struct {
+	ctx context.Context
+	rr  *rangeReader
+}
+
+func (r *ctxReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.rr.readAt(r.ctx, p, off)
+}
+
+// contentRangeSize returns the complete length of a Content-Range header
+// value like "bytes 0-0/1234".
+func contentRangeSize(v string) (int64, error) {
+	i := strings.LastIndex(v, "/")
+	if !strings.HasPrefix(v, "bytes ") || i < 0 {
+		return 0, errors.Errorf("invalid content range %q", v)
+	}
+	size, err := strconv.ParseInt(v[i+1:], 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid content range %q", v)
+	}
+	return size, nil
+}
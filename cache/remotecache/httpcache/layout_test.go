@@ -0,0 +1,149 @@
+package httpcache
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/moby/buildkit/cache/remotecache"
+	"github.com/moby/buildkit/client/ociindex"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportTarball(t *testing.T) {
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cs, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+
+	dt := bytes.Repeat([]byte("layer"), 1<<18)
+	layer := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+		Annotations: map[string]string{
+			"containerd.io/uncompressed": digest.FromBytes(dt).String(),
+		},
+	}
+	err = content.WriteBlob(ctx, cs, layer.Digest.String(), bytes.NewReader(dt), layer)
+	require.NoError(t, err)
+
+	ce := remotecache.NewExporter(cs, true, compression.Uncompressed)
+	ce.Add(digest.FromString("foo")).AddResult(time.Now(), &solver.Remote{
+		Descriptors: []ocispec.Descriptor{layer},
+		Provider:    cs,
+	})
+	res, err := ce.Finalize(ctx)
+	require.NoError(t, err)
+	var desc ocispec.Descriptor
+	err = json.Unmarshal([]byte(res[remotecache.ExporterResponseManifestDesc]), &desc)
+	require.NoError(t, err)
+	err = ociindex.PutDescToIndexJSONFileLocked(filepath.Join(tmpdir, "index.json"), desc, "latest")
+	require.NoError(t, err)
+
+	tarball := tarDir(t, tmpdir)
+	var served int64
+	ranged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(&countingWriter{ResponseWriter: w, n: &served}, r, "cache.tar", time.Time{}, bytes.NewReader(tarball))
+	}))
+	defer ranged.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer plain.Close()
+
+	resolve := ResolveCacheImporterFunc()
+	for _, attrs := range []map[string]string{
+		{"url": ranged.URL},
+		{"url": plain.URL},
+		{"url": ranged.URL, "checksum": digest.FromBytes(tarball).String()},
+	} {
+		atomic.StoreInt64(&served, 0)
+		_, mfstDesc, err := resolve(ctx, nil, attrs)
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest, mfstDesc.Digest)
+
+		l, err := openLayout(ctx, http.DefaultClient, attrs["url"], digest.Digest(attrs["checksum"]))
+		require.NoError(t, err)
+		mfst, err := content.ReadBlob(ctx, l, desc)
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest, digest.FromBytes(mfst))
+		if attrs["url"] == ranged.URL && attrs["checksum"] == "" {
+			// the layer is not downloaded before it's needed
+			require.True(t, atomic.LoadInt64(&served) < layer.Size)
+		}
+		got, err := content.ReadBlob(ctx, l, layer)
+		require.NoError(t, err)
+		require.Equal(t, dt, got)
+	}
+
+	_, _, err = resolve(ctx, nil, map[string]string{"url": ranged.URL, "checksum": digest.FromString("foo").String()})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match checksum")
+
+	_, _, err = resolve(ctx, nil, map[string]string{"url": plain.URL, "tag": "other"})
+	require.Error(t, err)
+
+	_, _, err = resolve(ctx, nil, map[string]string{"url": "file:///cache.tar"})
+	require.Error(t, err)
+}
+
+func tarDir(t *testing.T, dir string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		dt, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     "./" + filepath.ToSlash(rel),
+			Mode:     0644,
+			Size:     int64(len(dt)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return err
+		}
+		_, err = tw.Write(dt)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.n, int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
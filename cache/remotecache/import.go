@@ -39,6 +39,7 @@ func NewImporter(provider content.Provider) Importer {
 
 type contentCacheImporter struct {
 	provider content.Provider
+	verifier *Verifier
 }
 
 func (ci *contentCacheImporter) Resolve(ctx context.Context, desc ocispec.Descriptor, id string, w worker.Worker) (solver.CacheManager, error) {
@@ -57,7 +58,7 @@ func (ci *contentCacheImporter) Resolve(ctx context.Context, desc ocispec.Descri
 	var configDesc ocispec.Descriptor
 
 	for _, m := range mfst.Manifests {
-		if m.MediaType == v1.CacheConfigMediaTypeV0 {
+		if isCacheConfig(m.MediaType) {
 			configDesc = m
 			continue
 		}
@@ -77,13 +78,28 @@ func (ci *contentCacheImporter) Resolve(ctx context.Context, desc ocispec.Descri
 	}
 
 	if configDesc.Digest == "" {
+		if cm, ok, err := ci.importPlatforms(ctx, mfst, id, w); ok || err != nil {
+			return cm, err
+		}
+		if ci.verifier != nil {
+			return nil, ci.verifier.reject(errors.Errorf("inline cache of %s can't be signed", desc.Digest))
+		}
 		return ci.importInlineCache(ctx, dt, id, w)
 	}
 
+	if ci.verifier != nil {
+		if err := ci.verifier.verify(configDesc); err != nil {
+			return nil, err
+		}
+	}
 	dt, err = readBlob(ctx, ci.provider, configDesc)
 	if err != nil {
 		return nil, err
 	}
+	dt, err = decompressConfig(dt)
+	if err != nil {
+		return nil, err
+	}
 
 	cc := v1.NewCacheChains()
 	if err := v1.Parse(dt, allLayers, cc); err != nil {
@@ -114,8 +130,14 @@ func readBlob(ctx context.Context, provider content.Provider, desc ocispec.Descr
 				err = nil
 			}
 		}
+		return dt, errors.WithStack(err)
+	}
+	// stores like local directories don't verify the content they return,
+	// layers are verified when they are pulled
+	if dtDigest := desc.Digest.Algorithm().FromBytes(dt); dtDigest != desc.Digest {
+		return nil, errors.Errorf("corrupted cache blob %s: content has digest %s", desc.Digest, dtDigest)
 	}
-	return dt, errors.WithStack(err)
+	return dt, nil
 }
 
 func (ci *contentCacheImporter) importInlineCache(ctx context.Context, dt []byte, id string, w worker.Worker) (solver.CacheManager, error) {
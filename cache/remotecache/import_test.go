@@ -0,0 +1,172 @@
+package remotecache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/klauspost/compress/zstd"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/worker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportLayerCompression(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	src, err := local.NewStore(tmpdir + "/src")
+	require.NoError(t, err)
+	dst, err := local.NewStore(tmpdir + "/dst")
+	require.NoError(t, err)
+	wcs, err := local.NewStore(tmpdir + "/worker")
+	require.NoError(t, err)
+
+	for _, ct := range []compression.Type{compression.Uncompressed, compression.Gzip, compression.Zstd} {
+		ct := ct
+		t.Run(ct.String(), func(t *testing.T) {
+			var layers []ocispec.Descriptor
+			for _, data := range []string{"foo", "bar"} {
+				layers = append(layers, writeCompressedLayer(ctx, t, src, ct, data+"-"+ct.String()))
+			}
+
+			ce := NewExporter(dst, true, compression.Uncompressed)
+			var parent solver.CacheExporterRecord
+			var vertexes []digest.Digest
+			for i, l := range layers {
+				vtx := digest.FromString(l.Digest.String())
+				vertexes = append(vertexes, vtx)
+				rec := ce.Add(outputKey(vtx, 0))
+				rec.AddResult(time.Now(), &solver.Remote{
+					Descriptors: layers[:i+1],
+					Provider:    src,
+				})
+				if parent != nil {
+					rec.LinkFrom(parent, 0, "")
+				}
+				parent = rec
+			}
+			res, err := ce.Finalize(ctx)
+			require.NoError(t, err)
+			var desc ocispec.Descriptor
+			err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+			require.NoError(t, err)
+
+			w := &remoteWorker{cs: wcs}
+			cm, err := NewImporter(dst).Resolve(ctx, desc, "test", w)
+			require.NoError(t, err)
+
+			base, err := cm.Query(nil, 0, vertexes[0], 0)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(base))
+			ck, err := cm.Query([]solver.CacheKeyWithSelector{{CacheKey: solver.ExportableCacheKey{CacheKey: base[0]}}}, 0, vertexes[1], 0)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(ck))
+			recs, err := cm.Records(ck[0])
+			require.NoError(t, err)
+			require.Equal(t, 1, len(recs))
+			_, err = cm.Load(ctx, recs[0])
+			require.NoError(t, err)
+			require.NotNil(t, w.remote)
+			require.Equal(t, len(layers), len(w.remote.Descriptors))
+			for i, imported := range w.remote.Descriptors {
+				require.Equal(t, layers[i].Digest, imported.Digest)
+				require.Equal(t, layers[i].MediaType, imported.MediaType)
+				require.Equal(t, layers[i].Size, imported.Size)
+				require.Equal(t, layers[i].Annotations, imported.Annotations)
+
+				// the imported blob is the exported one
+				dt, err := content.ReadBlob(ctx, w.remote.Provider, imported)
+				require.NoError(t, err)
+				require.Equal(t, layers[i].Digest, digest.FromBytes(dt))
+				lct, err := compression.DetectLayerCompression(ctx, dst, imported.Digest)
+				require.NoError(t, err)
+				require.Equal(t, ct, lct)
+			}
+		})
+	}
+}
+
+// outputKey returns the cache key of the output idx of a vertex without
+// inputs like the solver does.
+func outputKey(dgst digest.Digest, idx int) digest.Digest {
+	return digest.FromBytes([]byte(fmt.Sprintf("%s@%d", dgst, idx)))
+}
+
+// writeCompressedLayer writes data compressed with ct as a layer blob with
+// the annotations of a layer created by the cache manager.
+func writeCompressedLayer(ctx context.Context, t *testing.T, cs content.Store, ct compression.Type, data string) ocispec.Descriptor {
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	err := tw.WriteHeader(&tar.Header{Name: "data", Mode: 0644, Size: int64(len(data))})
+	require.NoError(t, err)
+	_, err = tw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	buf := &bytes.Buffer{}
+	mediaType := ocispec.MediaTypeImageLayer
+	switch ct {
+	case compression.Gzip:
+		mediaType = ocispec.MediaTypeImageLayerGzip
+		w := gzip.NewWriter(buf)
+		_, err = w.Write(tarBuf.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	case compression.Zstd:
+		mediaType = ocispec.MediaTypeImageLayer + "+zstd"
+		w, err := zstd.NewWriter(buf)
+		require.NoError(t, err)
+		_, err = w.Write(tarBuf.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	default:
+		buf = tarBuf
+	}
+	dt := buf.Bytes()
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+		Annotations: map[string]string{
+			"containerd.io/uncompressed":               digest.FromBytes(tarBuf.Bytes()).String(),
+			"containerd.io/snapshot/stargz/toc.digest": digest.FromString("toc-" + data).String(),
+		},
+	}
+	err = content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(dt), desc)
+	require.NoError(t, err)
+	return desc
+}
+
+// remoteWorker records the remote of the last loaded cache result.
+type remoteWorker struct {
+	worker.Worker
+	cs     content.Store
+	remote *solver.Remote
+}
+
+func (w *remoteWorker) ContentStore() content.Store {
+	return w.cs
+}
+
+func (w *remoteWorker) FromRemote(ctx context.Context, remote *solver.Remote) (cache.ImmutableRef, error) {
+	w.remote = remote
+	return nil, nil
+}
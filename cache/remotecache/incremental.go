@@ -0,0 +1,100 @@
+package remotecache
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// PreviousCacheFunc returns the provider and the manifest descriptor of the
+// cache previously exported to the destination of an exporter. It returns
+// an error matching errdefs.ErrNotFound if there is no previous cache.
+type PreviousCacheFunc func(ctx context.Context) (content.Provider, ocispec.Descriptor, error)
+
+// previousCache is the content of the previous cache export that doesn't
+// need to be written again.
+type previousCache struct {
+	manifest digest.Digest
+	blobs    map[digest.Digest]struct{}
+}
+
+func (pc *previousCache) hasBlob(dgst digest.Digest) bool {
+	if pc == nil {
+		return false
+	}
+	_, ok := pc.blobs[dgst]
+	return ok
+}
+
+// loadPrevious reads the manifest of the previous cache export. It returns
+// nil if the exporter isn't incremental or the full cache has to be written.
+func (ce *contentCacheExporter) loadPrevious(ctx context.Context) *previousCache {
+	if ce.previous == nil {
+		return nil
+	}
+	pc, err := ce.readPrevious(ctx)
+	if err != nil {
+		if errors.Is(err, errdefs.ErrNotFound) {
+			logrus.Debugf("no previous cache export found, writing full cache")
+		} else {
+			logrus.Warnf("failed to read previous cache export, writing full cache: %v", err)
+		}
+		return nil
+	}
+	return pc
+}
+
+func (ce *contentCacheExporter) readPrevious(ctx context.Context) (*previousCache, error) {
+	provider, desc, err := ce.previous(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc := &previousCache{
+		manifest: desc.Digest,
+		blobs:    map[digest.Digest]struct{}{},
+	}
+	if err := pc.add(ctx, provider, desc, true); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// add adds the blobs of the cache manifest desc. The manifests of a cache
+// split by platform are added if nested is set.
+func (pc *previousCache) add(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, nested bool) error {
+	dt, err := readBlob(ctx, provider, desc)
+	if err != nil {
+		return err
+	}
+	var mfst ocispec.Index
+	if err := json.Unmarshal(dt, &mfst); err != nil {
+		return errors.WithStack(err)
+	}
+
+	pc.blobs[desc.Digest] = struct{}{}
+	hasConfig := false
+	for _, m := range mfst.Manifests {
+		if nested && isCacheManifest(m) {
+			if err := pc.add(ctx, provider, m, false); err != nil {
+				return err
+			}
+			hasConfig = true
+			continue
+		}
+		if isCacheConfig(m.MediaType) {
+			hasConfig = true
+		}
+		pc.blobs[m.Digest] = struct{}{}
+	}
+	// images with inline cache and unknown formats are replaced as a whole
+	if !hasConfig {
+		return errors.Errorf("%s is not a cache manifest", desc.Digest)
+	}
+	return nil
+}
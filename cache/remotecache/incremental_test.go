@@ -0,0 +1,145 @@
+package remotecache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/moby/buildkit/solver"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrementalExport(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	src, err := local.NewStore(tmpdir + "/src")
+	require.NoError(t, err)
+	dst, err := local.NewStore(tmpdir + "/dst")
+	require.NoError(t, err)
+	ingester := &countingIngester{Ingester: dst}
+
+	foo := writeTestLayer(ctx, t, src, "foo")
+	bar := writeTestLayer(ctx, t, src, "bar")
+
+	// the config only stays the same if the results are unchanged
+	createdAt := time.Now()
+
+	var prevDesc *ocispec.Descriptor
+	previous := func(ctx context.Context) (content.Provider, ocispec.Descriptor, error) {
+		if prevDesc == nil {
+			return nil, ocispec.Descriptor{}, errdefs.ErrNotFound
+		}
+		return dst, *prevDesc, nil
+	}
+
+	export := func(layers ...ocispec.Descriptor) []digest.Digest {
+		ingester.reset()
+		ce := NewIncrementalExporter(ingester, true, 0, previous)
+		var parent solver.CacheExporterRecord
+		for i, l := range layers {
+			rec := ce.Add(digest.FromString(l.Digest.String()))
+			rec.AddResult(createdAt, &solver.Remote{
+				Descriptors: layers[:i+1],
+				Provider:    src,
+			})
+			if parent != nil {
+				rec.LinkFrom(parent, 0, "")
+			}
+			parent = rec
+		}
+		res, err := ce.Finalize(ctx)
+		require.NoError(t, err)
+		var desc ocispec.Descriptor
+		err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+		require.NoError(t, err)
+		prevDesc = &desc
+		return ingester.written()
+	}
+
+	// config, manifest and the layer
+	require.Equal(t, 3, len(export(foo)))
+	// nothing changed
+	require.Equal(t, 0, len(export(foo)))
+
+	written := export(foo, bar)
+	require.Equal(t, 3, len(written))
+	require.Contains(t, written, bar.Digest)
+	require.NotContains(t, written, foo.Digest)
+
+	// a previous manifest without a cache config is not a cache export
+	dt, err := json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{foo, bar}})
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+	}
+	err = content.WriteBlob(ctx, dst, desc.Digest.String(), bytes.NewReader(dt), desc)
+	require.NoError(t, err)
+	prevDesc = &desc
+
+	written = export(foo, bar)
+	require.Equal(t, 4, len(written))
+	require.Contains(t, written, foo.Digest)
+}
+
+func writeTestLayer(ctx context.Context, t *testing.T, cs content.Store, data string) ocispec.Descriptor {
+	dt := []byte(data)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+		Annotations: map[string]string{
+			"containerd.io/uncompressed": digest.FromBytes(dt).String(),
+		},
+	}
+	err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(dt), desc)
+	require.NoError(t, err)
+	return desc
+}
+
+type countingIngester struct {
+	content.Ingester
+	mu   sync.Mutex
+	refs []digest.Digest
+}
+
+func (ci *countingIngester) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	ci.mu.Lock()
+	ci.refs = append(ci.refs, wOpts.Desc.Digest)
+	ci.mu.Unlock()
+	return ci.Ingester.Writer(ctx, opts...)
+}
+
+func (ci *countingIngester) reset() {
+	ci.mu.Lock()
+	ci.refs = nil
+	ci.mu.Unlock()
+}
+
+func (ci *countingIngester) written() []digest.Digest {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return append([]digest.Digest{}, ci.refs...)
+}
@@ -8,10 +8,17 @@ import (
 	v1 "github.com/moby/buildkit/cache/remotecache/v1"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
 	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// maxInlineCacheSize limits the size of the cache embedded in the image
+// config. The results of intermediate layers exported with mode=max are left
+// out if the cache would be larger.
+const maxInlineCacheSize = 1 << 20
+
 func ResolveCacheExporterFunc() remotecache.ResolveCacheExporterFunc {
 	return func(ctx context.Context, _ session.Group, _ map[string]string) (remotecache.Exporter, error) {
 		return NewExporter(), nil
@@ -32,6 +39,18 @@ func (ce *exporter) Finalize(ctx context.Context) (map[string]string, error) {
 	return nil, nil
 }
 
+// SupportedLayerCompressions returns all compressions, the layers of the
+// inline cache are the ones of the image.
+func (ce *exporter) SupportedLayerCompressions() []compression.Type {
+	return []compression.Type{compression.Uncompressed, compression.Gzip, compression.Zstd}
+}
+
+// PreferredLayerCompression returns the default compression of the image
+// exporter, so that the cache refers to the layers of the image.
+func (ce *exporter) PreferredLayerCompression() compression.Config {
+	return compression.New(compression.Default)
+}
+
 func (ce *exporter) reset() {
 	cc := v1.NewCacheChains()
 	ce.CacheExporterTarget = cc
@@ -76,12 +95,16 @@ func (ce *exporter) ExportForLayers(layers []digest.Digest) ([]byte, error) {
 	cache := map[int]int{}
 
 	// reorder layers based on the order in the image
+	top := -1
 	for i, r := range cfg.Records {
 		for j, rr := range r.Results {
 			n := getSortedLayerIndex(rr.LayerIndex, cfg.Layers, cache)
 			rr.LayerIndex = n
 			r.Results[j] = rr
 			cfg.Records[i] = r
+			if n > top {
+				top = n
+			}
 		}
 	}
 
@@ -89,11 +112,35 @@ func (ce *exporter) ExportForLayers(layers []digest.Digest) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(dt) > maxInlineCacheSize {
+		logrus.Warnf("inline cache of %d bytes exceeds the limit of %d bytes, exporting only the results of the image", len(dt), maxInlineCacheSize)
+		if dt, err = marshalTopResults(cfg.Records, top); err != nil {
+			return nil, err
+		}
+	}
 	ce.reset()
 
 	return dt, nil
 }
 
+// marshalTopResults marshals records without the results of intermediate
+// layers, the same records that are exported with mode=min.
+func marshalTopResults(records []v1.CacheRecord, top int) ([]byte, error) {
+	out := make([]v1.CacheRecord, len(records))
+	for i, r := range records {
+		var results []v1.CacheResult
+		for _, rr := range r.Results {
+			if rr.LayerIndex == top {
+				results = append(results, rr)
+			}
+		}
+		r.Results = results
+		out[i] = r
+	}
+	dt, err := json.Marshal(out)
+	return dt, errors.WithStack(err)
+}
+
 func getSortedLayerIndex(idx int, layers []v1.CacheLayer, cache map[int]int) int {
 	if idx == -1 {
 		return -1
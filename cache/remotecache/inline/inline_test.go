@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	v1 "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/solver"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportIntermediateLayers(t *testing.T) {
+	t.Parallel()
+
+	var layers []ocispec.Descriptor
+	for _, s := range []string{"l0", "l1", "l2", "builder"} {
+		layers = append(layers, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString(s),
+			Size:      1,
+			Annotations: map[string]string{
+				"containerd.io/uncompressed": digest.FromString("uncompressed-" + s).String(),
+			},
+		})
+	}
+
+	// records of a build with mode=max, the builder stage isn't part of
+	// the image
+	ce := NewExporter()
+	var parent solver.CacheExporterRecord
+	for i := 0; i < 3; i++ {
+		rec := ce.Add(digest.FromString("key" + layers[i].Digest.String()))
+		rec.AddResult(time.Now(), &solver.Remote{Descriptors: layers[:i+1]})
+		if parent != nil {
+			rec.LinkFrom(parent, 0, "")
+		}
+		parent = rec
+	}
+	builder := ce.Add(digest.FromString("builder"))
+	builder.AddResult(time.Now(), &solver.Remote{Descriptors: layers[3:]})
+	parent.LinkFrom(builder, 1, "")
+
+	dt, err := ce.(*exporter).ExportForLayers([]digest.Digest{layers[0].Digest, layers[1].Digest, layers[2].Digest})
+	require.NoError(t, err)
+
+	var records []v1.CacheRecord
+	err = json.Unmarshal(dt, &records)
+	require.NoError(t, err)
+
+	indexes := map[int]struct{}{}
+	for _, r := range records {
+		for _, rr := range r.Results {
+			indexes[rr.LayerIndex] = struct{}{}
+		}
+	}
+	require.Equal(t, map[int]struct{}{0: {}, 1: {}, 2: {}}, indexes)
+
+	// the size guard keeps only the result of the image
+	dt, err = marshalTopResults(records, 2)
+	require.NoError(t, err)
+	records = nil
+	err = json.Unmarshal(dt, &records)
+	require.NoError(t, err)
+
+	results := 0
+	for _, r := range records {
+		for _, rr := range r.Results {
+			require.Equal(t, 2, rr.LayerIndex)
+			results++
+		}
+	}
+	require.Equal(t, 1, results)
+}
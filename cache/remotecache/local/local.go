@@ -15,11 +15,12 @@ import (
 )
 
 const (
-	attrDigest           = "digest"
-	attrSrc              = "src"
-	attrDest             = "dest"
-	attrOCIMediatypes    = "oci-mediatypes"
-	contentStoreIDPrefix = "local:"
+	attrDigest            = "digest"
+	attrSrc               = "src"
+	attrDest              = "dest"
+	attrOCIMediatypes     = "oci-mediatypes"
+	attrConfigCompression = "config-compression"
+	contentStoreIDPrefix  = "local:"
 )
 
 // ResolveCacheExporterFunc for "local" cache exporter.
@@ -37,12 +38,24 @@ func ResolveCacheExporterFunc(sm *session.Manager) remotecache.ResolveCacheExpor
 			}
 			ociMediatypes = b
 		}
+		configCompression, err := remotecache.ParseConfigCompression(attrs[attrConfigCompression])
+		if err != nil {
+			return nil, err
+		}
+		eviction, err := remotecache.ParseEvictionPolicy(attrs)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := remotecache.ParseSigner(ctx, sm, g, attrs)
+		if err != nil {
+			return nil, err
+		}
 		csID := contentStoreIDPrefix + store
 		cs, err := getContentStore(ctx, sm, g, csID)
 		if err != nil {
 			return nil, err
 		}
-		return remotecache.NewExporter(cs, ociMediatypes), nil
+		return remotecache.WithSigner(remotecache.WithEvictionPolicy(remotecache.NewExporter(cs, ociMediatypes, configCompression), eviction), signer), nil
 	}
 }
 
@@ -58,6 +71,10 @@ func ResolveCacheImporterFunc(sm *session.Manager) remotecache.ResolveCacheImpor
 		if store == "" {
 			return nil, specs.Descriptor{}, errors.New("local cache importer requires src")
 		}
+		verifier, err := remotecache.ParseVerifier(ctx, sm, g, attrs)
+		if err != nil {
+			return nil, specs.Descriptor{}, err
+		}
 		csID := contentStoreIDPrefix + store
 		cs, err := getContentStore(ctx, sm, g, csID)
 		if err != nil {
@@ -73,7 +90,7 @@ func ResolveCacheImporterFunc(sm *session.Manager) remotecache.ResolveCacheImpor
 			Digest: dgst,
 			Size:   info.Size,
 		}
-		return remotecache.NewImporter(cs), desc, nil
+		return remotecache.WithVerifier(remotecache.NewImporter(cs), verifier), desc, nil
 	}
 }
 
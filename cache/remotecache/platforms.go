@@ -0,0 +1,116 @@
+package remotecache
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	v1 "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/worker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type platformChains struct {
+	platform ocispec.Platform
+	chains   *v1.CacheChains
+}
+
+// ForPlatform returns the chains for the cache of platform. Finalize writes
+// an index of the cache manifests of all platforms if it's called.
+func (ce *contentCacheExporter) ForPlatform(platform ocispec.Platform) solver.CacheExporterTarget {
+	platform = platforms.Normalize(platform)
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	for _, pc := range ce.platforms {
+		if platforms.Format(pc.platform) == platforms.Format(platform) {
+			return pc.chains
+		}
+	}
+	cc := v1.NewCacheChains()
+	ce.platforms = append(ce.platforms, &platformChains{platform: platform, chains: cc})
+	return cc
+}
+
+// writePlatformIndex writes the cache manifests of all platforms and an
+// index of them. Records exported without a platform are written to a
+// manifest without a platform.
+func (ce *contentCacheExporter) writePlatformIndex(ctx context.Context, prev *previousCache) (ocispec.Descriptor, error) {
+	mfst := ce.newManifestList()
+	if config, _, err := ce.chains.Marshal(); err != nil {
+		return ocispec.Descriptor{}, err
+	} else if len(config.Records) > 0 {
+		desc, err := ce.writeManifest(ctx, ce.chains, prev)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		mfst.Manifests = append(mfst.Manifests, desc)
+	}
+	for _, pc := range ce.platforms {
+		desc, err := ce.writeManifest(ctx, pc.chains, prev)
+		if err != nil {
+			return ocispec.Descriptor{}, errors.Wrapf(err, "failed to write cache for %s", platforms.Format(pc.platform))
+		}
+		p := pc.platform
+		desc.Platform = &p
+		mfst.Manifests = append(mfst.Manifests, desc)
+	}
+	return ce.writeManifestList(ctx, mfst, prev)
+}
+
+// importPlatforms imports the cache manifests of the platforms of w from the
+// index of a cache split by platform. Manifests without a platform are
+// always imported. The bool is false if mfst isn't such an index.
+func (ci *contentCacheImporter) importPlatforms(ctx context.Context, mfst ocispec.Index, id string, w worker.Worker) (solver.CacheManager, bool, error) {
+	descs, ok := platformCacheManifests(mfst, w.Platforms(false))
+	if !ok {
+		return nil, false, nil
+	}
+
+	cms := make([]solver.CacheManager, 0, len(descs))
+	for _, desc := range descs {
+		cm, err := ci.Resolve(ctx, desc, id, w)
+		if err != nil {
+			return nil, true, err
+		}
+		cms = append(cms, cm)
+	}
+	if len(cms) == 0 {
+		return nil, true, errors.Errorf("no cache for the platforms of worker %s", w.ID())
+	}
+	return solver.NewCombinedCacheManager(cms, nil), true, nil
+}
+
+// platformCacheManifests returns the cache manifests of mfst that match one
+// of ps or have no platform. The bool is false if mfst isn't the index of a
+// cache split by platform.
+func platformCacheManifests(mfst ocispec.Index, ps []ocispec.Platform) ([]ocispec.Descriptor, bool) {
+	matcher := platforms.Any(ps...)
+	var descs []ocispec.Descriptor
+	found := false
+	for _, m := range mfst.Manifests {
+		if !isCacheManifest(m) {
+			continue
+		}
+		found = true
+		if m.Platform != nil && !matcher.Match(*m.Platform) {
+			logrus.Debugf("skipping cache for platform %s", platforms.Format(*m.Platform))
+			continue
+		}
+		descs = append(descs, m)
+	}
+	return descs, found
+}
+
+// isCacheManifest returns true if desc is a cache manifest in the index of a
+// cache split by platform.
+func isCacheManifest(desc ocispec.Descriptor) bool {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		return true
+	default:
+		return false
+	}
+}
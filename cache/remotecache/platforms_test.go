@@ -0,0 +1,128 @@
+package remotecache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/solver"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlatformSplitExport(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	src, err := local.NewStore(tmpdir + "/src")
+	require.NoError(t, err)
+	dst, err := local.NewStore(tmpdir + "/dst")
+	require.NoError(t, err)
+	ingester := &countingIngester{Ingester: dst}
+
+	amd64 := writeTestLayer(ctx, t, src, "amd64")
+	arm64 := writeTestLayer(ctx, t, src, "arm64")
+	createdAt := time.Now()
+
+	var prevDesc *ocispec.Descriptor
+	previous := func(ctx context.Context) (content.Provider, ocispec.Descriptor, error) {
+		if prevDesc == nil {
+			return nil, ocispec.Descriptor{}, errdefs.ErrNotFound
+		}
+		return dst, *prevDesc, nil
+	}
+
+	export := func() ocispec.Descriptor {
+		ingester.reset()
+		ce := NewIncrementalExporter(ingester, true, 0, previous)
+		ps, ok := ce.(PlatformSplitter)
+		require.True(t, ok)
+		for _, l := range []struct {
+			platform string
+			desc     ocispec.Descriptor
+		}{{"linux/amd64", amd64}, {"linux/arm64", arm64}} {
+			rec := ps.ForPlatform(platforms.MustParse(l.platform)).Add(digest.FromString(l.platform))
+			rec.AddResult(createdAt, &solver.Remote{
+				Descriptors: []ocispec.Descriptor{l.desc},
+				Provider:    src,
+			})
+		}
+		res, err := ce.Finalize(ctx)
+		require.NoError(t, err)
+		var desc ocispec.Descriptor
+		err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+		require.NoError(t, err)
+		return desc
+	}
+
+	desc := export()
+	// a layer, config and manifest per platform and the index
+	require.Equal(t, 7, len(ingester.written()))
+
+	dt, err := readBlob(ctx, dst, desc)
+	require.NoError(t, err)
+	var idx ocispec.Index
+	err = json.Unmarshal(dt, &idx)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(idx.Manifests))
+
+	for i, layer := range []ocispec.Descriptor{amd64, arm64} {
+		m := idx.Manifests[i]
+		require.True(t, isCacheManifest(m))
+		require.NotNil(t, m.Platform)
+		require.Equal(t, []string{"linux/amd64", "linux/arm64"}[i], platforms.Format(*m.Platform))
+
+		dt, err := readBlob(ctx, dst, m)
+		require.NoError(t, err)
+		var mfst ocispec.Index
+		err = json.Unmarshal(dt, &mfst)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(mfst.Manifests))
+		require.Equal(t, layer.Digest, mfst.Manifests[0].Digest)
+		require.True(t, isCacheConfig(mfst.Manifests[1].MediaType))
+	}
+
+	// the manifests of the platforms are read by incremental exports
+	prevDesc = &desc
+	require.Equal(t, desc, export())
+	require.Equal(t, 0, len(ingester.written()))
+}
+
+func TestPlatformCacheManifests(t *testing.T) {
+	amd64 := platforms.MustParse("linux/amd64")
+	arm64 := platforms.MustParse("linux/arm64")
+	mfst := ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("amd64"), Platform: &amd64},
+			{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("arm64"), Platform: &arm64},
+			{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("any")},
+		},
+	}
+
+	descs, ok := platformCacheManifests(mfst, []ocispec.Platform{amd64})
+	require.True(t, ok)
+	require.Equal(t, 2, len(descs))
+	require.Equal(t, digest.FromString("amd64"), descs[0].Digest)
+	require.Equal(t, digest.FromString("any"), descs[1].Digest)
+
+	// single cache configs and inline cache aren't split by platform
+	_, ok = platformCacheManifests(ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer")},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image"), Platform: &amd64},
+		},
+	}, []ocispec.Platform{amd64})
+	require.False(t, ok)
+}
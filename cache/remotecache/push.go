@@ -0,0 +1,85 @@
+package remotecache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	v1 "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/moby/buildkit/util/progress/logs"
+	"github.com/moby/buildkit/util/resolver/retryhandler"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const attrPushConcurrency = "push-concurrency"
+
+// DefaultPushConcurrency is the number of layers an exporter writes at the
+// same time unless configured otherwise.
+const DefaultPushConcurrency = 8
+
+// ParsePushConcurrency parses the push-concurrency attribute of the cache
+// exporters.
+func ParsePushConcurrency(attrs map[string]string) (int, error) {
+	v, ok := attrs[attrPushConcurrency]
+	if !ok {
+		return DefaultPushConcurrency, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, errors.Errorf("invalid %s %q", attrPushConcurrency, v)
+	}
+	return n, nil
+}
+
+// WithPushConcurrency sets the number of layers written at the same time by
+// an exporter returned by NewExporter or NewIncrementalExporter. Other
+// exporters are returned unchanged.
+func WithPushConcurrency(e Exporter, n int) Exporter {
+	if ce, ok := e.(*contentCacheExporter); ok {
+		ce.pushConcurrency = n
+	}
+	return e
+}
+
+// writeLayers writes layers to the ingester of the exporter. For a registry
+// writing a layer that already exists only costs the existence check, which
+// is why the layers are written concurrently. The first layer is written
+// alone so that the requests of the others reuse the token it fetched
+// instead of all being challenged by the registry.
+func (ce *contentCacheExporter) writeLayers(ctx context.Context, layers []v1.DescriptorProviderPair) error {
+	if len(layers) == 0 {
+		return nil
+	}
+	if err := ce.writeLayer(ctx, layers[0]); err != nil {
+		return err
+	}
+
+	n := ce.pushConcurrency
+	if n < 1 {
+		n = DefaultPushConcurrency
+	}
+	sem := semaphore.NewWeighted(int64(n))
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, l := range layers[1:] {
+		l := l
+		eg.Go(func() error {
+			if err := sem.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer sem.Release(1)
+			return ce.writeLayer(ctx, l)
+		})
+	}
+	return eg.Wait()
+}
+
+func (ce *contentCacheExporter) writeLayer(ctx context.Context, l v1.DescriptorProviderPair) error {
+	layerDone := oneOffProgress(ctx, fmt.Sprintf("writing layer %s", l.Descriptor.Digest))
+	if err := contentutil.Copy(ctx, ce.ingester, l.Provider, l.Descriptor, retryhandler.DefaultPolicy, logs.LoggerFromContext(ctx)); err != nil {
+		return layerDone(errors.Wrap(err, "error writing layer blob"))
+	}
+	return layerDone(nil)
+}
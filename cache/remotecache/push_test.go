@@ -0,0 +1,113 @@
+package remotecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportPushConcurrency(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	src, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+	var layers []ocispec.Descriptor
+	for i := 0; i < 20; i++ {
+		layers = append(layers, writeTestLayer(ctx, t, src, fmt.Sprintf("layer%d", i)))
+	}
+
+	n, err := ParsePushConcurrency(nil)
+	require.NoError(t, err)
+	require.Equal(t, DefaultPushConcurrency, n)
+	n, err = ParsePushConcurrency(map[string]string{"push-concurrency": "3"})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	for _, v := range []string{"0", "-1", "many"} {
+		_, err := ParsePushConcurrency(map[string]string{"push-concurrency": v})
+		require.Error(t, err)
+	}
+
+	now := time.Now()
+	export := func(ingester content.Ingester, n int) ocispec.Descriptor {
+		ce := WithPushConcurrency(NewExporter(ingester, true, compression.Uncompressed), n)
+		for i, l := range layers {
+			rec := ce.Add(digest.FromString(fmt.Sprintf("record%d", i)))
+			rec.AddResult(now, &solver.Remote{
+				Descriptors: []ocispec.Descriptor{l},
+				Provider:    src,
+			})
+		}
+		res, err := ce.Finalize(ctx)
+		require.NoError(t, err)
+		var desc ocispec.Descriptor
+		err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+		require.NoError(t, err)
+		return desc
+	}
+
+	dest, err := local.NewStore(tmpdir + "-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir + "-dest")
+	ci := &concurrencyIngester{Ingester: dest}
+	desc := export(ci, 3)
+
+	require.True(t, ci.max > 1)
+	require.True(t, ci.max <= 3)
+	for _, l := range layers {
+		_, err := dest.Info(ctx, l.Digest)
+		require.NoError(t, err)
+	}
+
+	// the manifest doesn't depend on the order the layers were written in
+	require.Equal(t, desc, export(src, 1))
+	dt, err := readBlob(ctx, dest, desc)
+	require.NoError(t, err)
+	var mfst ocispec.Index
+	err = json.Unmarshal(dt, &mfst)
+	require.NoError(t, err)
+	require.Equal(t, len(layers)+1, len(mfst.Manifests))
+}
+
+// concurrencyIngester records the maximum number of writers opened at the
+// same time.
+type concurrencyIngester struct {
+	content.Ingester
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (ci *concurrencyIngester) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	ci.mu.Lock()
+	ci.active++
+	if ci.active > ci.max {
+		ci.max = ci.active
+	}
+	ci.mu.Unlock()
+
+	// simulates the existence check of a registry
+	time.Sleep(10 * time.Millisecond)
+
+	ci.mu.Lock()
+	ci.active--
+	ci.mu.Unlock()
+	return ci.Ingester.Writer(ctx, opts...)
+}
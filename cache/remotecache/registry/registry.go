@@ -3,12 +3,15 @@ package registry
 import (
 	"context"
 	"strconv"
+	"strings"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/distribution/reference"
 	"github.com/moby/buildkit/cache/remotecache"
 	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/resolver"
 	digest "github.com/opencontainers/go-digest"
@@ -29,11 +32,18 @@ func canonicalizeRef(rawRef string) (string, error) {
 }
 
 const (
-	attrRef           = "ref"
-	attrOCIMediatypes = "oci-mediatypes"
+	attrRef               = "ref"
+	attrOCIMediatypes     = "oci-mediatypes"
+	attrConfigCompression = "config-compression"
+	attrIncremental       = "incremental"
+
+	labelDistributionSource = "containerd.io/distribution.source."
 )
 
-func ResolveCacheExporterFunc(sm *session.Manager, hosts docker.RegistryHosts) remotecache.ResolveCacheExporterFunc {
+// ResolveCacheExporterFunc for "registry" cache exporter. Layers of the
+// worker content store cs with a distribution source on the same registry
+// are mounted from their source repository instead of being uploaded.
+func ResolveCacheExporterFunc(sm *session.Manager, cs content.Store, hosts docker.RegistryHosts) remotecache.ResolveCacheExporterFunc {
 	return func(ctx context.Context, g session.Group, attrs map[string]string) (remotecache.Exporter, error) {
 		ref, err := canonicalizeRef(attrs[attrRef])
 		if err != nil {
@@ -47,12 +57,67 @@ func ResolveCacheExporterFunc(sm *session.Manager, hosts docker.RegistryHosts) r
 			}
 			ociMediatypes = b
 		}
+		configCompression, err := remotecache.ParseConfigCompression(attrs[attrConfigCompression])
+		if err != nil {
+			return nil, err
+		}
+		eviction, err := remotecache.ParseEvictionPolicy(attrs)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := remotecache.ParseSigner(ctx, sm, g, attrs)
+		if err != nil {
+			return nil, err
+		}
+		pushConcurrency, err := remotecache.ParsePushConcurrency(attrs)
+		if err != nil {
+			return nil, err
+		}
+		layerCompression, forceCompression, err := remotecache.ParseLayerCompression(attrs)
+		if err != nil {
+			return nil, err
+		}
+		if layerCompression.Type == compression.Zstd && !ociMediatypes {
+			return nil, errors.Errorf("%s layers require %s", layerCompression.Type, attrOCIMediatypes)
+		}
+		incremental := false
+		if v, ok := attrs[attrIncremental]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse %s", attrIncremental)
+			}
+			incremental = b
+		}
 		remote := resolver.DefaultPool.GetResolver(hosts, ref, "push", sm, g)
 		pusher, err := remote.Pusher(ctx, ref)
 		if err != nil {
 			return nil, err
 		}
-		return remotecache.NewExporter(contentutil.FromPusher(pusher), ociMediatypes), nil
+		ingester := &withDistributionSource{
+			Ingester: contentutil.FromPusher(pusher),
+			source:   cs,
+		}
+		withOpts := func(e remotecache.Exporter) remotecache.Exporter {
+			if remotecache.HasLayerCompression(attrs) {
+				e = remotecache.WithLayerCompression(e, layerCompression, forceCompression)
+			}
+			return remotecache.WithPushConcurrency(remotecache.WithSigner(remotecache.WithEvictionPolicy(e, eviction), signer), pushConcurrency)
+		}
+		if !incremental {
+			return withOpts(remotecache.NewExporter(ingester, ociMediatypes, configCompression)), nil
+		}
+		previous := func(ctx context.Context) (content.Provider, ocispec.Descriptor, error) {
+			xref, desc, err := remote.Resolve(ctx, ref)
+			if err != nil {
+				return nil, ocispec.Descriptor{}, err
+			}
+			fetcher, err := remote.Fetcher(ctx, xref)
+			if err != nil {
+				return nil, ocispec.Descriptor{}, err
+			}
+			return contentutil.FromFetcher(fetcher), desc, nil
+		}
+		return withOpts(remotecache.NewIncrementalExporter(ingester, ociMediatypes, configCompression, previous)), nil
 	}
 }
 
@@ -62,6 +127,10 @@ func ResolveCacheImporterFunc(sm *session.Manager, cs content.Store, hosts docke
 		if err != nil {
 			return nil, specs.Descriptor{}, err
 		}
+		verifier, err := remotecache.ParseVerifier(ctx, sm, g, attrs)
+		if err != nil {
+			return nil, specs.Descriptor{}, err
+		}
 		remote := resolver.DefaultPool.GetResolver(hosts, ref, "pull", sm, g)
 		xref, desc, err := remote.Resolve(ctx, ref)
 		if err != nil {
@@ -75,15 +144,37 @@ func ResolveCacheImporterFunc(sm *session.Manager, cs content.Store, hosts docke
 			Provider: contentutil.FromFetcher(fetcher),
 			ref:      ref,
 			source:   cs,
+			resolver: remote,
 		}
-		return remotecache.NewImporter(src), desc, nil
+		return remotecache.WithVerifier(remotecache.NewImporter(src), verifier), desc, nil
 	}
 }
 
 type withDistributionSourceLabel struct {
 	content.Provider
-	ref    string
-	source content.Manager
+	ref      string
+	source   content.Manager
+	resolver *resolver.Resolver
+}
+
+var _ contentutil.InfoProvider = &withDistributionSourceLabel{}
+
+// Info checks that a blob exists in the repository of the cache with a HEAD
+// request instead of fetching it.
+func (dsl *withDistributionSourceLabel) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	named, err := reference.ParseNormalizedNamed(dsl.ref)
+	if err != nil {
+		return content.Info{}, err
+	}
+	ref, err := reference.WithDigest(reference.TrimNamed(named), dgst)
+	if err != nil {
+		return content.Info{}, err
+	}
+	_, desc, err := dsl.resolver.Resolve(ctx, ref.String())
+	if err != nil {
+		return content.Info{}, err
+	}
+	return content.Info{Digest: desc.Digest, Size: desc.Size}, nil
 }
 
 var _ remotecache.DistributionSourceLabelSetter = &withDistributionSourceLabel{}
@@ -104,3 +195,37 @@ func (dsl *withDistributionSourceLabel) SetDistributionSourceAnnotation(desc oci
 	desc.Annotations["containerd.io/distribution.source.ref"] = dsl.ref
 	return desc
 }
+
+// withDistributionSource adds the distribution sources recorded in the
+// content store to the descriptors of pushed blobs. The pusher tries to
+// mount blobs with a source repository on the destination registry.
+type withDistributionSource struct {
+	content.Ingester
+	source content.Manager
+}
+
+func (ds *withDistributionSource) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	info, err := ds.source.Info(ctx, wOpts.Desc.Digest)
+	if err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+		return nil, err
+	}
+	desc := wOpts.Desc
+	// the annotations of the descriptor are shared with the cache manifest
+	desc.Annotations = map[string]string{}
+	for k, v := range info.Labels {
+		if strings.HasPrefix(k, labelDistributionSource) {
+			desc.Annotations[k] = v
+		}
+	}
+	// sources of lazy layers are already set on their descriptor
+	for k, v := range wOpts.Desc.Annotations {
+		desc.Annotations[k] = v
+	}
+	return ds.Ingester.Writer(ctx, content.WithRef(wOpts.Ref), content.WithDescriptor(desc))
+}
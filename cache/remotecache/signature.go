@@ -0,0 +1,212 @@
+package remotecache
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	attrSign        = "sign"
+	attrVerify      = "verify"
+	attrIgnoreError = "ignore-error"
+
+	// AnnotationCacheSignature is the annotation of the cache config
+	// descriptor in a cache manifest with the base64 encoded signature of
+	// the config digest.
+	AnnotationCacheSignature = "moby.buildkit.cache.signature.v0"
+)
+
+// ErrSignatureVerification is returned by importers if a cache isn't signed
+// by the key to verify it with.
+var ErrSignatureVerification = errors.New("cache signature verification failed")
+
+// Verifier verifies the signatures of imported caches.
+type Verifier struct {
+	key crypto.PublicKey
+	// IgnoreError reports a failed verification as a regular import error,
+	// the cache is skipped instead of failing the build.
+	IgnoreError bool
+}
+
+// ParseSigner parses the signing key read from the session secret named
+// by the sign attribute of the cache exporters. It returns nil if the
+// attribute isn't set. ECDSA, RSA and Ed25519 keys in PKCS #8, SEC 1 or
+// PKCS #1 PEM encoding are supported.
+func ParseSigner(ctx context.Context, sm *session.Manager, g session.Group, attrs map[string]string) (crypto.Signer, error) {
+	id, ok := attrs[attrSign]
+	if !ok {
+		return nil, nil
+	}
+	dt, err := readSecret(ctx, sm, g, id)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dt)
+	if block == nil {
+		return nil, errors.Errorf("invalid cache signing key %s: no PEM data", id)
+	}
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid cache signing key %s", id)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported cache signing key %s: %T", id, key)
+	}
+	return signer, nil
+}
+
+// ParseVerifier parses the public key read from the session secret named
+// by the verify attribute of the cache importers. It returns nil if the
+// attribute isn't set.
+func ParseVerifier(ctx context.Context, sm *session.Manager, g session.Group, attrs map[string]string) (*Verifier, error) {
+	id, ok := attrs[attrVerify]
+	if !ok {
+		return nil, nil
+	}
+	v := &Verifier{}
+	if s, ok := attrs[attrIgnoreError]; ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", attrIgnoreError)
+		}
+		v.IgnoreError = b
+	}
+	dt, err := readSecret(ctx, sm, g, id)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dt)
+	if block == nil {
+		return nil, errors.Errorf("invalid cache verification key %s: no PEM data", id)
+	}
+	if v.key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, errors.Wrapf(err, "invalid cache verification key %s", id)
+	}
+	return v, nil
+}
+
+func readSecret(ctx context.Context, sm *session.Manager, g session.Group, id string) ([]byte, error) {
+	var dt []byte
+	err := sm.Any(ctx, g, func(ctx context.Context, _ string, caller session.Caller) error {
+		var err error
+		dt, err = secrets.GetSecret(ctx, caller, id)
+		return err
+	})
+	return dt, errors.Wrapf(err, "failed to read cache key %s", id)
+}
+
+// WithSigner sets the key that signs the cache configs of an exporter
+// returned by NewExporter or NewIncrementalExporter. Other exporters are
+// returned unchanged.
+func WithSigner(e Exporter, signer crypto.Signer) Exporter {
+	if ce, ok := e.(*contentCacheExporter); ok {
+		ce.signer = signer
+	}
+	return e
+}
+
+// WithVerifier makes an importer returned by NewImporter reject caches that
+// aren't signed with the key of v. Other importers are returned unchanged.
+func WithVerifier(i Importer, v *Verifier) Importer {
+	if ci, ok := i.(*contentCacheImporter); ok {
+		ci.verifier = v
+	}
+	return i
+}
+
+// signConfig adds the signature of the config digest to desc.
+func signConfig(signer crypto.Signer, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	payload := []byte(desc.Digest.String())
+	var sig []byte
+	var err error
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sig, err = signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		h := sha256.Sum256(payload)
+		sig, err = signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	}
+	if err != nil {
+		return desc, errors.Wrap(err, "failed to sign cache config")
+	}
+	annotations := map[string]string{}
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	annotations[AnnotationCacheSignature] = base64.StdEncoding.EncodeToString(sig)
+	desc.Annotations = annotations
+	return desc, nil
+}
+
+// verify checks the signature of the config descriptor desc. The config
+// content is verified against the digest when it's read.
+func (v *Verifier) verify(desc ocispec.Descriptor) error {
+	if err := v.verifySignature(desc.Digest, desc.Annotations[AnnotationCacheSignature]); err != nil {
+		return v.reject(err)
+	}
+	return nil
+}
+
+// reject returns the error of a failed verification. Only errors of
+// verifiers without IgnoreError match ErrSignatureVerification.
+func (v *Verifier) reject(err error) error {
+	if v.IgnoreError {
+		return errors.Errorf("%v: %v", ErrSignatureVerification, err)
+	}
+	return errors.Wrap(ErrSignatureVerification, err.Error())
+}
+
+func (v *Verifier) verifySignature(dgst digest.Digest, s string) error {
+	if s == "" {
+		return errors.Errorf("cache config %s is not signed", dgst)
+	}
+	sig, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return errors.Errorf("invalid signature of cache config %s", dgst)
+	}
+	payload := []byte(dgst.String())
+	h := sha256.Sum256(payload)
+	ok := false
+	switch key := v.key.(type) {
+	case *ecdsa.PublicKey:
+		var es struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &es); err == nil && len(rest) == 0 {
+			ok = ecdsa.Verify(key, h[:], es.R, es.S)
+		}
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, payload, sig)
+	default:
+		return errors.Errorf("unsupported cache verification key %T", v.key)
+	}
+	if !ok {
+		return errors.Errorf("invalid signature of cache config %s", dgst)
+	}
+	return nil
+}
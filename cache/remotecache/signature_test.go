@@ -0,0 +1,76 @@
+package remotecache
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	cs, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	export := func(signer crypto.Signer) ocispec.Descriptor {
+		ce := WithSigner(NewExporter(cs, true, compression.Uncompressed), signer)
+		ce.Add(digest.FromString("foo"))
+		res, err := ce.Finalize(ctx)
+		require.NoError(t, err)
+		var desc ocispec.Descriptor
+		err = json.Unmarshal([]byte(res[ExporterResponseManifestDesc]), &desc)
+		require.NoError(t, err)
+		return desc
+	}
+	resolve := func(desc ocispec.Descriptor, v *Verifier) error {
+		_, err := WithVerifier(NewImporter(cs), v).Resolve(ctx, desc, "test", nil)
+		return err
+	}
+
+	for _, key := range []crypto.Signer{ecKey, edKey} {
+		desc := export(key)
+		require.NoError(t, resolve(desc, &Verifier{key: key.Public()}))
+		require.NoError(t, resolve(desc, nil))
+
+		err := resolve(desc, &Verifier{key: otherKey.Public()})
+		require.Error(t, err)
+		require.True(t, errors.Is(err, ErrSignatureVerification))
+	}
+
+	unsigned := export(nil)
+	err = resolve(unsigned, &Verifier{key: ecKey.Public()})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrSignatureVerification))
+	require.Contains(t, err.Error(), "is not signed")
+
+	// failures are regular import errors with ignore-error
+	err = resolve(unsigned, &Verifier{key: ecKey.Public(), IgnoreError: true})
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrSignatureVerification))
+}
@@ -2,14 +2,24 @@ package cacheimport
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/moby/buildkit/util/flightcontrol"
+	"github.com/moby/buildkit/util/progress/logs"
 	"github.com/moby/buildkit/worker"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 func NewCacheKeyStorage(cc *CacheChains, w worker.Worker) (solver.CacheKeyStorage, solver.CacheResultStorage, error) {
@@ -27,6 +37,7 @@ func NewCacheKeyStorage(cc *CacheChains, w worker.Worker) (solver.CacheKeyStorag
 
 	results := &cacheResultStorage{
 		w:        w,
+		checked:  map[digest.Digest]error{},
 		byID:     storage.byID,
 		byItem:   storage.byItem,
 		byResult: storage.byResult,
@@ -207,6 +218,10 @@ type cacheResultStorage struct {
 	byID     map[string]*itemWithOutgoingLinks
 	byResult map[string]map[string]struct{}
 	byItem   map[*item]string
+
+	mu      sync.Mutex
+	checked map[digest.Digest]error
+	g       flightcontrol.Group
 }
 
 func (cs *cacheResultStorage) Save(res solver.Result, createdAt time.Time) (solver.CacheResult, error) {
@@ -218,6 +233,10 @@ func (cs *cacheResultStorage) LoadWithParents(ctx context.Context, res solver.Ca
 	if v == nil || v.result == nil {
 		return nil, errors.WithStack(solver.ErrNotFound)
 	}
+	// the results of the parents are part of the remote of v
+	if err := cs.checkBlobs(ctx, v.result); err != nil {
+		return nil, err
+	}
 
 	m := map[string]solver.Result{}
 
@@ -231,7 +250,7 @@ func (cs *cacheResultStorage) LoadWithParents(ctx context.Context, res solver.Ca
 			return nil
 		}
 		if isSubRemote(*i.result, *v.result) {
-			ref, err := cs.w.FromRemote(ctx, i.result)
+			ref, err := cs.w.FromRemote(ctx, withOrigin(i.result, i.origin))
 			if err != nil {
 				return err
 			}
@@ -253,14 +272,112 @@ func (cs *cacheResultStorage) Load(ctx context.Context, res solver.CacheResult)
 	if item == nil || item.result == nil {
 		return nil, errors.WithStack(solver.ErrNotFound)
 	}
+	if err := cs.checkBlobs(ctx, item.result); err != nil {
+		return nil, err
+	}
 
-	ref, err := cs.w.FromRemote(ctx, item.result)
+	ref, err := cs.w.FromRemote(ctx, withOrigin(item.result, item.origin))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to load result from remote")
 	}
 	return worker.NewWorkerRefResult(ref, cs.w), nil
 }
 
+// withOrigin returns r with the origin as the description of its top layer,
+// so the disk usage shows which build step an imported record is for.
+func withOrigin(r *solver.Remote, o *CacheOrigin) *solver.Remote {
+	if o == nil || len(r.Descriptors) == 0 {
+		return r
+	}
+	name := o.Name
+	if name == "" {
+		name = o.Vertex.String()
+	}
+	descr := "imported cache of " + name
+	if o.Source != "" {
+		descr += " (" + o.Source + ")"
+	}
+
+	descs := append([]ocispec.Descriptor{}, r.Descriptors...)
+	top := &descs[len(descs)-1]
+	annotations := make(map[string]string, len(top.Annotations)+1)
+	for k, v := range top.Annotations {
+		annotations[k] = v
+	}
+	annotations["buildkit/description"] = descr
+	top.Annotations = annotations
+	return &solver.Remote{Descriptors: descs, Provider: r.Provider}
+}
+
+// checkBlobs returns an error if a blob of r is neither in the content store
+// of the worker nor available from the provider of r. Registries might
+// have removed blobs of a cache manifest that still exists. Failing the
+// load makes the solver execute the vertex instead of failing the build
+// when the lazy blob is pulled. The blobs are checked concurrently, with a
+// HEAD request if the provider implements contentutil.InfoProvider.
+func (cs *cacheResultStorage) checkBlobs(ctx context.Context, r *solver.Remote) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, desc := range r.Descriptors {
+		desc := desc
+		eg.Go(func() error {
+			return cs.checkBlob(ctx, r.Provider, desc)
+		})
+	}
+	return eg.Wait()
+}
+
+func (cs *cacheResultStorage) checkBlob(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) error {
+	_, err := cs.g.Do(ctx, desc.Digest.String(), func(ctx context.Context) (interface{}, error) {
+		cs.mu.Lock()
+		err, ok := cs.checked[desc.Digest]
+		cs.mu.Unlock()
+		if ok {
+			return nil, err
+		}
+		if _, err := cs.w.ContentStore().Info(ctx, desc.Digest); err == nil || provider == nil {
+			return nil, nil
+		}
+
+		err = blobExists(ctx, provider, desc)
+		switch {
+		case err == nil:
+		case errdefs.IsNotFound(err):
+			logrus.Warnf("cache blob %s is missing, the cache using it is ignored: %v", desc.Digest, err)
+			logs.LoggerFromContext(ctx)([]byte(fmt.Sprintf("WARNING: cache blob %s is missing, rebuilding\n", desc.Digest)))
+			err = errors.Wrapf(solver.ErrNotFound, "cache blob %s is missing", desc.Digest)
+		case ctx.Err() != nil:
+			// not remembered, the check is done again by the next load
+			return nil, ctx.Err()
+		default:
+			// the pull of the lazy blob is retried when it's needed
+			logrus.Debugf("failed to check cache blob %s: %v", desc.Digest, err)
+			err = nil
+		}
+
+		cs.mu.Lock()
+		cs.checked[desc.Digest] = err
+		cs.mu.Unlock()
+		return nil, err
+	})
+	return err
+}
+
+// blobExists checks a blob with the Info of the provider if it has one and
+// falls back to opening the blob.
+func blobExists(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) error {
+	if ip, ok := provider.(contentutil.InfoProvider); ok {
+		_, err := ip.Info(ctx, desc.Digest)
+		if !errdefs.IsNotImplemented(err) {
+			return err
+		}
+	}
+	ra, err := provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	return ra.Close()
+}
+
 func (cs *cacheResultStorage) LoadRemote(ctx context.Context, res solver.CacheResult, _ session.Group) (*solver.Remote, error) {
 	if r := cs.byResultID(res.ID); r != nil && r.result != nil {
 		return r.result, nil
@@ -0,0 +1,187 @@
+package cacheimport
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/worker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMissingBlob(t *testing.T) {
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "cacheimport")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	cs, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+
+	p := &missingBlobProvider{missing: dgst("l1")}
+	cc := NewCacheChains()
+	base := cc.Add(outputKey(dgst("base"), 0))
+	base.AddResult(time.Now(), &solver.Remote{
+		Descriptors: []ocispec.Descriptor{{Digest: dgst("l0")}},
+		Provider:    p,
+	})
+	top := cc.Add(outputKey(dgst("top"), 0))
+	top.LinkFrom(base, 0, "")
+	top.AddResult(time.Now(), &solver.Remote{
+		Descriptors: []ocispec.Descriptor{{Digest: dgst("l0")}, {Digest: dgst("l1")}},
+		Provider:    p,
+	})
+
+	w := &blobCheckWorker{cs: cs}
+	_, results, err := NewCacheKeyStorage(cc, w)
+	require.NoError(t, err)
+
+	load := func(name string) (solver.Result, error) {
+		var res *solver.CacheResult
+		for _, it := range cc.items {
+			if it.dgst != outputKey(dgst(name), 0) {
+				continue
+			}
+			r := solver.CacheResult{ID: remoteID(it.result), CreatedAt: it.resultTime}
+			res = &r
+		}
+		require.NotNil(t, res)
+		return results.Load(ctx, *res)
+	}
+
+	_, err = load("base")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), w.loaded)
+
+	// the failure makes the solver execute the vertex instead
+	for i := 0; i < 2; i++ {
+		_, err = load("top")
+		require.Error(t, err)
+		require.True(t, errors.Is(err, solver.ErrNotFound))
+		require.Contains(t, err.Error(), dgst("l1").String())
+	}
+	require.Equal(t, int64(1), w.loaded)
+	require.Equal(t, int64(2), atomic.LoadInt64(&p.reads))
+}
+
+func TestLoadMissingBlobInfo(t *testing.T) {
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "cacheimport")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	cs, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+
+	p := &infoBlobProvider{missingBlobProvider: missingBlobProvider{missing: dgst("l3")}}
+	var descs []ocispec.Descriptor
+	for _, l := range []string{"l0", "l1", "l2", "l3"} {
+		descs = append(descs, ocispec.Descriptor{Digest: dgst(l)})
+	}
+	cc := NewCacheChains()
+	rec := cc.Add(outputKey(dgst("top"), 0))
+	rec.AddResult(time.Now(), &solver.Remote{
+		Descriptors: descs,
+		Provider:    p,
+	})
+
+	w := &blobCheckWorker{cs: cs}
+	_, results, err := NewCacheKeyStorage(cc, w)
+	require.NoError(t, err)
+
+	var res solver.CacheResult
+	for _, it := range cc.items {
+		res = solver.CacheResult{ID: remoteID(it.result), CreatedAt: it.resultTime}
+	}
+	_, err = results.Load(ctx, res)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, solver.ErrNotFound))
+	require.Contains(t, err.Error(), dgst("l3").String())
+
+	// the blobs are checked concurrently without fetching them
+	require.Equal(t, int64(0), atomic.LoadInt64(&p.reads))
+	require.Equal(t, int64(4), atomic.LoadInt64(&p.infos))
+	require.True(t, atomic.LoadInt64(&p.max) > 1)
+}
+
+type blobCheckWorker struct {
+	worker.Worker
+	cs     content.Store
+	loaded int64
+}
+
+func (w *blobCheckWorker) ContentStore() content.Store {
+	return w.cs
+}
+
+func (w *blobCheckWorker) FromRemote(ctx context.Context, remote *solver.Remote) (cache.ImmutableRef, error) {
+	atomic.AddInt64(&w.loaded, 1)
+	return nil, nil
+}
+
+// missingBlobProvider returns a not found error for the missing blob like a
+// registry that has removed it.
+type missingBlobProvider struct {
+	missing digest.Digest
+	reads   int64
+}
+
+func (p *missingBlobProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	atomic.AddInt64(&p.reads, 1)
+	if desc.Digest == p.missing {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "content at %s not found", desc.Digest)
+	}
+	return &emptyReaderAt{}, nil
+}
+
+type emptyReaderAt struct{}
+
+func (r *emptyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, nil
+}
+
+func (r *emptyReaderAt) Close() error {
+	return nil
+}
+
+func (r *emptyReaderAt) Size() int64 {
+	return 0
+}
+
+// infoBlobProvider answers existence checks without reading the blob, like
+// a registry does for a HEAD request.
+type infoBlobProvider struct {
+	missingBlobProvider
+	infos  int64
+	active int64
+	max    int64
+}
+
+func (p *infoBlobProvider) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	atomic.AddInt64(&p.infos, 1)
+	n := atomic.AddInt64(&p.active, 1)
+	defer atomic.AddInt64(&p.active, -1)
+	for {
+		max := atomic.LoadInt64(&p.max)
+		if n <= max || atomic.CompareAndSwapInt64(&p.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if dgst == p.missing {
+		return content.Info{}, errors.Wrapf(errdefs.ErrNotFound, "content at %s not found", dgst)
+	}
+	return content.Info{Digest: dgst}, nil
+}
@@ -3,6 +3,7 @@ package cacheimport
 import (
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/containerd/containerd/content"
 	"github.com/moby/buildkit/solver"
@@ -111,6 +112,7 @@ type item struct {
 
 	result     *solver.Remote
 	resultTime time.Time
+	origin     *CacheOrigin
 
 	links     []map[link]struct{}
 	backlinks map[*item]struct{}
@@ -146,6 +148,32 @@ func (c *item) AddResult(createdAt time.Time, result *solver.Remote) {
 	c.result = result
 }
 
+// maxOriginLength is the maximum length of the strings of a CacheOrigin.
+const maxOriginLength = 200
+
+// SetOrigin records the build step of the result. Long names are truncated
+// to keep the size of the cache config bounded.
+func (c *item) SetOrigin(o solver.CacheRecordOrigin) {
+	c.origin = &CacheOrigin{
+		Vertex: o.Vertex,
+		Name:   truncate(o.Name, maxOriginLength),
+		Source: truncate(o.SourceLocation, maxOriginLength),
+	}
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	const ellipsis = "..."
+	i := n - len(ellipsis)
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i] + ellipsis
+}
+
 func (c *item) LinkFrom(rec solver.CacheExporterRecord, index int, selector string) {
 	src, ok := rec.(*item)
 	if !ok {
@@ -214,3 +242,4 @@ func (c *nopRecord) LinkFrom(rec solver.CacheExporterRecord, index int, selector
 }
 
 var _ solver.CacheExporterTarget = &CacheChains{}
+var _ solver.CacheExporterRecordOrigin = &item{}
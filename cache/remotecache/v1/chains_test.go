@@ -2,8 +2,10 @@ package cacheimport
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/moby/buildkit/solver"
 	digest "github.com/opencontainers/go-digest"
@@ -91,6 +93,115 @@ func TestSimpleMarshal(t *testing.T) {
 	require.Equal(t, len(cfg.Records), 4)
 }
 
+func TestEvict(t *testing.T) {
+	now := time.Now()
+	layer := func(s string, size int64) ocispec.Descriptor {
+		return ocispec.Descriptor{Digest: dgst(s), Size: size}
+	}
+
+	newChains := func() *CacheChains {
+		cc := NewCacheChains()
+		base := cc.Add(outputKey(dgst("base"), 0))
+		base.AddResult(now.Add(-3*time.Hour), &solver.Remote{
+			Descriptors: []ocispec.Descriptor{layer("l0", 10)},
+		})
+		old := cc.Add(outputKey(dgst("old"), 0))
+		old.LinkFrom(base, 0, "")
+		old.AddResult(now.Add(-2*time.Hour), &solver.Remote{
+			Descriptors: []ocispec.Descriptor{layer("l0", 10), layer("l1", 100)},
+		})
+		recent := cc.Add(outputKey(dgst("recent"), 0))
+		recent.LinkFrom(old, 0, "")
+		recent.AddResult(now.Add(-time.Minute), &solver.Remote{
+			Descriptors: []ocispec.Descriptor{layer("l2", 1000)},
+		})
+		return cc
+	}
+	results := func(cfg *CacheConfig) map[digest.Digest]int {
+		m := map[digest.Digest]int{}
+		for _, r := range cfg.Records {
+			m[r.Digest] = len(r.Results)
+		}
+		return m
+	}
+
+	cc := newChains()
+	require.Equal(t, 2, cc.Evict(time.Hour, 0, now))
+	cfg, _, err := cc.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(cfg.Records))
+	require.Equal(t, 1, len(cfg.Layers))
+	require.Equal(t, map[digest.Digest]int{
+		outputKey(dgst("base"), 0):   0,
+		outputKey(dgst("old"), 0):    0,
+		outputKey(dgst("recent"), 0): 1,
+	}, results(cfg))
+
+	// dropping base doesn't free l0 of old, so old is evicted too
+	cc = newChains()
+	require.Equal(t, 2, cc.Evict(0, 1100, now))
+	cfg, _, err = cc.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, 1, results(cfg)[outputKey(dgst("recent"), 0)])
+
+	cc = newChains()
+	require.Equal(t, 0, cc.Evict(0, 1110, now))
+	require.Equal(t, 3, cc.Evict(0, 999, now))
+}
+
+func TestMarshalOrigin(t *testing.T) {
+	cc := NewCacheChains()
+	foo := cc.Add(outputKey(dgst("foo"), 0))
+	bar := cc.Add(outputKey(dgst("bar"), 0))
+	bar.LinkFrom(foo, 0, "")
+	r := &solver.Remote{
+		Descriptors: []ocispec.Descriptor{{Digest: dgst("d0")}},
+	}
+	bar.AddResult(time.Now(), r)
+	bar.(solver.CacheExporterRecordOrigin).SetOrigin(solver.CacheRecordOrigin{
+		Vertex:         dgst("vtx"),
+		Name:           "[build 2/3] RUN " + strings.Repeat("é", 200),
+		SourceLocation: "Dockerfile:3-5",
+	})
+
+	cfg, descPairs, err := cc.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(cfg.Records))
+	var origin *CacheOrigin
+	for _, rec := range cfg.Records {
+		if rec.Digest == outputKey(dgst("bar"), 0) {
+			origin = rec.Origin
+		} else {
+			require.Nil(t, rec.Origin)
+		}
+	}
+	require.NotNil(t, origin)
+	require.Equal(t, dgst("vtx"), origin.Vertex)
+	require.Equal(t, "Dockerfile:3-5", origin.Source)
+	require.True(t, len(origin.Name) <= maxOriginLength)
+	require.True(t, utf8.ValidString(origin.Name))
+	require.True(t, strings.HasSuffix(origin.Name, "..."))
+
+	dt, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	newChains := NewCacheChains()
+	err = Parse(dt, descPairs, newChains)
+	require.NoError(t, err)
+	cfg2, _, err := newChains.Marshal()
+	require.NoError(t, err)
+	var parsed []*CacheOrigin
+	for _, rec := range cfg2.Records {
+		if rec.Origin != nil {
+			parsed = append(parsed, rec.Origin)
+		}
+	}
+	require.Equal(t, []*CacheOrigin{origin}, parsed)
+
+	r2 := withOrigin(r, origin)
+	require.Equal(t, "imported cache of "+origin.Name+" (Dockerfile:3-5)", r2.Descriptors[0].Annotations["buildkit/description"])
+	require.Nil(t, r.Descriptors[0].Annotations)
+}
+
 func dgst(s string) digest.Digest {
 	return digest.FromBytes([]byte(s))
 }
@@ -5,7 +5,9 @@ package cacheimport
 // Main manifest is OCI image index
 // https://github.com/opencontainers/image-spec/blob/master/image-index.md .
 // Manifests array contains descriptors to the cache layers and one instance of
-// build cache config with media type application/vnd.buildkit.cacheconfig.v0 .
+// build cache config with media type application/vnd.buildkit.cacheconfig.v0 ,
+// or application/vnd.buildkit.cacheconfig.v0+zstd if the config is zstd
+// compressed.
 // The cache layer descriptors need to have an annotation with uncompressed digest
 // to allow deduplication on extraction and optionally "buildkit/createdat"
 // annotation to support maintaining original timestamps.
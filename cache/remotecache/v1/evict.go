@@ -0,0 +1,74 @@
+package cacheimport
+
+import (
+	"sort"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Evict drops the results of the records created before now minus ttl and
+// then the results of the oldest records until the layers referenced by the
+// remaining results fit in maxSize bytes. The records stay in the chains to
+// keep the keys of their dependents. A zero ttl or maxSize disables the
+// respective policy. Results without a creation time never expire but are
+// the first ones dropped for maxSize. It returns the number of evicted
+// results.
+func (c *CacheChains) Evict(ttl time.Duration, maxSize int64, now time.Time) int {
+	var results []*item
+	for _, it := range c.items {
+		if it.result != nil {
+			results = append(results, it)
+		}
+	}
+
+	evicted := 0
+	if ttl > 0 {
+		remaining := results[:0]
+		for _, it := range results {
+			if !it.resultTime.IsZero() && now.Sub(it.resultTime) > ttl {
+				it.result = nil
+				evicted++
+				continue
+			}
+			remaining = append(remaining, it)
+		}
+		results = remaining
+	}
+
+	if maxSize <= 0 {
+		return evicted
+	}
+
+	refs := map[digest.Digest]int{}
+	var size int64
+	for _, it := range results {
+		for _, desc := range it.result.Descriptors {
+			if refs[desc.Digest] == 0 {
+				size += desc.Size
+			}
+			refs[desc.Digest]++
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if !results[i].resultTime.Equal(results[j].resultTime) {
+			return results[i].resultTime.Before(results[j].resultTime)
+		}
+		return results[i].dgst < results[j].dgst
+	})
+	for _, it := range results {
+		if size <= maxSize {
+			break
+		}
+		for _, desc := range it.result.Descriptors {
+			refs[desc.Digest]--
+			if refs[desc.Digest] == 0 {
+				size -= desc.Size
+			}
+		}
+		it.result = nil
+		evicted++
+	}
+	return evicted
+}
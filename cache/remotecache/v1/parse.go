@@ -64,6 +64,13 @@ func parseRecord(cc CacheConfig, idx int, provider DescriptorProvider, t solver.
 			r.AddResult(res.CreatedAt, remote)
 		}
 	}
+	if o, ok := r.(solver.CacheExporterRecordOrigin); ok && rec.Origin != nil {
+		o.SetOrigin(solver.CacheRecordOrigin{
+			Vertex:         rec.Origin.Vertex,
+			Name:           rec.Origin.Name,
+			SourceLocation: rec.Origin.Source,
+		})
+	}
 
 	cache[idx] = r
 	return r, nil
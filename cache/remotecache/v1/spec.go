@@ -8,6 +8,10 @@ import (
 
 const CacheConfigMediaTypeV0 = "application/vnd.buildkit.cacheconfig.v0"
 
+// CacheConfigMediaTypeV0Zstd is the media type of a zstd compressed cache
+// config.
+const CacheConfigMediaTypeV0Zstd = CacheConfigMediaTypeV0 + "+zstd"
+
 type CacheConfig struct {
 	Layers  []CacheLayer  `json:"layers,omitempty"`
 	Records []CacheRecord `json:"records,omitempty"`
@@ -22,6 +26,19 @@ type CacheRecord struct {
 	Results []CacheResult  `json:"layers,omitempty"`
 	Digest  digest.Digest  `json:"digest,omitempty"`
 	Inputs  [][]CacheInput `json:"inputs,omitempty"`
+	Origin  *CacheOrigin   `json:"origin,omitempty"`
+}
+
+// CacheOrigin describes the build step the results of a record were
+// created by. It's only informational, importers don't use it for cache
+// matching.
+type CacheOrigin struct {
+	// Vertex is the digest of the LLB operation.
+	Vertex digest.Digest `json:"vertex,omitempty"`
+	// Name is the truncated description of the operation.
+	Name string `json:"name,omitempty"`
+	// Source is the location in the frontend source, e.g. "Dockerfile:3-5".
+	Source string `json:"source,omitempty"`
 }
 
 type CacheResult struct {
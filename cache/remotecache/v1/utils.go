@@ -245,6 +245,9 @@ func normalizeItem(it *item, state *normalizeState) (*item, error) {
 
 	it2 := state.byKey[id]
 	state.added[it] = it2
+	if it2.origin == nil {
+		it2.origin = it.origin
+	}
 
 	for i, m := range links {
 		for l := range m {
@@ -327,6 +330,9 @@ func marshalItem(it *item, state *marshalState) error {
 		Digest: it.dgst,
 		Inputs: make([][]CacheInput, len(it.links)),
 	}
+	if it.result != nil {
+		rec.Origin = it.origin
+	}
 
 	for i, m := range it.links {
 		for l := range m {
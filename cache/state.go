@@ -0,0 +1,290 @@
+package cache
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/solver"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stateVersion    = 1
+	stateIndexName  = "index.json"
+	stateRecordsDir = "records"
+)
+
+// stateIndex is the first entry of an exported cache state. Records are
+// listed with parents before their children.
+type stateIndex struct {
+	Version int
+	Records []string
+	// Blobs are the digests of all layer blobs referenced by the records.
+	// The content is not part of the state and is fetched on demand.
+	Blobs []digest.Digest
+}
+
+// stateRecord is the exported metadata of a record with a blob.
+type stateRecord struct {
+	ID          string
+	Parent      string `json:",omitempty"`
+	Descriptor  ocispec.Descriptor
+	Description string                 `json:",omitempty"`
+	RecordType  client.UsageRecordType `json:",omitempty"`
+	CreatedAt   time.Time
+	ImageRefs   []string `json:",omitempty"`
+	Namespace   string   `json:",omitempty"`
+}
+
+// ExportState writes the metadata of the committed records matching the
+// prune filter expressions to w as a tar archive. Only records with a blob
+// can be restored from their metadata, other records are skipped. The
+// parents of matching records are always included. The archive can be
+// restored on another worker with ImportState. The IDs of the exported
+// records are returned.
+func (cm *cacheManager) ExportState(ctx context.Context, w io.Writer, filter ...string) ([]string, error) {
+	du, err := cm.DiskUsage(ctx, client.DiskUsageInfo{Filter: filter})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(du))
+	for _, ui := range du {
+		ids = append(ids, ui.ID)
+	}
+	sort.Strings(ids)
+
+	var records []stateRecord
+	cm.mu.Lock()
+	seen := map[string]struct{}{}
+	for _, id := range ids {
+		cr, ok := cm.records[id]
+		if !ok {
+			continue
+		}
+		records = appendStateRecords(records, cr, seen)
+	}
+	cm.mu.Unlock()
+
+	idx := stateIndex{Version: stateVersion}
+	blobs := map[digest.Digest]struct{}{}
+	for _, r := range records {
+		idx.Records = append(idx.Records, r.ID)
+		if _, ok := blobs[r.Descriptor.Digest]; !ok {
+			blobs[r.Descriptor.Digest] = struct{}{}
+			idx.Blobs = append(idx.Blobs, r.Descriptor.Digest)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeStateEntry(tw, stateIndexName, idx); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if err := writeStateEntry(tw, path.Join(stateRecordsDir, r.ID+".json"), r); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return idx.Records, nil
+}
+
+// appendStateRecords appends the exportable chain of cr to records, parents
+// first. Records in seen are not added again. Requires cm.mu.
+func appendStateRecords(records []stateRecord, cr *cacheRecord, seen map[string]struct{}) []stateRecord {
+	var chain []*cacheRecord
+	for rec := cr; rec != nil; {
+		chain = append([]*cacheRecord{rec}, chain...)
+		if rec.parent == nil {
+			break
+		}
+		rec = rec.parent.cacheRecord
+	}
+
+	for _, rec := range chain {
+		if _, ok := seen[rec.ID()]; ok {
+			continue
+		}
+		rec.mu.Lock()
+		r, ok := exportStateRecord(rec)
+		rec.mu.Unlock()
+		if !ok {
+			// children can't be restored without their parent
+			return records
+		}
+		seen[rec.ID()] = struct{}{}
+		records = append(records, r)
+	}
+	return records
+}
+
+// exportStateRecord returns the metadata of rec. The bool is false if the
+// record can't be restored from its blob. Requires rec.mu.
+func exportStateRecord(rec *cacheRecord) (stateRecord, bool) {
+	if rec.isDead() || rec.mutable || !getCommitted(rec.md) {
+		return stateRecord{}, false
+	}
+	blob := getBlob(rec.md)
+	diffID := getDiffID(rec.md)
+	if blob == "" || diffID == "" {
+		return stateRecord{}, false
+	}
+
+	annotations := map[string]string{}
+	for k, v := range getBlobAnnotations(rec.md) {
+		annotations[k] = v
+	}
+	annotations[containerdUncompressed] = diffID
+
+	r := stateRecord{
+		ID: rec.ID(),
+		Descriptor: ocispec.Descriptor{
+			Digest:      digest.Digest(blob),
+			MediaType:   getMediaType(rec.md),
+			Size:        getBlobSize(rec.md),
+			Annotations: annotations,
+		},
+		Description: GetDescription(rec.md),
+		RecordType:  GetRecordType(rec),
+		CreatedAt:   GetCreatedAt(rec.md),
+		ImageRefs:   getImageRefs(rec.md),
+		Namespace:   GetNamespace(rec.md),
+	}
+	if rec.parent != nil {
+		r.Parent = rec.parent.ID()
+	}
+	return r, true
+}
+
+func writeStateEntry(tw *tar.Writer, name string, v interface{}) error {
+	dt, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(dt)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tw.Write(dt)
+	return errors.WithStack(err)
+}
+
+// ImportState recreates the records of a state written by ExportState as
+// lazy records. Their blobs are not needed for the import, the content is
+// fetched through the descriptor handlers of a later pull of the same
+// layers. Records that already exist with the same blob chain are reused.
+// Records that fail to import are skipped together with their children.
+// The imported records are retained like the results of the solver cache,
+// the caller is expected to link them to cache keys. The returned map has
+// the IDs of the imported records by their ID in the state.
+func (cm *cacheManager) ImportState(ctx context.Context, r io.Reader) (map[string]string, error) {
+	var idx *stateIndex
+	records := map[string]stateRecord{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read cache state")
+		}
+		switch {
+		case hdr.Name == stateIndexName:
+			idx = &stateIndex{}
+			if err := json.NewDecoder(tr).Decode(idx); err != nil {
+				return nil, errors.Wrap(err, "failed to decode cache state index")
+			}
+			if idx.Version != stateVersion {
+				return nil, errors.Errorf("unsupported cache state version %d", idx.Version)
+			}
+		case path.Dir(hdr.Name) == stateRecordsDir:
+			var rec stateRecord
+			if err := json.NewDecoder(tr).Decode(&rec); err != nil {
+				return nil, errors.Wrapf(err, "failed to decode cache state record %s", hdr.Name)
+			}
+			if rec.ID != strings.TrimSuffix(path.Base(hdr.Name), ".json") {
+				return nil, errors.Errorf("invalid cache state record %s", hdr.Name)
+			}
+			records[rec.ID] = rec
+		}
+	}
+	if idx == nil {
+		return nil, errors.Errorf("invalid cache state: missing %s", stateIndexName)
+	}
+
+	// all blobs of the state are lazy, the handlers are only needed to
+	// create the records
+	dhs := DescHandlers{}
+	for _, dgst := range idx.Blobs {
+		dhs[dgst] = &DescHandler{}
+	}
+
+	refs := map[string]ImmutableRef{}
+	defer func() {
+		for _, ref := range refs {
+			ref.Release(context.TODO())
+		}
+	}()
+
+	for _, id := range idx.Records {
+		rec, ok := records[id]
+		if !ok {
+			logrus.Warnf("skipping cache state record %s: metadata missing", id)
+			continue
+		}
+		var parent ImmutableRef
+		if rec.Parent != "" {
+			if parent, ok = refs[rec.Parent]; !ok {
+				logrus.Debugf("skipping cache state record %s: parent %s was not imported", id, rec.Parent)
+				continue
+			}
+		}
+		if _, ok := dhs[rec.Descriptor.Digest]; !ok {
+			dhs[rec.Descriptor.Digest] = &DescHandler{}
+		}
+
+		opts := []RefOption{dhs, CachePolicyRetain}
+		if rec.Description != "" {
+			opts = append(opts, WithDescription(rec.Description))
+		}
+		if !rec.CreatedAt.IsZero() {
+			opts = append(opts, WithCreationTime(rec.CreatedAt))
+		}
+		if rec.RecordType != "" {
+			opts = append(opts, WithRecordType(rec.RecordType))
+		}
+		for _, imageRef := range rec.ImageRefs {
+			opts = append(opts, WithImageRef(imageRef))
+		}
+
+		ref, err := cm.GetByBlob(solver.WithCacheNamespace(ctx, rec.Namespace), rec.Descriptor, parent, opts...)
+		if err != nil {
+			logrus.Warnf("skipping cache state record %s: %v", id, err)
+			continue
+		}
+		refs[id] = ref
+	}
+
+	ids := make(map[string]string, len(refs))
+	for id, ref := range refs {
+		ids[id] = ref.ID()
+	}
+	return ids, nil
+}
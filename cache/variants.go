@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/containerd/leases"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var variantSelectorRe = regexp.MustCompile(`^\s*variant\s*==\s*"?([A-Za-z0-9._-]+)"?\s*$`)
+
+// variantPrune removes the blob variants called name, or the variants of
+// the compression type name, of the records matching filter.
+type variantPrune struct {
+	name   string
+	filter filters.Filter
+}
+
+// splitVariantFilters returns the prune filters with a "variant==<name>"
+// selector as variant prunes and the other filters unchanged. The other
+// selectors of a variant filter, joined with "&&", select the records whose
+// variants are removed.
+func splitVariantFilters(fs []string) ([]variantPrune, []string, error) {
+	var vps []variantPrune
+	var rest []string
+	for _, f := range fs {
+		var name string
+		var others []string
+		ors := splitFilter(f, "||")
+		for _, or := range ors {
+			for _, and := range splitFilter(or, "&&") {
+				if m := variantSelectorRe.FindStringSubmatch(and); m != nil {
+					if name != "" {
+						return nil, nil, errors.Errorf("invalid filter %q: more than one variant selector", f)
+					}
+					name = m[1]
+					continue
+				}
+				others = append(others, and)
+			}
+		}
+		if name == "" {
+			rest = append(rest, f)
+			continue
+		}
+		if len(ors) > 1 {
+			return nil, nil, errors.Errorf("invalid filter %q: variant selectors can't be combined with \"||\"", f)
+		}
+		switch t := strings.SplitN(name, ".", 2)[0]; t {
+		case compression.Uncompressed.String(), compression.Gzip.String(), compression.Zstd.String():
+		default:
+			return nil, nil, errors.Errorf("invalid filter %q: unknown blob variant %q", f, name)
+		}
+		var filter filters.Filter = filters.Always
+		if len(others) > 0 {
+			var err error
+			if filter, err = parseFilters(strings.Join(others, "&&")); err != nil {
+				return nil, nil, err
+			}
+		}
+		vps = append(vps, variantPrune{name: name, filter: filter})
+	}
+	return vps, rest, nil
+}
+
+// pruneVariants removes the blob variants selected by vp. The records and
+// their blobs are kept. The variant blobs are removed from the leases of all
+// records with the same blob and deleted by the garbage collection if
+// nothing else refers to them. Records whose blob is one of the selected
+// variants are skipped with a warning.
+func (cm *cacheManager) pruneVariants(ctx context.Context, ch chan client.UsageInfo, vp variantPrune) error {
+	var pruned []client.UsageInfo
+	cm.mu.Lock()
+	byBlob := map[digest.Digest][]string{}
+	for id, cr := range cm.records {
+		cr.mu.Lock()
+		if blob := getBlob(cr.md); blob != "" && !cr.isDead() {
+			byBlob[digest.Digest(blob)] = append(byBlob[digest.Digest(blob)], id)
+		}
+		cr.mu.Unlock()
+	}
+	for _, cr := range cm.records {
+		cr.mu.Lock()
+		blob := getBlob(cr.md)
+		if cr.isDead() || blob == "" {
+			cr.mu.Unlock()
+			continue
+		}
+
+		usageCount, lastUsedAt := getLastUsed(cr.md)
+		c := client.UsageInfo{
+			ID:          cr.ID(),
+			Mutable:     cr.mutable,
+			InUse:       len(cr.refs) > 0,
+			CreatedAt:   GetCreatedAt(cr.md),
+			Description: GetDescription(cr.md),
+			LastUsedAt:  lastUsedAt,
+			UsageCount:  usageCount,
+			RecordType:  GetRecordType(cr),
+			Namespace:   GetNamespace(cr.md),
+		}
+		if !vp.filter.Match(adaptUsageInfo(&c)) {
+			cr.mu.Unlock()
+			continue
+		}
+
+		freed, err := cm.removeVariants(ctx, cr.ID(), digest.Digest(blob), vp.name, byBlob[digest.Digest(blob)])
+		cr.mu.Unlock()
+		if err != nil {
+			cm.mu.Unlock()
+			return err
+		}
+		if freed == 0 {
+			continue
+		}
+		c.Size = freed
+		c.Description = fmt.Sprintf("%s variants of %s", vp.name, c.Description)
+		pruned = append(pruned, c)
+	}
+	cm.mu.Unlock()
+
+	for _, c := range pruned {
+		logrus.Debugf("pruned %s variants of cache record %s", vp.name, c.ID)
+		if ch != nil {
+			select {
+			case ch <- c:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// removeVariants removes the labels of the variants of blob matching name
+// and the variants from the leases of the records owners. It returns the
+// size of the variant blobs. Requires the record lock of id.
+func (cm *cacheManager) removeVariants(ctx context.Context, id string, blob digest.Digest, name string, owners []string) (int64, error) {
+	info, err := cm.ContentStore.Info(ctx, blob)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var fields []string
+	var variants []digest.Digest
+	var size int64
+	for k, v := range info.Labels {
+		if !strings.HasPrefix(k, labelVariantPrefix) {
+			continue
+		}
+		vname := strings.TrimPrefix(k, labelVariantPrefix)
+		if vname != name && !strings.HasPrefix(vname, name+".") {
+			continue
+		}
+		// the choice of an if-smaller conversion may be the blob itself
+		if digest.Digest(v) == blob {
+			logrus.Warnf("not pruning %s variants of cache record %s: %s is the blob of the record", name, id, vname)
+			return 0, nil
+		}
+		fields = append(fields, "labels."+k)
+		variants = append(variants, digest.Digest(v))
+		if vinfo, err := cm.ContentStore.Info(ctx, digest.Digest(v)); err == nil {
+			size += vinfo.Size
+		}
+	}
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	for _, f := range fields {
+		delete(info.Labels, strings.TrimPrefix(f, "labels."))
+	}
+	if _, err := cm.ContentStore.Update(ctx, info, fields...); err != nil {
+		return 0, err
+	}
+	for _, owner := range owners {
+		for _, v := range variants {
+			if err := cm.LeaseManager.DeleteResource(ctx, leases.Lease{ID: owner}, leases.Resource{
+				ID:   v.String(),
+				Type: "content",
+			}); err != nil && !errdefs.IsNotFound(err) {
+				return 0, errors.Wrapf(err, "failed to remove variant %s from lease %s", v, owner)
+			}
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/moby/buildkit/cache/metadata"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// VerifyResult describes an inconsistency found between a cache record's
+// metadata and the snapshotter or content store backing it.
+type VerifyResult struct {
+	ID       string
+	Problem  string
+	Repaired bool
+}
+
+// verifyState is the metadata of a record that is checked against the
+// snapshotter and content store.
+type verifyState struct {
+	blob       digest.Digest
+	diffID     string
+	blobOnly   bool
+	snapshotID string
+	// checkSnapshot is false if the snapshot belongs to the mutable
+	// record the record was committed from
+	checkSnapshot bool
+}
+
+func getVerifyState(cr *cacheRecord) verifyState {
+	return verifyState{
+		blob:          digest.Digest(getBlob(cr.md)),
+		diffID:        getDiffID(cr.md),
+		blobOnly:      getBlobOnly(cr.md),
+		snapshotID:    getSnapshotID(cr.md),
+		checkSnapshot: cr.equalMutable == nil,
+	}
+}
+
+// verifyProblems are the inconsistencies found for a record.
+type verifyProblems struct {
+	// diffIDMismatch is the uncompressed digest of the blob if it doesn't
+	// match the diffID of the record
+	diffIDMismatch  string
+	blobMissing     bool
+	snapshotMissing bool
+}
+
+// Verify checks every cache record against the snapshotter and content
+// store. Snapshots of extracted records must exist, referenced blobs of
+// extracted records must be present and their uncompressed label must match the recorded diffID. If
+// repair is set, records that can be rebuilt from their blob are marked for
+// re-extraction, stale blob metadata is cleared so that it is recomputed on
+// the next export, and unrecoverable records that are not in use are
+// deleted.
+//
+// The snapshotter and content store are queried without holding the lock of
+// the manager. Records that change while they are checked are skipped.
+func (cm *cacheManager) Verify(ctx context.Context, repair bool) ([]VerifyResult, error) {
+	cm.mu.Lock()
+	records := make([]*cacheRecord, 0, len(cm.records))
+	for _, cr := range cm.records {
+		records = append(records, cr)
+	}
+	cm.mu.Unlock()
+
+	var results []VerifyResult
+	var toDelete []*cacheRecord
+	for _, cr := range records {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		cr.mu.Lock()
+		if cr.isDead() {
+			cr.mu.Unlock()
+			continue
+		}
+		st := getVerifyState(cr)
+		cr.mu.Unlock()
+
+		p, err := cm.verifyRecord(ctx, st)
+		if err != nil {
+			return results, err
+		}
+		if p == (verifyProblems{}) {
+			continue
+		}
+
+		cm.mu.Lock()
+		cr.mu.Lock()
+		if cr.isDead() || getVerifyState(cr) != st {
+			cr.mu.Unlock()
+			cm.mu.Unlock()
+			continue
+		}
+		res, remove, err := repairRecord(cr, st, p, repair && len(cr.refs) == 0)
+		if err == nil && remove {
+			cr.dead = true
+			cr.updateUsage()
+			err = setDeleted(cr.md)
+			toDelete = append(toDelete, cr)
+		}
+		cr.mu.Unlock()
+		cm.mu.Unlock()
+		results = append(results, res...)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	for _, cr := range toDelete {
+		cr.mu.Lock()
+		err := cr.remove(ctx, true)
+		cr.mu.Unlock()
+		if err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// verifyRecord checks the state of a single record against the content
+// store and snapshotter.
+func (cm *cacheManager) verifyRecord(ctx context.Context, st verifyState) (verifyProblems, error) {
+	var p verifyProblems
+	if st.blob != "" {
+		info, err := cm.ContentStore.Info(ctx, st.blob)
+		if err != nil {
+			if !errors.Is(err, errdefs.ErrNotFound) {
+				return p, err
+			}
+			// the blob of a lazy record is fetched on demand
+			p.blobMissing = !st.blobOnly
+		} else if v, ok := info.Labels[containerdUncompressed]; ok && st.diffID != "" && v != st.diffID {
+			p.diffIDMismatch = v
+		}
+	}
+
+	// lazy records are fetched on demand, nothing to verify locally
+	if !st.blobOnly && st.checkSnapshot {
+		if _, err := cm.Snapshotter.Stat(ctx, st.snapshotID); err != nil {
+			if !errors.Is(err, errdefs.ErrNotFound) {
+				return p, err
+			}
+			p.snapshotMissing = true
+		}
+	}
+	return p, nil
+}
+
+// repairRecord returns the results for the problems of a record and repairs
+// them if repair is set. Requires cm.mu and cr.mu. The returned bool reports
+// whether the record should be removed.
+func repairRecord(cr *cacheRecord, st verifyState, p verifyProblems, repair bool) ([]VerifyResult, bool, error) {
+	var results []VerifyResult
+	blob := st.blob
+
+	if p.diffIDMismatch != "" {
+		res := VerifyResult{
+			ID:      cr.ID(),
+			Problem: fmt.Sprintf("blob %s uncompressed digest %s does not match diffID %s", blob, p.diffIDMismatch, st.diffID),
+		}
+		if repair && !st.blobOnly {
+			if err := clearBlob(cr.md); err != nil {
+				return nil, false, err
+			}
+			res.Repaired = true
+			blob = ""
+		}
+		results = append(results, res)
+	}
+
+	if p.snapshotMissing {
+		res := VerifyResult{
+			ID:      cr.ID(),
+			Problem: fmt.Sprintf("snapshot %s is missing", st.snapshotID),
+		}
+		if !repair {
+			return append(results, res), false, nil
+		}
+		res.Repaired = true
+		if blob != "" && !p.blobMissing {
+			queueBlobOnly(cr.md, true)
+			if err := cr.md.Commit(); err != nil {
+				return nil, false, err
+			}
+			return append(results, res), false, nil
+		}
+		return append(results, res), true, nil
+	}
+
+	if blob != "" && p.blobMissing {
+		res := VerifyResult{
+			ID:      cr.ID(),
+			Problem: fmt.Sprintf("blob %s is missing from the content store", blob),
+		}
+		if repair {
+			if err := clearBlob(cr.md); err != nil {
+				return nil, false, err
+			}
+			res.Repaired = true
+		}
+		results = append(results, res)
+	}
+
+	return results, false, nil
+}
+
+// clearBlob removes the blob association of a record so that it is computed
+// again from the snapshot the next time the record is exported.
+func clearBlob(si *metadata.StorageItem) error {
+	return si.Update(func(b *bolt.Bucket) error {
+		for _, k := range []string{keyBlob, keyMediaType, keyBlobSize, keyBlobAnnotations, keyDiffID, keyChainID, keyBlobChainID} {
+			if err := si.SetValue(b, k, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -90,6 +90,7 @@ func TestIntegration(t *testing.T) {
 		testInvalidExporter,
 		testReadonlyRootFS,
 		testBasicRegistryCacheImportExport,
+		testZstdConfigRegistryCacheImportExport,
 		testBasicLocalCacheImportExport,
 		testCachedMounts,
 		testProxyEnv,
@@ -2446,6 +2447,30 @@ func testBasicRegistryCacheImportExport(t *testing.T, sb integration.Sandbox) {
 	testBasicCacheImportExport(t, sb, []CacheOptionsEntry{o}, []CacheOptionsEntry{o})
 }
 
+func testZstdConfigRegistryCacheImportExport(t *testing.T, sb integration.Sandbox) {
+	skipDockerd(t, sb)
+	registry, err := sb.NewRegistry()
+	if errors.Is(err, integration.ErrorRequirements) {
+		t.Skip(err.Error())
+	}
+	require.NoError(t, err)
+	target := registry + "/buildkit/testexportzstd:latest"
+	im := CacheOptionsEntry{
+		Type: "registry",
+		Attrs: map[string]string{
+			"ref": target,
+		},
+	}
+	ex := CacheOptionsEntry{
+		Type: "registry",
+		Attrs: map[string]string{
+			"ref":                target,
+			"config-compression": "zstd",
+		},
+	}
+	testBasicCacheImportExport(t, sb, []CacheOptionsEntry{im}, []CacheOptionsEntry{ex})
+}
+
 func testMultipleRegistryCacheImportExport(t *testing.T, sb integration.Sandbox) {
 	skipDockerd(t, sb)
 	registry, err := sb.NewRegistry()
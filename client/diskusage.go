@@ -6,6 +6,7 @@ import (
 	"time"
 
 	controlapi "github.com/moby/buildkit/api/services/control"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -22,6 +23,27 @@ type UsageInfo struct {
 	Description string
 	RecordType  UsageRecordType
 	Shared      bool
+	Pinned      bool
+	PinReason   string
+
+	// ChainID, Blob and MediaType describe the layer of the record if
+	// it has one. Lazy records have not been pulled yet.
+	ChainID   digest.Digest
+	Blob      digest.Digest
+	MediaType string
+	Lazy      bool
+	// BlobSize is the part of Size used by the blob in the content store,
+	// the rest is used by the snapshot.
+	BlobSize int64
+	// BuildID is the session of the build that created the record.
+	BuildID string
+	// Namespace is the cache namespace of the build that created the
+	// record.
+	Namespace string
+	// UsageScore is the number of uses of the record, each decayed by the
+	// time since the use. Prunes that stop at a size limit remove records
+	// with a low score first.
+	UsageScore float64
 }
 
 func (c *Client) DiskUsage(ctx context.Context, opts ...DiskUsageOption) ([]*UsageInfo, error) {
@@ -48,9 +70,19 @@ func (c *Client) DiskUsage(ctx context.Context, opts ...DiskUsageOption) ([]*Usa
 			CreatedAt:   d.CreatedAt,
 			Description: d.Description,
 			UsageCount:  int(d.UsageCount),
+			UsageScore:  d.UsageScore,
 			LastUsedAt:  d.LastUsedAt,
 			RecordType:  UsageRecordType(d.RecordType),
 			Shared:      d.Shared,
+			Pinned:      d.Pinned,
+			PinReason:   d.PinReason,
+			ChainID:     digest.Digest(d.ChainID),
+			Blob:        digest.Digest(d.Blob),
+			MediaType:   d.MediaType,
+			Lazy:        d.Lazy,
+			BlobSize:    d.BlobSize,
+			BuildID:     d.BuildID,
+			Namespace:   d.Namespace,
 		})
 	}
 
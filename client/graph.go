@@ -44,3 +44,20 @@ type SolveResponse struct {
 	// ExporterResponse is also used for CacheExporter
 	ExporterResponse map[string]string
 }
+
+// ExporterResponseCacheImportStats is the key of the exporter response
+// holding the JSON encoded []CacheImportStats of a build.
+const ExporterResponseCacheImportStats = "cache.import.stats"
+
+// CacheImportStats describe the results a build loaded from an imported
+// cache source.
+type CacheImportStats struct {
+	// Source is the cache ref for registry imports and the type and a hash
+	// of the attributes for other cache importers.
+	Source string
+	// Hits is the number of vertexes loaded from the source.
+	Hits int
+	// Size is the total size of the layers of the loaded results. Imported
+	// layers are only pulled when their content is needed.
+	Size int64
+}
@@ -0,0 +1,74 @@
+package ociindex
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/gofrs/flock"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// PruneIndexJSONFileLocked removes the blobs of cs that aren't reachable
+// from the manifests of the index at indexJSONPath. Blobs updated after
+// before are kept, they might belong to a concurrent export that hasn't
+// updated the index yet. Nothing is removed if a referenced manifest can't
+// be read.
+func PruneIndexJSONFileLocked(ctx context.Context, cs content.Store, indexJSONPath string, before time.Time) error {
+	lockPath := indexJSONPath + IndexJSONLockFileSuffix
+	lock := flock.New(lockPath)
+	locked, err := lock.TryLock()
+	if err != nil {
+		return errors.Wrapf(err, "could not lock %s", lockPath)
+	}
+	if !locked {
+		return errors.Errorf("could not lock %s", lockPath)
+	}
+	defer func() {
+		lock.Unlock()
+		os.RemoveAll(lockPath)
+	}()
+
+	b, err := ioutil.ReadFile(indexJSONPath)
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", indexJSONPath)
+	}
+	var idx v1.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return errors.Wrapf(err, "could not unmarshal %s (%q)", indexJSONPath, string(b))
+	}
+
+	referenced := map[digest.Digest]struct{}{}
+	handler := images.HandlerFunc(func(ctx context.Context, desc v1.Descriptor) ([]v1.Descriptor, error) {
+		if _, ok := referenced[desc.Digest]; ok {
+			return nil, images.ErrSkipDesc
+		}
+		referenced[desc.Digest] = struct{}{}
+		return images.Children(ctx, cs, desc)
+	})
+	if err := images.Walk(ctx, handler, idx.Manifests...); err != nil {
+		return errors.Wrapf(err, "could not walk manifests of %s", indexJSONPath)
+	}
+
+	var unreferenced []digest.Digest
+	if err := cs.Walk(ctx, func(info content.Info) error {
+		if _, ok := referenced[info.Digest]; !ok && info.UpdatedAt.Before(before) {
+			unreferenced = append(unreferenced, info.Digest)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, dgst := range unreferenced {
+		if err := cs.Delete(ctx, dgst); err != nil {
+			return errors.Wrapf(err, "could not remove blob %s", dgst)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package ociindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneIndexJSONFile(t *testing.T) {
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "ociindex")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cs, err := local.NewStore(dir)
+	require.NoError(t, err)
+
+	writeBlob := func(mediaType string, dt []byte) v1.Descriptor {
+		desc := v1.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(dt),
+			Size:      int64(len(dt)),
+		}
+		err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(dt), desc)
+		require.NoError(t, err)
+		return desc
+	}
+	writeIndex := func(descs ...v1.Descriptor) v1.Descriptor {
+		dt, err := json.Marshal(v1.Index{Manifests: descs})
+		require.NoError(t, err)
+		return writeBlob(images.MediaTypeDockerSchema2ManifestList, dt)
+	}
+	age := func(desc v1.Descriptor) {
+		p := filepath.Join(dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Hex())
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(p, old, old))
+	}
+
+	layer := writeBlob(images.MediaTypeDockerSchema2LayerGzip, []byte("layer"))
+	config := writeBlob("application/vnd.buildkit.cacheconfig.v0", []byte("{}"))
+	platformManifest := writeIndex(layer, config)
+	manifest := writeIndex(platformManifest)
+
+	oldLayer := writeBlob(images.MediaTypeDockerSchema2LayerGzip, []byte("old layer"))
+	oldManifest := writeIndex(oldLayer, config)
+	concurrent := writeBlob(images.MediaTypeDockerSchema2LayerGzip, []byte("concurrent"))
+
+	for _, desc := range []v1.Descriptor{layer, config, platformManifest, manifest, oldLayer, oldManifest} {
+		age(desc)
+	}
+
+	indexJSONPath := filepath.Join(dir, "index.json")
+	require.NoError(t, PutDescToIndexJSONFileLocked(indexJSONPath, oldManifest, "latest"))
+	require.NoError(t, PutDescToIndexJSONFileLocked(indexJSONPath, manifest, "latest"))
+
+	err = PruneIndexJSONFileLocked(ctx, cs, indexJSONPath, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+
+	for _, desc := range []v1.Descriptor{layer, config, platformManifest, manifest, concurrent} {
+		_, err := cs.Info(ctx, desc.Digest)
+		require.NoError(t, err, "blob %s was removed", desc.MediaType)
+	}
+	for _, desc := range []v1.Descriptor{oldLayer, oldManifest} {
+		_, err := cs.Info(ctx, desc.Digest)
+		require.True(t, errdefs.IsNotFound(err), "blob %s was not removed", desc.MediaType)
+	}
+
+	// a broken index doesn't remove anything
+	age(concurrent)
+	require.NoError(t, cs.Delete(ctx, platformManifest.Digest))
+	err = PruneIndexJSONFileLocked(ctx, cs, indexJSONPath, time.Now().Add(-time.Hour))
+	require.Error(t, err)
+	_, err = cs.Info(ctx, concurrent.Digest)
+	require.NoError(t, err)
+}
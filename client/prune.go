@@ -19,10 +19,15 @@ func (c *Client) Prune(ctx context.Context, ch chan UsageInfo, opts ...PruneOpti
 		Filter:       info.Filter,
 		KeepDuration: int64(info.KeepDuration),
 		KeepBytes:    int64(info.KeepBytes),
+		MinHits:      int64(info.MinHits),
+		MaxFreed:     info.MaxFreed,
 	}
 	if info.All {
 		req.All = true
 	}
+	if info.Force {
+		req.Force = true
+	}
 	cl, err := c.controlClient().Prune(ctx, req)
 	if err != nil {
 		return errors.Wrap(err, "failed to call prune")
@@ -46,9 +51,12 @@ func (c *Client) Prune(ctx context.Context, ch chan UsageInfo, opts ...PruneOpti
 				CreatedAt:   d.CreatedAt,
 				Description: d.Description,
 				UsageCount:  int(d.UsageCount),
+				UsageScore:  d.UsageScore,
 				LastUsedAt:  d.LastUsedAt,
 				RecordType:  UsageRecordType(d.RecordType),
 				Shared:      d.Shared,
+				Pinned:      d.Pinned,
+				PinReason:   d.PinReason,
 			}
 		}
 	}
@@ -63,6 +71,15 @@ type PruneInfo struct {
 	All          bool
 	KeepDuration time.Duration
 	KeepBytes    int64
+	// MinHits keeps records that have been used at least this many
+	// times in the last week.
+	MinHits int
+	// MaxFreed stops the prune once records of this total size have been
+	// removed. The records freeing the most space for how recently and how
+	// often they were used are removed first.
+	MaxFreed int64
+	// Force also removes pinned records.
+	Force bool
 }
 
 type pruneOptionFunc func(*PruneInfo)
@@ -75,9 +92,25 @@ var PruneAll = pruneOptionFunc(func(pi *PruneInfo) {
 	pi.All = true
 })
 
+var PruneForce = pruneOptionFunc(func(pi *PruneInfo) {
+	pi.Force = true
+})
+
 func WithKeepOpt(duration time.Duration, bytes int64) PruneOption {
 	return pruneOptionFunc(func(pi *PruneInfo) {
 		pi.KeepDuration = duration
 		pi.KeepBytes = bytes
 	})
 }
+
+func WithMinHits(count int) PruneOption {
+	return pruneOptionFunc(func(pi *PruneInfo) {
+		pi.MinHits = count
+	})
+}
+
+func WithMaxFreed(bytes int64) PruneOption {
+	return pruneOptionFunc(func(pi *PruneInfo) {
+		pi.MaxFreed = bytes
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +30,10 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// localCachePruneGracePeriod protects the blobs of concurrent exports to the
+// same local cache directory from being pruned.
+const localCachePruneGracePeriod = time.Hour
+
 type SolveOpt struct {
 	Exports               []ExportEntry
 	LocalDirs             map[string]string
@@ -42,6 +47,10 @@ type SolveOpt struct {
 	AllowedEntitlements   []entitlements.Entitlement
 	SharedSession         *session.Session // TODO: refactor to better session syncing
 	SessionPreInitialized bool             // TODO: refactor to better session syncing
+	// CacheNamespace isolates the build cache from builds in other
+	// namespaces. Only layers pulled in namespaces shared by the worker
+	// are used across namespaces.
+	CacheNamespace string
 }
 
 type ExportEntry struct {
@@ -209,6 +218,7 @@ func (c *Client) solve(ctx context.Context, def *llb.Definition, runGateway runG
 			FrontendInputs: frontendInputs,
 			Cache:          cacheOpt.options,
 			Entitlements:   opt.AllowedEntitlements,
+			CacheNamespace: opt.CacheNamespace,
 		})
 		if err != nil {
 			return errors.Wrap(err, "failed to solve")
@@ -309,6 +319,11 @@ func (c *Client) solve(ctx context.Context, def *llb.Definition, runGateway runG
 				return nil, err
 			}
 		}
+		for indexJSONPath, cs := range cacheOpt.indicesToPrune {
+			if err = ociindex.PruneIndexJSONFileLocked(ctx, cs, indexJSONPath, time.Now().Add(-localCachePruneGracePeriod)); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return res, nil
 }
@@ -367,6 +382,7 @@ type cacheOptions struct {
 	options         controlapi.CacheOptions
 	contentStores   map[string]content.Store // key: ID of content store ("local:" + csDir)
 	indicesToUpdate map[string]string        // key: index.JSON file name, value: tag
+	indicesToPrune  map[string]content.Store // key: index.JSON file name
 	frontendAttrs   map[string]string
 }
 
@@ -380,6 +396,7 @@ func parseCacheOptions(opt SolveOpt) (*cacheOptions, error) {
 	)
 	contentStores := make(map[string]content.Store)
 	indicesToUpdate := make(map[string]string) // key: index.JSON file name, value: tag
+	indicesToPrune := make(map[string]content.Store)
 	frontendAttrs := make(map[string]string)
 	legacyExportAttrs := make(map[string]string)
 	for _, ex := range opt.CacheExports {
@@ -399,6 +416,15 @@ func parseCacheOptions(opt SolveOpt) (*cacheOptions, error) {
 			// TODO(AkihiroSuda): support custom index JSON path and tag
 			indexJSONPath := filepath.Join(csDir, "index.json")
 			indicesToUpdate[indexJSONPath] = "latest"
+			if v, ok := ex.Attrs["prune"]; ok {
+				prune, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid value for local cache exporter prune: %s", v)
+				}
+				if prune {
+					indicesToPrune[indexJSONPath] = cs
+				}
+			}
 		}
 		if ex.Type == "registry" && legacyExportRef == "" {
 			legacyExportRef = ex.Attrs["ref"]
@@ -482,6 +508,7 @@ func parseCacheOptions(opt SolveOpt) (*cacheOptions, error) {
 		},
 		contentStores:   contentStores,
 		indicesToUpdate: indicesToUpdate,
+		indicesToPrune:  indicesToPrune,
 		frontendAttrs:   frontendAttrs,
 	}
 	return &res, nil
@@ -64,6 +64,7 @@ func fromAPIGCPolicy(in []*apitypes.GCPolicy) []PruneInfo {
 			Filter:       p.Filters,
 			KeepDuration: time.Duration(p.KeepDuration),
 			KeepBytes:    p.KeepBytes,
+			MinHits:      int(p.MinHits),
 		})
 	}
 	return out
@@ -101,6 +101,10 @@ var buildCommand = cli.Command{
 			Name:  "ssh",
 			Usage: "Allow forwarding SSH agent to the builder. Format default|<id>[=<socket>|<key>[,<key>]]",
 		},
+		cli.StringFlag{
+			Name:  "cache-namespace",
+			Usage: "Isolate the build cache from builds in other namespaces",
+		},
 	},
 }
 
@@ -214,6 +218,7 @@ func buildAction(clicontext *cli.Context) error {
 		CacheImports:        cacheImports,
 		Session:             attachable,
 		AllowedEntitlements: allowed,
+		CacheNamespace:      clicontext.String("cache-namespace"),
 	}
 
 	solveOpt.FrontendAttrs, err = build.ParseOpt(clicontext.StringSlice("opt"), clicontext.StringSlice("frontend-opt"))
@@ -12,5 +12,7 @@ var debugCommand = cli.Command{
 		debug.DumpLLBCommand,
 		debug.DumpMetadataCommand,
 		debug.WorkersCommand,
+		debug.MigrateSnapshotterCommand,
+		debug.VerifyCacheCommand,
 	},
 }
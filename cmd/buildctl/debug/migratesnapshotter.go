@@ -0,0 +1,31 @@
+package debug
+
+import (
+	"github.com/moby/buildkit/util/appdefaults"
+	"github.com/urfave/cli"
+)
+
+var MigrateSnapshotterCommand = cli.Command{
+	Name:  "migrate-snapshotter",
+	Usage: "move the cache of the OCI worker to another snapshotter.  This command requires the daemon NOT to be running.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "path to state directory",
+			Value: appdefaults.Root,
+		},
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "name of the snapshotter the cache was created with",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "name of the snapshotter to move the cache to",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only report how many records can be migrated",
+		},
+	},
+	Action: migrateSnapshotter,
+}
@@ -0,0 +1,98 @@
+package debug
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshot "github.com/containerd/containerd/snapshots"
+	containerdsnapshot "github.com/moby/buildkit/snapshot/containerd"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// workerState are the files of an OCI worker root that are moved to the
+// root of the new snapshotter
+var workerState = []string{"workerid", "content", "containerdmeta.db", "metadata_v2.db"}
+
+func migrateSnapshotter(clicontext *cli.Context) error {
+	from, to := clicontext.String("from"), clicontext.String("to")
+	if from == "" || to == "" {
+		return errors.New("--from and --to are required")
+	}
+	if from == to {
+		return errors.New("--from and --to are the same snapshotter")
+	}
+	dryRun := clicontext.Bool("dry-run")
+
+	fromRoot := filepath.Join(clicontext.String("root"), "runc-"+from)
+	toRoot := filepath.Join(clicontext.String("root"), "runc-"+to)
+	if _, err := os.Stat(filepath.Join(fromRoot, "metadata_v2.db")); err != nil {
+		return errors.Wrapf(err, "no cache for snapshotter %s", from)
+	}
+	for _, name := range workerState {
+		if _, err := os.Stat(filepath.Join(toRoot, name)); err == nil {
+			return errors.Errorf("%s already exists, the worker for snapshotter %s has been used", filepath.Join(toRoot, name), to)
+		}
+	}
+
+	fromSn, err := newSnapshotter(from, filepath.Join(fromRoot, "snapshots"))
+	if err != nil {
+		return err
+	}
+	snapshotsRoot := filepath.Join(toRoot, "snapshots")
+	if dryRun {
+		// nothing is written to the new snapshotter
+		if snapshotsRoot, err = ioutil.TempDir("", "migrate-snapshotter"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(snapshotsRoot)
+	} else if err := os.MkdirAll(toRoot, 0700); err != nil {
+		return err
+	}
+	toSn, err := newSnapshotter(to, snapshotsRoot)
+	if err != nil {
+		return err
+	}
+
+	ctx := namespaces.WithNamespace(context.TODO(), "buildkit")
+
+	wc, err := openWorkerCache(ctx, fromRoot, from, map[string]ctdsnapshot.Snapshotter{
+		from: fromSn,
+		to:   toSn,
+	})
+	if err != nil {
+		return err
+	}
+
+	stats, err := wc.cm.MigrateSnapshotter(ctx, containerdsnapshot.NewSnapshotter(to, wc.mdb.Snapshotter(to), "buildkit", nil), dryRun)
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	if dryRun {
+		fmt.Printf("%d records can be migrated to %s, %d records can't be migrated\n", stats.Migratable, to, stats.Unmigratable)
+		return wc.Close()
+	}
+
+	// release the old snapshots
+	if _, err := wc.mdb.GarbageCollect(ctx); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+
+	for _, name := range workerState {
+		if err := os.Rename(filepath.Join(fromRoot, name), filepath.Join(toRoot, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.WithStack(err)
+		}
+	}
+	fmt.Printf("migrated %d records to %s, %d records couldn't be migrated and were dropped\n", stats.Migratable, to, stats.Unmigratable)
+	fmt.Printf("%s can be removed\n", fromRoot)
+	return nil
+}
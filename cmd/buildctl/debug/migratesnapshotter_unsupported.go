@@ -0,0 +1,12 @@
+// +build !linux
+
+package debug
+
+import (
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func migrateSnapshotter(clicontext *cli.Context) error {
+	return errors.New("migrate-snapshotter is only supported on linux")
+}
@@ -0,0 +1,28 @@
+package debug
+
+import (
+	"github.com/moby/buildkit/util/appdefaults"
+	"github.com/urfave/cli"
+)
+
+var VerifyCacheCommand = cli.Command{
+	Name:  "verify-cache",
+	Usage: "check the cache of the OCI worker against its snapshotter and content store.  This command requires the daemon NOT to be running.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "path to state directory",
+			Value: appdefaults.Root,
+		},
+		cli.StringFlag{
+			Name:  "snapshotter",
+			Usage: "name of the snapshotter the cache was created with",
+			Value: "overlayfs",
+		},
+		cli.BoolFlag{
+			Name:  "repair",
+			Usage: "repair the inconsistencies that are found",
+		},
+	},
+	Action: verifyCache,
+}
@@ -0,0 +1,49 @@
+package debug
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshot "github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func verifyCache(clicontext *cli.Context) error {
+	name := clicontext.String("snapshotter")
+	root := filepath.Join(clicontext.String("root"), "runc-"+name)
+	if _, err := os.Stat(filepath.Join(root, "metadata_v2.db")); err != nil {
+		return errors.Wrapf(err, "no cache for snapshotter %s", name)
+	}
+	sn, err := newSnapshotter(name, filepath.Join(root, "snapshots"))
+	if err != nil {
+		return err
+	}
+
+	ctx := namespaces.WithNamespace(context.TODO(), "buildkit")
+
+	wc, err := openWorkerCache(ctx, root, name, map[string]ctdsnapshot.Snapshotter{
+		name: sn,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := wc.cm.Verify(ctx, clicontext.Bool("repair"))
+	if err != nil {
+		wc.Close()
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "ID\tREPAIRED\tPROBLEM")
+	for _, r := range res {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", r.ID, r.Repaired, r.Problem)
+	}
+	tw.Flush()
+	return wc.Close()
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package debug
+
+import (
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func verifyCache(clicontext *cli.Context) error {
+	return errors.New("verify-cache is only supported on linux")
+}
@@ -0,0 +1,90 @@
+package debug
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/diff/apply"
+	"github.com/containerd/containerd/diff/walking"
+	ctdmetadata "github.com/containerd/containerd/metadata"
+	ctdsnapshot "github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/native"
+	"github.com/containerd/containerd/snapshots/overlay"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/metadata"
+	containerdsnapshot "github.com/moby/buildkit/snapshot/containerd"
+	"github.com/moby/buildkit/util/leaseutil"
+	"github.com/moby/buildkit/util/winlayers"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// workerCache is the cache of an OCI worker opened without the daemon.
+type workerCache struct {
+	db  *bolt.DB
+	mdb *ctdmetadata.DB
+	cm  cache.Manager
+}
+
+// openWorkerCache opens the cache of the OCI worker state in root created
+// with the snapshotter name. Additional snapshotters are registered in the
+// containerd metadata so that snapshots can be moved to them.
+func openWorkerCache(ctx context.Context, root, name string, snapshotters map[string]ctdsnapshot.Snapshotter) (*workerCache, error) {
+	cs, err := local.NewStore(filepath.Join(root, "content"))
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(root, "containerdmeta.db"), 0644, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	mdb := ctdmetadata.NewDB(db, cs, snapshotters)
+	if err := mdb.Init(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := containerdsnapshot.NewContentStore(mdb.ContentStore(), "buildkit")
+
+	md, err := metadata.NewStore(filepath.Join(root, "metadata_v2.db"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	cm, err := cache.NewManager(cache.ManagerOpt{
+		Snapshotter:    containerdsnapshot.NewSnapshotter(name, mdb.Snapshotter(name), "buildkit", nil),
+		MetadataStore:  md,
+		ContentStore:   c,
+		LeaseManager:   leaseutil.WithNamespace(ctdmetadata.NewLeaseManager(mdb), "buildkit"),
+		GarbageCollect: mdb.GarbageCollect,
+		Applier:        winlayers.NewFileSystemApplierWithWindows(c, apply.NewFileSystemApplier(c)),
+		Differ:         winlayers.NewWalkingDiffWithWindows(c, walking.NewWalkingDiff(c)),
+	})
+	if err != nil {
+		md.Close()
+		db.Close()
+		return nil, err
+	}
+	return &workerCache{db: db, mdb: mdb, cm: cm}, nil
+}
+
+// Close closes the cache manager and the containerd metadata.
+func (wc *workerCache) Close() error {
+	err := wc.cm.Close()
+	if err1 := wc.db.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func newSnapshotter(name, root string) (ctdsnapshot.Snapshotter, error) {
+	switch name {
+	case "native":
+		return native.NewSnapshotter(root)
+	case "overlayfs":
+		return overlay.NewSnapshotter(root)
+	default:
+		return nil, errors.Errorf("snapshotter %q is not supported", name)
+	}
+}
@@ -73,6 +73,9 @@ func printWorkersVerbose(tw *tabwriter.Writer, winfo []*client.WorkerInfo) {
 			if rule.KeepBytes > 0 {
 				fmt.Fprintf(tw, "\tKeep Bytes:\t%g\n", units.Bytes(rule.KeepBytes))
 			}
+			if rule.MinHits > 0 {
+				fmt.Fprintf(tw, "\tMin Hits:\t%d\n", rule.MinHits)
+			}
 		}
 		fmt.Fprintf(tw, "\n")
 	}
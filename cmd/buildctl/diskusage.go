@@ -19,7 +19,7 @@ var diskUsageCommand = cli.Command{
 	Flags: []cli.Flag{
 		cli.StringSliceFlag{
 			Name:  "filter, f",
-			Usage: "Filter records",
+			Usage: "Filter records, e.g. \"type==exec.cachemount && unused>72h\"",
 		},
 		cli.BoolFlag{
 			Name:  "verbose, v",
@@ -66,19 +66,39 @@ func printVerbose(tw *tabwriter.Writer, du []*client.UsageInfo) {
 		}
 		printKV(tw, "Created at", di.CreatedAt)
 		printKV(tw, "Mutable", di.Mutable)
-		printKV(tw, "Reclaimable", !di.InUse)
+		printKV(tw, "Reclaimable", !di.InUse && !di.Pinned)
 		printKV(tw, "Shared", di.Shared)
+		if di.Pinned {
+			printKV(tw, "Pinned", di.Pinned)
+			if di.PinReason != "" {
+				printKV(tw, "Pin reason", di.PinReason)
+			}
+		}
 		printKV(tw, "Size", fmt.Sprintf("%.2f", units.Bytes(di.Size)))
 		if di.Description != "" {
 			printKV(tw, "Description", di.Description)
 		}
 		printKV(tw, "Usage count", di.UsageCount)
+		printKV(tw, "Usage score", fmt.Sprintf("%.2f", di.UsageScore))
 		if di.LastUsedAt != nil {
 			printKV(tw, "Last used", di.LastUsedAt)
 		}
 		if di.RecordType != "" {
 			printKV(tw, "Type", di.RecordType)
 		}
+		if di.BuildID != "" {
+			printKV(tw, "Build", di.BuildID)
+		}
+		if di.Namespace != "" {
+			printKV(tw, "Namespace", di.Namespace)
+		}
+		if di.Blob != "" {
+			printKV(tw, "Chain ID", di.ChainID)
+			printKV(tw, "Blob", di.Blob)
+			printKV(tw, "Media type", di.MediaType)
+			printKV(tw, "Lazy", di.Lazy)
+			printKV(tw, "Blob size", fmt.Sprintf("%.2f", units.Bytes(di.BlobSize)))
+		}
 
 		fmt.Fprintf(tw, "\n")
 	}
@@ -109,7 +129,10 @@ func printTableRow(tw *tabwriter.Writer, di *client.UsageInfo) {
 	if di.Shared {
 		size += "*"
 	}
-	fmt.Fprintf(tw, "%-71s\t%-11v\t%s\t\n", id, !di.InUse, size)
+	if di.Lazy {
+		size += " (lazy)"
+	}
+	fmt.Fprintf(tw, "%-71s\t%-11v\t%s\t\n", id, !di.InUse && !di.Pinned, size)
 }
 
 func printSummary(tw *tabwriter.Writer, du []*client.UsageInfo) {
@@ -120,7 +143,7 @@ func printSummary(tw *tabwriter.Writer, du []*client.UsageInfo) {
 	for _, di := range du {
 		if di.Size > 0 {
 			total += di.Size
-			if !di.InUse {
+			if !di.InUse && !di.Pinned {
 				reclaimable += di.Size
 			}
 		}
@@ -24,14 +24,26 @@ var pruneCommand = cli.Command{
 			Name:  "keep-storage",
 			Usage: "Keep data below this limit (in MB)",
 		},
+		cli.IntFlag{
+			Name:  "min-hits",
+			Usage: "Keep data used at least this many times in the last week",
+		},
+		cli.Float64Flag{
+			Name:  "max-freed",
+			Usage: "Stop after freeing this much data (in MB)",
+		},
 		cli.StringSliceFlag{
 			Name:  "filter, f",
-			Usage: "Filter records",
+			Usage: "Filter records, e.g. \"type==exec.cachemount && unused>72h\"",
 		},
 		cli.BoolFlag{
 			Name:  "all",
 			Usage: "Include internal/frontend references",
 		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Include pinned references",
+		},
 		cli.BoolFlag{
 			Name:  "verbose, v",
 			Usage: "Verbose output",
@@ -72,11 +84,16 @@ func prune(clicontext *cli.Context) error {
 	opts := []client.PruneOption{
 		client.WithFilter(clicontext.StringSlice("filter")),
 		client.WithKeepOpt(clicontext.Duration("keep-duration"), int64(clicontext.Float64("keep-storage")*1e6)),
+		client.WithMinHits(clicontext.Int("min-hits")),
+		client.WithMaxFreed(int64(clicontext.Float64("max-freed") * 1e6)),
 	}
 
 	if clicontext.Bool("all") {
 		opts = append(opts, client.PruneAll)
 	}
+	if clicontext.Bool("force") {
+		opts = append(opts, client.PruneForce)
+	}
 
 	err = c.Prune(bccommon.CommandContext(clicontext), ch, opts...)
 	close(ch)
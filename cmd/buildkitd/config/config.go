@@ -6,6 +6,11 @@ import "github.com/BurntSushi/toml"
 type Config struct {
 	Debug bool `toml:"debug"`
 
+	// LockWatchdogTimeout logs the stacks of the holder and the waiters of
+	// cache record locks that are held for longer than the given number of
+	// seconds. 0 disables the watchdog.
+	LockWatchdogTimeout int64 `toml:"lockWatchdogTimeout"`
+
 	// Root is the path to a directory where buildkit will store persistent data
 	Root string `toml:"root"`
 
@@ -61,6 +66,21 @@ type GCConfig struct {
 	GCPolicy      []GCPolicy `toml:"gcpolicy"`
 }
 
+// RetryConfig configures how failed registry requests for layers and
+// manifests are retried. Zero values use the defaults.
+type RetryConfig struct {
+	// RetryMaxAttempts is the number of attempts including the first one.
+	RetryMaxAttempts int `toml:"retryMaxAttempts"`
+	// RetryInitialBackoff is the wait in milliseconds before the first
+	// retry. It doubles on every retry.
+	RetryInitialBackoff int64 `toml:"retryInitialBackoff"`
+	// RetryMaxBackoff caps the wait in milliseconds between two attempts.
+	RetryMaxBackoff int64 `toml:"retryMaxBackoff"`
+	// RetryOn4xx retries client errors such as 429 Too Many Requests.
+	// Unauthorized, forbidden and not found responses are never retried.
+	RetryOn4xx bool `toml:"retryOn4xx"`
+}
+
 type NetworkConfig struct {
 	Mode          string `toml:"networkMode"`
 	CNIConfigPath string `toml:"cniConfigPath"`
@@ -76,6 +96,7 @@ type OCIConfig struct {
 	NoProcessSandbox bool              `toml:"noProcessSandbox"`
 	GCConfig
 	NetworkConfig
+	RetryConfig
 	// UserRemapUnsupported is unsupported key for testing. The feature is
 	// incomplete and the intention is to make it default without config.
 	UserRemapUnsupported string `toml:"userRemapUnsupported"`
@@ -91,6 +112,65 @@ type OCIConfig struct {
 	// ApparmorProfile is the name of the apparmor profile that should be used to constrain build containers.
 	// The profile should already be loaded (by a higher level system) before creating a worker.
 	ApparmorProfile string `toml:"apparmor-profile"`
+
+	// SkipLayerVerification disables checking that layer data matches the
+	// compression of the layer media type before extracting it.
+	SkipLayerVerification bool `toml:"skipLayerVerification"`
+
+	// VerifyCacheOnStartup checks cache records against the snapshotter and
+	// content store in the background when the worker starts and repairs
+	// inconsistencies.
+	VerifyCacheOnStartup bool `toml:"verifyCacheOnStartup"`
+
+	// EagerUnlazy fetches all lazily pulled layers of a result when it is
+	// exported instead of fetching them on demand.
+	EagerUnlazy bool `toml:"eagerUnlazy"`
+
+	// LazyRecordTTL is the time in seconds after their last use after which
+	// lazy cache records whose layers were never fetched are removed on
+	// garbage collection.
+	// 0 keeps them until a gc policy removes them.
+	LazyRecordTTL int64 `toml:"lazyRecordTTL"`
+
+	// DiskQuota is the limit in bytes for the size of the cache plus the
+	// space reserved by running builds. Exec ops that would exceed it fail
+	// with a quota error. 0 disables it.
+	DiskQuota int64 `toml:"diskQuota"`
+
+	// ReservationSize is the space in bytes reserved for each exec mount
+	// until its snapshot grows larger.
+	ReservationSize int64 `toml:"reservationSize"`
+
+	// DiffPlans records the entries of layer diffs so that blobs that have
+	// to be created again, e.g. after they were pruned, are written from the
+	// recorded entries if the files didn't change. Linux only.
+	DiffPlans bool `toml:"diffPlans"`
+
+	// MetadataCompactThreshold is the size in bytes of the free space in
+	// the cache metadata database after which it is compacted following a
+	// prune. 0 disables compaction.
+	MetadataCompactThreshold int64 `toml:"metadataCompactThreshold"`
+
+	// SharedCacheNamespaces are the cache namespaces whose pulled layers
+	// are used by builds in all namespaces. An empty string shares the
+	// layers pulled by builds without a namespace.
+	SharedCacheNamespaces []string `toml:"sharedCacheNamespaces"`
+
+	// NoSpaceReclaimSize is the size in bytes of unused cache that is pruned
+	// when creating a layer blob fails because the disk is full, before
+	// the blob is created again. 0 disables it.
+	NoSpaceReclaimSize int64 `toml:"noSpaceReclaimSize"`
+
+	// MaxParallelConversions limits the number of layers that are converted
+	// to another compression at the same time, e.g. for force-compression.
+	// 0 doesn't limit them.
+	MaxParallelConversions int `toml:"maxParallelConversions"`
+
+	// KeepUncompressedDiff keeps the uncompressed diff of new layers in the
+	// content store with their cache record. Converting the layers to other
+	// compressions starts from it instead of decompressing them, at the
+	// cost of the disk space of the diff.
+	KeepUncompressedDiff bool `toml:"keepUncompressedDiff"`
 }
 
 type ContainerdConfig struct {
@@ -101,11 +181,71 @@ type ContainerdConfig struct {
 	Namespace string            `toml:"namespace"`
 	GCConfig
 	NetworkConfig
+	RetryConfig
 	Snapshotter string `toml:"snapshotter"`
 
 	// ApparmorProfile is the name of the apparmor profile that should be used to constrain build containers.
 	// The profile should already be loaded (by a higher level system) before creating a worker.
 	ApparmorProfile string `toml:"apparmor-profile"`
+
+	// SkipLayerVerification disables checking that layer data matches the
+	// compression of the layer media type before extracting it.
+	SkipLayerVerification bool `toml:"skipLayerVerification"`
+
+	// VerifyCacheOnStartup checks cache records against the snapshotter and
+	// content store in the background when the worker starts and repairs
+	// inconsistencies.
+	VerifyCacheOnStartup bool `toml:"verifyCacheOnStartup"`
+
+	// EagerUnlazy fetches all lazily pulled layers of a result when it is
+	// exported instead of fetching them on demand.
+	EagerUnlazy bool `toml:"eagerUnlazy"`
+
+	// LazyRecordTTL is the time in seconds after their last use after which
+	// lazy cache records whose layers were never fetched are removed on
+	// garbage collection.
+	// 0 keeps them until a gc policy removes them.
+	LazyRecordTTL int64 `toml:"lazyRecordTTL"`
+
+	// DiskQuota is the limit in bytes for the size of the cache plus the
+	// space reserved by running builds. Exec ops that would exceed it fail
+	// with a quota error. 0 disables it.
+	DiskQuota int64 `toml:"diskQuota"`
+
+	// ReservationSize is the space in bytes reserved for each exec mount
+	// until its snapshot grows larger.
+	ReservationSize int64 `toml:"reservationSize"`
+
+	// DiffPlans records the entries of layer diffs so that blobs that have
+	// to be created again, e.g. after they were pruned, are written from the
+	// recorded entries if the files didn't change. Linux only.
+	DiffPlans bool `toml:"diffPlans"`
+
+	// MetadataCompactThreshold is the size in bytes of the free space in
+	// the cache metadata database after which it is compacted following a
+	// prune. 0 disables compaction.
+	MetadataCompactThreshold int64 `toml:"metadataCompactThreshold"`
+
+	// SharedCacheNamespaces are the cache namespaces whose pulled layers
+	// are used by builds in all namespaces. An empty string shares the
+	// layers pulled by builds without a namespace.
+	SharedCacheNamespaces []string `toml:"sharedCacheNamespaces"`
+
+	// NoSpaceReclaimSize is the size in bytes of unused cache that is pruned
+	// when creating a layer blob fails because the disk is full, before
+	// the blob is created again. 0 disables it.
+	NoSpaceReclaimSize int64 `toml:"noSpaceReclaimSize"`
+
+	// MaxParallelConversions limits the number of layers that are converted
+	// to another compression at the same time, e.g. for force-compression.
+	// 0 doesn't limit them.
+	MaxParallelConversions int `toml:"maxParallelConversions"`
+
+	// KeepUncompressedDiff keeps the uncompressed diff of new layers in the
+	// content store with their cache record. Converting the layers to other
+	// compressions starts from it instead of decompressing them, at the
+	// cost of the disk space of the diff.
+	KeepUncompressedDiff bool `toml:"keepUncompressedDiff"`
 }
 
 type GCPolicy struct {
@@ -113,6 +253,7 @@ type GCPolicy struct {
 	KeepBytes    int64    `toml:"keepBytes"`
 	KeepDuration int64    `toml:"keepDuration"`
 	Filters      []string `toml:"filters"`
+	MinHits      int      `toml:"minHits"`
 }
 
 type DNSConfig struct {
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"expvar"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"runtime"
+	"time"
 
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/control"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/trace"
 )
 
-func setupDebugHandlers(addr string) error {
+func setupDebugHandlers(addr string) (*http.ServeMux, error) {
 	m := http.NewServeMux()
 	m.Handle("/debug/vars", expvar.Handler())
 	m.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
@@ -22,6 +27,50 @@ func setupDebugHandlers(addr string) error {
 	m.Handle("/debug/requests", http.HandlerFunc(trace.Traces))
 	m.Handle("/debug/events", http.HandlerFunc(trace.Events))
 
+	m.Handle("/debug/cache/locks", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var threshold time.Duration
+		if v := req.URL.Query().Get("threshold"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			threshold = d
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(cache.HeldLocks(threshold)); err != nil {
+			logrus.Errorf("failed to write cache locks: %v", err)
+		}
+	}))
+
+	// POST compacts the stores before reporting their size
+	m.Handle("/debug/cache/metadata", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var stats []metadata.Stats
+		for _, s := range metadata.OpenStores() {
+			if req.Method == http.MethodPost {
+				if err := s.Compact(); err != nil {
+					http.Error(rw, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				logrus.Debugf("compacted %s from debug endpoint", s.Path())
+			}
+			st, err := s.Stats()
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			stats = append(stats, st)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			logrus.Errorf("failed to write metadata stats: %v", err)
+		}
+	}))
+
 	m.Handle("/debug/gc", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		runtime.GC()
 		logrus.Debugf("triggered GC from debug endpoint")
@@ -34,9 +83,33 @@ func setupDebugHandlers(addr string) error {
 
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logrus.Debugf("debug handlers listening at %s", addr)
 	go http.Serve(l, m)
-	return nil
+	return m, nil
+}
+
+// setupCacheStateHandler adds the handler exporting the cache state of the
+// default worker with its cache keys. A GET writes the records matching the
+// filter parameters, a POST imports a state written by a GET.
+func setupCacheStateHandler(m *http.ServeMux, c *control.Controller) {
+	m.Handle("/debug/cache/state", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			rw.Header().Set("Content-Type", "application/x-tar")
+			if err := c.ExportCacheState(req.Context(), rw, req.URL.Query()["filter"]...); err != nil {
+				logrus.Errorf("failed to export cache state: %v", err)
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+			}
+		case http.MethodPost:
+			if err := c.ImportCacheState(req.Context(), req.Body); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logrus.Debugf("imported cache state from debug endpoint")
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
 }
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -26,7 +27,9 @@ import (
 	"github.com/gofrs/flock"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/cache/remotecache"
+	httpremotecache "github.com/moby/buildkit/cache/remotecache/httpcache"
 	inlineremotecache "github.com/moby/buildkit/cache/remotecache/inline"
 	localremotecache "github.com/moby/buildkit/cache/remotecache/local"
 	registryremotecache "github.com/moby/buildkit/cache/remotecache/registry"
@@ -47,6 +50,7 @@ import (
 	"github.com/moby/buildkit/util/grpcerrors"
 	"github.com/moby/buildkit/util/profiler"
 	"github.com/moby/buildkit/util/resolver"
+	"github.com/moby/buildkit/util/resolver/retryhandler"
 	"github.com/moby/buildkit/util/stack"
 	"github.com/moby/buildkit/version"
 	"github.com/moby/buildkit/worker"
@@ -201,11 +205,16 @@ func main() {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
 
+		var debugMux *http.ServeMux
 		if cfg.GRPC.DebugAddress != "" {
-			if err := setupDebugHandlers(cfg.GRPC.DebugAddress); err != nil {
+			if debugMux, err = setupDebugHandlers(cfg.GRPC.DebugAddress); err != nil {
 				return err
 			}
 		}
+
+		if cfg.LockWatchdogTimeout > 0 {
+			cache.StartLockWatchdog(ctx, time.Duration(cfg.LockWatchdogTimeout)*time.Second)
+		}
 		unary := grpc_middleware.ChainUnaryServer(unaryInterceptor(ctx), grpcerrors.UnaryServerInterceptor)
 		stream := grpc_middleware.ChainStreamServer(otgrpc.OpenTracingStreamServerInterceptor(tracer), grpcerrors.StreamServerInterceptor)
 
@@ -241,6 +250,9 @@ func main() {
 		if err != nil {
 			return err
 		}
+		if debugMux != nil {
+			setupCacheStateHandler(debugMux, controller)
+		}
 
 		controller.Register(server)
 
@@ -613,13 +625,14 @@ func newController(c *cli.Context, cfg *config.Config, md *toml.MetaData) (*cont
 	}
 
 	remoteCacheExporterFuncs := map[string]remotecache.ResolveCacheExporterFunc{
-		"registry": registryremotecache.ResolveCacheExporterFunc(sessionManager, resolverFn),
+		"registry": registryremotecache.ResolveCacheExporterFunc(sessionManager, w.ContentStore(), resolverFn),
 		"local":    localremotecache.ResolveCacheExporterFunc(sessionManager),
 		"inline":   inlineremotecache.ResolveCacheExporterFunc(),
 	}
 	remoteCacheImporterFuncs := map[string]remotecache.ResolveCacheImporterFunc{
 		"registry": registryremotecache.ResolveCacheImporterFunc(sessionManager, w.ContentStore(), resolverFn),
 		"local":    localremotecache.ResolveCacheImporterFunc(sessionManager),
+		"http":     httpremotecache.ResolveCacheImporterFunc(),
 	}
 	return control.NewController(control.Opt{
 		SessionManager:            sessionManager,
@@ -698,6 +711,15 @@ func parsePlatforms(platformsStr []string) ([]specs.Platform, error) {
 	return out, nil
 }
 
+func getRetryPolicy(cfg config.RetryConfig) retryhandler.Policy {
+	return retryhandler.Policy{
+		MaxAttempts:    cfg.RetryMaxAttempts,
+		InitialBackoff: time.Duration(cfg.RetryInitialBackoff) * time.Millisecond,
+		MaxBackoff:     time.Duration(cfg.RetryMaxBackoff) * time.Millisecond,
+		RetryOn4xx:     cfg.RetryOn4xx,
+	}
+}
+
 func getGCPolicy(cfg config.GCConfig, root string) []client.PruneInfo {
 	if cfg.GC != nil && !*cfg.GC {
 		return nil
@@ -712,11 +734,28 @@ func getGCPolicy(cfg config.GCConfig, root string) []client.PruneInfo {
 			All:          rule.All,
 			KeepBytes:    rule.KeepBytes,
 			KeepDuration: time.Duration(rule.KeepDuration) * time.Second,
+			MinHits:      rule.MinHits,
 		})
 	}
 	return out
 }
 
+// verifyCache checks the cache records of a worker and repairs them. It is
+// run in the background so that it doesn't delay the startup of the daemon.
+func verifyCache(ctx context.Context, w worker.Worker) {
+	res, err := w.CacheManager().Verify(ctx, true)
+	for _, r := range res {
+		if r.Repaired {
+			logrus.Warnf("repaired cache record %s: %s", r.ID, r.Problem)
+		} else {
+			logrus.Warnf("cache record %s: %s", r.ID, r.Problem)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("failed to verify cache for worker %s: %+v", w.ID(), err)
+	}
+}
+
 func getDNSConfig(cfg *config.DNSConfig) *oci.DNSConfig {
 	var dns *oci.DNSConfig
 	if cfg != nil {
@@ -10,6 +10,7 @@ import (
 
 	ctd "github.com/containerd/containerd"
 	"github.com/moby/buildkit/cmd/buildkitd/config"
+	"github.com/moby/buildkit/util/appcontext"
 	"github.com/moby/buildkit/util/network/cniprovider"
 	"github.com/moby/buildkit/util/network/netproviders"
 	"github.com/moby/buildkit/worker"
@@ -234,6 +235,18 @@ func containerdWorkerInitializer(c *cli.Context, common workerInitializerOpt) ([
 		return nil, err
 	}
 	opt.GCPolicy = getGCPolicy(cfg.GCConfig, common.config.Root)
+	opt.RetryPolicy = getRetryPolicy(cfg.RetryConfig)
+	opt.SkipLayerVerification = cfg.SkipLayerVerification
+	opt.EagerUnlazy = cfg.EagerUnlazy
+	opt.LazyRecordTTL = time.Duration(cfg.LazyRecordTTL) * time.Second
+	opt.DiskQuota = cfg.DiskQuota
+	opt.ReservationSize = cfg.ReservationSize
+	opt.DiffPlans = cfg.DiffPlans
+	opt.MetadataCompactThreshold = cfg.MetadataCompactThreshold
+	opt.SharedCacheNamespaces = cfg.SharedCacheNamespaces
+	opt.NoSpaceReclaimSize = cfg.NoSpaceReclaimSize
+	opt.MaxParallelConversions = cfg.MaxParallelConversions
+	opt.KeepUncompressedDiff = cfg.KeepUncompressedDiff
 	opt.RegistryHosts = resolverFunc(common.config)
 
 	if platformsStr := cfg.Platforms; len(platformsStr) != 0 {
@@ -247,6 +260,9 @@ func containerdWorkerInitializer(c *cli.Context, common workerInitializerOpt) ([
 	if err != nil {
 		return nil, err
 	}
+	if cfg.VerifyCacheOnStartup {
+		go verifyCache(appcontext.Context(), w)
+	}
 	return []worker.Worker{w}, nil
 }
 
@@ -28,6 +28,7 @@ import (
 	remotesn "github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/moby/buildkit/cmd/buildkitd/config"
 	"github.com/moby/buildkit/executor/oci"
+	"github.com/moby/buildkit/util/appcontext"
 	"github.com/moby/buildkit/util/network/cniprovider"
 	"github.com/moby/buildkit/util/network/netproviders"
 	"github.com/moby/buildkit/worker"
@@ -281,6 +282,18 @@ func ociWorkerInitializer(c *cli.Context, common workerInitializerOpt) ([]worker
 		return nil, err
 	}
 	opt.GCPolicy = getGCPolicy(cfg.GCConfig, common.config.Root)
+	opt.RetryPolicy = getRetryPolicy(cfg.RetryConfig)
+	opt.SkipLayerVerification = cfg.SkipLayerVerification
+	opt.EagerUnlazy = cfg.EagerUnlazy
+	opt.LazyRecordTTL = time.Duration(cfg.LazyRecordTTL) * time.Second
+	opt.DiskQuota = cfg.DiskQuota
+	opt.ReservationSize = cfg.ReservationSize
+	opt.DiffPlans = cfg.DiffPlans
+	opt.MetadataCompactThreshold = cfg.MetadataCompactThreshold
+	opt.SharedCacheNamespaces = cfg.SharedCacheNamespaces
+	opt.NoSpaceReclaimSize = cfg.NoSpaceReclaimSize
+	opt.MaxParallelConversions = cfg.MaxParallelConversions
+	opt.KeepUncompressedDiff = cfg.KeepUncompressedDiff
 	opt.RegistryHosts = hosts
 
 	if platformsStr := cfg.Platforms; len(platformsStr) != 0 {
@@ -294,6 +307,9 @@ func ociWorkerInitializer(c *cli.Context, common workerInitializerOpt) ([]worker
 	if err != nil {
 		return nil, err
 	}
+	if cfg.VerifyCacheOnStartup {
+		go verifyCache(appcontext.Context(), w)
+	}
 	return []worker.Worker{w}, nil
 }
 
@@ -0,0 +1,214 @@
+package control
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/solver"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cacheStateRecordsName = "records.tar"
+	cacheStateKeysName    = "keys.json"
+)
+
+// cacheStateKey is a solver cache key of an exported cache state. Results
+// point to records by their ID in the state of the worker.
+type cacheStateKey struct {
+	ID      string
+	Results []cacheStateResult `json:",omitempty"`
+	Links   []cacheStateLink   `json:",omitempty"`
+}
+
+type cacheStateResult struct {
+	Record    string
+	CreatedAt time.Time
+}
+
+type cacheStateLink struct {
+	Link   solver.CacheInfoLink
+	Target string
+}
+
+// ExportCacheState writes the cache records of the default worker matching
+// the prune filters together with the solver cache keys that resolve to
+// them. The keys are exported with all the keys they are linked from, so a
+// build on the worker that imports the state gets cache hits for the same
+// vertexes without running them.
+func (c *Controller) ExportCacheState(ctx context.Context, w io.Writer, filters ...string) error {
+	wk, err := c.opt.WorkerController.GetDefault()
+	if err != nil {
+		return err
+	}
+
+	records := &bytes.Buffer{}
+	ids, err := wk.CacheManager().ExportState(ctx, records, filters...)
+	if err != nil {
+		return err
+	}
+	exported := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		exported[id] = struct{}{}
+	}
+
+	keys, err := exportCacheKeys(c.opt.CacheKeyStorage, wk.ID(), exported)
+	if err != nil {
+		return err
+	}
+	dt, err := json.Marshal(keys)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, e := range []struct {
+		name string
+		dt   []byte
+	}{
+		{cacheStateRecordsName, records.Bytes()},
+		{cacheStateKeysName, dt},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Mode:     0644,
+			Size:     int64(len(e.dt)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := tw.Write(e.dt); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(tw.Close())
+}
+
+// exportCacheKeys returns the keys with results on the exported records of
+// the worker and all the keys linking to them, sorted by ID.
+func exportCacheKeys(s solver.CacheKeyStorage, workerID string, exported map[string]struct{}) ([]cacheStateKey, error) {
+	lw, ok := s.(solver.CacheLinkWalker)
+	if !ok {
+		return nil, errors.Errorf("cache key storage %T can't export links", s)
+	}
+
+	keys := map[string]*cacheStateKey{}
+	var queue []string
+	if err := s.Walk(func(id string) error {
+		return s.WalkResults(id, func(res solver.CacheResult) error {
+			if !strings.HasPrefix(res.ID, workerID+"::") {
+				return nil
+			}
+			recordID := strings.TrimPrefix(res.ID, workerID+"::")
+			if _, ok := exported[recordID]; !ok {
+				return nil
+			}
+			k, ok := keys[id]
+			if !ok {
+				k = &cacheStateKey{ID: id}
+				keys[id] = k
+				queue = append(queue, id)
+			}
+			k.Results = append(k.Results, cacheStateResult{Record: recordID, CreatedAt: res.CreatedAt})
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	for len(queue) > 0 {
+		target := queue[0]
+		queue = queue[1:]
+		if err := lw.WalkLinksTo(target, func(id string, link solver.CacheInfoLink) error {
+			k, ok := keys[id]
+			if !ok {
+				k = &cacheStateKey{ID: id}
+				keys[id] = k
+				queue = append(queue, id)
+			}
+			k.Links = append(k.Links, cacheStateLink{Link: link, Target: target})
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]cacheStateKey, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, *k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// ImportCacheState restores a state written by ExportCacheState on the
+// default worker. The records are imported as lazy records and the cache
+// keys are added with results pointing to them. Results of records that
+// couldn't be imported are skipped.
+func (c *Controller) ImportCacheState(ctx context.Context, r io.Reader) error {
+	wk, err := c.opt.WorkerController.GetDefault()
+	if err != nil {
+		return err
+	}
+
+	var ids map[string]string
+	var keys []cacheStateKey
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read cache state")
+		}
+		switch hdr.Name {
+		case cacheStateRecordsName:
+			ids, err = wk.CacheManager().ImportState(ctx, tr)
+			if err != nil {
+				return err
+			}
+		case cacheStateKeysName:
+			if err := json.NewDecoder(tr).Decode(&keys); err != nil {
+				return errors.Wrap(err, "failed to decode cache state keys")
+			}
+		}
+	}
+	if ids == nil {
+		return errors.Errorf("invalid cache state: missing %s", cacheStateRecordsName)
+	}
+
+	return importCacheKeys(c.opt.CacheKeyStorage, wk.ID(), keys, ids)
+}
+
+// importCacheKeys adds keys to s with their results pointing to the records
+// of the worker the state records were imported as.
+func importCacheKeys(s solver.CacheKeyStorage, workerID string, keys []cacheStateKey, ids map[string]string) error {
+	for _, k := range keys {
+		for _, res := range k.Results {
+			id, ok := ids[res.Record]
+			if !ok {
+				logrus.Debugf("skipping result of cache key %s: record %s was not imported", k.ID, res.Record)
+				continue
+			}
+			if err := s.AddResult(k.ID, solver.CacheResult{ID: workerID + "::" + id, CreatedAt: res.CreatedAt}); err != nil {
+				return err
+			}
+		}
+		for _, l := range k.Links {
+			if err := s.AddLink(k.ID, l.Link, l.Target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package control
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/solver"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheStateKeys(t *testing.T) {
+	t.Parallel()
+	now := time.Now().UTC()
+
+	// base -> exec -> copy, with another chain on a record that isn't
+	// exported and a result of another worker
+	s := solver.NewInMemoryCacheStorage()
+	link := func(dgst string) solver.CacheInfoLink {
+		return solver.CacheInfoLink{Digest: digest.FromString(dgst)}
+	}
+	require.NoError(t, s.AddResult("base", solver.CacheResult{ID: "w1::rec1", CreatedAt: now}))
+	require.NoError(t, s.AddLink("base", link("exec"), "exec"))
+	require.NoError(t, s.AddResult("exec", solver.CacheResult{ID: "w1::rec2", CreatedAt: now}))
+	require.NoError(t, s.AddLink("exec", link("copy"), "copy"))
+	require.NoError(t, s.AddResult("copy", solver.CacheResult{ID: "w1::rec3", CreatedAt: now}))
+	require.NoError(t, s.AddResult("copy", solver.CacheResult{ID: "w2::rec3", CreatedAt: now}))
+	require.NoError(t, s.AddResult("other", solver.CacheResult{ID: "w1::rec4", CreatedAt: now}))
+
+	keys, err := exportCacheKeys(s, "w1", map[string]struct{}{"rec2": {}, "rec3": {}})
+	require.NoError(t, err)
+	require.Equal(t, []cacheStateKey{
+		{ID: "base", Links: []cacheStateLink{{Link: link("exec"), Target: "exec"}}},
+		{ID: "copy", Results: []cacheStateResult{{Record: "rec3", CreatedAt: now}}},
+		{
+			ID:      "exec",
+			Results: []cacheStateResult{{Record: "rec2", CreatedAt: now}},
+			Links:   []cacheStateLink{{Link: link("copy"), Target: "copy"}},
+		},
+	}, keys)
+
+	// results of records that weren't imported are skipped
+	s2 := solver.NewInMemoryCacheStorage()
+	err = importCacheKeys(s2, "w3", keys, map[string]string{"rec3": "new3"})
+	require.NoError(t, err)
+
+	res, err := s2.Load("copy", "w3::new3")
+	require.NoError(t, err)
+	require.Equal(t, now, res.CreatedAt)
+	err = s2.WalkResults("exec", func(res solver.CacheResult) error {
+		return errors.Errorf("unexpected result %s", res.ID)
+	})
+	require.NoError(t, err)
+	require.True(t, s2.HasLink("base", link("exec"), "exec"))
+	require.True(t, s2.HasLink("exec", link("copy"), "copy"))
+}
@@ -2,6 +2,7 @@ package control
 
 import (
 	"context"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -50,9 +51,24 @@ type Controller struct { // TODO: ControlService
 func NewController(opt Opt) (*Controller, error) {
 	cache := solver.NewCacheManager("local", opt.CacheKeyStorage, worker.NewCacheResultStorage(opt.WorkerController))
 
+	// the caches of namespaces share the cache keys with the default cache
+	// but only load the results of their namespace
+	var mu sync.Mutex
+	namespaceCaches := map[string]solver.CacheManager{}
+	namespaceCache := func(ns string) solver.CacheManager {
+		mu.Lock()
+		defer mu.Unlock()
+		cm, ok := namespaceCaches[ns]
+		if !ok {
+			cm = solver.NewCacheManager("local", opt.CacheKeyStorage, worker.NewNamespaceCacheResultStorage(opt.WorkerController, ns))
+			namespaceCaches[ns] = cm
+		}
+		return cm
+	}
+
 	gatewayForwarder := controlgateway.NewGatewayForwarder()
 
-	solver, err := llbsolver.New(opt.WorkerController, opt.Frontends, cache, opt.ResolveCacheImporterFuncs, gatewayForwarder, opt.SessionManager, opt.Entitlements)
+	solver, err := llbsolver.New(opt.WorkerController, opt.Frontends, cache, namespaceCache, opt.ResolveCacheImporterFuncs, gatewayForwarder, opt.SessionManager, opt.Entitlements)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create solver")
 	}
@@ -101,11 +117,21 @@ func (c *Controller) DiskUsage(ctx context.Context, r *controlapi.DiskUsageReque
 				Size_:       r.Size,
 				Parent:      r.Parent,
 				UsageCount:  int64(r.UsageCount),
+				UsageScore:  r.UsageScore,
 				Description: r.Description,
 				CreatedAt:   r.CreatedAt,
 				LastUsedAt:  r.LastUsedAt,
 				RecordType:  string(r.RecordType),
 				Shared:      r.Shared,
+				Pinned:      r.Pinned,
+				PinReason:   r.PinReason,
+				ChainID:     string(r.ChainID),
+				Blob:        string(r.Blob),
+				MediaType:   r.MediaType,
+				Lazy:        r.Lazy,
+				BlobSize:    r.BlobSize,
+				BuildID:     r.BuildID,
+				Namespace:   r.Namespace,
 			})
 		}
 	}
@@ -146,6 +172,9 @@ func (c *Controller) Prune(req *controlapi.PruneRequest, stream controlapi.Contr
 					All:          req.All,
 					KeepDuration: time.Duration(req.KeepDuration),
 					KeepBytes:    req.KeepBytes,
+					Force:        req.Force,
+					MinHits:      int(req.MinHits),
+					MaxFreed:     req.MaxFreed,
 				})
 			})
 		}(w)
@@ -169,11 +198,14 @@ func (c *Controller) Prune(req *controlapi.PruneRequest, stream controlapi.Contr
 				Size_:       r.Size,
 				Parent:      r.Parent,
 				UsageCount:  int64(r.UsageCount),
+				UsageScore:  r.UsageScore,
 				Description: r.Description,
 				CreatedAt:   r.CreatedAt,
 				LastUsedAt:  r.LastUsedAt,
 				RecordType:  string(r.RecordType),
 				Shared:      r.Shared,
+				Pinned:      r.Pinned,
+				PinReason:   r.PinReason,
 			}); err != nil {
 				return err
 			}
@@ -244,9 +276,10 @@ func (c *Controller) Solve(ctx context.Context, req *controlapi.SolveRequest) (*
 	}
 
 	var (
-		cacheExporter   remotecache.Exporter
-		cacheExportMode solver.CacheExportMode
-		cacheImports    []frontend.CacheOptionsEntry
+		cacheExporter            remotecache.Exporter
+		cacheExportMode          solver.CacheExportMode
+		cacheExportPlatformSplit bool
+		cacheImports             []frontend.CacheOptionsEntry
 	)
 	if len(req.Cache.Exports) > 1 {
 		// TODO(AkihiroSuda): this should be fairly easy
@@ -264,6 +297,13 @@ func (c *Controller) Solve(ctx context.Context, req *controlapi.SolveRequest) (*
 			return nil, err
 		}
 		cacheExportMode = parseCacheExportMode(e.Attrs["mode"])
+		if v, ok := e.Attrs["platform-split"]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to parse platform-split")
+			}
+			cacheExportPlatformSplit = b
+		}
 	}
 	for _, im := range req.Cache.Imports {
 		cacheImports = append(cacheImports, frontend.CacheOptionsEntry{
@@ -272,16 +312,17 @@ func (c *Controller) Solve(ctx context.Context, req *controlapi.SolveRequest) (*
 		})
 	}
 
-	resp, err := c.solver.Solve(ctx, req.Ref, req.Session, frontend.SolveRequest{
+	resp, err := c.solver.Solve(ctx, req.Ref, req.Session, req.CacheNamespace, frontend.SolveRequest{
 		Frontend:       req.Frontend,
 		Definition:     req.Definition,
 		FrontendOpt:    req.FrontendAttrs,
 		FrontendInputs: req.FrontendInputs,
 		CacheImports:   cacheImports,
 	}, llbsolver.ExporterRequest{
-		Exporter:        expi,
-		CacheExporter:   cacheExporter,
-		CacheExportMode: cacheExportMode,
+		Exporter:                 expi,
+		CacheExporter:            cacheExporter,
+		CacheExportMode:          cacheExportMode,
+		CacheExportPlatformSplit: cacheExportPlatformSplit,
 	}, req.Entitlements)
 	if err != nil {
 		return nil, err
@@ -459,6 +500,7 @@ func toPBGCPolicy(in []client.PruneInfo) []*apitypes.GCPolicy {
 			KeepBytes:    p.KeepBytes,
 			KeepDuration: int64(p.KeepDuration),
 			Filters:      p.Filter,
+			MinHits:      int64(p.MinHits),
 		})
 	}
 	return policy
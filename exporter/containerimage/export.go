@@ -18,10 +18,12 @@ import (
 	"github.com/moby/buildkit/exporter"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/leaseutil"
 	"github.com/moby/buildkit/util/push"
+	"github.com/moby/buildkit/util/resolver/retryhandler"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -37,7 +39,13 @@ const (
 	keyDanglingPrefix   = "dangling-name-prefix"
 	keyNameCanonical    = "name-canonical"
 	keyLayerCompression = "compression"
+	keyCompressionLevel = "compression-level"
+	keyForceCompression = "force-compression"
 	ociTypes            = "oci-mediatypes"
+
+	// forceCompressionIfSmaller only keeps converted layers that are
+	// smaller than the original ones
+	forceCompressionIfSmaller = "if-smaller"
 )
 
 type Opt struct {
@@ -46,6 +54,7 @@ type Opt struct {
 	Images         images.Store
 	RegistryHosts  docker.RegistryHosts
 	LeaseManager   leases.Manager
+	RetryPolicy    retryhandler.Policy
 }
 
 type imageExporter struct {
@@ -64,7 +73,7 @@ func New(opt Opt) (exporter.Exporter, error) {
 func (e *imageExporter) Resolve(ctx context.Context, opt map[string]string) (exporter.ExporterInstance, error) {
 	i := &imageExporterInstance{
 		imageExporter:    e,
-		layerCompression: compression.Default,
+		layerCompression: compression.New(compression.Default),
 	}
 
 	for k, v := range opt {
@@ -136,12 +145,33 @@ func (e *imageExporter) Resolve(ctx context.Context, opt map[string]string) (exp
 		case keyLayerCompression:
 			switch v {
 			case "gzip":
-				i.layerCompression = compression.Gzip
+				i.layerCompression.Type = compression.Gzip
 			case "uncompressed":
-				i.layerCompression = compression.Uncompressed
+				i.layerCompression.Type = compression.Uncompressed
 			default:
 				return nil, errors.Errorf("unsupported layer compression type: %v", v)
 			}
+		case keyCompressionLevel:
+			l, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value specified for %s", k)
+			}
+			i.layerCompression = i.layerCompression.SetLevel(l)
+		case keyForceCompression:
+			if v == "" {
+				i.forceCompression = true
+				continue
+			}
+			if v == forceCompressionIfSmaller {
+				i.forceCompression = true
+				i.layerCompression = i.layerCompression.SetIfSmaller()
+				continue
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value specified for %s", k)
+			}
+			i.forceCompression = b
 		default:
 			if i.meta == nil {
 				i.meta = make(map[string][]byte)
@@ -149,6 +179,10 @@ func (e *imageExporter) Resolve(ctx context.Context, opt map[string]string) (exp
 			i.meta[k] = []byte(v)
 		}
 	}
+	i.layerCompression = i.layerCompression.SetMediaTypes(compression.ManifestMediaTypes(i.ociTypes))
+	if err := i.layerCompression.Validate(); err != nil {
+		return nil, err
+	}
 	return i, nil
 }
 
@@ -162,7 +196,8 @@ type imageExporterInstance struct {
 	ociTypes         bool
 	nameCanonical    bool
 	danglingPrefix   string
-	layerCompression compression.Type
+	layerCompression compression.Config
+	forceCompression bool
 	meta             map[string][]byte
 }
 
@@ -184,7 +219,7 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 	}
 	defer done(context.TODO())
 
-	desc, err := e.opt.ImageWriter.Commit(ctx, src, e.ociTypes, e.layerCompression, sessionID)
+	desc, err := e.opt.ImageWriter.Commit(ctx, src, e.ociTypes, e.layerCompression, e.forceCompression, sessionID)
 	if err != nil {
 		return nil, err
 	}
@@ -242,7 +277,7 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 				annotations := map[digest.Digest]map[string]string{}
 				mprovider := contentutil.NewMultiProvider(e.opt.ImageWriter.ContentStore())
 				if src.Ref != nil {
-					remote, err := src.Ref.GetRemote(ctx, false, e.layerCompression, session.NewGroup(sessionID))
+					remote, err := e.getRemote(ctx, src.Ref, false, session.NewGroup(sessionID))
 					if err != nil {
 						return nil, err
 					}
@@ -253,7 +288,7 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 				}
 				if len(src.Refs) > 0 {
 					for _, r := range src.Refs {
-						remote, err := r.GetRemote(ctx, false, e.layerCompression, session.NewGroup(sessionID))
+						remote, err := e.getRemote(ctx, r, false, session.NewGroup(sessionID))
 						if err != nil {
 							return nil, err
 						}
@@ -264,7 +299,7 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 					}
 				}
 
-				if err := push.Push(ctx, e.opt.SessionManager, sessionID, mprovider, e.opt.ImageWriter.ContentStore(), desc.Digest, targetName, e.insecure, e.opt.RegistryHosts, e.pushByDigest, annotations); err != nil {
+				if err := push.Push(ctx, e.opt.SessionManager, sessionID, mprovider, e.opt.ImageWriter.ContentStore(), desc.Digest, targetName, e.insecure, e.opt.RegistryHosts, e.pushByDigest, annotations, e.opt.RetryPolicy); err != nil {
 					return nil, err
 				}
 			}
@@ -279,6 +314,16 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 	return resp, nil
 }
 
+// getRemote returns the remote of ref with the layers the image was
+// committed with.
+func (e *imageExporterInstance) getRemote(ctx context.Context, ref cache.ImmutableRef, createIfNeeded bool, s session.Group) (*solver.Remote, error) {
+	remotes, err := ref.GetRemotes(ctx, createIfNeeded, []compression.Config{e.layerCompression}, e.forceCompression, s)
+	if err != nil {
+		return nil, err
+	}
+	return remotes[0], nil
+}
+
 func (e *imageExporterInstance) unpackImage(ctx context.Context, img images.Image, src exporter.Source, s session.Group) (err0 error) {
 	unpackDone := oneOffProgress(ctx, "unpacking to "+img.Name)
 	defer func() {
@@ -306,7 +351,7 @@ func (e *imageExporterInstance) unpackImage(ctx context.Context, img images.Imag
 		}
 	}
 
-	remote, err := topLayerRef.GetRemote(ctx, true, e.layerCompression, s)
+	remote, err := e.getRemote(ctx, topLayerRef, true, s)
 	if err != nil {
 		return err
 	}
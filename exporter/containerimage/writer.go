@@ -44,7 +44,13 @@ type ImageWriter struct {
 	opt WriterOpt
 }
 
-func (ic *ImageWriter) Commit(ctx context.Context, inp exporter.Source, oci bool, compressionType compression.Type, sessionID string) (*ocispec.Descriptor, error) {
+// Commit writes the image of inp to the content store. If forceCompression
+// is set, layers with another compression than comp are exported as blob
+// variants with comp.
+func (ic *ImageWriter) Commit(ctx context.Context, inp exporter.Source, oci bool, comp compression.Config, forceCompression bool, sessionID string) (*ocispec.Descriptor, error) {
+	// the layers get the media types of the manifest
+	comp = comp.SetMediaTypes(compression.ManifestMediaTypes(oci))
+
 	platformsBytes, ok := inp.Metadata[exptypes.ExporterPlatformsKey]
 
 	if len(inp.Refs) > 0 && !ok {
@@ -52,7 +58,7 @@ func (ic *ImageWriter) Commit(ctx context.Context, inp exporter.Source, oci bool
 	}
 
 	if len(inp.Refs) == 0 {
-		remotes, err := ic.exportLayers(ctx, compressionType, session.NewGroup(sessionID), inp.Ref)
+		remotes, err := ic.exportLayers(ctx, comp, forceCompression, session.NewGroup(sessionID), inp.Ref)
 		if err != nil {
 			return nil, err
 		}
@@ -83,7 +89,7 @@ func (ic *ImageWriter) Commit(ctx context.Context, inp exporter.Source, oci bool
 		refs = append(refs, r)
 	}
 
-	remotes, err := ic.exportLayers(ctx, compressionType, session.NewGroup(sessionID), refs...)
+	remotes, err := ic.exportLayers(ctx, comp, forceCompression, session.NewGroup(sessionID), refs...)
 	if err != nil {
 		return nil, err
 	}
@@ -148,8 +154,9 @@ func (ic *ImageWriter) Commit(ctx context.Context, inp exporter.Source, oci bool
 	return &idxDesc, nil
 }
 
-func (ic *ImageWriter) exportLayers(ctx context.Context, compressionType compression.Type, s session.Group, refs ...cache.ImmutableRef) ([]solver.Remote, error) {
-	eg, ctx := errgroup.WithContext(ctx)
+func (ic *ImageWriter) exportLayers(ctx context.Context, comp compression.Config, forceCompression bool, s session.Group, refs ...cache.ImmutableRef) ([]solver.Remote, error) {
+	var stats cache.CompressionStats
+	eg, ctx := errgroup.WithContext(cache.WithCompressionStats(ctx, &stats))
 	layersDone := oneOffProgress(ctx, "exporting layers")
 
 	out := make([]solver.Remote, len(refs))
@@ -160,11 +167,11 @@ func (ic *ImageWriter) exportLayers(ctx context.Context, compressionType compres
 				return
 			}
 			eg.Go(func() error {
-				remote, err := ref.GetRemote(ctx, true, compressionType, s)
+				remotes, err := ref.GetRemotes(ctx, true, []compression.Config{comp}, forceCompression, s)
 				if err != nil {
 					return err
 				}
-				out[i] = *remote
+				out[i] = *remotes[0]
 				return nil
 			})
 		}(i, ref)
@@ -173,6 +180,11 @@ func (ic *ImageWriter) exportLayers(ctx context.Context, compressionType compres
 	if err := layersDone(eg.Wait()); err != nil {
 		return nil, err
 	}
+	// the time spent diffing and compressing the layers created or
+	// converted for the export
+	if s := stats.String(); s != "" {
+		oneOffProgress(ctx, "created layers: "+s)(nil)
+	}
 
 	return out, nil
 }
@@ -198,6 +210,9 @@ func (ic *ImageWriter) commitDistributionManifest(ctx context.Context, ref cache
 	}
 
 	remote, history = normalizeLayersAndHistory(remote, history, ref, oci)
+	if err := compression.ValidateLayerMediaTypes(oci, remote.Descriptors...); err != nil {
+		return nil, nil, err
+	}
 
 	config, err = patchImageConfig(config, remote.Descriptors, history, inlineCache)
 	if err != nil {
@@ -0,0 +1,86 @@
+package nydus
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets"
+	"github.com/pkg/errors"
+)
+
+const (
+	backendTypeRegistry = "registry"
+	backendTypeOSS      = "oss"
+)
+
+// Session secret IDs holding the OSS backend credentials, the credentials
+// are never accepted as exporter attributes so that they can't leak into
+// the build history or image annotations.
+const (
+	secretOSSAccessKeyID     = "nydus-oss-access-key-id"
+	secretOSSAccessKeySecret = "nydus-oss-access-key-secret"
+)
+
+// backendOpt describes the storage backend Nydus blobs are uploaded to,
+// only the bootstrap layer is pushed to the registry when it's not the
+// registry backend.
+type backendOpt struct {
+	typ          string
+	endpoint     string
+	bucket       string
+	objectPrefix string
+}
+
+func (opt *backendOpt) validate() error {
+	switch opt.typ {
+	case "", backendTypeRegistry:
+		if opt.endpoint != "" || opt.bucket != "" || opt.objectPrefix != "" {
+			return errors.Errorf("%s=%s is required for nydus backend options", keyBackend, backendTypeOSS)
+		}
+	case backendTypeOSS:
+		if opt.endpoint == "" {
+			return errors.Errorf("%s is required for %s backend", keyBackendEndpoint, opt.typ)
+		}
+		if opt.bucket == "" {
+			return errors.Errorf("%s is required for %s backend", keyBackendBucket, opt.typ)
+		}
+	default:
+		return errors.Errorf("unsupported nydus backend type: %s", opt.typ)
+	}
+	return nil
+}
+
+// config returns the backend type and config understood by nydusify, the
+// credentials are read from the client session. An empty config means
+// that blobs are pushed to the registry.
+func (opt *backendOpt) config(ctx context.Context, sm *session.Manager, g session.Group) (string, string, error) {
+	if opt.typ != backendTypeOSS {
+		return backendTypeRegistry, "", nil
+	}
+
+	var accessKeyID, accessKeySecret []byte
+	if err := sm.Any(ctx, g, func(ctx context.Context, _ string, caller session.Caller) error {
+		var err error
+		if accessKeyID, err = secrets.GetSecret(ctx, caller, secretOSSAccessKeyID); err != nil {
+			return err
+		}
+		accessKeySecret, err = secrets.GetSecret(ctx, caller, secretOSSAccessKeySecret)
+		return err
+	}); err != nil {
+		return "", "", errors.Wrap(err, "get nydus backend credentials")
+	}
+
+	config, err := json.Marshal(map[string]string{
+		"endpoint":          opt.endpoint,
+		"bucket_name":       opt.bucket,
+		"object_prefix":     opt.objectPrefix,
+		"access_key_id":     string(accessKeyID),
+		"access_key_secret": string(accessKeySecret),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return opt.typ, string(config), nil
+}
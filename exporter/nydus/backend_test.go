@@ -0,0 +1,72 @@
+package nydus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendOptValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  backendOpt
+		err  string
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "registry",
+			opt:  backendOpt{typ: backendTypeRegistry},
+		},
+		{
+			name: "registry with endpoint",
+			opt:  backendOpt{typ: backendTypeRegistry, endpoint: "oss.example.com"},
+			err:  "nydus-backend=oss is required",
+		},
+		{
+			name: "default with bucket",
+			opt:  backendOpt{bucket: "blobs"},
+			err:  "nydus-backend=oss is required",
+		},
+		{
+			name: "default with prefix",
+			opt:  backendOpt{objectPrefix: "nydus/"},
+			err:  "nydus-backend=oss is required",
+		},
+		{
+			name: "oss",
+			opt:  backendOpt{typ: backendTypeOSS, endpoint: "oss.example.com", bucket: "blobs"},
+		},
+		{
+			name: "oss with prefix",
+			opt:  backendOpt{typ: backendTypeOSS, endpoint: "oss.example.com", bucket: "blobs", objectPrefix: "nydus/"},
+		},
+		{
+			name: "oss without endpoint",
+			opt:  backendOpt{typ: backendTypeOSS, bucket: "blobs"},
+			err:  "nydus-backend-endpoint is required for oss backend",
+		},
+		{
+			name: "oss without bucket",
+			opt:  backendOpt{typ: backendTypeOSS, endpoint: "oss.example.com"},
+			err:  "nydus-backend-bucket is required for oss backend",
+		},
+		{
+			name: "unknown",
+			opt:  backendOpt{typ: "s3", endpoint: "s3.example.com", bucket: "blobs"},
+			err:  "unsupported nydus backend type: s3",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opt.validate()
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/exporter"
@@ -17,9 +19,12 @@ import (
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/leaseutil"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 )
 
 const builderName = "nydus-image"
@@ -34,8 +39,36 @@ const (
 	keyOCIMediaTypes = "oci-mediatypes"
 	// Push to insecure HTTP registry.
 	keyInsecure = "registry.insecure"
+	// Set compression type of the Nydus bootstrap layer.
+	keyLayerCompression = "compression"
+	// Specify RAFS filesystem version of the Nydus image.
+	keyFsVersion = "nydus-fs-version"
+	// Specify chunk dictionary image reference for chunk deduplication.
+	keyChunkDict = "nydus-chunk-dict"
+	// Specify Nydus cache image reference, converted layers are recorded
+	// there by source layer chain ID and reused by later exports.
+	keyCacheRef = "nydus-cache-ref"
+	// Maximum number of layer records kept in the Nydus cache image.
+	keyCacheMaxRecords = "nydus-cache-max-records"
+	// Specify storage backend type of Nydus blobs, "registry" or "oss".
+	keyBackend = "nydus-backend"
+	// Specify endpoint of the Nydus blob storage backend.
+	keyBackendEndpoint = "nydus-backend-endpoint"
+	// Specify bucket name of the Nydus blob storage backend.
+	keyBackendBucket = "nydus-backend-bucket"
+	// Specify object prefix of Nydus blobs in the storage backend.
+	keyBackendPrefix = "nydus-backend-prefix"
+	// Specify comma-separated paths the snapshotter prefetches on container
+	// start, e.g. "/usr/bin/*,/app/**".
+	keyPrefetchPatterns = "nydus-prefetch-patterns"
 )
 
+const defaultCacheMaxRecords = 200
+
+// defaultFsVersion is the only RAFS version produced by the Nydus builder
+// driven through nydusify.
+const defaultFsVersion = "5"
+
 type Opt struct {
 	ImageOpt     containerimage.Opt
 	CacheManager cache.Manager
@@ -48,11 +81,15 @@ type nydusExporter struct {
 type nydusExporterInstance struct {
 	*nydusExporter
 
-	nydusBuilder  string
-	targetRef     string
-	insecure      bool
-	mergeManifest bool
-	ociMediaTypes bool
+	nydusBuilder    string
+	targetRef       string
+	insecure        bool
+	mergeManifest   bool
+	ociMediaTypes   bool
+	cacheRef        string
+	cacheMaxRecords uint
+	backend         backendOpt
+	prefetchDir     string
 }
 
 func New(opt Opt) (exporter.Exporter, error) {
@@ -67,8 +104,9 @@ func (exporter *nydusExporter) Resolve(ctx context.Context, opt map[string]strin
 	}
 
 	instance := &nydusExporterInstance{
-		nydusExporter: exporter,
-		nydusBuilder:  builderName,
+		nydusExporter:   exporter,
+		nydusBuilder:    builderName,
+		cacheMaxRecords: defaultCacheMaxRecords,
 	}
 
 	for k, v := range opt {
@@ -93,14 +131,108 @@ func (exporter *nydusExporter) Resolve(ctx context.Context, opt map[string]strin
 			if v == "" || v == "true" {
 				instance.ociMediaTypes = true
 			}
+		case keyLayerCompression:
+			if err := validateLayerCompression(v); err != nil {
+				return nil, err
+			}
+		case keyFsVersion:
+			if err := validateFsVersion(v); err != nil {
+				return nil, err
+			}
+		case keyChunkDict:
+			// Fail instead of silently producing an image without the
+			// requested deduplication.
+			return nil, errors.Errorf("%s is not supported by the nydus builder", keyChunkDict)
+		case keyCacheRef:
+			instance.cacheRef = v
+		case keyCacheMaxRecords:
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-uint value specified for %s", k)
+			}
+			if n == 0 {
+				return nil, errors.Errorf("%s must be greater than 0", k)
+			}
+			instance.cacheMaxRecords = uint(n)
+		case keyBackend:
+			instance.backend.typ = v
+		case keyBackendEndpoint:
+			instance.backend.endpoint = v
+		case keyBackendBucket:
+			instance.backend.bucket = v
+		case keyBackendPrefix:
+			instance.backend.objectPrefix = v
+		case keyPrefetchPatterns:
+			dir, err := parsePrefetchPatterns(v)
+			if err != nil {
+				return nil, err
+			}
+			instance.prefetchDir = dir
 		}
 	}
 
+	if err := instance.backend.validate(); err != nil {
+		return nil, err
+	}
+
 	return instance, nil
 }
 
-// Mount a temp directory to save intermediate of Nydus image during exporting
-func (exporter *nydusExporterInstance) createTempDir(ctx context.Context, sessionGroup session.Group) (string, func() error, error) {
+// validateFsVersion checks the requested RAFS version before any layer is
+// converted. All layers of an image are built by one workflow, so the
+// version can't differ between layers.
+func validateFsVersion(v string) error {
+	switch v {
+	case defaultFsVersion:
+		return nil
+	case "6":
+		return errors.Errorf("RAFS v6 is not supported by the nydus builder, use %s=%s", keyFsVersion, defaultFsVersion)
+	default:
+		return errors.Errorf("invalid value %q for %s, supported versions: %s", v, keyFsVersion, defaultFsVersion)
+	}
+}
+
+// validateLayerCompression checks the requested compression of the bootstrap
+// layer. The Nydus builder always packs the bootstrap layer as gzip, so other
+// compression types are refused rather than silently producing an image that
+// mixes compression types across layers.
+func validateLayerCompression(v string) error {
+	if v != compression.Gzip.String() {
+		return errors.Errorf("unsupported layer compression type for nydus exporter: %v", v)
+	}
+	return nil
+}
+
+// parsePrefetchPatterns converts comma-separated prefetch patterns to the
+// newline-separated path list read by the Nydus builder. The builder
+// prefetches whole directories, so a trailing "/*" or "/**" selects the
+// directory itself and other wildcards are rejected.
+func parsePrefetchPatterns(v string) (string, error) {
+	var paths []string
+	for _, pattern := range strings.Split(v, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		p := strings.TrimSuffix(strings.TrimSuffix(pattern, "/**"), "/*")
+		if p == "" {
+			p = "/"
+		}
+		if !path.IsAbs(p) {
+			return "", errors.Errorf("invalid prefetch pattern %q: path must be absolute", pattern)
+		}
+		if strings.ContainsAny(p, "*?[") {
+			return "", errors.Errorf("invalid prefetch pattern %q: only a trailing /* or /** is supported", pattern)
+		}
+		paths = append(paths, path.Clean(p))
+	}
+	return strings.Join(paths, "\n"), nil
+}
+
+// Mount a temp directory to save intermediate of Nydus image during exporting,
+// the returned release function unmounts the directory and releases the
+// underlying ref, it must be called even if the export fails or is cancelled.
+func (exporter *nydusExporterInstance) createTempDir(ctx context.Context, sessionGroup session.Group) (_ string, _ func() error, rerr error) {
 	cacheManager := exporter.opt.CacheManager
 
 	mountableRef, err := cacheManager.New(
@@ -109,6 +241,12 @@ func (exporter *nydusExporterInstance) createTempDir(ctx context.Context, sessio
 	if err != nil {
 		return "", nil, errors.Wrap(err, "create mountable ref")
 	}
+	defer func() {
+		if rerr != nil {
+			mountableRef.Release(context.TODO())
+		}
+	}()
+
 	mountable, err := mountableRef.Mount(ctx, false, sessionGroup)
 	if err != nil {
 		return "", nil, errors.Wrap(err, "get mountable from mountable ref")
@@ -120,7 +258,15 @@ func (exporter *nydusExporterInstance) createTempDir(ctx context.Context, sessio
 		return "", nil, errors.Wrap(err, "mount from mountable ref")
 	}
 
-	return dir, mounter.Unmount, nil
+	release := func() error {
+		err := mounter.Unmount()
+		if err1 := mountableRef.Release(context.TODO()); err == nil {
+			err = err1
+		}
+		return err
+	}
+
+	return dir, release, nil
 }
 
 // Source prepares image config and layers for Nydusify building
@@ -171,10 +317,28 @@ func (exporter *nydusExporterInstance) Name() string {
 func (exporter *nydusExporterInstance) Export(
 	ctx context.Context, inp exporter.Source, sessionID string,
 ) (map[string]string, error) {
+	// Hold a lease for the whole export so content pulled while mounting
+	// lazy source layers can't be garbage collected before it's pushed.
+	ctx, done, err := leaseutil.WithLease(ctx, exporter.opt.ImageOpt.LeaseManager, leaseutil.MakeTemporary)
+	if err != nil {
+		return nil, err
+	}
+	defer done(context.TODO())
+
 	sources, err := exporter.getSources(inp, sessionID)
 	if err != nil {
 		return nil, errors.Wrap(err, "get image sources")
 	}
+	// The converter unmounts a source layer once it's built, but layers
+	// mounted ahead by the pull workers are left behind if the conversion
+	// fails or the context is cancelled.
+	defer func() {
+		for _, source := range sources {
+			if err := source.(*sourceProvider).Release(); err != nil {
+				logrus.Warnf("failed to release nydus source layers: %v", err)
+			}
+		}
+	}()
 
 	// The remote instance communicates with registry
 	targetRemote, err := NewRemote(
@@ -184,22 +348,55 @@ func (exporter *nydusExporterInstance) Export(
 		return nil, errors.Wrap(err, "create target remote")
 	}
 
+	// The cache image records converted layers by source layer chain ID,
+	// so exporting an unchanged image again reuses them without rebuilding
+	var cacheRemote *remote.Remote
+	if exporter.cacheRef != "" {
+		cacheRemote, err = NewRemote(
+			exporter.opt.ImageOpt.SessionManager, sessionID, exporter.opt.ImageOpt.RegistryHosts, exporter.cacheRef, exporter.insecure,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "create cache remote")
+		}
+	}
+
+	backendType, backendConfig, err := exporter.backend.config(
+		ctx, exporter.opt.ImageOpt.SessionManager, session.NewGroup(sessionID),
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	// Prepare temp directory for Nydus builder, the builder will output
 	// blob/bootstrap intermediate of Nydus image to this directory
-	workDir, umount, err := exporter.createTempDir(ctx, session.NewGroup(sessionID))
+	workDir, release, err := exporter.createTempDir(ctx, session.NewGroup(sessionID))
 	if err != nil {
 		return nil, errors.Wrap(err, "create work directory")
 	}
-	defer umount()
+	defer func() {
+		if err := release(); err != nil {
+			logrus.Warnf("failed to release nydus work directory: %v", err)
+		}
+	}()
+
+	metrics := newConversionMetrics(workDir)
+	for _, source := range sources {
+		source.(*sourceProvider).metrics = metrics
+	}
 
 	cvt, err := converter.New(converter.Opt{
-		Logger:          &progressLogger{},
+		Logger:          &progressLogger{metrics: metrics},
 		SourceProviders: sources,
 		TargetRemote:    targetRemote,
+		CacheRemote:     cacheRemote,
+		CacheMaxRecords: exporter.cacheMaxRecords,
 		WorkDir:         workDir,
 		NydusImagePath:  exporter.nydusBuilder,
+		PrefetchDir:     exporter.prefetchDir,
 		MultiPlatform:   exporter.mergeManifest,
 		DockerV2Format:  !exporter.ociMediaTypes,
+		BackendType:     backendType,
+		BackendConfig:   backendConfig,
 	})
 	if err != nil {
 		return nil, err
@@ -209,5 +406,12 @@ func (exporter *nydusExporterInstance) Export(
 		return nil, err
 	}
 
-	return nil, nil
+	dt, err := metrics.marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal conversion metrics")
+	}
+
+	return map[string]string{
+		ExporterMetricsKey: string(dt),
+	}, nil
 }
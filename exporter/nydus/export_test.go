@@ -0,0 +1,424 @@
+package nydus
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	ctdmetadata "github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/exporter"
+	"github.com/moby/buildkit/exporter/containerimage"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/moby/buildkit/util/leaseutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestValidateLayerCompression(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		err   bool
+	}{
+		{value: "gzip"},
+		{value: "zstd", err: true},
+		{value: "uncompressed", err: true},
+		{value: "", err: true},
+		{value: "brotli", err: true},
+	} {
+		err := validateLayerCompression(tc.value)
+		if tc.err {
+			require.Error(t, err, tc.value)
+			continue
+		}
+		require.NoError(t, err, tc.value)
+	}
+}
+
+func TestParsePrefetchPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		patterns string
+		expected string
+		err      string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "paths",
+			patterns: "/usr/bin,/etc/passwd",
+			expected: "/usr/bin\n/etc/passwd",
+		},
+		{
+			name:     "wildcards",
+			patterns: "/usr/bin/*,/app/**",
+			expected: "/usr/bin\n/app",
+		},
+		{
+			name:     "root",
+			patterns: "/*",
+			expected: "/",
+		},
+		{
+			name:     "root recursive",
+			patterns: "/**",
+			expected: "/",
+		},
+		{
+			name:     "spaces and empty entries",
+			patterns: " /usr/bin/* ,, /app/ ,",
+			expected: "/usr/bin\n/app",
+		},
+		{
+			name:     "cleaned",
+			patterns: "/usr/../lib//modules/",
+			expected: "/lib/modules",
+		},
+		{
+			name:     "relative",
+			patterns: "/usr/bin,app/**",
+			err:      `invalid prefetch pattern "app/**": path must be absolute`,
+		},
+		{
+			name:     "wildcard in path",
+			patterns: "/usr/*/bin",
+			err:      `invalid prefetch pattern "/usr/*/bin": only a trailing /* or /** is supported`,
+		},
+		{
+			name:     "wildcard in name",
+			patterns: "/usr/bin/python*",
+			err:      "only a trailing /* or /** is supported",
+		},
+		{
+			name:     "character class",
+			patterns: "/usr/lib[64]",
+			err:      "only a trailing /* or /** is supported",
+		},
+		{
+			name:     "question mark",
+			patterns: "/app/?",
+			err:      "only a trailing /* or /** is supported",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := parsePrefetchPatterns(tc.patterns)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, dir)
+		})
+	}
+}
+
+// TestBootstrapLayerCompression converts an image for each compression type
+// of the exporter and checks that the bootstrap layer of the manifest
+// decompresses to its diff ID in the image config. Zstd is refused
+// before the conversion as the Nydus builder only packs gzip bootstraps.
+func TestBootstrapLayerCompression(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("depends on a shell script as nydus builder")
+	}
+	for _, bin := range []string{"sh", "sed", "sha256sum", "cut"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+
+	tmpdir, err := ioutil.TempDir("", "nydusbootstrap")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	builder := filepath.Join(tmpdir, "nydus-image")
+	err = ioutil.WriteFile(builder, []byte(fakeBuilder), 0700)
+	require.NoError(t, err)
+
+	for _, ct := range []compression.Type{compression.Gzip, compression.Zstd} {
+		ct := ct
+		t.Run(ct.String(), func(t *testing.T) {
+			err := validateLayerCompression(ct.String())
+			if ct != compression.Gzip {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			workDir := filepath.Join(tmpdir, "work-"+ct.String())
+			require.NoError(t, os.Mkdir(workDir, 0700))
+
+			sp := &testSourceProvider{}
+			for i := 0; i < 2; i++ {
+				dir := filepath.Join(tmpdir, fmt.Sprintf("layer%d-%s", i, ct))
+				require.NoError(t, os.Mkdir(dir, 0700))
+				sp.layers = append(sp.layers, &testSourceLayer{
+					dir:  dir,
+					dgst: digest.FromString(dir),
+					size: 10,
+				})
+			}
+
+			resolver := &testResolver{buf: contentutil.NewBuffer()}
+			target, err := remote.New("docker.io/library/test:nydus", resolver)
+			require.NoError(t, err)
+
+			cvt, err := converter.New(converter.Opt{
+				Logger:          &progressLogger{metrics: newConversionMetrics(workDir)},
+				SourceProviders: []provider.SourceProvider{sp},
+				TargetRemote:    target,
+				WorkDir:         workDir,
+				NydusImagePath:  builder,
+			})
+			require.NoError(t, err)
+			require.NoError(t, cvt.Convert(context.TODO()))
+
+			ctx := context.TODO()
+			var manifest ocispec.Manifest
+			var found bool
+			for _, desc := range resolver.pushed {
+				if desc.MediaType != ocispec.MediaTypeImageManifest {
+					continue
+				}
+				dt, err := content.ReadBlob(ctx, resolver.buf, desc)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(dt, &manifest))
+				found = true
+			}
+			require.True(t, found, "no manifest pushed")
+
+			var config ocispec.Image
+			dt, err := content.ReadBlob(ctx, resolver.buf, manifest.Config)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(dt, &config))
+			require.Equal(t, len(manifest.Layers), len(config.RootFS.DiffIDs))
+
+			// the uncompressed digest is moved from the layer annotations
+			// to the diff IDs of the config
+			var bootstrap *ocispec.Descriptor
+			var diffID digest.Digest
+			for i, l := range manifest.Layers {
+				if l.Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+					bootstrap = &manifest.Layers[i]
+					diffID = config.RootFS.DiffIDs[i]
+				}
+			}
+			require.NotNil(t, bootstrap, "no bootstrap layer in manifest")
+			require.Equal(t, ocispec.MediaTypeImageLayerGzip, bootstrap.MediaType)
+			require.Equal(t, ct, compression.FromMediaType(bootstrap.MediaType))
+
+			dt, err = content.ReadBlob(ctx, resolver.buf, *bootstrap)
+			require.NoError(t, err)
+			require.Equal(t, bootstrap.Digest, digest.FromBytes(dt))
+
+			zr, err := gzip.NewReader(bytes.NewReader(dt))
+			require.NoError(t, err)
+			uncompressed, err := ioutil.ReadAll(zr)
+			require.NoError(t, err)
+			require.Equal(t, diffID, digest.FromBytes(uncompressed))
+
+			// the bootstrap written by the builder for the top layer is
+			// the only file in the layer
+			tr := tar.NewReader(bytes.NewReader(uncompressed))
+			var files []string
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				if hdr.Typeflag != tar.TypeReg {
+					continue
+				}
+				files = append(files, hdr.Name)
+				b, err := ioutil.ReadAll(tr)
+				require.NoError(t, err)
+				require.Equal(t, sp.layers[len(sp.layers)-1].dir+"\n", string(b))
+			}
+			require.Equal(t, []string{utils.BootstrapFileNameInLayer}, files)
+		})
+	}
+}
+
+// TestExportLease exports an image whose source layer pulls its blob into
+// the content store when mounted, like a lazy ref, and runs the garbage
+// collection before the first blob is pushed. The blob must be kept until
+// the export returns and collected after.
+func TestExportLease(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("depends on a shell script as nydus builder")
+	}
+	for _, bin := range []string{"sh", "sed", "sha256sum", "cut"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit-test")
+
+	tmpdir, err := ioutil.TempDir("", "nydusexport")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	builder := filepath.Join(tmpdir, "nydus-image")
+	err = ioutil.WriteFile(builder, []byte(fakeBuilder), 0700)
+	require.NoError(t, err)
+
+	store, err := local.NewStore(filepath.Join(tmpdir, "content"))
+	require.NoError(t, err)
+	db, err := bolt.Open(filepath.Join(tmpdir, "containerdmeta.db"), 0644, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	mdb := ctdmetadata.NewDB(db, store, nil)
+	require.NoError(t, mdb.Init(ctx))
+	cs := mdb.ContentStore()
+
+	dir := filepath.Join(tmpdir, "layer")
+	require.NoError(t, os.Mkdir(dir, 0700))
+	blob := []byte("lazy layer blob")
+	blobDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	var mounted int64
+	var writeErr error
+	ref := &testRef{
+		dir:     dir,
+		blob:    blobDesc.Digest,
+		mounted: &mounted,
+		onMount: func(ctx context.Context) {
+			writeErr = content.WriteBlob(ctx, cs, blobDesc.Digest.String(), bytes.NewReader(blob), blobDesc)
+		},
+	}
+
+	var gcOnce sync.Once
+	var gcErr, blobErr error
+	srv := httptest.NewServer(&testRegistry{beforePush: func() {
+		gcOnce.Do(func() {
+			if _, gcErr = mdb.GarbageCollect(ctx); gcErr == nil {
+				_, blobErr = cs.Info(ctx, blobDesc.Digest)
+			}
+		})
+	}})
+	defer srv.Close()
+
+	config, err := json.Marshal(ocispec.Image{})
+	require.NoError(t, err)
+
+	workDir := filepath.Join(tmpdir, "work")
+	require.NoError(t, os.Mkdir(workDir, 0700))
+	exp := &nydusExporterInstance{
+		nydusExporter: &nydusExporter{opt: Opt{
+			ImageOpt: containerimage.Opt{
+				SessionManager: &session.Manager{},
+				RegistryHosts:  docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts)),
+				LeaseManager:   leaseutil.WithNamespace(ctdmetadata.NewLeaseManager(mdb), "buildkit-test"),
+			},
+			CacheManager: &testCacheManager{dir: workDir},
+		}},
+		nydusBuilder: builder,
+		targetRef:    strings.TrimPrefix(srv.URL, "http://") + "/test:nydus",
+	}
+	_, err = exp.Export(ctx, exporter.Source{
+		Ref:      ref,
+		Metadata: map[string][]byte{exptypes.ExporterImageConfigKey: config},
+	}, "")
+	require.NoError(t, err)
+
+	require.NoError(t, writeErr)
+	require.NoError(t, gcErr)
+	require.NoError(t, blobErr, "blob collected before push")
+	require.Equal(t, int64(0), atomic.LoadInt64(&mounted))
+
+	_, err = mdb.GarbageCollect(ctx)
+	require.NoError(t, err)
+	_, err = cs.Info(ctx, blobDesc.Digest)
+	require.True(t, errdefs.IsNotFound(err), "blob not collected after export: %v", err)
+}
+
+// testRegistry accepts every pushed blob and manifest. beforePush is called
+// before each blob upload starts.
+type testRegistry struct {
+	beforePush func()
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		r.beforePush()
+		w.Header().Set("Location", req.URL.Path+"upload")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		dt, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dgst := digest.FromBytes(dt)
+		if v := req.URL.Query().Get("digest"); v != "" && v != dgst.String() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// testCacheManager creates the work directory of the exporter in dir.
+type testCacheManager struct {
+	cache.Manager
+	dir string
+}
+
+func (cm *testCacheManager) New(ctx context.Context, parent cache.ImmutableRef, s session.Group, opts ...cache.RefOption) (cache.MutableRef, error) {
+	return &testWorkRef{dir: cm.dir}, nil
+}
+
+type testWorkRef struct {
+	cache.MutableRef
+	dir string
+}
+
+func (r *testWorkRef) Mount(ctx context.Context, readonly bool, s session.Group) (snapshot.Mountable, error) {
+	var mounted int64
+	return &testMountable{ref: &testRef{dir: r.dir, mounted: &mounted}}, nil
+}
+
+func (r *testWorkRef) Release(ctx context.Context) error {
+	return nil
+}
@@ -10,10 +10,21 @@ import (
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
 
 	"github.com/moby/buildkit/util/progress"
+	"github.com/moby/buildkit/util/tracing"
+	"github.com/opencontainers/go-digest"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/sirupsen/logrus"
 )
 
-type progressLogger struct{}
+// buildLayerMsg is the log message the converter emits around the Nydus
+// builder run of a layer, with the source layer digest in its fields. It is
+// the only hook the converter offers to time a layer build, TestMetrics
+// fails if a converter update changes it.
+const buildLayerMsg = "[DUMP] Build layer"
+
+type progressLogger struct {
+	metrics *conversionMetrics
+}
 
 // Log outputs Nydus image exporting progress log
 func (logger *progressLogger) Log(ctx context.Context, msg string, fields provider.LoggerFields) func(err error) error {
@@ -21,6 +32,17 @@ func (logger *progressLogger) Log(ctx context.Context, msg string, fields provid
 		fields = make(provider.LoggerFields)
 	}
 	logrus.WithFields(fields).Info(msg)
+
+	// Only layer builds are traced, the other steps are short or already
+	// traced by the registry client.
+	var span opentracing.Span
+	if msg == buildLayerMsg {
+		span, _ = tracing.StartSpan(ctx, msg)
+		for key, value := range fields {
+			span.SetTag(key, value)
+		}
+	}
+	title := msg
 	if len(fields) != 0 {
 		var infos []string
 		for key, value := range fields {
@@ -28,18 +50,31 @@ func (logger *progressLogger) Log(ctx context.Context, msg string, fields provid
 			infos = append(infos, line)
 		}
 		sort.Strings(infos)
-		msg = msg + " [" + strings.Join(infos, " ") + "]"
+		title = msg + " [" + strings.Join(infos, " ") + "]"
 	}
 	pw, _, _ := progress.FromContext(ctx)
 	now := time.Now()
 	st := progress.Status{
 		Started: &now,
 	}
-	pw.Write(msg, st)
+	pw.Write(title, st)
 	return func(err error) error {
 		now := time.Now()
+		if span != nil {
+			if dgst, ok := fields["Digest"].(digest.Digest); ok && err == nil && logger.metrics != nil {
+				lm, merr := logger.metrics.record(dgst, now.Sub(*st.Started))
+				if merr != nil {
+					logrus.Warnf("failed to record nydus conversion metrics of %s: %v", dgst, merr)
+				} else {
+					span.SetTag("output.digest", lm.OutputDigest)
+					span.SetTag("output.size", lm.OutputSize)
+					span.SetTag("ratio", lm.Ratio)
+				}
+			}
+			tracing.FinishWithError(span, err)
+		}
 		st.Completed = &now
-		pw.Write(msg, st)
+		pw.Write(title, st)
 		pw.Close()
 		return err
 	}
@@ -0,0 +1,112 @@
+package nydus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ExporterMetricsKey is the exporter response key holding the JSON encoded
+// per-layer conversion metrics, keyed by source layer digest.
+const ExporterMetricsKey = "nydus.metrics"
+
+// LayerMetrics describes the conversion of a source layer to a Nydus layer.
+type LayerMetrics struct {
+	// Duration is the wall time spent by the Nydus builder on the layer.
+	Duration time.Duration `json:"duration"`
+	// InputSize is the size of the source layer.
+	InputSize int64 `json:"inputSize"`
+	// OutputDigest and OutputSize describe the built Nydus blob, empty if
+	// the layer didn't produce one.
+	OutputDigest digest.Digest `json:"outputDigest,omitempty"`
+	OutputSize   int64         `json:"outputSize"`
+	// Ratio is OutputSize divided by InputSize.
+	Ratio float64 `json:"ratio"`
+}
+
+// The converter runs the Nydus builder with its work dir as target dir. The
+// builder lists the blobs of the image built so far, the latest last, in
+// builderOutputFile and writes them to builderBlobsDir.
+const (
+	builderOutputFile = "output.json"
+	builderBlobsDir   = "blobs"
+)
+
+// builderOutput is the part of the Nydus builder output the converter reads
+// to find the blob of a layer.
+type builderOutput struct {
+	Blobs []string `json:"blobs"`
+}
+
+// conversionMetrics collects LayerMetrics of the layers built during an
+// export, layers reused from the Nydus cache image aren't recorded.
+type conversionMetrics struct {
+	mu         sync.Mutex
+	workDir    string
+	lastBlob   string
+	inputSizes map[digest.Digest]int64
+	layers     map[digest.Digest]LayerMetrics
+}
+
+func newConversionMetrics(workDir string) *conversionMetrics {
+	return &conversionMetrics{
+		workDir:    workDir,
+		inputSizes: map[digest.Digest]int64{},
+		layers:     map[digest.Digest]LayerMetrics{},
+	}
+}
+
+func (m *conversionMetrics) setInputSize(dgst digest.Digest, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputSizes[dgst] = size
+}
+
+// record adds the metrics of a finished layer build. The Nydus builder
+// runs one layer at a time, like the converter it takes the output blob of
+// the layer from the builder output, a layer without new data doesn't
+// change the latest blob.
+func (m *conversionMetrics) record(dgst digest.Digest, duration time.Duration) (LayerMetrics, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lm := LayerMetrics{
+		Duration:  duration,
+		InputSize: m.inputSizes[dgst],
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(m.workDir, builderOutputFile))
+	if err != nil {
+		return lm, errors.Wrap(err, "read nydus builder output")
+	}
+	var out builderOutput
+	if err := json.Unmarshal(dt, &out); err != nil {
+		return lm, errors.Wrap(err, "parse nydus builder output")
+	}
+	if n := len(out.Blobs); n > 0 && out.Blobs[n-1] != m.lastBlob {
+		blob := out.Blobs[n-1]
+		fi, err := os.Stat(filepath.Join(m.workDir, builderBlobsDir, blob))
+		if err != nil {
+			return lm, errors.Wrapf(err, "stat nydus blob %s", blob)
+		}
+		m.lastBlob = blob
+		lm.OutputDigest = digest.NewDigestFromEncoded(digest.SHA256, blob)
+		lm.OutputSize = fi.Size()
+	}
+	if lm.InputSize > 0 {
+		lm.Ratio = float64(lm.OutputSize) / float64(lm.InputSize)
+	}
+	m.layers[dgst] = lm
+	return lm, nil
+}
+
+func (m *conversionMetrics) marshal() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.layers)
+}
@@ -0,0 +1,206 @@
+package nydus
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/remotes"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBuilder stands in for nydus-image. It writes the rootfs path of the
+// layer as blob to the localfs backend dir and lists it in the output json.
+const fakeBuilder = `#!/bin/sh
+set -e
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--bootstrap) bootstrap="$2"; shift ;;
+	--backend-config) dir=$(echo "$2" | sed 's/.*"dir": *"\([^"]*\)".*/\1/'); shift ;;
+	--output-json) output="$2"; shift ;;
+	--parent-bootstrap|--backend-type|--log-level|--whiteout-spec|--prefetch-policy) shift ;;
+	*) rootfs="$1" ;;
+	esac
+	shift
+done
+cat > /dev/null
+echo "$rootfs" > "$bootstrap"
+if [ -e "$rootfs/empty" ]; then
+	exit 0
+fi
+blob=$(printf %s "$rootfs" | sha256sum | cut -d' ' -f1)
+printf %s "$rootfs" > "$dir/$blob"
+echo "{\"blobs\": [\"$blob\"]}" > "$output"
+`
+
+// TestMetrics runs the converter with the progress logger of the exporter
+// and checks the metrics of every built layer. It fails if the converter no
+// longer logs buildLayerMsg around a layer build or if the builder output
+// isn't where the metrics look for it.
+func TestMetrics(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("depends on a shell script as nydus builder")
+	}
+	for _, bin := range []string{"sh", "sed", "sha256sum", "cut"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+
+	tmpdir, err := ioutil.TempDir("", "nydusmetrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	builder := filepath.Join(tmpdir, "nydus-image")
+	err = ioutil.WriteFile(builder, []byte(fakeBuilder), 0700)
+	require.NoError(t, err)
+
+	workDir := filepath.Join(tmpdir, "work")
+	require.NoError(t, os.Mkdir(workDir, 0700))
+
+	sp := &testSourceProvider{}
+	for i, empty := range []bool{false, true, false} {
+		dir := filepath.Join(tmpdir, fmt.Sprintf("layer%d", i))
+		require.NoError(t, os.Mkdir(dir, 0700))
+		if empty {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "empty"), nil, 0600))
+		}
+		sp.layers = append(sp.layers, &testSourceLayer{
+			dir:  dir,
+			dgst: digest.FromString(dir),
+			size: int64(10 * (i + 1)),
+		})
+	}
+
+	metrics := newConversionMetrics(workDir)
+	for _, l := range sp.layers {
+		metrics.setInputSize(l.dgst, l.size)
+	}
+
+	target, err := remote.New("docker.io/library/test:nydus", &testResolver{buf: contentutil.NewBuffer()})
+	require.NoError(t, err)
+
+	cvt, err := converter.New(converter.Opt{
+		Logger:          &progressLogger{metrics: metrics},
+		SourceProviders: []provider.SourceProvider{sp},
+		TargetRemote:    target,
+		WorkDir:         workDir,
+		NydusImagePath:  builder,
+	})
+	require.NoError(t, err)
+	require.NoError(t, cvt.Convert(context.TODO()))
+
+	require.Equal(t, len(sp.layers), len(metrics.layers))
+	for i, l := range sp.layers {
+		lm, ok := metrics.layers[l.dgst]
+		require.True(t, ok, "no metrics for layer %d", i)
+		require.Equal(t, l.size, lm.InputSize)
+		if i == 1 {
+			require.Equal(t, digest.Digest(""), lm.OutputDigest)
+			require.Equal(t, int64(0), lm.OutputSize)
+			require.Equal(t, float64(0), lm.Ratio)
+			continue
+		}
+		require.Equal(t, digest.NewDigestFromEncoded(digest.SHA256, fmt.Sprintf("%x", sha256.Sum256([]byte(l.dir)))), lm.OutputDigest)
+		require.Equal(t, int64(len(l.dir)), lm.OutputSize)
+		require.Equal(t, float64(lm.OutputSize)/float64(l.size), lm.Ratio)
+	}
+}
+
+type testSourceProvider struct {
+	layers []*testSourceLayer
+}
+
+func (sp *testSourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
+	return nil, nil
+}
+
+func (sp *testSourceProvider) Config(ctx context.Context) (*ocispec.Image, error) {
+	return &ocispec.Image{}, nil
+}
+
+func (sp *testSourceProvider) Layers(ctx context.Context) ([]provider.SourceLayer, error) {
+	var layers []provider.SourceLayer
+	var chainID digest.Digest
+	for _, l := range sp.layers {
+		if chainID != "" {
+			parent := chainID
+			l.parentChainID = &parent
+			chainID = digest.FromString(chainID.String() + " " + l.dgst.String())
+		} else {
+			chainID = l.dgst
+		}
+		l.chainID = chainID
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+type testSourceLayer struct {
+	dir           string
+	dgst          digest.Digest
+	size          int64
+	chainID       digest.Digest
+	parentChainID *digest.Digest
+}
+
+func (l *testSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	return []mount.Mount{{Type: "bind", Source: l.dir}}, func() error { return nil }, nil
+}
+
+func (l *testSourceLayer) Size() int64 {
+	return l.size
+}
+
+func (l *testSourceLayer) Digest() digest.Digest {
+	return l.dgst
+}
+
+func (l *testSourceLayer) ChainID() digest.Digest {
+	return l.chainID
+}
+
+func (l *testSourceLayer) ParentChainID() *digest.Digest {
+	return l.parentChainID
+}
+
+// testResolver pushes to an in-memory buffer instead of a registry.
+type testResolver struct {
+	buf contentutil.Buffer
+
+	mu     sync.Mutex
+	pushed []ocispec.Descriptor
+}
+
+func (r *testResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return "", ocispec.Descriptor{}, errors.New("not implemented")
+}
+
+func (r *testResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *testResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return remotes.PusherFunc(func(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+		r.mu.Lock()
+		r.pushed = append(r.pushed, desc)
+		r.mu.Unlock()
+		return r.buf.Writer(ctx, content.WithRef(remotes.MakeRefKey(ctx, desc)), content.WithDescriptor(desc))
+	}), nil
+}
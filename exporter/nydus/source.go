@@ -2,6 +2,7 @@ package nydus
 
 import (
 	"context"
+	"sync"
 
 	"github.com/containerd/containerd/mount"
 	"github.com/opencontainers/go-digest"
@@ -18,12 +19,75 @@ type sourceLayer struct {
 	ref       cache.ImmutableRef
 	sessionID string
 	size      int64
+	mounts    *mountTracker
 }
 
 type sourceProvider struct {
 	ref       cache.ImmutableRef
 	sessionID string
 	config    ocispec.Image
+	mounts    mountTracker
+	metrics   *conversionMetrics
+}
+
+// mountTracker keeps the release functions of source layers that are still
+// mounted, so they can be released if the conversion is aborted before the
+// converter unmounts them.
+type mountTracker struct {
+	mu       sync.Mutex
+	next     int
+	releases map[int]func() error
+	closed   bool
+}
+
+// track returns release wrapped to be called once. The pull workers of the
+// converter keep running after a failed conversion returns, so a layer
+// mounted after releaseAll is released right away.
+func (mt *mountTracker) track(release func() error) (func() error, error) {
+	mt.mu.Lock()
+	if mt.closed {
+		mt.mu.Unlock()
+		if err := release(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("source layers already released")
+	}
+	defer mt.mu.Unlock()
+	if mt.releases == nil {
+		mt.releases = map[int]func() error{}
+	}
+	id := mt.next
+	mt.next++
+
+	var once sync.Once
+	var err error
+	tracked := func() error {
+		once.Do(func() {
+			mt.mu.Lock()
+			delete(mt.releases, id)
+			mt.mu.Unlock()
+			err = release()
+		})
+		return err
+	}
+	mt.releases[id] = tracked
+	return tracked, nil
+}
+
+func (mt *mountTracker) releaseAll() error {
+	mt.mu.Lock()
+	releases := mt.releases
+	mt.releases = nil
+	mt.closed = true
+	mt.mu.Unlock()
+
+	var rerr error
+	for _, release := range releases {
+		if err := release(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	return rerr
 }
 
 func (layer *sourceLayer) Size() int64 {
@@ -47,12 +111,30 @@ func (layer *sourceLayer) ParentChainID() *digest.Digest {
 }
 
 func (layer *sourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	// Mounting an extracted ref doesn't observe the context, stop the pull
+	// workers from mounting the remaining layers of a cancelled export
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
 	mountable, err := layer.ref.Mount(ctx, true, session.NewGroup(layer.sessionID))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "mount from source ref")
 	}
 
-	return mountable.Mount()
+	mounts, release, err := mountable.Mount()
+	if err != nil {
+		return nil, nil, err
+	}
+	if release == nil {
+		return mounts, func() error { return nil }, nil
+	}
+
+	release, err = layer.mounts.track(release)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mounts, release, nil
 }
 
 func (sp *sourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
@@ -76,6 +158,10 @@ func (sp *sourceProvider) Layers(ctx context.Context) ([]provider.SourceLayer, e
 			ref:       ref,
 			sessionID: sp.sessionID,
 			size:      size,
+			mounts:    &sp.mounts,
+		}
+		if sp.metrics != nil {
+			sp.metrics.setInputSize(layer.Digest(), size)
 		}
 		layers = append([]provider.SourceLayer{layer}, layers...)
 		ref = ref.Parent()
@@ -83,3 +169,8 @@ func (sp *sourceProvider) Layers(ctx context.Context) ([]provider.SourceLayer, e
 
 	return layers, nil
 }
+
+// Release unmounts the source layers which are still mounted
+func (sp *sourceProvider) Release() error {
+	return sp.mounts.releaseAll()
+}
@@ -0,0 +1,160 @@
+package nydus
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// TestCancelConversion cancels an export while its source layers are being
+// mounted and checks that every mounted layer is released and no goroutine
+// is left behind once the conversion has returned.
+func TestCancelConversion(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("depends on a shell script as nydus builder")
+	}
+	for _, bin := range []string{"sh", "sed", "sha256sum", "cut"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+	ignore := []goleak.Option{
+		goleak.IgnoreCurrent(),
+		// The converter leaves its push workers waiting for jobs when a
+		// layer fails, they can't be stopped from outside the converter.
+		goleak.IgnoreTopFunction("github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils.NewWorkerPool.func1"),
+	}
+
+	tmpdir, err := ioutil.TempDir("", "nydussource")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	builder := filepath.Join(tmpdir, "nydus-image")
+	err = ioutil.WriteFile(builder, []byte(fakeBuilder), 0700)
+	require.NoError(t, err)
+
+	workDir := filepath.Join(tmpdir, "work")
+	require.NoError(t, os.Mkdir(workDir, 0700))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var mounted int64
+	var ref *testRef
+	for i := 0; i < 8; i++ {
+		dir := filepath.Join(tmpdir, fmt.Sprintf("layer%d", i))
+		require.NoError(t, os.Mkdir(dir, 0700))
+		ref = &testRef{
+			dir:     dir,
+			blob:    digest.FromString(dir),
+			parent:  ref,
+			mounted: &mounted,
+		}
+		if i == 2 {
+			ref.onMount = func(context.Context) {
+				cancel()
+			}
+		}
+	}
+	sp := &sourceProvider{ref: ref}
+
+	target, err := remote.New("docker.io/library/test:nydus", &testResolver{buf: contentutil.NewBuffer()})
+	require.NoError(t, err)
+
+	cvt, err := converter.New(converter.Opt{
+		Logger:          &progressLogger{metrics: newConversionMetrics(workDir)},
+		SourceProviders: []provider.SourceProvider{sp},
+		TargetRemote:    target,
+		WorkDir:         workDir,
+		NydusImagePath:  builder,
+	})
+	require.NoError(t, err)
+	err = cvt.Convert(ctx)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, context.Canceled), err)
+
+	require.NoError(t, sp.Release())
+
+	// the pull workers and the unmounts of built layers outlive the
+	// conversion
+	goleak.VerifyNone(t, ignore...)
+	require.Equal(t, int64(0), atomic.LoadInt64(&mounted))
+}
+
+// testRef is an extracted source ref of a layer directory. Like a ref of
+// the cache manager, mounting it doesn't observe the context.
+type testRef struct {
+	cache.ImmutableRef
+	dir     string
+	blob    digest.Digest
+	parent  *testRef
+	mounted *int64
+	onMount func(ctx context.Context)
+}
+
+func (r *testRef) Info() cache.RefInfo {
+	chainID := r.blob
+	if r.parent != nil {
+		chainID = digest.FromString(r.parent.Info().ChainID.String() + " " + r.blob.String())
+	}
+	return cache.RefInfo{Blob: r.blob, ChainID: chainID}
+}
+
+func (r *testRef) Parent() cache.ImmutableRef {
+	if r.parent == nil {
+		return nil
+	}
+	return r.parent
+}
+
+func (r *testRef) Size(ctx context.Context) (int64, error) {
+	return 10, nil
+}
+
+func (r *testRef) Mount(ctx context.Context, readonly bool, s session.Group) (snapshot.Mountable, error) {
+	if r.onMount != nil {
+		r.onMount(ctx)
+	}
+	return &testMountable{ref: r}, nil
+}
+
+// testMountable counts the mounts of a testRef that aren't released.
+type testMountable struct {
+	ref *testRef
+}
+
+func (m *testMountable) Mount() ([]mount.Mount, func() error, error) {
+	atomic.AddInt64(m.ref.mounted, 1)
+	var once sync.Once
+	return []mount.Mount{{Type: "bind", Source: m.ref.dir}}, func() error {
+		once.Do(func() {
+			atomic.AddInt64(m.ref.mounted, -1)
+		})
+		return nil
+	}, nil
+}
+
+func (m *testMountable) IdentityMapping() *idtools.IdentityMapping {
+	return nil
+}
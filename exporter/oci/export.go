@@ -14,6 +14,7 @@ import (
 	"github.com/moby/buildkit/exporter/containerimage"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/session/filesync"
+	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/grpcerrors"
@@ -29,9 +30,15 @@ type ExporterVariant string
 const (
 	keyImageName        = "name"
 	keyLayerCompression = "compression"
+	keyCompressionLevel = "compression-level"
+	keyForceCompression = "force-compression"
 	VariantOCI          = "oci"
 	VariantDocker       = "docker"
 	ociTypes            = "oci-mediatypes"
+
+	// forceCompressionIfSmaller only keeps converted layers that are
+	// smaller than the original ones
+	forceCompressionIfSmaller = "if-smaller"
 )
 
 type Opt struct {
@@ -54,7 +61,7 @@ func (e *imageExporter) Resolve(ctx context.Context, opt map[string]string) (exp
 	var ot *bool
 	i := &imageExporterInstance{
 		imageExporter:    e,
-		layerCompression: compression.Default,
+		layerCompression: compression.New(compression.Default),
 	}
 	for k, v := range opt {
 		switch k {
@@ -63,12 +70,33 @@ func (e *imageExporter) Resolve(ctx context.Context, opt map[string]string) (exp
 		case keyLayerCompression:
 			switch v {
 			case "gzip":
-				i.layerCompression = compression.Gzip
+				i.layerCompression.Type = compression.Gzip
 			case "uncompressed":
-				i.layerCompression = compression.Uncompressed
+				i.layerCompression.Type = compression.Uncompressed
 			default:
 				return nil, errors.Errorf("unsupported layer compression type: %v", v)
 			}
+		case keyCompressionLevel:
+			l, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value specified for %s", k)
+			}
+			i.layerCompression = i.layerCompression.SetLevel(l)
+		case keyForceCompression:
+			if v == "" {
+				i.forceCompression = true
+				continue
+			}
+			if v == forceCompressionIfSmaller {
+				i.forceCompression = true
+				i.layerCompression = i.layerCompression.SetIfSmaller()
+				continue
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value specified for %s", k)
+			}
+			i.forceCompression = b
 		case ociTypes:
 			ot = new(bool)
 			if v == "" {
@@ -92,6 +120,10 @@ func (e *imageExporter) Resolve(ctx context.Context, opt map[string]string) (exp
 	} else {
 		i.ociTypes = *ot
 	}
+	i.layerCompression = i.layerCompression.SetMediaTypes(compression.ManifestMediaTypes(i.ociTypes))
+	if err := i.layerCompression.Validate(); err != nil {
+		return nil, err
+	}
 	return i, nil
 }
 
@@ -100,7 +132,8 @@ type imageExporterInstance struct {
 	meta             map[string][]byte
 	name             string
 	ociTypes         bool
-	layerCompression compression.Type
+	layerCompression compression.Config
+	forceCompression bool
 }
 
 func (e *imageExporterInstance) Name() string {
@@ -125,7 +158,7 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 	}
 	defer done(context.TODO())
 
-	desc, err := e.opt.ImageWriter.Commit(ctx, src, e.ociTypes, e.layerCompression, sessionID)
+	desc, err := e.opt.ImageWriter.Commit(ctx, src, e.ociTypes, e.layerCompression, e.forceCompression, sessionID)
 	if err != nil {
 		return nil, err
 	}
@@ -181,7 +214,7 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 
 	mprovider := contentutil.NewMultiProvider(e.opt.ImageWriter.ContentStore())
 	if src.Ref != nil {
-		remote, err := src.Ref.GetRemote(ctx, false, e.layerCompression, session.NewGroup(sessionID))
+		remote, err := e.getRemote(ctx, src.Ref, session.NewGroup(sessionID))
 		if err != nil {
 			return nil, err
 		}
@@ -198,7 +231,7 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 	}
 	if len(src.Refs) > 0 {
 		for _, r := range src.Refs {
-			remote, err := r.GetRemote(ctx, false, e.layerCompression, session.NewGroup(sessionID))
+			remote, err := e.getRemote(ctx, r, session.NewGroup(sessionID))
 			if err != nil {
 				return nil, err
 			}
@@ -228,6 +261,16 @@ func (e *imageExporterInstance) Export(ctx context.Context, src exporter.Source,
 	return resp, report(err)
 }
 
+// getRemote returns the remote of ref with the layers the image was
+// committed with.
+func (e *imageExporterInstance) getRemote(ctx context.Context, ref cache.ImmutableRef, s session.Group) (*solver.Remote, error) {
+	remotes, err := ref.GetRemotes(ctx, false, []compression.Config{e.layerCompression}, e.forceCompression, s)
+	if err != nil {
+		return nil, err
+	}
+	return remotes[0], nil
+}
+
 func oneOffProgress(ctx context.Context, id string) func(err error) error {
 	pw, _, _ := progress.FromContext(ctx)
 	now := time.Now()
@@ -385,6 +385,16 @@ func (s *Store) HasLink(id string, link solver.CacheInfoLink, target string) boo
 }
 
 func (s *Store) WalkBacklinks(id string, fn func(id string, link solver.CacheInfoLink) error) error {
+	return s.WalkLinksTo(id, func(id string, l solver.CacheInfoLink) error {
+		l.Digest = digest.FromBytes([]byte(fmt.Sprintf("%s@%d", l.Digest, l.Output)))
+		l.Output = 0
+		return fn(id, l)
+	})
+}
+
+// WalkLinksTo calls fn with the keys linking to id and their links as they
+// were added.
+func (s *Store) WalkLinksTo(id string, fn func(id string, link solver.CacheInfoLink) error) error {
 	var outIDs []string
 	var outLinks []solver.CacheInfoLink
 
@@ -417,8 +427,6 @@ func (s *Store) WalkBacklinks(id string, fn func(id string, link solver.CacheInf
 					if err := json.Unmarshal(parts[0], &l); err != nil {
 						return err
 					}
-					l.Digest = digest.FromBytes([]byte(fmt.Sprintf("%s@%d", l.Digest, l.Output)))
-					l.Output = 0
 					outIDs = append(outIDs, string(bid))
 					outLinks = append(outLinks, l)
 				}
@@ -354,6 +354,50 @@ func TestCarryOverFromSublink(t *testing.T) {
 	require.Equal(t, len(keys), 1)
 }
 
+func TestCombinedCachePrecedence(t *testing.T) {
+	ctx := context.TODO()
+
+	m1 := NewInMemoryCacheManager()
+	m2 := NewInMemoryCacheManager()
+
+	now := time.Now()
+	_, err := m1.Save(NewCacheKey(dgst("foo"), 0), &dummyResult{id: "shared", value: "result1"}, now)
+	require.NoError(t, err)
+	_, err = m2.Save(NewCacheKey(dgst("foo"), 0), &dummyResult{id: "shared", value: "result2"}, now)
+	require.NoError(t, err)
+	_, err = m2.Save(NewCacheKey(dgst("foo"), 0), &dummyResult{id: "other", value: "other2"}, now)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		// loaded records are copied to main
+		m0 := NewInMemoryCacheManager()
+		cm := NewCombinedCacheManager([]CacheManager{m0, m1, m2}, m0)
+
+		keys, err := cm.Query(nil, 0, dgst("foo"), 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(keys))
+
+		// records of both sources are merged, identical ones are only
+		// returned once
+		matches, err := cm.Records(keys[0])
+		require.NoError(t, err)
+		require.Equal(t, 2, len(matches))
+
+		var shared *CacheRecord
+		for _, m := range matches {
+			if m.ID == "shared" {
+				shared = m
+			}
+		}
+		require.NotNil(t, shared)
+		require.Equal(t, m1.ID(), shared.cacheManager.ID())
+
+		res, err := cm.Load(ctx, shared)
+		require.NoError(t, err)
+		require.Equal(t, "result1", unwrap(res))
+	}
+}
+
 func dgst(s string) digest.Digest {
 	return digest.FromBytes([]byte(s))
 }
@@ -28,6 +28,13 @@ type CacheKeyStorage interface {
 	WalkBacklinks(id string, fn func(id string, link CacheInfoLink) error) error
 }
 
+// CacheLinkWalker is implemented by a CacheKeyStorage that can return the
+// links to a key as they were added. WalkBacklinks merges the output of a
+// link into its digest.
+type CacheLinkWalker interface {
+	WalkLinksTo(id string, fn func(id string, link CacheInfoLink) error) error
+}
+
 // CacheResult is a record for a single solve result
 type CacheResult struct {
 	CreatedAt time.Time
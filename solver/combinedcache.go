@@ -11,6 +11,11 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// NewCombinedCacheManager returns a cache manager that merges the cache
+// chains of cms. The order of cms is the precedence of the sources: if the
+// same record is found in several of them, it is loaded from the first one.
+// Results are saved to main and records loaded from other sources are copied
+// to it.
 func NewCombinedCacheManager(cms []CacheManager, main CacheManager) CacheManager {
 	return &combinedCacheManager{cms: cms, main: main}
 }
@@ -35,38 +40,61 @@ func (cm *combinedCacheManager) ID() string {
 
 func (cm *combinedCacheManager) Query(inp []CacheKeyWithSelector, inputIndex Index, dgst digest.Digest, outputIndex Index) ([]*CacheKey, error) {
 	eg, _ := errgroup.WithContext(context.TODO())
-	keys := make(map[string]*CacheKey, len(cm.cms))
-	var mu sync.Mutex
-	for _, c := range cm.cms {
-		func(c CacheManager) {
+	results := make([][]*CacheKey, len(cm.cms))
+	for i, c := range cm.cms {
+		func(i int, c CacheManager) {
 			eg.Go(func() error {
 				recs, err := c.Query(inp, inputIndex, dgst, outputIndex)
 				if err != nil {
 					return err
 				}
-				mu.Lock()
-				for _, r := range recs {
-					if _, ok := keys[r.ID]; !ok || c == cm.main {
-						keys[r.ID] = r
-					}
-				}
-				mu.Unlock()
+				results[i] = recs
 				return nil
 			})
-		}(c)
+		}(i, c)
 	}
 
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
 
-	out := make([]*CacheKey, 0, len(keys))
-	for _, k := range keys {
-		out = append(out, k)
+	// keys with the same ID are merged so that the records of all sources
+	// are found for them
+	keys := make(map[string]*CacheKey, len(cm.cms))
+	out := make([]*CacheKey, 0, len(cm.cms))
+	for _, recs := range results {
+		for _, r := range recs {
+			k, ok := keys[r.ID]
+			if !ok {
+				keys[r.ID] = r
+				out = append(out, r)
+				continue
+			}
+			r.mu.RLock()
+			k.mu.Lock()
+			for c, id := range r.ids {
+				if _, ok := k.ids[c]; !ok {
+					k.ids[c] = id
+				}
+			}
+			k.mu.Unlock()
+			r.mu.RUnlock()
+		}
 	}
 	return out, nil
 }
 
+// priority returns the precedence of the source with id, sources earlier in
+// cm.cms have higher priority.
+func (cm *combinedCacheManager) priority(id string) int {
+	for i, c := range cm.cms {
+		if c.ID() == id {
+			return len(cm.cms) - i
+		}
+	}
+	return 0
+}
+
 func (cm *combinedCacheManager) Load(ctx context.Context, rec *CacheRecord) (res Result, err error) {
 	results, err := rec.cacheManager.LoadWithParents(ctx, rec)
 	if err != nil {
@@ -101,7 +129,13 @@ func (cm *combinedCacheManager) Save(key *CacheKey, s Result, createdAt time.Tim
 }
 
 func (cm *combinedCacheManager) Records(ck *CacheKey) ([]*CacheRecord, error) {
-	if len(ck.ids) == 0 {
+	ck.mu.RLock()
+	cms := make([]*cacheManager, 0, len(ck.ids))
+	for c := range ck.ids {
+		cms = append(cms, c)
+	}
+	ck.mu.RUnlock()
+	if len(cms) == 0 {
 		return nil, errors.Errorf("no results")
 	}
 
@@ -109,19 +143,20 @@ func (cm *combinedCacheManager) Records(ck *CacheKey) ([]*CacheRecord, error) {
 	var mu sync.Mutex
 
 	eg, _ := errgroup.WithContext(context.TODO())
-	for c := range ck.ids {
+	for _, c := range cms {
 		func(c *cacheManager) {
 			eg.Go(func() error {
 				recs, err := c.Records(ck)
 				if err != nil {
 					return err
 				}
+				priority := cm.priority(c.ID())
 				mu.Lock()
+				// identical results are deduplicated by their ID, the
+				// source with the highest precedence provides them
 				for _, rec := range recs {
-					if _, ok := records[rec.ID]; !ok || c == cm.main {
-						if c == cm.main {
-							rec.Priority = 1
-						}
+					rec.Priority = priority
+					if prev, ok := records[rec.ID]; !ok || prev.Priority < priority {
 						records[rec.ID] = rec
 					}
 				}
@@ -121,6 +121,9 @@ func (e *exporter) ExportTo(ctx context.Context, t CacheExporterTarget, opt Cach
 			for _, rec := range allRec {
 				rec.AddResult(v.CreatedAt, remote)
 			}
+			if e.edge != nil {
+				setOrigin(allRec, e.edge.edge.Vertex)
+			}
 		}
 	}
 
@@ -185,6 +188,20 @@ func (e *exporter) ExportTo(ctx context.Context, t CacheExporterTarget, opt Cach
 	return e.res, nil
 }
 
+// setOrigin records vtx as the origin of the results of recs.
+func setOrigin(recs []CacheExporterRecord, vtx Vertex) {
+	origin := CacheRecordOrigin{
+		Vertex:         vtx.Digest(),
+		Name:           vtx.Name(),
+		SourceLocation: vtx.Options().SourceLocation,
+	}
+	for _, rec := range recs {
+		if r, ok := rec.(CacheExporterRecordOrigin); ok {
+			r.SetOrigin(origin)
+		}
+	}
+}
+
 func getBestResult(records []*CacheRecord) *CacheRecord {
 	var rec *CacheRecord
 	for _, r := range records {
@@ -14,6 +14,7 @@ import (
 	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/util/tracing"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 )
@@ -40,6 +41,7 @@ type Solver struct {
 	updateCond *sync.Cond
 	s          *scheduler
 	index      *edgeIndex
+	indexes    map[string]*edgeIndex // by cache namespace
 }
 
 type state struct {
@@ -62,9 +64,13 @@ type state struct {
 	opts  SolverOpt
 	index *edgeIndex
 
-	cache     map[string]CacheManager
-	mainCache CacheManager
-	solver    *Solver
+	cache map[string]CacheManager
+	// cacheOrder is the order the cache sources were added in, earlier
+	// sources take precedence
+	cacheOrder []string
+	mainCache  CacheManager
+	solver     *Solver
+	namespace  string
 }
 
 func (s *state) SessionIterator() session.Iterator {
@@ -171,8 +177,8 @@ func (s *state) combinedCacheManager() CacheManager {
 	s.mu.Lock()
 	cms := make([]CacheManager, 0, len(s.cache)+1)
 	cms = append(cms, s.mainCache)
-	for _, cm := range s.cache {
-		cms = append(cms, cm)
+	for _, id := range s.cacheOrder {
+		cms = append(cms, s.cache[id])
 	}
 	s.mu.Unlock()
 
@@ -183,6 +189,32 @@ func (s *state) combinedCacheManager() CacheManager {
 	return NewCombinedCacheManager(cms, s.mainCache)
 }
 
+func (s *state) addCache(cm CacheManager) {
+	if _, ok := s.cache[cm.ID()]; ok {
+		return
+	}
+	s.cache[cm.ID()] = cm
+	s.cacheOrder = append(s.cacheOrder, cm.ID())
+}
+
+// recordCacheHit counts a result loaded from an imported cache source for
+// all jobs of the vertex.
+func (s *state) recordCacheHit(ctx context.Context, rec *CacheRecord) {
+	if rec.cacheManager == nil || rec.cacheManager.ID() == s.mainCache.ID() {
+		return
+	}
+	// the layers are only known if the source stores remotes
+	var descs []ocispec.Descriptor
+	if remote, err := rec.cacheManager.results.LoadRemote(ctx, CacheResult{ID: rec.ID, CreatedAt: rec.CreatedAt}, nil); err == nil && remote != nil {
+		descs = remote.Descriptors
+	}
+	s.mu.Lock()
+	for j := range s.jobs {
+		j.addCacheHit(rec.cacheManager.ID(), descs)
+	}
+	s.mu.Unlock()
+}
+
 func (s *state) Release() {
 	for _, e := range s.edges {
 		e.release()
@@ -234,11 +266,21 @@ type Job struct {
 
 	progressCloser func()
 	SessionID      string
+	// CacheNamespace isolates the cache of the job from jobs in other
+	// namespaces. Its vertexes are not shared with jobs of other namespaces
+	// and use the cache returned by SolverOpt.NamespaceCache.
+	CacheNamespace string
+
+	cacheStatsMu sync.Mutex
+	cacheStats   map[string]*cacheSourceStats
 }
 
 type SolverOpt struct {
 	ResolveOpFunc ResolveOpFunc
 	DefaultCache  CacheManager
+	// NamespaceCache returns the cache used instead of DefaultCache for
+	// jobs with a CacheNamespace.
+	NamespaceCache func(ns string) CacheManager
 }
 
 func NewSolver(opts SolverOpt) *Solver {
@@ -250,6 +292,7 @@ func NewSolver(opts SolverOpt) *Solver {
 		actives: make(map[digest.Digest]*state),
 		opts:    opts,
 		index:   newEdgeIndex(),
+		indexes: make(map[string]*edgeIndex),
 	}
 	jl.s = newScheduler(jl)
 	jl.updateCond = sync.NewCond(jl.mu.RLocker())
@@ -329,6 +372,11 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 
 	dgst := v.Digest()
 
+	ns := jl.cacheNamespace(parent, j)
+	if ns != "" {
+		dgst = namespacedDigest(dgst, ns)
+	}
+
 	dgstWithoutCache := digest.FromBytes([]byte(fmt.Sprintf("%s-ignorecache", dgst)))
 
 	// if same vertex is already loaded without cache just use that
@@ -352,6 +400,10 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 	}
 
 	if !ok {
+		mainCache := jl.opts.DefaultCache
+		if ns != "" && jl.opts.NamespaceCache != nil {
+			mainCache = jl.opts.NamespaceCache(ns)
+		}
 		st = &state{
 			opts:         jl.opts,
 			jobs:         map[*Job]struct{}{},
@@ -364,11 +416,12 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 			vtx:          v,
 			clientVertex: initClientVertex(v),
 			edges:        map[Index]*edge{},
-			index:        jl.index,
-			mainCache:    jl.opts.DefaultCache,
+			index:        jl.namespaceIndex(ns),
+			mainCache:    mainCache,
 			cache:        map[string]CacheManager{},
 			solver:       jl,
 			origDigest:   origVtx.Digest(),
+			namespace:    ns,
 		}
 		jl.actives[dgst] = st
 	}
@@ -376,9 +429,7 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 	st.mu.Lock()
 	for _, cache := range v.Options().CacheSources {
 		if cache.ID() != st.mainCache.ID() {
-			if _, ok := st.cache[cache.ID()]; !ok {
-				st.cache[cache.ID()] = cache
-			}
+			st.addCache(cache)
 		}
 	}
 
@@ -398,8 +449,8 @@ func (jl *Solver) loadUnlocked(v, parent Vertex, j *Job, cache map[Vertex]Vertex
 			}
 			parentState.childVtx[dgst] = struct{}{}
 
-			for id, c := range parentState.cache {
-				st.cache[id] = c
+			for _, id := range parentState.cacheOrder {
+				st.addCache(parentState.cache[id])
 			}
 		}
 	}
@@ -541,6 +592,56 @@ func (j *Job) InContext(ctx context.Context, f func(context.Context, session.Gro
 	return f(progress.WithProgress(ctx, j.pw), session.NewGroup(j.SessionID))
 }
 
+// CacheSourceStats describe the results a job loaded from an imported
+// cache source.
+type CacheSourceStats struct {
+	// Hits is the number of vertexes loaded from the source.
+	Hits int
+	// Size is the total size of the distinct layer blobs of the loaded
+	// results. Layers of imported results are only pulled if their content
+	// is needed, so this is the most that loading them could have pulled.
+	Size int64
+}
+
+type cacheSourceStats struct {
+	hits  int
+	blobs map[digest.Digest]int64
+}
+
+func (j *Job) addCacheHit(id string, descs []ocispec.Descriptor) {
+	j.cacheStatsMu.Lock()
+	defer j.cacheStatsMu.Unlock()
+	if j.cacheStats == nil {
+		j.cacheStats = map[string]*cacheSourceStats{}
+	}
+	st, ok := j.cacheStats[id]
+	if !ok {
+		st = &cacheSourceStats{blobs: map[digest.Digest]int64{}}
+		j.cacheStats[id] = st
+	}
+	st.hits++
+	for _, desc := range descs {
+		st.blobs[desc.Digest] = desc.Size
+	}
+}
+
+// CacheStats returns the results of the job loaded from each imported cache
+// source, keyed by the ID of the source cache manager. Results found in the
+// cache of the solver are not counted.
+func (j *Job) CacheStats() map[string]CacheSourceStats {
+	j.cacheStatsMu.Lock()
+	defer j.cacheStatsMu.Unlock()
+	m := make(map[string]CacheSourceStats, len(j.cacheStats))
+	for id, st := range j.cacheStats {
+		stats := CacheSourceStats{Hits: st.hits}
+		for _, size := range st.blobs {
+			stats.Size += size
+		}
+		m[id] = stats
+	}
+	return m
+}
+
 func (j *Job) SetValue(key string, v interface{}) {
 	j.values.Store(key, v)
 }
@@ -617,7 +718,11 @@ func (s *sharedOp) LoadCache(ctx context.Context, rec *CacheRecord) (Result, err
 	// no cache hit. start evaluating the node
 	span, ctx := tracing.StartSpan(ctx, "load cache: "+s.st.vtx.Name())
 	notifyStarted(ctx, &s.st.clientVertex, true)
+	ctx = WithCacheNamespace(ctx, s.st.namespace)
 	res, err := s.Cache().Load(withAncestorCacheOpts(ctx, s.st), rec)
+	if err == nil {
+		s.st.recordCacheHit(ctx, rec)
+	}
 	tracing.FinishWithError(span, err)
 	notifyCompleted(ctx, &s.st.clientVertex, err, true)
 	return res, err
@@ -708,6 +813,7 @@ func (s *sharedOp) CacheMap(ctx context.Context, index int) (resp *cacheMapResp,
 		}
 		ctx = opentracing.ContextWithSpan(progress.WithProgress(ctx, s.st.mpw), s.st.mspan)
 		ctx = withAncestorCacheOpts(ctx, s.st)
+		ctx = WithCacheNamespace(ctx, s.st.namespace)
 		if len(s.st.vtx.Inputs()) == 0 {
 			// no cache hit. start evaluating the node
 			span, ctx := tracing.StartSpan(ctx, "cache request: "+s.st.vtx.Name())
@@ -766,6 +872,7 @@ func (s *sharedOp) Exec(ctx context.Context, inputs []Result) (outputs []Result,
 
 		ctx = opentracing.ContextWithSpan(progress.WithProgress(ctx, s.st.mpw), s.st.mspan)
 		ctx = withAncestorCacheOpts(ctx, s.st)
+		ctx = WithCacheNamespace(ctx, s.st.namespace)
 
 		// no cache hit. start evaluating the node
 		span, ctx := tracing.StartSpan(ctx, s.st.vtx.Name())
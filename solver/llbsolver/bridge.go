@@ -46,6 +46,7 @@ func (b *llbBridge) loadResult(ctx context.Context, def *pb.Definition, cacheImp
 		return nil, err
 	}
 	var cms []solver.CacheManager
+	var verified []*lazyCacheManager
 	for _, im := range cacheImports {
 		cmID, err := cmKey(im)
 		if err != nil {
@@ -80,8 +81,18 @@ func (b *llbBridge) loadResult(ctx context.Context, def *pb.Definition, cacheImp
 			cm = prevCm
 		}
 		cms = append(cms, cm)
+		if lcm, ok := cm.(*lazyCacheManager); ok && im.Attrs["verify"] != "" {
+			verified = append(verified, lcm)
+		}
 		b.cmsMu.Unlock()
 	}
+	// caches failing the signature verification fail the build instead of
+	// being skipped like other import errors
+	for _, lcm := range verified {
+		if err := lcm.wait(); errors.Is(err, remotecache.ErrSignatureVerification) {
+			return nil, err
+		}
+	}
 	dpc := &detectPrunedCacheID{}
 
 	edge, err := Load(def, dpc.Load, ValidateEntitlements(ent), WithCacheSources(cms), NormalizeRuntimePlatforms(), WithValidateCaps())
@@ -226,7 +226,7 @@ func (e *execOp) Exec(ctx context.Context, g session.Group, inputs []solver.Resu
 
 	p, err := gateway.PrepareMounts(ctx, e.mm, e.cm, g, e.op.Mounts, refs, func(m *pb.Mount, ref cache.ImmutableRef) (cache.MutableRef, error) {
 		desc := fmt.Sprintf("mount %s from exec %s", m.Dest, strings.Join(e.op.Meta.Args, " "))
-		return e.cm.New(ctx, ref, g, cache.WithDescription(desc))
+		return e.cm.New(ctx, ref, g, cache.WithDescription(desc), cache.ReserveSpace)
 	})
 	defer func() {
 		if err != nil {
@@ -6,6 +6,7 @@ import (
 	"path"
 
 	"github.com/moby/buildkit/cache/contenthash"
+	"github.com/moby/buildkit/cache/remotecache"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/util/compression"
@@ -75,13 +76,32 @@ func NewContentHashFunc(selectors []Selector) solver.ResultBasedCacheFunc {
 	}
 }
 
-func workerRefConverter(g session.Group) func(ctx context.Context, res solver.Result) (*solver.Remote, error) {
+// cacheExportConverter returns the converter of the results exported with
+// the layer compression lc. Without force, existing layers are only
+// converted if the backend can't store their compression.
+func cacheExportConverter(lc remotecache.LayerCompressionChoice, g session.Group) func(ctx context.Context, res solver.Result) (*solver.Remote, error) {
 	return func(ctx context.Context, res solver.Result) (*solver.Remote, error) {
 		ref, ok := res.Sys().(*worker.WorkerRef)
 		if !ok {
 			return nil, errors.Errorf("invalid result: %T", res.Sys())
 		}
 
-		return ref.GetRemote(ctx, true, compression.Default, g)
+		remotes, err := ref.GetRemotes(ctx, true, []compression.Config{lc.Config}, lc.Force, g)
+		if err != nil {
+			return nil, err
+		}
+		if lc.Force {
+			return remotes[0], nil
+		}
+		for _, desc := range remotes[0].Descriptors {
+			if !lc.IsSupported(compression.FromMediaType(desc.MediaType)) {
+				remotes, err = ref.GetRemotes(ctx, true, []compression.Config{lc.Config}, true, g)
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		return remotes[0], nil
 	}
 }
@@ -2,10 +2,13 @@ package llbsolver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/cache/remotecache"
 	"github.com/moby/buildkit/client"
@@ -18,10 +21,13 @@ import (
 	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/entitlements"
+	"github.com/moby/buildkit/util/leaseutil"
 	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/worker"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -31,6 +37,10 @@ type ExporterRequest struct {
 	Exporter        exporter.ExporterInstance
 	CacheExporter   remotecache.Exporter
 	CacheExportMode solver.CacheExportMode
+	// CacheExportPlatformSplit writes the cache of every platform of a
+	// multi-platform build to its own cache manifest if the cache exporter
+	// supports it.
+	CacheExportPlatformSplit bool
 }
 
 // ResolveWorkerFunc returns default worker for the temporary default non-distributed use cases
@@ -48,7 +58,7 @@ type Solver struct {
 	entitlements              []string
 }
 
-func New(wc *worker.Controller, f map[string]frontend.Frontend, cache solver.CacheManager, resolveCI map[string]remotecache.ResolveCacheImporterFunc, gatewayForwarder *controlgateway.GatewayForwarder, sm *session.Manager, ents []string) (*Solver, error) {
+func New(wc *worker.Controller, f map[string]frontend.Frontend, cache solver.CacheManager, namespaceCache func(string) solver.CacheManager, resolveCI map[string]remotecache.ResolveCacheImporterFunc, gatewayForwarder *controlgateway.GatewayForwarder, sm *session.Manager, ents []string) (*Solver, error) {
 	s := &Solver{
 		workerController:          wc,
 		resolveWorker:             defaultResolver(wc),
@@ -61,8 +71,9 @@ func New(wc *worker.Controller, f map[string]frontend.Frontend, cache solver.Cac
 	}
 
 	s.solver = solver.NewSolver(solver.SolverOpt{
-		ResolveOpFunc: s.resolver(),
-		DefaultCache:  cache,
+		ResolveOpFunc:  s.resolver(),
+		DefaultCache:   cache,
+		NamespaceCache: namespaceCache,
 	})
 	return s, nil
 }
@@ -89,7 +100,7 @@ func (s *Solver) Bridge(b solver.Builder) frontend.FrontendLLBBridge {
 	}
 }
 
-func (s *Solver) Solve(ctx context.Context, id string, sessionID string, req frontend.SolveRequest, exp ExporterRequest, ent []entitlements.Entitlement) (*client.SolveResponse, error) {
+func (s *Solver) Solve(ctx context.Context, id string, sessionID string, cacheNamespace string, req frontend.SolveRequest, exp ExporterRequest, ent []entitlements.Entitlement) (*client.SolveResponse, error) {
 	j, err := s.solver.NewJob(id)
 	if err != nil {
 		return nil, err
@@ -104,6 +115,7 @@ func (s *Solver) Solve(ctx context.Context, id string, sessionID string, req fro
 	j.SetValue(keyEntitlements, set)
 
 	j.SessionID = sessionID
+	j.CacheNamespace = cacheNamespace
 
 	var res *frontend.Result
 	if s.gatewayForwarder != nil && req.Definition == nil && req.Frontend == "" {
@@ -154,6 +166,14 @@ func (s *Solver) Solve(ctx context.Context, id string, sessionID string, req fro
 		return nil, err
 	}
 
+	importStats, err := cacheImportStats(j, req.CacheImports)
+	if err != nil {
+		return nil, err
+	}
+	if err := reportCacheImportStats(ctx, j, importStats); err != nil {
+		return nil, err
+	}
+
 	var exporterResponse map[string]string
 	if e := exp.Exporter; e != nil {
 		inp := exporter.Source{
@@ -173,7 +193,7 @@ func (s *Solver) Solve(ctx context.Context, id string, sessionID string, req fro
 			}
 			inp.Ref = workerRef.ImmutableRef
 
-			dt, err := inlineCache(ctx, exp.CacheExporter, r, session.NewGroup(sessionID))
+			dt, err := inlineCache(ctx, exp.CacheExporter, r, exp.CacheExportMode, session.NewGroup(sessionID))
 			if err != nil {
 				return nil, err
 			}
@@ -197,7 +217,7 @@ func (s *Solver) Solve(ctx context.Context, id string, sessionID string, req fro
 					}
 					m[k] = workerRef.ImmutableRef
 
-					dt, err := inlineCache(ctx, exp.CacheExporter, r, session.NewGroup(sessionID))
+					dt, err := inlineCache(ctx, exp.CacheExporter, r, exp.CacheExportMode, session.NewGroup(sessionID))
 					if err != nil {
 						return nil, err
 					}
@@ -221,15 +241,39 @@ func (s *Solver) Solve(ctx context.Context, id string, sessionID string, req fro
 	var cacheExporterResponse map[string]string
 	if e := exp.CacheExporter; e != nil {
 		if err := inBuilderContext(ctx, j, "exporting cache", "", func(ctx context.Context, _ session.Group) error {
+			// refs are released as soon as their remotes are collected, the
+			// lease keeps the blobs from being pruned until they are pushed
+			w, err := s.resolveWorker()
+			if err != nil {
+				return err
+			}
+			ctx, done, err := leaseutil.WithLease(ctx, w.LeaseManager(), leaseutil.MakeTemporary)
+			if err != nil {
+				return err
+			}
+			defer done(context.TODO())
+
+			targets, err := cacheExportTargets(e, res, exp.CacheExportPlatformSplit)
+			if err != nil {
+				return err
+			}
+
+			lc := remotecache.NegotiateLayerCompression(e)
+			oneOffProgress(ctx, fmt.Sprintf("using %s cache layer compression", lc))(nil)
+
 			prepareDone := oneOffProgress(ctx, "preparing build cache for export")
 			if err := res.EachRef(func(res solver.ResultProxy) error {
 				r, err := res.Result(ctx)
 				if err != nil {
 					return err
 				}
+				t, ok := targets[res]
+				if !ok {
+					t = e
+				}
 				// all keys have same export chain so exporting others is not needed
-				_, err = r.CacheKeys()[0].Exporter.ExportTo(ctx, e, solver.CacheExportOpt{
-					Convert: workerRefConverter(g),
+				_, err = r.CacheKeys()[0].Exporter.ExportTo(ctx, t, solver.CacheExportOpt{
+					Convert: cacheExportConverter(lc, g),
 					Mode:    exp.CacheExportMode,
 					Session: g,
 				})
@@ -259,13 +303,61 @@ func (s *Solver) Solve(ctx context.Context, id string, sessionID string, req fro
 			exporterResponse[k] = v
 		}
 	}
+	if len(importStats) > 0 {
+		dt, err := json.Marshal(importStats)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		exporterResponse[client.ExporterResponseCacheImportStats] = string(dt)
+	}
 
 	return &client.SolveResponse{
 		ExporterResponse: exporterResponse,
 	}, nil
 }
 
-func inlineCache(ctx context.Context, e remotecache.Exporter, res solver.CachedResult, g session.Group) ([]byte, error) {
+// cacheExportTargets returns the targets for the cache of the platform refs
+// of res if the cache is split by platform. Other refs are exported to e.
+func cacheExportTargets(e remotecache.Exporter, res *frontend.Result, split bool) (map[solver.ResultProxy]solver.CacheExporterTarget, error) {
+	if !split || len(res.Refs) == 0 {
+		return nil, nil
+	}
+	ps, ok := e.(remotecache.PlatformSplitter)
+	if !ok {
+		logrus.Warn("cache exporter doesn't support splitting the cache by platform")
+		return nil, nil
+	}
+
+	byID := map[string]ocispec.Platform{}
+	if dt, ok := res.Metadata[exptypes.ExporterPlatformsKey]; ok {
+		var p exptypes.Platforms
+		if err := json.Unmarshal(dt, &p); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse platforms passed to exporter")
+		}
+		for _, pl := range p.Platforms {
+			byID[pl.ID] = pl.Platform
+		}
+	}
+
+	targets := map[solver.ResultProxy]solver.CacheExporterTarget{}
+	for k, ref := range res.Refs {
+		if ref == nil {
+			continue
+		}
+		p, ok := byID[k]
+		if !ok {
+			var err error
+			if p, err = platforms.Parse(k); err != nil {
+				logrus.Debugf("not splitting cache of ref %s: %v", k, err)
+				continue
+			}
+		}
+		targets[ref] = ps.ForPlatform(p)
+	}
+	return targets, nil
+}
+
+func inlineCache(ctx context.Context, e remotecache.Exporter, res solver.CachedResult, mode solver.CacheExportMode, g session.Group) ([]byte, error) {
 	if efl, ok := e.(interface {
 		ExportForLayers([]digest.Digest) ([]byte, error)
 	}); ok {
@@ -274,7 +366,7 @@ func inlineCache(ctx context.Context, e remotecache.Exporter, res solver.CachedR
 			return nil, errors.Errorf("invalid reference: %T", res.Sys())
 		}
 
-		remote, err := workerRef.GetRemote(ctx, true, compression.Default, g)
+		remote, err := workerRef.GetRemote(ctx, true, compression.New(compression.Default), g)
 		if err != nil || remote == nil {
 			return nil, nil
 		}
@@ -284,9 +376,11 @@ func inlineCache(ctx context.Context, e remotecache.Exporter, res solver.CachedR
 			digests = append(digests, desc.Digest)
 		}
 
+		// with mode=max only the results of intermediate steps that are
+		// layers of the image are kept by ExportForLayers
 		if _, err := res.CacheKeys()[0].Exporter.ExportTo(ctx, e, solver.CacheExportOpt{
-			Convert: workerRefConverter(g),
-			Mode:    solver.CacheExportModeMin,
+			Convert: cacheExportConverter(remotecache.NegotiateLayerCompression(e), g),
+			Mode:    mode,
 			Session: g,
 		}); err != nil {
 			return nil, err
@@ -297,6 +391,66 @@ func inlineCache(ctx context.Context, e remotecache.Exporter, res solver.CachedR
 	return nil, nil
 }
 
+// cacheImportStats returns the results the job loaded from each imported
+// cache. Sources imported by frontends are listed after the cache imports of
+// the request.
+func cacheImportStats(j *solver.Job, cacheImports []frontend.CacheOptionsEntry) ([]client.CacheImportStats, error) {
+	stats := j.CacheStats()
+	ids := make([]string, 0, len(cacheImports)+len(stats))
+	seen := map[string]struct{}{}
+	for _, im := range cacheImports {
+		id, err := cmKey(im)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	var other []string
+	for id := range stats {
+		if _, ok := seen[id]; !ok {
+			other = append(other, id)
+		}
+	}
+	sort.Strings(other)
+	ids = append(ids, other...)
+
+	out := make([]client.CacheImportStats, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, client.CacheImportStats{
+			Source: id,
+			Hits:   stats[id].Hits,
+			Size:   stats[id].Size,
+		})
+	}
+	return out, nil
+}
+
+// reportCacheImportStats writes the stats of each imported cache to the
+// progress of the job. The size of the loaded layers is reported as the
+// progress of the source.
+func reportCacheImportStats(ctx context.Context, j *solver.Job, stats []client.CacheImportStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	return inBuilderContext(ctx, j, "cache import summary", "", func(ctx context.Context, _ session.Group) error {
+		pw, _, _ := progress.FromContext(ctx)
+		defer pw.Close()
+		now := time.Now()
+		for _, st := range stats {
+			pw.Write(fmt.Sprintf("%s: %d cache hits", st.Source, st.Hits), progress.Status{
+				Current:   int(st.Size),
+				Total:     int(st.Size),
+				Started:   &now,
+				Completed: &now,
+			})
+		}
+		return nil
+	})
+}
+
 func (s *Solver) Status(ctx context.Context, id string, statusChan chan *client.SolveStatus) error {
 	j, err := s.solver.Get(id)
 	if err != nil {
@@ -2,6 +2,7 @@ package llbsolver
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd/platforms"
@@ -150,10 +151,40 @@ func Load(def *pb.Definition, opts ...LoadOpt) (solver.Edge, error) {
 		if err != nil {
 			return nil, err
 		}
+		vtx.options.SourceLocation = sourceLocation(def.Source, dgst)
 		return vtx, nil
 	})
 }
 
+// sourceLocation formats the first source mapping of the vertex dgst as
+// the file name followed by the line ranges, e.g. "Dockerfile:3-5,7".
+func sourceLocation(src *pb.Source, dgst digest.Digest) string {
+	if src == nil {
+		return ""
+	}
+	locs, ok := src.Locations[dgst.String()]
+	if !ok || len(locs.Locations) == 0 {
+		return ""
+	}
+	loc := locs.Locations[0]
+	if loc.SourceIndex < 0 || int(loc.SourceIndex) >= len(src.Infos) {
+		return ""
+	}
+	ranges := make([]string, 0, len(loc.Ranges))
+	for _, r := range loc.Ranges {
+		if r.Start.Line == r.End.Line {
+			ranges = append(ranges, strconv.Itoa(int(r.Start.Line)))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", r.Start.Line, r.End.Line))
+		}
+	}
+	name := src.Infos[loc.SourceIndex].Filename
+	if len(ranges) == 0 {
+		return name
+	}
+	return name + ":" + strings.Join(ranges, ",")
+}
+
 func newVertex(dgst digest.Digest, op *pb.Op, opMeta *pb.OpMetadata, load func(digest.Digest) (solver.Vertex, error), opts ...LoadOpt) (*vertex, error) {
 	opt := solver.VertexOptions{}
 	if opMeta != nil {
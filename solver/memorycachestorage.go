@@ -242,6 +242,16 @@ func (s *inMemoryStore) HasLink(id string, link CacheInfoLink, target string) bo
 }
 
 func (s *inMemoryStore) WalkBacklinks(id string, fn func(id string, link CacheInfoLink) error) error {
+	return s.WalkLinksTo(id, func(id string, l CacheInfoLink) error {
+		return fn(id, CacheInfoLink{
+			Digest:   rootKey(l.Digest, l.Output),
+			Input:    l.Input,
+			Selector: l.Selector,
+		})
+	})
+}
+
+func (s *inMemoryStore) WalkLinksTo(id string, fn func(id string, link CacheInfoLink) error) error {
 	s.mu.RLock()
 	k, ok := s.byID[id]
 	if !ok {
@@ -260,11 +270,7 @@ func (s *inMemoryStore) WalkBacklinks(id string, fn func(id string, link CacheIn
 				continue
 			}
 			outIDs = append(outIDs, bid)
-			outLinks = append(outLinks, CacheInfoLink{
-				Digest:   rootKey(l.Digest, l.Output),
-				Input:    l.Input,
-				Selector: l.Selector,
-			})
+			outLinks = append(outLinks, l)
 		}
 	}
 	s.mu.RUnlock()
@@ -0,0 +1,60 @@
+package solver
+
+import (
+	"context"
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type cacheNamespaceKey struct{}
+
+// WithCacheNamespace returns a context for the operations of a build in the
+// cache namespace ns. Cache records created with the context belong to the
+// namespace and records of other namespaces are not loaded with it. An empty
+// ns clears the namespace of ctx.
+func WithCacheNamespace(ctx context.Context, ns string) context.Context {
+	if ns == "" && CacheNamespaceOf(ctx) == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, cacheNamespaceKey{}, ns)
+}
+
+// CacheNamespaceOf returns the cache namespace of the build ctx belongs to or
+// an empty string for builds without a namespace.
+func CacheNamespaceOf(ctx context.Context) string {
+	ns, _ := ctx.Value(cacheNamespaceKey{}).(string)
+	return ns
+}
+
+// cacheNamespace returns the namespace for a vertex loaded by j or as a
+// dependency of parent. Requires jl.mu.
+func (jl *Solver) cacheNamespace(parent Vertex, j *Job) string {
+	if j != nil {
+		return j.CacheNamespace
+	}
+	if parent != nil {
+		if st, ok := jl.actives[parent.Digest()]; ok {
+			return st.namespace
+		}
+	}
+	return ""
+}
+
+// namespaceIndex returns the edge index for the namespace so that edges with
+// equal cache keys are not merged across namespaces. Requires jl.mu.
+func (jl *Solver) namespaceIndex(ns string) *edgeIndex {
+	if ns == "" {
+		return jl.index
+	}
+	idx, ok := jl.indexes[ns]
+	if !ok {
+		idx = newEdgeIndex()
+		jl.indexes[ns] = idx
+	}
+	return idx
+}
+
+func namespacedDigest(dgst digest.Digest, ns string) digest.Digest {
+	return digest.FromBytes([]byte(fmt.Sprintf("%s-ns-%s", dgst, ns)))
+}
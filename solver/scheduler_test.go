@@ -1427,6 +1427,79 @@ func TestMultipleCacheSources(t *testing.T) {
 	j1 = nil
 }
 
+func TestCacheSourceStats(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	cacheManager := NewCacheManager(identity.NewID(), NewInMemoryCacheStorage(), &remoteResultStorage{
+		CacheResultStorage: NewInMemoryResultStorage(),
+		size:               10,
+	})
+
+	l := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		DefaultCache:  cacheManager,
+	})
+	defer l.Close()
+
+	j0, err := l.NewJob("j0")
+	require.NoError(t, err)
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			value:        "result0",
+		}),
+	}
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrap(res), "result0")
+	require.Equal(t, 0, len(j0.CacheStats()))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+
+	l2 := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		DefaultCache:  NewInMemoryCacheManager(),
+	})
+	defer l2.Close()
+
+	j1, err := l2.NewJob("j1")
+	require.NoError(t, err)
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	g1 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			value:        "result0-no-cache",
+			cacheSource:  cacheManager,
+		}),
+	}
+
+	res, err = j1.Build(ctx, g1)
+	require.NoError(t, err)
+	require.Equal(t, unwrap(res), "result0")
+	require.Equal(t, map[string]CacheSourceStats{cacheManager.ID(): {Hits: 1, Size: 10}}, j1.CacheStats())
+
+	require.NoError(t, j1.Discard())
+	j1 = nil
+}
+
 func TestRepeatBuildWithIgnoreCache(t *testing.T) {
 	t.Parallel()
 	ctx := context.TODO()
@@ -2144,6 +2217,9 @@ func TestCacheExporting(t *testing.T) {
 	require.Equal(t, expTarget.records[0].links, 2)
 	require.Equal(t, expTarget.records[1].links, 0)
 	require.Equal(t, expTarget.records[2].links, 0)
+	require.NotNil(t, expTarget.records[0].origin)
+	require.Equal(t, g0.Vertex.Digest(), expTarget.records[0].origin.Vertex)
+	require.Equal(t, g0.Vertex.Name(), expTarget.records[0].origin.Name)
 
 	j1, err := l.NewJob("j1")
 	require.NoError(t, err)
@@ -2175,6 +2251,9 @@ func TestCacheExporting(t *testing.T) {
 	require.Equal(t, expTarget.records[0].links, 2)
 	require.Equal(t, expTarget.records[1].links, 0)
 	require.Equal(t, expTarget.records[2].links, 0)
+	require.NotNil(t, expTarget.records[0].origin)
+	require.Equal(t, g0.Vertex.Digest(), expTarget.records[0].origin.Vertex)
+	require.Equal(t, g0.Vertex.Name(), expTarget.records[0].origin.Name)
 }
 
 func TestCacheExportingModeMin(t *testing.T) {
@@ -3103,6 +3182,124 @@ func TestMergedEdgesLookup(t *testing.T) {
 	}
 }
 
+func TestCacheNamespace(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	caches := map[string]CacheManager{
+		"a": NewInMemoryCacheManager(),
+		"b": NewInMemoryCacheManager(),
+	}
+
+	s := NewSolver(SolverOpt{
+		ResolveOpFunc: testOpResolver,
+		NamespaceCache: func(ns string) CacheManager {
+			return caches[ns]
+		},
+	})
+	defer s.Close()
+
+	j0, err := s.NewJob("job0")
+	require.NoError(t, err)
+	j0.CacheNamespace = "a"
+
+	defer func() {
+		if j0 != nil {
+			j0.Discard()
+		}
+	}()
+
+	g0 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v0",
+			cacheKeySeed: "seed0",
+			value:        "result0",
+		}),
+	}
+	g0.Vertex.(*vertex).setupCallCounters()
+
+	res, err := j0.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrap(res), "result0")
+
+	// the active vertex of the other namespace is not shared
+	j1, err := s.NewJob("job1")
+	require.NoError(t, err)
+	j1.CacheNamespace = "b"
+
+	defer func() {
+		if j1 != nil {
+			j1.Discard()
+		}
+	}()
+
+	res, err = j1.Build(ctx, g0)
+	require.NoError(t, err)
+	require.Equal(t, unwrap(res), "result0")
+
+	require.Equal(t, *g0.Vertex.(*vertex).execCallCount, int64(2))
+
+	require.NoError(t, j0.Discard())
+	j0 = nil
+	require.NoError(t, j1.Discard())
+	j1 = nil
+
+	// the cache of the namespace matches
+	j2, err := s.NewJob("job2")
+	require.NoError(t, err)
+	j2.CacheNamespace = "a"
+
+	defer func() {
+		if j2 != nil {
+			j2.Discard()
+		}
+	}()
+
+	g2 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v2",
+			cacheKeySeed: "seed0",
+			value:        "result2",
+		}),
+	}
+	g2.Vertex.(*vertex).setupCallCounters()
+
+	res, err = j2.Build(ctx, g2)
+	require.NoError(t, err)
+	require.Equal(t, unwrap(res), "result0")
+	require.Equal(t, *g2.Vertex.(*vertex).execCallCount, int64(0))
+
+	require.NoError(t, j2.Discard())
+	j2 = nil
+
+	// the default cache doesn't match the namespaced builds
+	j3, err := s.NewJob("job3")
+	require.NoError(t, err)
+
+	defer func() {
+		if j3 != nil {
+			j3.Discard()
+		}
+	}()
+
+	g3 := Edge{
+		Vertex: vtx(vtxOpt{
+			name:         "v3",
+			cacheKeySeed: "seed0",
+			value:        "result3",
+		}),
+	}
+	g3.Vertex.(*vertex).setupCallCounters()
+
+	res, err = j3.Build(ctx, g3)
+	require.NoError(t, err)
+	require.Equal(t, unwrap(res), "result3")
+	require.Equal(t, *g3.Vertex.(*vertex).execCallCount, int64(1))
+
+	require.NoError(t, j3.Discard())
+	j3 = nil
+}
+
 func TestCacheLoadError(t *testing.T) {
 	t.Parallel()
 
@@ -3685,6 +3882,22 @@ func newTrackingCacheManager(cm CacheManager) *trackingCacheManager {
 	return &trackingCacheManager{CacheManager: cm}
 }
 
+// remoteResultStorage returns a remote with a single layer of size for all
+// results.
+type remoteResultStorage struct {
+	CacheResultStorage
+	size int64
+}
+
+func (s *remoteResultStorage) LoadRemote(_ context.Context, res CacheResult, _ session.Group) (*Remote, error) {
+	return &Remote{
+		Descriptors: []ocispec.Descriptor{{
+			Digest: digest.FromBytes([]byte(res.ID)),
+			Size:   s.size,
+		}},
+	}, nil
+}
+
 type trackingCacheManager struct {
 	CacheManager
 	loadCounter int64
@@ -3768,6 +3981,11 @@ type testExporterRecord struct {
 	results int
 	links   int
 	linkMap map[digest.Digest]struct{}
+	origin  *CacheRecordOrigin
+}
+
+func (r *testExporterRecord) SetOrigin(o CacheRecordOrigin) {
+	r.origin = &o
 }
 
 func (r *testExporterRecord) AddResult(createdAt time.Time, result *Remote) {
@@ -53,6 +53,9 @@ type VertexOptions struct {
 	CacheSources []CacheManager
 	Description  map[string]string // text values with no special meaning for solver
 	ExportCache  *bool
+	// SourceLocation is the location of the vertex in the source of the
+	// frontend, e.g. "Dockerfile:3-5".
+	SourceLocation string
 	// WorkerConstraint
 }
 
@@ -118,6 +121,20 @@ type CacheExporterRecord interface {
 	LinkFrom(src CacheExporterRecord, index int, selector string)
 }
 
+// CacheRecordOrigin describes the vertex the result of an exported record
+// was created for.
+type CacheRecordOrigin struct {
+	Vertex         digest.Digest
+	Name           string
+	SourceLocation string
+}
+
+// CacheExporterRecordOrigin is implemented by exported records that keep
+// the origin of their result.
+type CacheExporterRecordOrigin interface {
+	SetOrigin(CacheRecordOrigin)
+}
+
 // Remote is a descriptor or a list of stacked descriptors that can be pulled
 // from a content provider
 // TODO: add closer to keep referenced data from getting deleted
@@ -31,6 +31,7 @@ import (
 	"github.com/moby/buildkit/util/progress/controller"
 	"github.com/moby/buildkit/util/pull"
 	"github.com/moby/buildkit/util/resolver"
+	"github.com/moby/buildkit/util/resolver/retryhandler"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
@@ -48,6 +49,7 @@ type SourceOpt struct {
 	ImageStore    images.Store // optional
 	RegistryHosts docker.RegistryHosts
 	LeaseManager  leases.Manager
+	RetryPolicy   retryhandler.Policy
 }
 
 type Source struct {
@@ -114,6 +116,7 @@ func (is *Source) Resolve(ctx context.Context, id source.Identifier, sm *session
 		ContentStore: is.ContentStore,
 		Platform:     platform,
 		Src:          imageIdentifier.Reference,
+		RetryPolicy:  is.RetryPolicy,
 	}
 	p := &puller{
 		CacheAccessor:  is.CacheAccessor,
@@ -2,8 +2,11 @@ package compression
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
@@ -23,23 +26,161 @@ const (
 	// Gzip is used for blob data.
 	Gzip
 
+	// Zstd is used for blob data.
+	Zstd
+
+	// Bzip2 is only supported for reading existing blobs.
+	Bzip2
+
+	// Xz is only supported for reading existing blobs.
+	Xz
+
 	// UnknownCompression means not supported yet.
 	UnknownCompression Type = -1
 )
 
 var Default = Gzip
 
+// MediaTypes is the family of the media types of layer descriptors.
+type MediaTypes int
+
+const (
+	// AnyMediaTypes keeps the family of the media type of existing blobs.
+	// New blobs get OCI media types.
+	AnyMediaTypes MediaTypes = iota
+
+	// OCIMediaTypes uses OCI media types for all layers.
+	OCIMediaTypes
+
+	// DockerMediaTypes uses Docker media types for all layers. Compression
+	// types without a Docker media type, e.g. zstd, can't be used.
+	DockerMediaTypes
+)
+
+// ManifestMediaTypes returns the media type family of the layers of a
+// manifest with OCI or Docker media types.
+func ManifestMediaTypes(oci bool) MediaTypes {
+	if oci {
+		return OCIMediaTypes
+	}
+	return DockerMediaTypes
+}
+
+// Config specifies the compression type and options used when creating
+// layer blobs.
+type Config struct {
+	Type Type
+	// Level is the compression level, the default level of the compression
+	// type is used if nil.
+	Level *int
+	// MediaTypes is the family of the media types of the layer descriptors
+	// created with the config.
+	MediaTypes MediaTypes
+	// IfSmaller keeps an existing blob instead of converting it to the
+	// compression type if the converted blob isn't smaller.
+	IfSmaller bool
+}
+
+// New returns a Config for the compression type with default options.
+func New(t Type) Config {
+	return Config{Type: t}
+}
+
+// SetLevel returns a copy of the Config with the compression level set.
+func (c Config) SetLevel(l int) Config {
+	c.Level = &l
+	return c
+}
+
+// SetMediaTypes returns a copy of the Config with the media type family
+// set.
+func (c Config) SetMediaTypes(m MediaTypes) Config {
+	c.MediaTypes = m
+	return c
+}
+
+// SetIfSmaller returns a copy of the Config that only converts existing
+// blobs if the result is smaller.
+func (c Config) SetIfSmaller() Config {
+	c.IfSmaller = true
+	return c
+}
+
+// Validate checks that the options are supported by the compression type.
+func (c Config) Validate() error {
+	if c.MediaTypes == DockerMediaTypes {
+		switch c.Type {
+		case Uncompressed, Gzip:
+		default:
+			return errors.Errorf("no Docker media type for %s layers, use OCI media types", c.Type)
+		}
+	}
+	if c.Level == nil {
+		return nil
+	}
+	switch c.Type {
+	case Gzip:
+		if *c.Level < gzip.HuffmanOnly || *c.Level > gzip.BestCompression {
+			return errors.Errorf("invalid compression level %d for %s, must be between %d and %d", *c.Level, c.Type, gzip.HuffmanOnly, gzip.BestCompression)
+		}
+	case Uncompressed:
+		return errors.Errorf("compression level is not supported for %s", c.Type)
+	}
+	return nil
+}
+
 func (ct Type) String() string {
 	switch ct {
 	case Uncompressed:
 		return "uncompressed"
 	case Gzip:
 		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
 	default:
 		return "unknown"
 	}
 }
 
+// mediaTypeImageLayerZstd is the OCI media type of zstd compressed layers,
+// Docker has no media type of its own for them.
+const mediaTypeImageLayerZstd = ocispec.MediaTypeImageLayer + "+zstd"
+
+// IsLayerMediaTypeKnown returns false if the media type doesn't identify
+// the compression of a layer, e.g. it's empty or a generic type such as
+// application/octet-stream, so the compression has to be detected from the
+// blob data.
+func IsLayerMediaTypeKnown(mediaType string) bool {
+	if mediaType == "" {
+		return false
+	}
+	_, err := images.DiffCompression(context.TODO(), mediaType)
+	return err == nil
+}
+
+// FromMediaType returns the compression type of a layer media type, or
+// UnknownCompression if it isn't a layer media type.
+func FromMediaType(mediaType string) Type {
+	switch mediaType {
+	case ocispec.MediaTypeImageLayer, images.MediaTypeDockerSchema2Layer, images.MediaTypeDockerSchema2LayerForeign:
+		return Uncompressed
+	case ocispec.MediaTypeImageLayerGzip, images.MediaTypeDockerSchema2LayerGzip, images.MediaTypeDockerSchema2LayerForeignGzip:
+		return Gzip
+	}
+	if i := strings.LastIndex(mediaType, "+"); i != -1 && strings.HasPrefix(mediaType, ocispec.MediaTypeImageLayer) {
+		for _, ct := range []Type{Zstd, Bzip2, Xz} {
+			if mediaType[i+1:] == ct.String() {
+				return ct
+			}
+		}
+	}
+	return UnknownCompression
+}
+
 // DetectLayerMediaType returns media type from existing blob data.
 func DetectLayerMediaType(ctx context.Context, cs content.Store, id digest.Digest, oci bool) (string, error) {
 	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: id})
@@ -64,11 +205,62 @@ func DetectLayerMediaType(ctx context.Context, cs content.Store, id digest.Diges
 			return ocispec.MediaTypeImageLayerGzip, nil
 		}
 		return images.MediaTypeDockerSchema2LayerGzip, nil
+	case Zstd, Bzip2, Xz:
+		return ocispec.MediaTypeImageLayer + "+" + ct.String(), nil
 	default:
 		return "", errors.Errorf("failed to detect layer %v compression type", id)
 	}
 }
 
+// DetectLayerCompression returns the compression type of existing blob
+// data. Blob data that isn't compressed must be empty or start with a tar
+// header, otherwise an error is returned.
+func DetectLayerCompression(ctx context.Context, cs content.Store, id digest.Digest) (Type, error) {
+	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: id})
+	if err != nil {
+		return UnknownCompression, err
+	}
+	defer ra.Close()
+
+	var buf [512]byte
+	n, err := io.ReadFull(content.NewReader(ra), buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return UnknownCompression, err
+	}
+
+	ct, err := detectCompressionType(bytes.NewReader(buf[:n]))
+	if err != nil {
+		return UnknownCompression, err
+	}
+	if ct == Uncompressed && n != 0 && !isTarHeader(buf[:n]) {
+		return UnknownCompression, errors.Errorf("layer %v is neither compressed nor a tar stream", id)
+	}
+	return ct, nil
+}
+
+// isTarHeader reports whether b is a tar header block with a valid
+// checksum, or the zero block ending an empty archive.
+func isTarHeader(b []byte) bool {
+	if len(b) != 512 {
+		return false
+	}
+	if bytes.Equal(b, make([]byte, 512)) {
+		return true
+	}
+	expected, err := strconv.ParseUint(strings.Trim(string(b[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum uint64
+	for i, c := range b {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		sum += uint64(c)
+	}
+	return sum == expected
+}
+
 // detectCompressionType detects compression type from real blob data.
 func detectCompressionType(cr io.Reader) (Type, error) {
 	var buf [10]byte
@@ -86,7 +278,10 @@ func detectCompressionType(cr io.Reader) (Type, error) {
 	}
 
 	for c, m := range map[Type][]byte{
-		Gzip: {0x1F, 0x8B, 0x08},
+		Gzip:  {0x1F, 0x8B, 0x08},
+		Zstd:  {0x28, 0xB5, 0x2F, 0xFD},
+		Bzip2: {0x42, 0x5A, 0x68},
+		Xz:    {0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
 	} {
 		if n < len(m) {
 			continue
@@ -105,6 +300,7 @@ var toDockerLayerType = map[string]string{
 	images.MediaTypeDockerSchema2LayerGzip:        images.MediaTypeDockerSchema2LayerGzip,
 	images.MediaTypeDockerSchema2LayerForeign:     images.MediaTypeDockerSchema2Layer,
 	images.MediaTypeDockerSchema2LayerForeignGzip: images.MediaTypeDockerSchema2LayerGzip,
+	mediaTypeImageLayerZstd:                       mediaTypeImageLayerZstd,
 }
 
 var toOCILayerType = map[string]string{
@@ -114,6 +310,7 @@ var toOCILayerType = map[string]string{
 	images.MediaTypeDockerSchema2LayerGzip:        ocispec.MediaTypeImageLayerGzip,
 	images.MediaTypeDockerSchema2LayerForeign:     ocispec.MediaTypeImageLayer,
 	images.MediaTypeDockerSchema2LayerForeignGzip: ocispec.MediaTypeImageLayerGzip,
+	mediaTypeImageLayerZstd:                       mediaTypeImageLayerZstd,
 }
 
 func convertLayerMediaType(mediaType string, oci bool) string {
@@ -138,3 +335,39 @@ func ConvertAllLayerMediaTypes(oci bool, descs ...ocispec.Descriptor) []ocispec.
 	}
 	return converted
 }
+
+// LayerMediaTypes converts the media types of the layer descriptors to the
+// media type family of the config and checks that all of them belong to it.
+// The descriptors are returned unchanged for AnyMediaTypes.
+func (c Config) LayerMediaTypes(descs ...ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	if c.MediaTypes == AnyMediaTypes {
+		return descs, nil
+	}
+	oci := c.MediaTypes == OCIMediaTypes
+	descs = ConvertAllLayerMediaTypes(oci, descs...)
+	if err := ValidateLayerMediaTypes(oci, descs...); err != nil {
+		return nil, err
+	}
+	return descs, nil
+}
+
+// ValidateLayerMediaTypes checks that all layers use media types of the
+// same family as the manifest, so that a manifest never mixes Docker and OCI
+// layer media types. Layers without a Docker media type, e.g. zstd, can only
+// be used in an OCI manifest.
+func ValidateLayerMediaTypes(oci bool, descs ...ocispec.Descriptor) error {
+	for _, desc := range descs {
+		if oci && strings.HasPrefix(desc.MediaType, "application/vnd.oci.") {
+			continue
+		}
+		if !oci && strings.HasPrefix(desc.MediaType, "application/vnd.docker.") {
+			continue
+		}
+		family := "Docker"
+		if oci {
+			family = "OCI"
+		}
+		return errors.Errorf("layer %s media type %q is not allowed in %s manifests", desc.Digest, desc.MediaType, family)
+	}
+	return nil
+}
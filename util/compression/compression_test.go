@@ -0,0 +1,128 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectCompressionType(t *testing.T) {
+	data := []byte("layer data")
+
+	gz := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(gz)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	zs := bytes.NewBuffer(nil)
+	zw, err := zstd.NewWriter(zs)
+	require.NoError(t, err)
+	_, err = zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		typ  Type
+	}{
+		{"gzip", gz.Bytes(), Gzip},
+		{"zstd", zs.Bytes(), Zstd},
+		{"bzip2", []byte("BZh91AY&SY"), Bzip2},
+		{"xz", []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00, 0x00, 0x04}, Xz},
+		{"uncompressed", data, Uncompressed},
+		{"empty", nil, Uncompressed},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			typ, err := detectCompressionType(bytes.NewReader(tc.data))
+			require.NoError(t, err)
+			require.Equal(t, tc.typ, typ)
+		})
+	}
+}
+
+func TestIsLayerMediaTypeKnown(t *testing.T) {
+	for _, mt := range []string{
+		ocispec.MediaTypeImageLayer,
+		ocispec.MediaTypeImageLayerGzip,
+		mediaTypeImageLayerZstd,
+		images.MediaTypeDockerSchema2Layer,
+		images.MediaTypeDockerSchema2LayerGzip,
+	} {
+		require.True(t, IsLayerMediaTypeKnown(mt), mt)
+	}
+	for _, mt := range []string{
+		"",
+		"application/octet-stream",
+	} {
+		require.False(t, IsLayerMediaTypeKnown(mt), mt)
+	}
+}
+
+func TestFromMediaType(t *testing.T) {
+	for mt, typ := range map[string]Type{
+		ocispec.MediaTypeImageLayer:              Uncompressed,
+		images.MediaTypeDockerSchema2Layer:       Uncompressed,
+		ocispec.MediaTypeImageLayerGzip:          Gzip,
+		images.MediaTypeDockerSchema2LayerGzip:   Gzip,
+		ocispec.MediaTypeImageLayer + "+zstd":    Zstd,
+		ocispec.MediaTypeImageLayer + "+bzip2":   Bzip2,
+		ocispec.MediaTypeImageLayer + "+xz":      Xz,
+		ocispec.MediaTypeImageLayer + "+foo":     UnknownCompression,
+		"application/octet-stream":               UnknownCompression,
+		"application/vnd.oci.image.config.v1+xz": UnknownCompression,
+	} {
+		require.Equal(t, typ, FromMediaType(mt), mt)
+	}
+}
+
+func TestValidateLayerMediaTypes(t *testing.T) {
+	docker := []ocispec.Descriptor{
+		{MediaType: images.MediaTypeDockerSchema2Layer},
+		{MediaType: images.MediaTypeDockerSchema2LayerGzip},
+	}
+	oci := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageLayer},
+		{MediaType: ocispec.MediaTypeImageLayerGzip},
+		{MediaType: ocispec.MediaTypeImageLayer + "+zstd"},
+	}
+	require.NoError(t, ValidateLayerMediaTypes(false, docker...))
+	require.NoError(t, ValidateLayerMediaTypes(true, oci...))
+	require.Error(t, ValidateLayerMediaTypes(false, append(docker, oci[2])...))
+	require.Error(t, ValidateLayerMediaTypes(true, append(oci, docker[0])...))
+	require.Error(t, ValidateLayerMediaTypes(true, ocispec.Descriptor{MediaType: "application/octet-stream"}))
+}
+
+func TestLayerMediaTypes(t *testing.T) {
+	mixed := []ocispec.Descriptor{
+		{MediaType: images.MediaTypeDockerSchema2LayerGzip},
+		{MediaType: ocispec.MediaTypeImageLayer},
+	}
+
+	descs, err := New(Gzip).LayerMediaTypes(mixed...)
+	require.NoError(t, err)
+	require.Equal(t, mixed, descs)
+
+	descs, err = New(Gzip).SetMediaTypes(OCIMediaTypes).LayerMediaTypes(mixed...)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, descs[0].MediaType)
+	require.Equal(t, ocispec.MediaTypeImageLayer, descs[1].MediaType)
+
+	descs, err = New(Gzip).SetMediaTypes(DockerMediaTypes).LayerMediaTypes(mixed...)
+	require.NoError(t, err)
+	require.Equal(t, images.MediaTypeDockerSchema2LayerGzip, descs[0].MediaType)
+	require.Equal(t, images.MediaTypeDockerSchema2Layer, descs[1].MediaType)
+
+	_, err = New(Gzip).SetMediaTypes(DockerMediaTypes).LayerMediaTypes(ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer + "+zstd"})
+	require.Error(t, err)
+
+	require.NoError(t, New(Zstd).SetMediaTypes(OCIMediaTypes).Validate())
+	require.Error(t, New(Zstd).SetMediaTypes(DockerMediaTypes).Validate())
+}
@@ -11,6 +11,13 @@ import (
 	"github.com/pkg/errors"
 )
 
+// InfoProvider returns the info of content without reading it. Content
+// stores implement it, and remote providers can implement it with a HEAD
+// request.
+type InfoProvider interface {
+	Info(ctx context.Context, dgst digest.Digest) (content.Info, error)
+}
+
 // NewMultiProvider creates a new mutable provider with a base provider
 func NewMultiProvider(base content.Provider) *MultiProvider {
 	return &MultiProvider{
@@ -46,3 +53,23 @@ func (mp *MultiProvider) Add(dgst digest.Digest, p content.Provider) {
 	defer mp.mu.Unlock()
 	mp.sub[dgst] = p
 }
+
+// Info returns the info of a blob from the provider added for its digest or
+// the base provider. errdefs.ErrNotImplemented is returned if that provider
+// doesn't implement InfoProvider.
+func (mp *MultiProvider) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	mp.mu.RLock()
+	p, ok := mp.sub[dgst]
+	mp.mu.RUnlock()
+	if !ok {
+		p = mp.base
+	}
+	if p == nil {
+		return content.Info{}, errors.Wrapf(errdefs.ErrNotFound, "content %v", dgst)
+	}
+	ip, ok := p.(InfoProvider)
+	if !ok {
+		return content.Info{}, errors.Wrapf(errdefs.ErrNotImplemented, "info of content %v", dgst)
+	}
+	return ip.Info(ctx, dgst)
+}
@@ -3,9 +3,12 @@ package contentutil
 import (
 	"bytes"
 	"context"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/errdefs"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -42,3 +45,38 @@ func TestMultiProvider(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, true, errors.Is(err, errdefs.ErrNotFound))
 }
+
+func TestMultiProviderInfo(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	tmpdir, err := ioutil.TempDir("", "multiprovider")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	cs, err := local.NewStore(tmpdir)
+	require.NoError(t, err)
+
+	b := NewBuffer()
+
+	err = content.WriteBlob(ctx, cs, "foo", bytes.NewBuffer([]byte("foo0")), ocispec.Descriptor{Size: -1})
+	require.NoError(t, err)
+	err = content.WriteBlob(ctx, b, "foo", bytes.NewBuffer([]byte("foo1")), ocispec.Descriptor{Size: -1})
+	require.NoError(t, err)
+
+	mp := NewMultiProvider(nil)
+	mp.Add(digest.FromBytes([]byte("foo0")), cs)
+	mp.Add(digest.FromBytes([]byte("foo1")), b)
+
+	info, err := mp.Info(ctx, digest.FromBytes([]byte("foo0")))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), info.Size)
+
+	// the buffer can only be read
+	_, err = mp.Info(ctx, digest.FromBytes([]byte("foo1")))
+	require.Error(t, err)
+	require.Equal(t, true, errors.Is(err, errdefs.ErrNotImplemented))
+
+	_, err = mp.Info(ctx, digest.FromBytes([]byte("foo2")))
+	require.Error(t, err)
+	require.Equal(t, true, errors.Is(err, errdefs.ErrNotFound))
+}
@@ -29,6 +29,8 @@ type Puller struct {
 	Resolver     *resolver.Resolver
 	Src          reference.Spec
 	Platform     ocispec.Platform
+	// RetryPolicy is used for fetching the manifests and blobs.
+	RetryPolicy retryhandler.Policy
 
 	g           flightcontrol.Group
 	resolveErr  error
@@ -148,7 +150,7 @@ func (p *Puller) PullManifests(ctx context.Context) (*PulledManifests, error) {
 		}
 		handlers = append(handlers,
 			filterLayerBlobs(metadata, &mu),
-			retryhandler.New(remotes.FetchHandler(p.ContentStore, fetcher), logs.LoggerFromContext(ctx)),
+			retryhandler.New(remotes.FetchHandler(p.ContentStore, fetcher), p.RetryPolicy, logs.LoggerFromContext(ctx)),
 			childrenHandler,
 			dslHandler,
 		)
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strings"
 	"syscall"
 	"time"
@@ -15,46 +16,102 @@ import (
 	"github.com/pkg/errors"
 )
 
-func New(f images.HandlerFunc, logger func([]byte)) images.HandlerFunc {
+// Policy configures how often and how fast a failed handler is retried.
+// Zero fields use the value of DefaultPolicy.
+type Policy struct {
+	// MaxAttempts is the number of times the handler is called before the
+	// error is returned, including the first call.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. It doubles on
+	// every retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts.
+	MaxBackoff time.Duration
+	// RetryOn4xx retries client errors such as 429 Too Many Requests.
+	// Unauthorized, forbidden and not found responses are never retried.
+	RetryOn4xx bool
+}
+
+// DefaultPolicy makes 4 attempts waiting 1s, 2s and 4s in between.
+var DefaultPolicy = Policy{
+	MaxAttempts:    4,
+	InitialBackoff: time.Second,
+	MaxBackoff:     8 * time.Second,
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultPolicy.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultPolicy.MaxBackoff
+	}
+	return p
+}
+
+func New(f images.HandlerFunc, p Policy, logger func([]byte)) images.HandlerFunc {
+	p = p.withDefaults()
 	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-		backoff := time.Second
-		for {
+		backoff := p.InitialBackoff
+		for attempt := 1; ; attempt++ {
 			descs, err := f(ctx, desc)
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return nil, err
-				default:
-					if !retryError(err) {
-						return nil, err
-					}
-				}
-				if logger != nil {
-					logger([]byte(fmt.Sprintf("error: %v\n", err.Error())))
-				}
-			} else {
+			if err == nil {
 				return descs, nil
 			}
-			// backoff logic
-			if backoff >= 8*time.Second {
-				return nil, err
+			select {
+			case <-ctx.Done():
+				return nil, wrapAttempts(err, desc, attempt)
+			default:
+				if !retryError(err, p.RetryOn4xx) {
+					return nil, wrapAttempts(err, desc, attempt)
+				}
+			}
+			if logger != nil {
+				logger([]byte(fmt.Sprintf("error: %v\n", err.Error())))
+			}
+			if attempt >= p.MaxAttempts {
+				return nil, wrapAttempts(err, desc, attempt)
+			}
+			if backoff > p.MaxBackoff {
+				backoff = p.MaxBackoff
 			}
 			if logger != nil {
-				logger([]byte(fmt.Sprintf("retrying in %v\n", backoff)))
+				logger([]byte(fmt.Sprintf("retrying %s in %v (attempt %d)\n", desc.Digest, backoff, attempt+1)))
+			}
+			select {
+			case <-ctx.Done():
+				return nil, wrapAttempts(err, desc, attempt)
+			case <-time.After(backoff):
 			}
-			time.Sleep(backoff)
 			backoff *= 2
 		}
 	}
 }
 
-func retryError(err error) bool {
-	// Retry on 5xx errors
+// wrapAttempts records the number of attempts in the error if the
+// handler was retried.
+func wrapAttempts(err error, desc ocispec.Descriptor, attempts int) error {
+	if attempts == 1 {
+		return err
+	}
+	return errors.Wrapf(err, "failed %s after %d attempts", desc.Digest, attempts)
+}
+
+func retryError(err error, retryOn4xx bool) bool {
 	var errUnexpectedStatus remoteserrors.ErrUnexpectedStatus
-	if errors.As(err, &errUnexpectedStatus) &&
-		errUnexpectedStatus.StatusCode >= 500 &&
-		errUnexpectedStatus.StatusCode <= 599 {
-		return true
+	if errors.As(err, &errUnexpectedStatus) {
+		switch code := errUnexpectedStatus.StatusCode; {
+		case code >= 500 && code <= 599:
+			return true
+		case code == http.StatusUnauthorized, code == http.StatusForbidden, code == http.StatusNotFound:
+			// permanent failures, e.g. unknown manifests or missing access
+			return false
+		case code >= 400 && code <= 499:
+			return retryOn4xx
+		}
 	}
 
 	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
@@ -0,0 +1,69 @@
+package retryhandler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy := Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+
+	for _, tc := range []struct {
+		name       string
+		status     int
+		retryOn4xx bool
+		attempts   int
+	}{
+		{"server-error", http.StatusBadGateway, false, 3},
+		{"too-many-requests", http.StatusTooManyRequests, false, 1},
+		{"too-many-requests-retried", http.StatusTooManyRequests, true, 3},
+		{"not-found", http.StatusNotFound, true, 1},
+		{"unauthorized", http.StatusUnauthorized, true, 1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := policy
+			p.RetryOn4xx = tc.retryOn4xx
+
+			attempts := 0
+			h := New(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+				attempts++
+				return nil, remoteserrors.ErrUnexpectedStatus{StatusCode: tc.status}
+			}, p, nil)
+			_, err := h(context.TODO(), ocispec.Descriptor{})
+			require.Error(t, err)
+			require.Equal(t, tc.attempts, attempts)
+			if tc.attempts > 1 {
+				require.Contains(t, err.Error(), "after 3 attempts")
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	attempts := 0
+	h := New(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		attempts++
+		cancel()
+		return nil, remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusBadGateway}
+	}, Policy{InitialBackoff: time.Hour}, nil)
+	_, err := h(ctx, ocispec.Descriptor{})
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+}
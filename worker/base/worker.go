@@ -45,6 +45,7 @@ import (
 	"github.com/moby/buildkit/util/archutil"
 	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/util/progress/controller"
+	"github.com/moby/buildkit/util/resolver/retryhandler"
 	"github.com/moby/buildkit/worker"
 	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
@@ -75,6 +76,39 @@ type WorkerOpt struct {
 	IdentityMapping *idtools.IdentityMapping
 	LeaseManager    leases.Manager
 	GarbageCollect  func(context.Context) (gc.Stats, error)
+	// SkipLayerVerification disables checking layer data against the
+	// layer media type before extracting it.
+	SkipLayerVerification bool
+	// EagerUnlazy fetches all lazy blobs of a ref when it is exported.
+	EagerUnlazy bool
+	// LazyRecordTTL is the time after which unused lazy records are
+	// removed on prune. 0 disables it.
+	LazyRecordTTL time.Duration
+	// DiskQuota limits the size of the cache plus the space reserved by
+	// running exec ops. 0 disables it.
+	DiskQuota int64
+	// ReservationSize is the space reserved for each exec mount.
+	ReservationSize int64
+	// DiffPlans records the entries of layer diffs so blobs that have to be
+	// created again are written without comparing the snapshots.
+	DiffPlans bool
+	// MetadataCompactThreshold is the free space in the metadata store in
+	// bytes after which prune compacts it. 0 disables it.
+	MetadataCompactThreshold int64
+	// SharedCacheNamespaces are the cache namespaces whose pulled layers
+	// are used by builds in all namespaces.
+	SharedCacheNamespaces []string
+	// NoSpaceReclaimSize is the size pruned from the cache when creating a
+	// blob fails because the disk is full. 0 disables it.
+	NoSpaceReclaimSize int64
+	// RetryPolicy is used for fetching and pushing layers and manifests.
+	RetryPolicy retryhandler.Policy
+	// MaxParallelConversions limits the number of layers that are converted
+	// to another compression at the same time. 0 disables it.
+	MaxParallelConversions int
+	// KeepUncompressedDiff keeps the uncompressed diff of new layers to
+	// convert them to other compressions without decompressing them.
+	KeepUncompressedDiff bool
 }
 
 // Worker is a local worker instance with dedicated snapshotter, cache, and so on.
@@ -103,6 +137,19 @@ func NewWorker(opt WorkerOpt) (*Worker, error) {
 		LeaseManager:    opt.LeaseManager,
 		ContentStore:    opt.ContentStore,
 		Differ:          opt.Differ,
+
+		SkipLayerVerification:    opt.SkipLayerVerification,
+		EagerUnlazy:              opt.EagerUnlazy,
+		LazyRecordTTL:            opt.LazyRecordTTL,
+		DiskQuota:                opt.DiskQuota,
+		ReservationSize:          opt.ReservationSize,
+		DiffPlans:                opt.DiffPlans,
+		MetadataCompactThreshold: opt.MetadataCompactThreshold,
+		SharedNamespaces:         opt.SharedCacheNamespaces,
+		NoSpaceReclaimSize:       opt.NoSpaceReclaimSize,
+		RetryPolicy:              opt.RetryPolicy,
+		MaxParallelConversions:   opt.MaxParallelConversions,
+		KeepUncompressedDiff:     opt.KeepUncompressedDiff,
 	})
 	if err != nil {
 		return nil, err
@@ -121,6 +168,7 @@ func NewWorker(opt WorkerOpt) (*Worker, error) {
 		CacheAccessor: cm,
 		RegistryHosts: opt.RegistryHosts,
 		LeaseManager:  opt.LeaseManager,
+		RetryPolicy:   opt.RetryPolicy,
 	})
 	if err != nil {
 		return nil, err
@@ -191,6 +239,10 @@ func (w *Worker) ContentStore() content.Store {
 	return w.WorkerOpt.ContentStore
 }
 
+func (w *Worker) LeaseManager() leases.Manager {
+	return w.WorkerOpt.LeaseManager
+}
+
 func (w *Worker) ID() string {
 	return w.WorkerOpt.ID
 }
@@ -342,7 +394,8 @@ func (w *Worker) Exporter(name string, sm *session.Manager) (exporter.Exporter,
 			SessionManager: sm,
 			ImageWriter:    w.imageWriter,
 			RegistryHosts:  w.RegistryHosts,
-			LeaseManager:   w.LeaseManager,
+			LeaseManager:   w.WorkerOpt.LeaseManager,
+			RetryPolicy:    w.RetryPolicy,
 		})
 	case client.ExporterLocal:
 		return localexporter.New(localexporter.Opt{
@@ -357,14 +410,14 @@ func (w *Worker) Exporter(name string, sm *session.Manager) (exporter.Exporter,
 			SessionManager: sm,
 			ImageWriter:    w.imageWriter,
 			Variant:        ociexporter.VariantOCI,
-			LeaseManager:   w.LeaseManager,
+			LeaseManager:   w.WorkerOpt.LeaseManager,
 		})
 	case client.ExporterDocker:
 		return ociexporter.New(ociexporter.Opt{
 			SessionManager: sm,
 			ImageWriter:    w.imageWriter,
 			Variant:        ociexporter.VariantDocker,
-			LeaseManager:   w.LeaseManager,
+			LeaseManager:   w.WorkerOpt.LeaseManager,
 		})
 	case client.ExporterNydusImage:
 		return nydusexporter.New(nydusexporter.Opt{
@@ -373,7 +426,8 @@ func (w *Worker) Exporter(name string, sm *session.Manager) (exporter.Exporter,
 				SessionManager: sm,
 				ImageWriter:    w.imageWriter,
 				RegistryHosts:  w.RegistryHosts,
-				LeaseManager:   w.LeaseManager,
+				LeaseManager:   w.WorkerOpt.LeaseManager,
+				RetryPolicy:    w.RetryPolicy,
 			},
 			CacheManager: w.CacheManager(),
 		})
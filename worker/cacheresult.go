@@ -18,8 +18,18 @@ func NewCacheResultStorage(wc *Controller) solver.CacheResultStorage {
 	}
 }
 
+// NewNamespaceCacheResultStorage returns a result storage that only loads
+// the results usable by builds in the cache namespace ns.
+func NewNamespaceCacheResultStorage(wc *Controller, ns string) solver.CacheResultStorage {
+	return &cacheResultStorage{
+		wc:        wc,
+		namespace: ns,
+	}
+}
+
 type cacheResultStorage struct {
-	wc *Controller
+	wc        *Controller
+	namespace string
 }
 
 func (s *cacheResultStorage) Save(res solver.Result, createdAt time.Time) (solver.CacheResult, error) {
@@ -61,7 +71,7 @@ func (s *cacheResultStorage) load(ctx context.Context, id string, hidden bool) (
 	if refID == "" {
 		return NewWorkerRefResult(nil, w), nil
 	}
-	ref, err := w.LoadRef(ctx, refID, hidden)
+	ref, err := w.LoadRef(solver.WithCacheNamespace(ctx, s.namespace), refID, hidden)
 	if err != nil {
 		return nil, err
 	}
@@ -73,13 +83,13 @@ func (s *cacheResultStorage) LoadRemote(ctx context.Context, res solver.CacheRes
 	if err != nil {
 		return nil, err
 	}
-	ref, err := w.LoadRef(ctx, refID, true)
+	ref, err := w.LoadRef(solver.WithCacheNamespace(ctx, s.namespace), refID, true)
 	if err != nil {
 		return nil, err
 	}
 	defer ref.Release(context.TODO())
 	wref := WorkerRef{ref, w}
-	remote, err := wref.GetRemote(ctx, false, compression.Default, g)
+	remote, err := wref.GetRemote(ctx, false, compression.New(compression.Default), g)
 	if err != nil {
 		return nil, nil // ignore error. loadRemote is best effort
 	}
@@ -7,6 +7,7 @@ import (
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/util/compression"
+	"github.com/pkg/errors"
 )
 
 func NewWorkerRefResult(ref cache.ImmutableRef, worker Worker) solver.Result {
@@ -29,13 +30,32 @@ func (wr *WorkerRef) ID() string {
 // GetRemote method abstracts ImmutableRef's GetRemote to allow a Worker to override.
 // This is needed for moby integration.
 // Use this method instead of calling ImmutableRef.GetRemote() directly.
-func (wr *WorkerRef) GetRemote(ctx context.Context, createIfNeeded bool, compressionType compression.Type, g session.Group) (*solver.Remote, error) {
+func (wr *WorkerRef) GetRemote(ctx context.Context, createIfNeeded bool, comp compression.Config, g session.Group) (*solver.Remote, error) {
 	if w, ok := wr.Worker.(interface {
-		GetRemote(context.Context, cache.ImmutableRef, bool, compression.Type, session.Group) (*solver.Remote, error)
+		GetRemote(context.Context, cache.ImmutableRef, bool, compression.Config, session.Group) (*solver.Remote, error)
 	}); ok {
-		return w.GetRemote(ctx, wr.ImmutableRef, createIfNeeded, compressionType, g)
+		return w.GetRemote(ctx, wr.ImmutableRef, createIfNeeded, comp, g)
 	}
-	return wr.ImmutableRef.GetRemote(ctx, createIfNeeded, compressionType, g)
+	return wr.ImmutableRef.GetRemote(ctx, createIfNeeded, comp, g)
+}
+
+// GetRemotes is the batched version of GetRemote. Workers that override
+// GetRemote can't create blob variants, so they only get a single config
+// without all.
+func (wr *WorkerRef) GetRemotes(ctx context.Context, createIfNeeded bool, configs []compression.Config, all bool, g session.Group) ([]*solver.Remote, error) {
+	if _, ok := wr.Worker.(interface {
+		GetRemote(context.Context, cache.ImmutableRef, bool, compression.Config, session.Group) (*solver.Remote, error)
+	}); ok {
+		if all || len(configs) != 1 {
+			return nil, errors.Errorf("worker %s doesn't support blob variants", wr.Worker.ID())
+		}
+		remote, err := wr.GetRemote(ctx, createIfNeeded, configs[0], g)
+		if err != nil {
+			return nil, err
+		}
+		return []*solver.Remote{remote}, nil
+	}
+	return wr.ImmutableRef.GetRemotes(ctx, createIfNeeded, configs, all, g)
 }
 
 type workerRefResult struct {
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/leases"
 	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/cache/metadata"
 	"github.com/moby/buildkit/client"
@@ -34,6 +35,7 @@ type Worker interface {
 	FromRemote(ctx context.Context, remote *solver.Remote) (cache.ImmutableRef, error)
 	PruneCacheMounts(ctx context.Context, ids []string) error
 	ContentStore() content.Store
+	LeaseManager() leases.Manager
 	Executor() executor.Executor
 	CacheManager() cache.Manager
 	MetadataStore() *metadata.Store